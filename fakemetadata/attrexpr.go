@@ -0,0 +1,249 @@
+// Copyright 2022 The compute-metadata-server Authors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package fakemetadata
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// attrExpr is the compiled attribute mapping or attribute condition of the workload identity pool provider.
+//
+// It supports the subset of CEL which is enough for the most of the providers:
+//
+//	value      = string literal | path
+//	path       = ("assertion" | "attribute" | "google") { "." IDENT | "[" (string literal | INT) "]" }
+//	comparison = value [ ("==" | "!=") value ]
+//	condition  = comparison { ("&&" | "||") comparison }
+//
+// The "&&" binds tighter than "||", and the parentheses are not supported.
+type attrExpr interface {
+	eval(env map[string]any) (any, error)
+}
+
+type literalExpr string
+
+func (e literalExpr) eval(map[string]any) (any, error) { return string(e), nil }
+
+type pathExpr []any // root name, and the selectors of string or int
+
+func (e pathExpr) eval(env map[string]any) (any, error) {
+	v, ok := env[e[0].(string)]
+	if !ok {
+		return nil, fmt.Errorf("undeclared reference to %q", e[0])
+	}
+	for _, sel := range e[1:] {
+		switch sel := sel.(type) {
+		case string:
+			m, ok := v.(map[string]any)
+			if !ok {
+				return nil, fmt.Errorf("could not select %q of %T", sel, v)
+			}
+			if v, ok = m[sel]; !ok {
+				return nil, fmt.Errorf("no such key: %s", sel)
+			}
+		case int:
+			l, ok := v.([]any)
+			if !ok || sel < 0 || sel >= len(l) {
+				return nil, fmt.Errorf("could not index %d of %T", sel, v)
+			}
+			v = l[sel]
+		}
+	}
+
+	return v, nil
+}
+
+type binaryExpr struct {
+	op   string
+	x, y attrExpr
+}
+
+func (e binaryExpr) eval(env map[string]any) (any, error) {
+	x, err := e.x.eval(env)
+	if err != nil && e.op != "==" && e.op != "!=" {
+		return nil, err
+	}
+	switch e.op {
+	case "&&", "||":
+		xb, ok := x.(bool)
+		if !ok {
+			return nil, fmt.Errorf("%s operand must be bool, got %T", e.op, x)
+		}
+		if (e.op == "&&" && !xb) || (e.op == "||" && xb) {
+			return xb, nil
+		}
+		y, err := e.y.eval(env)
+		if err != nil {
+			return nil, err
+		}
+		yb, ok := y.(bool)
+		if !ok {
+			return nil, fmt.Errorf("%s operand must be bool, got %T", e.op, y)
+		}
+		return yb, nil
+	}
+
+	// the missing keys are compared as null, same as the has() guarded conditions
+	y, yerr := e.y.eval(env)
+	eq := err == nil && yerr == nil && fmt.Sprint(x) == fmt.Sprint(y)
+	if e.op == "!=" {
+		return !eq, nil
+	}
+
+	return eq, nil
+}
+
+// compileAttrExpr compiles src to the attrExpr.
+func compileAttrExpr(src string) (attrExpr, error) {
+	p := &attrExprParser{src: src}
+	p.next()
+	e, err := p.parseOr()
+	if err != nil {
+		return nil, fmt.Errorf("could not compile %q: %w", src, err)
+	}
+	if p.tok != "" {
+		return nil, fmt.Errorf("could not compile %q: unexpected %q", src, p.tok)
+	}
+
+	return e, nil
+}
+
+// attrExprParser is the recursive descent parser of attrExpr.
+type attrExprParser struct {
+	src string
+	pos int
+	tok string // current token, empty at the end
+	err error
+}
+
+// next reads the next token.
+func (p *attrExprParser) next() {
+	for p.pos < len(p.src) && strings.ContainsRune(" \t\n", rune(p.src[p.pos])) {
+		p.pos++
+	}
+	if p.pos >= len(p.src) {
+		p.tok = ""
+		return
+	}
+
+	start := p.pos
+	switch c := p.src[p.pos]; {
+	case c == '\'' || c == '"':
+		end := strings.IndexByte(p.src[p.pos+1:], c)
+		if end < 0 {
+			p.err = errors.New("unterminated string literal")
+			p.pos = len(p.src)
+		} else {
+			p.pos += end + 2
+		}
+	case strings.HasPrefix(p.src[p.pos:], "==") || strings.HasPrefix(p.src[p.pos:], "!=") ||
+		strings.HasPrefix(p.src[p.pos:], "&&") || strings.HasPrefix(p.src[p.pos:], "||"):
+		p.pos += 2
+	case c == '.' || c == '[' || c == ']':
+		p.pos++
+	default:
+		for p.pos < len(p.src) && (p.src[p.pos] == '_' || p.src[p.pos] == '-' ||
+			'a' <= p.src[p.pos] && p.src[p.pos] <= 'z' || 'A' <= p.src[p.pos] && p.src[p.pos] <= 'Z' || '0' <= p.src[p.pos] && p.src[p.pos] <= '9') {
+			p.pos++
+		}
+		if p.pos == start {
+			p.err = fmt.Errorf("unexpected character %q", c)
+			p.pos = len(p.src)
+		}
+	}
+	p.tok = p.src[start:p.pos]
+}
+
+func (p *attrExprParser) parseOr() (attrExpr, error) {
+	x, err := p.parseAnd()
+	for err == nil && p.tok == "||" {
+		p.next()
+		var y attrExpr
+		y, err = p.parseAnd()
+		x = binaryExpr{op: "||", x: x, y: y}
+	}
+
+	return x, err
+}
+
+func (p *attrExprParser) parseAnd() (attrExpr, error) {
+	x, err := p.parseComparison()
+	for err == nil && p.tok == "&&" {
+		p.next()
+		var y attrExpr
+		y, err = p.parseComparison()
+		x = binaryExpr{op: "&&", x: x, y: y}
+	}
+
+	return x, err
+}
+
+func (p *attrExprParser) parseComparison() (attrExpr, error) {
+	x, err := p.parseValue()
+	if err != nil {
+		return nil, err
+	}
+	if op := p.tok; op == "==" || op == "!=" {
+		p.next()
+		y, err := p.parseValue()
+		if err != nil {
+			return nil, err
+		}
+		return binaryExpr{op: op, x: x, y: y}, nil
+	}
+
+	return x, nil
+}
+
+func (p *attrExprParser) parseValue() (attrExpr, error) {
+	if p.err != nil {
+		return nil, p.err
+	}
+
+	tok := p.tok
+	switch {
+	case tok == "":
+		return nil, errors.New("unexpected end of expression")
+	case tok[0] == '\'' || tok[0] == '"':
+		p.next()
+		return literalExpr(tok[1 : len(tok)-1]), nil
+	case tok == "assertion" || tok == "attribute" || tok == "google":
+		path := pathExpr{tok}
+		p.next()
+		for p.tok == "." || p.tok == "[" {
+			sep := p.tok
+			p.next()
+			sel := p.tok
+			if sel == "" || p.err != nil {
+				return nil, errors.New("unexpected end of selector")
+			}
+			p.next()
+			if sep == "." {
+				path = append(path, sel)
+				continue
+			}
+
+			switch {
+			case sel[0] == '\'' || sel[0] == '"':
+				path = append(path, sel[1:len(sel)-1])
+			default:
+				n, err := strconv.Atoi(sel)
+				if err != nil || n < 0 {
+					return nil, fmt.Errorf("invalid index %q", sel)
+				}
+				path = append(path, n)
+			}
+			if p.tok != "]" {
+				return nil, fmt.Errorf("expected ] but got %q", p.tok)
+			}
+			p.next()
+		}
+		return path, nil
+	}
+
+	return nil, fmt.Errorf("unexpected %q", tok)
+}
@@ -0,0 +1,141 @@
+// Copyright 2022 The compute-metadata-server Authors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package fakemetadata
+
+import (
+	"testing"
+)
+
+func TestAttrExpr(t *testing.T) {
+	env := map[string]any{
+		"assertion": map[string]any{
+			"sub":    "repo:org/repo",
+			"groups": []any{"admins", "devs"},
+			"attributes": map[string]any{
+				"team": []any{"dev"},
+			},
+		},
+	}
+
+	tests := map[string]struct {
+		src     string
+		want    any
+		wantErr bool
+	}{
+		"Literal": {
+			src:  `'x'`,
+			want: "x",
+		},
+		"DoubleQuotedLiteral": {
+			src:  `"x y"`,
+			want: "x y",
+		},
+		"Selector": {
+			src:  "assertion.sub",
+			want: "repo:org/repo",
+		},
+		"Index": {
+			src:  "assertion.groups[1]",
+			want: "devs",
+		},
+		"KeyIndex": {
+			src:  "assertion['attributes'][\"team\"][0]",
+			want: "dev",
+		},
+		"Equal": {
+			src:  "assertion.sub == 'repo:org/repo'",
+			want: true,
+		},
+		"NotEqual": {
+			src:  "assertion.groups[0] != 'admins'",
+			want: false,
+		},
+		// the missing keys are not equal to any value
+		"MissingKeyEqual": {
+			src:  "assertion.missing == ''",
+			want: false,
+		},
+		"MissingKeyNotEqual": {
+			src:  "assertion.missing != 'x'",
+			want: true,
+		},
+		// a || b && c is a || (b && c), which is true, and (a || b) && c is false
+		"AndBindsTighterThanOr": {
+			src:  "'a' == 'a' || 'b' == 'b' && 'c' == 'd'",
+			want: true,
+		},
+		// a && b || c is (a && b) || c, which is true, and a && (b || c) is false
+		"OrBindsLooserThanAnd": {
+			src:  "'a' == 'b' && 'c' == 'c' || 'd' == 'd'",
+			want: true,
+		},
+		"ShortCircuit": {
+			src:  "'a' == 'b' && assertion.missing[0] == 'x'",
+			want: false,
+		},
+		"MissingKey": {
+			src:     "assertion.missing",
+			wantErr: true,
+		},
+		"IndexOutOfRange": {
+			src:     "assertion.groups[2]",
+			wantErr: true,
+		},
+		"IndexNotList": {
+			src:     "assertion.sub[0]",
+			wantErr: true,
+		},
+		"NotBoolOperand": {
+			src:     "assertion.sub && 'a' == 'a'",
+			wantErr: true,
+		},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			e, err := compileAttrExpr(tt.src)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := e.eval(env)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("eval() error = %v, wantErr %t", err, tt.wantErr)
+			}
+			if !tt.wantErr && got != tt.want {
+				t.Fatalf("eval() = %#v, want %#v", got, tt.want)
+			}
+		})
+	}
+}
+
+// TestPathExprNegativeIndex tests that the negative index which bypassed the compilation does not panic.
+func TestPathExprNegativeIndex(t *testing.T) {
+	e := pathExpr{"assertion", "groups", -1}
+	if v, err := e.eval(map[string]any{"assertion": map[string]any{"groups": []any{"admins"}}}); err == nil {
+		t.Fatalf("eval() = %#v, want error", v)
+	}
+}
+
+func TestCompileAttrExprError(t *testing.T) {
+	tests := map[string]string{
+		"Empty":                "",
+		"UnterminatedString":   "'abc",
+		"UnknownRoot":          "claims.sub",
+		"UnsupportedCharacter": "assertion.sub == 'a' + 'b'",
+		"Parentheses":          "(assertion.sub == 'a')",
+		"MissingOperand":       "assertion.sub ==",
+		"MissingSelector":      "assertion.",
+		"InvalidIndex":         "assertion.groups[x]",
+		"NegativeIndex":        "assertion.groups[-1]",
+		"UnterminatedIndex":    "assertion.groups[0",
+		"TrailingToken":        "assertion.sub 'a'",
+		"DanglingAnd":          "assertion.sub == 'a' &&",
+	}
+	for name, src := range tests {
+		t.Run(name, func(t *testing.T) {
+			if e, err := compileAttrExpr(src); err == nil {
+				t.Fatalf("compileAttrExpr(%q) = %#v, want error", src, e)
+			}
+		})
+	}
+}
@@ -0,0 +1,127 @@
+// Copyright 2022 The compute-metadata-server Authors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package fakemetadata_test
+
+import (
+	"net/http"
+	"reflect"
+	"testing"
+
+	"github.com/zchee/compute-metadata-server/fakemetadata"
+)
+
+func TestAttributes(t *testing.T) {
+	srv := startServer(t)
+
+	proj := fakemetadata.Project{
+		ProjectID: "my-project",
+		Attributes: map[string]string{
+			"enable-oslogin": "TRUE",
+			"project-only":   "<project> & value",
+		},
+	}
+	if err := srv.SetProject(proj); err != nil {
+		t.Fatal(err)
+	}
+	inst := fakemetadata.Instance{
+		Attributes: map[string]string{
+			"enable-oslogin": "FALSE",
+			"startup-script": `#!/bin/sh
+echo "<hello> & 'world'"`,
+		},
+	}
+	if err := srv.SetInstance(inst); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := map[string]struct {
+		path       string
+		wantStatus int
+		want       string
+	}{
+		"InstanceListing": {
+			// the inherited project keys are not listed
+			path:       "instance/attributes/",
+			wantStatus: http.StatusOK,
+			want:       "enable-oslogin\nstartup-script",
+		},
+		"InstanceValue": {
+			// the value is served as is
+			path:       "instance/attributes/startup-script",
+			wantStatus: http.StatusOK,
+			want:       inst.Attributes["startup-script"],
+		},
+		"InstanceShadowed": {
+			path:       "instance/attributes/enable-oslogin",
+			wantStatus: http.StatusOK,
+			want:       "FALSE",
+		},
+		"InstanceInherited": {
+			path:       "instance/attributes/project-only",
+			wantStatus: http.StatusNotFound,
+		},
+		"ProjectListing": {
+			path:       "project/attributes/",
+			wantStatus: http.StatusOK,
+			want:       "enable-oslogin\nproject-only",
+		},
+		"ProjectValue": {
+			path:       "project/attributes/project-only",
+			wantStatus: http.StatusOK,
+			want:       "<project> & value",
+		},
+		"ProjectShadowed": {
+			// the project attribute is served as is even if the instance attribute shadows it
+			path:       "project/attributes/enable-oslogin",
+			wantStatus: http.StatusOK,
+			want:       "TRUE",
+		},
+		"ProjectUnknown": {
+			path:       "project/attributes/unknown",
+			wantStatus: http.StatusNotFound,
+		},
+		"InvalidRecursive": {
+			path:       "instance/attributes/?recursive=maybe",
+			wantStatus: http.StatusBadRequest,
+		},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			resp := get(t, srv, tt.path)
+			if resp.status != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", resp.status, tt.wantStatus, resp.body)
+			}
+			if tt.wantStatus == http.StatusOK && resp.body != tt.want {
+				t.Fatalf("%s = %q, want %q", tt.path, resp.body, tt.want)
+			}
+		})
+	}
+
+	t.Run("Recursive", func(t *testing.T) {
+		var got map[string]string
+		getJSON(t, srv, "instance/attributes/?recursive=true", &got)
+		if !reflect.DeepEqual(got, inst.Attributes) {
+			t.Fatalf("instance attributes = %v, want %v", got, inst.Attributes)
+		}
+
+		got = nil
+		getJSON(t, srv, "project/attributes/?recursive=true", &got)
+		if !reflect.DeepEqual(got, proj.Attributes) {
+			t.Fatalf("project attributes = %v, want %v", got, proj.Attributes)
+		}
+	})
+
+	t.Run("Shadowing", func(t *testing.T) {
+		// the guest agents see the instance attribute, or the project attribute if the instance has no attribute of the same key
+		if got, ok := srv.Attribute("enable-oslogin"); !ok || got != "FALSE" {
+			t.Fatalf("Attribute(enable-oslogin) = %q, %t, want %q", got, ok, "FALSE")
+		}
+		if got, ok := srv.Attribute("project-only"); !ok || got != proj.Attributes["project-only"] {
+			t.Fatalf("Attribute(project-only) = %q, %t, want %q", got, ok, proj.Attributes["project-only"])
+		}
+		if _, ok := srv.Attribute("unknown"); ok {
+			t.Fatal("Attribute(unknown) must not be found")
+		}
+	})
+}
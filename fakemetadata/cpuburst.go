@@ -0,0 +1,128 @@
+// Copyright 2022 The compute-metadata-server Authors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package fakemetadata
+
+import (
+	"sync"
+	"time"
+)
+
+// defaultCPUBurstWindow is the default duration of the full burst from the full CPU burst budget.
+const defaultCPUBurstWindow = 30 * time.Second
+
+// CPUBurst configures the CPU burst budget of the shared-core machine types which is served as remaining-cpu-time.
+//
+// The zero value fields are derived from the machine type.
+type CPUBurst struct {
+	// Capacity is the CPU time of the full CPU burst budget.
+	//
+	// If zero, the CPU time of bursting for 30 seconds is used.
+	Capacity time.Duration
+
+	// DrainRate is the CPU time consumed from the budget per second while the instance is bursting.
+	//
+	// If zero, the number of vCPUs above the baseline (GuestCPUs - BaselineCPUs) is used.
+	DrainRate time.Duration
+
+	// RefillRate is the CPU time refilled to the budget per second while the instance is idle.
+	//
+	// If zero, the baseline vCPUs (BaselineCPUs) is used.
+	RefillRate time.Duration
+}
+
+// withDefaults returns the copy of c with the zero value fields derived from mt.
+func (c CPUBurst) withDefaults(mt MachineTypeInfo) CPUBurst {
+	burstCPUs := float64(mt.GuestCPUs) - mt.BaselineCPUs
+	if c.DrainRate == 0 {
+		c.DrainRate = time.Duration(burstCPUs * float64(time.Second))
+	}
+	if c.RefillRate == 0 {
+		c.RefillRate = time.Duration(mt.BaselineCPUs * float64(time.Second))
+	}
+	if c.Capacity == 0 {
+		c.Capacity = time.Duration(burstCPUs * float64(defaultCPUBurstWindow))
+	}
+
+	return c
+}
+
+// cpuBurst tracks the CPU burst budget of the shared-core machine types.
+//
+// The zero value is valid and ready to use, and starts with the full budget.
+type cpuBurst struct {
+	now func() time.Time // clock of the budget, time.Now if nil
+
+	mu       sync.Mutex // guard of below fields
+	cfg      CPUBurst
+	bursting bool
+	used     time.Duration // CPU time consumed from the full budget
+	updated  time.Time
+}
+
+// advance updates the consumed CPU time up to now.
+//
+// The caller must hold b.mu.
+func (b *cpuBurst) advance(mt MachineTypeInfo, now time.Time) CPUBurst {
+	cfg := b.cfg.withDefaults(mt)
+	if !b.updated.IsZero() {
+		elapsed := now.Sub(b.updated).Seconds()
+		if b.bursting {
+			b.used += time.Duration(elapsed * float64(cfg.DrainRate))
+		} else {
+			b.used -= time.Duration(elapsed * float64(cfg.RefillRate))
+		}
+	}
+	b.used = min(max(b.used, 0), cfg.Capacity)
+	b.updated = now
+
+	return cfg
+}
+
+// clock returns the current time of the clock of b.
+func (b *cpuBurst) clock() time.Time {
+	if b.now != nil {
+		return b.now()
+	}
+
+	return time.Now()
+}
+
+// remaining returns the remaining CPU time of the budget.
+func (b *cpuBurst) remaining(mt MachineTypeInfo) time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	cfg := b.advance(mt, b.clock())
+	return cfg.Capacity - b.used
+}
+
+// setBursting marks the instance as bursting or idle.
+func (b *cpuBurst) setBursting(mt MachineTypeInfo, bursting bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.advance(mt, b.clock())
+	b.bursting = bursting
+}
+
+// configure replaces the configuration and refills the budget.
+func (b *cpuBurst) configure(cfg CPUBurst) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.cfg = cfg
+	b.used = 0
+	b.updated = time.Time{}
+}
+
+// reset refills the budget and marks the instance as idle, which keeps the configuration and re-derives its zero value
+// fields from the next machine type.
+func (b *cpuBurst) reset() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.bursting = false
+	b.used = 0
+	b.updated = time.Time{}
+}
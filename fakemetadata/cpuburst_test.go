@@ -0,0 +1,70 @@
+// Copyright 2022 The compute-metadata-server Authors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package fakemetadata
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCPUBurst(t *testing.T) {
+	mt, ok := LookupMachineType("e2-micro")
+	if !ok {
+		t.Fatal("e2-micro not found")
+	}
+
+	// e2-micro has 2 vCPUs and 0.25 baseline vCPUs, so the budget of 30 seconds burst is 52.5 seconds of CPU time,
+	// which drains by 1.75 seconds and refills by 0.25 seconds per second
+	now := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	b := &cpuBurst{now: func() time.Time { return now }}
+	check := func(want time.Duration) {
+		t.Helper()
+
+		if got := b.remaining(mt); got != want {
+			t.Fatalf("remaining = %s, want %s", got, want)
+		}
+	}
+
+	check(52500 * time.Millisecond)
+
+	b.setBursting(mt, true)
+	now = now.Add(10 * time.Second)
+	check(35 * time.Second)
+
+	b.setBursting(mt, false)
+	now = now.Add(20 * time.Second)
+	check(40 * time.Second)
+
+	// the budget is capped at the capacity
+	now = now.Add(time.Hour)
+	check(52500 * time.Millisecond)
+
+	// and never falls below zero
+	b.setBursting(mt, true)
+	now = now.Add(time.Hour)
+	check(0)
+
+	// the configuration refills the budget
+	b.configure(CPUBurst{Capacity: 10 * time.Second, DrainRate: time.Second, RefillRate: 2 * time.Second})
+	check(10 * time.Second)
+	now = now.Add(4 * time.Second)
+	check(6 * time.Second)
+	b.setBursting(mt, false)
+	now = now.Add(time.Second)
+	check(8 * time.Second)
+
+	// the reset refills the budget of the next machine type, and keeps the configuration
+	b.setBursting(mt, true)
+	now = now.Add(5 * time.Second)
+	check(3 * time.Second)
+	small, ok := LookupMachineType("e2-small")
+	if !ok {
+		t.Fatal("e2-small not found")
+	}
+	b.reset()
+	mt = small
+	check(10 * time.Second)
+	now = now.Add(time.Hour)
+	check(10 * time.Second)
+}
@@ -25,6 +25,7 @@ const (
 	INTEL_HSW                             // https://en.wikipedia.org/wiki/Haswell_(microarchitecture)
 	INTEL_BDW                             // https://en.wikipedia.org/wiki/Broadwell_(microarchitecture)
 	INTEL_SKL                             // https://en.wikipedia.org/wiki/Skylake_(microarchitecture)
+	INTEL_CLX                             // https://en.wikichip.org/wiki/intel/microarchitectures/cascade_lake
 	INTEL_ATOM_GMT                        // https://en.wikipedia.org/wiki/Goldmont
 	INTEL_KBL                             // https://en.wikipedia.org/wiki/Kaby_Lake
 	INTEL_CFL                             // https://en.wikipedia.org/wiki/Coffee_Lake
@@ -91,6 +92,8 @@ func (x86 X86Microarchitecture) String() string {
 		return "Intel Broadwell"
 	case INTEL_SKL:
 		return "Intel Skylake"
+	case INTEL_CLX:
+		return "Intel Cascade Lake"
 	case INTEL_ATOM_GMT:
 		return "Intel Goldmont"
 	case INTEL_KBL:
@@ -160,6 +163,36 @@ func (x86 X86Microarchitecture) String() string {
 	return ""
 }
 
+// Platform returns the Compute Engine CPU platform name of x86.
+//
+// It returns an empty string if x86 is not offered as a Compute Engine CPU platform.
+//
+// See: https://cloud.google.com/compute/docs/cpu-platforms
+func (x86 X86Microarchitecture) Platform() string {
+	switch x86 {
+	case INTEL_HSW:
+		return "Intel Haswell"
+	case INTEL_BDW:
+		return "Intel Broadwell"
+	case INTEL_SKL:
+		return "Intel Skylake"
+	case INTEL_CLX:
+		return "Intel Cascade Lake"
+	case INTEL_ICL:
+		return "Intel Ice Lake"
+	case INTEL_SPR:
+		return "Intel Sapphire Rapids"
+	case AMD_ZEN2:
+		return "AMD Rome"
+	case AMD_ZEN3:
+		return "AMD Milan"
+	case AMD_ZEN4:
+		return "AMD Genoa"
+	}
+
+	return ""
+}
+
 func matchFamilyModel(info cpuid.CPUInfo, family, model int) bool {
 	return info.Family == family && info.Model == model
 }
@@ -241,8 +274,14 @@ func detectCPUMicroarchitecture(info cpuid.CPUInfo) X86Microarchitecture {
 			matchFamilyModel(info, 0x06, 0x56):
 			return INTEL_BDW
 
+		case matchFamilyModel(info, 0x06, 0x55):
+			// Skylake-SP and Cascade Lake share the model, and are distinguished by the stepping
+			if info.Stepping >= 5 && info.Stepping <= 7 {
+				return INTEL_CLX
+			}
+			return INTEL_SKL
+
 		case matchFamilyModel(info, 0x06, 0x4E),
-			matchFamilyModel(info, 0x06, 0x55),
 			matchFamilyModel(info, 0x06, 0x5E):
 			return INTEL_SKL
 
@@ -4,6 +4,7 @@
 package fakemetadata
 
 import (
+	"io"
 	"net/http"
 
 	json "github.com/goccy/go-json"
@@ -24,6 +25,21 @@ func WriteJSON(w safehttp.ResponseWriter, data interface{}) safehttp.Result {
 	return w.Write(JSONResponse{data})
 }
 
+// TextResponse should encapsulate a plain text that will be written to the
+// http.ResponseWriter as is.
+//
+// It is used for the user provided values such as the metadata attributes, which
+// the real metadata server serves without any escaping.
+type TextResponse struct {
+	Text string
+}
+
+// WriteText creates a TextResponse from the text and calls the Write
+// function of the ResponseWriter, passing the response.
+func WriteText(w safehttp.ResponseWriter, text string) safehttp.Result {
+	return w.Write(TextResponse{text})
+}
+
 // Dispatcher is a custom safehttp.Dispatcher implementation.
 // See:
 //
@@ -38,6 +54,10 @@ func (d Dispatcher) Write(rw http.ResponseWriter, resp safehttp.Response) error
 	case JSONResponse:
 		rw.Header().Set("Content-Type", "application/json; charset=utf-8")
 		return json.NewEncoder(rw).Encode(x.Data)
+	case TextResponse:
+		rw.Header().Set("Content-Type", "application/text")
+		_, err := io.WriteString(rw, x.Text)
+		return err
 	}
 
 	// calling the default dispatcher in case we have no custom responses that match.
@@ -51,6 +71,10 @@ func (d Dispatcher) Error(rw http.ResponseWriter, resp safehttp.ErrorResponse) e
 	case StatusError:
 		rw.Header().Set("Content-Type", "text/html; charset=utf-8")
 		return x.Error(rw, resp)
+	case OAuthError:
+		rw.Header().Set("Content-Type", "application/json; charset=utf-8")
+		rw.WriteHeader(int(x.Code()))
+		return json.NewEncoder(rw).Encode(x)
 	}
 
 	// calling the default dispatcher in case we have no custom responses that match.
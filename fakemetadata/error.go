@@ -35,3 +35,27 @@ func (e StatusError) Error(w http.ResponseWriter, resp safehttp.ErrorResponse) e
 	http.Error(w, e.err.Error(), int(e.Code()))
 	return nil
 }
+
+// OAuthError represents the OAuth 2.0 error response of RFC 6749 section 5.2, which is written as JSON.
+//
+// This error requires custom safehttp dispatcher.
+type OAuthError struct {
+	ErrorCode   string `json:"error"`
+	Description string `json:"error_description,omitempty"`
+
+	status safehttp.StatusCode
+}
+
+// NewOAuthError returns the new OAuthError of the error code and description with status.
+func NewOAuthError(code, description string, status safehttp.StatusCode) OAuthError {
+	return OAuthError{
+		ErrorCode:   code,
+		Description: description,
+		status:      status,
+	}
+}
+
+// Code implements safehttp.ErrorResponse.Code.
+func (e OAuthError) Code() safehttp.StatusCode {
+	return e.status
+}
@@ -0,0 +1,230 @@
+// Copyright 2022 The compute-metadata-server Authors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package fakemetadata
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash/fnv"
+	"maps"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// DefaultGKEVersion is the Kubernetes version of the GKE node pool served when the GKENodePool has no version.
+const DefaultGKEVersion = "1.30.5-gke.1014001"
+
+// DefaultGKENodePoolName is the node pool name served when the GKENodePool has no name.
+const DefaultGKENodePoolName = "default-pool"
+
+// List of GKE node taint effects.
+const (
+	TaintEffectNoSchedule       = "NoSchedule"
+	TaintEffectPreferNoSchedule = "PreferNoSchedule"
+	TaintEffectNoExecute        = "NoExecute"
+)
+
+// GKENodePool represents the GKE node pool which the VM belongs to.
+//
+// The GKE node attributes such as cluster-name, cluster-uid, kube-env and kube-labels are derived from the node pool.
+//
+// See: https://cloud.google.com/kubernetes-engine/docs/concepts/node-pools
+type GKENodePool struct {
+	// ClusterName is the name of the GKE cluster. It must be a RFC 1035 label. e.g. "cluster-1".
+	ClusterName string
+
+	// ClusterLocation is the zone or region of the GKE cluster. e.g. "us-central1".
+	//
+	// If empty, the zone of the VM is used, that is the zonal cluster.
+	ClusterLocation string
+
+	// ClusterUID is the UID of the GKE cluster, which is 64 hexadecimal characters.
+	//
+	// If empty, the UID is derived from the project ID, ClusterLocation and ClusterName so that it is stable across server restarts.
+	ClusterUID string
+
+	// Name is the name of the node pool. It must be a RFC 1035 label.
+	//
+	// If empty, DefaultGKENodePoolName is used.
+	Name string
+
+	// KubernetesVersion is the Kubernetes version of the node pool. e.g. "1.30.5-gke.1014001".
+	//
+	// If empty, DefaultGKEVersion is used.
+	KubernetesVersion string
+
+	// Labels is the Kubernetes node labels of the node pool, in addition to the labels GKE sets.
+	Labels map[string]string
+
+	// Taints is the Kubernetes node taints of the node pool.
+	Taints []GKETaint
+}
+
+// GKETaint represents the Kubernetes node taint.
+type GKETaint struct {
+	Key    string
+	Value  string
+	Effect string
+}
+
+// String returns the taint in KEY=VALUE:EFFECT format.
+func (t GKETaint) String() string {
+	return fmt.Sprintf("%s=%s:%s", t.Key, t.Value, t.Effect)
+}
+
+var (
+	// k8sLabelKeyRe matches to the Kubernetes label key, which is the optional DNS subdomain prefix and the name.
+	k8sLabelKeyRe = regexp.MustCompile(`^([a-z0-9]([-a-z0-9.]{0,251}[a-z0-9])?/)?[A-Za-z0-9]([-A-Za-z0-9_.]{0,61}[A-Za-z0-9])?$`)
+
+	// k8sLabelValueRe matches to the Kubernetes label value.
+	k8sLabelValueRe = regexp.MustCompile(`^([A-Za-z0-9]([-A-Za-z0-9_.]{0,61}[A-Za-z0-9])?)?$`)
+
+	// clusterUIDRe matches to the GKE cluster UID.
+	clusterUIDRe = regexp.MustCompile(`^[0-9a-f]{64}$`)
+)
+
+// Validate reports an error if np is not a valid GKE node pool configuration.
+func (np GKENodePool) Validate() error {
+	if !rfc1035Re.MatchString(np.ClusterName) {
+		return fmt.Errorf("cluster name %q must be a RFC 1035 label", np.ClusterName)
+	}
+	if np.Name != "" && !rfc1035Re.MatchString(np.Name) {
+		return fmt.Errorf("node pool name %q must be a RFC 1035 label", np.Name)
+	}
+	if np.ClusterUID != "" && !clusterUIDRe.MatchString(np.ClusterUID) {
+		return fmt.Errorf("cluster UID %q must be 64 hexadecimal characters", np.ClusterUID)
+	}
+
+	for key, val := range np.Labels {
+		if !k8sLabelKeyRe.MatchString(key) {
+			return fmt.Errorf("invalid node label key %q", key)
+		}
+		if !k8sLabelValueRe.MatchString(val) {
+			return fmt.Errorf("invalid value %q of node label %q", val, key)
+		}
+	}
+	for _, taint := range np.Taints {
+		if !k8sLabelKeyRe.MatchString(taint.Key) {
+			return fmt.Errorf("invalid node taint key %q", taint.Key)
+		}
+		if !k8sLabelValueRe.MatchString(taint.Value) {
+			return fmt.Errorf("invalid value %q of node taint %q", taint.Value, taint.Key)
+		}
+		switch taint.Effect {
+		case TaintEffectNoSchedule, TaintEffectPreferNoSchedule, TaintEffectNoExecute:
+			// nothing to do
+		default:
+			return fmt.Errorf("unknown effect %q of node taint %q", taint.Effect, taint.Key)
+		}
+	}
+
+	return nil
+}
+
+func (np GKENodePool) name() string {
+	if np.Name != "" {
+		return np.Name
+	}
+
+	return DefaultGKENodePoolName
+}
+
+func (np GKENodePool) kubernetesVersion() string {
+	if np.KubernetesVersion != "" {
+		return np.KubernetesVersion
+	}
+
+	return DefaultGKEVersion
+}
+
+func (np GKENodePool) clusterLocation(inst Instance) string {
+	if np.ClusterLocation != "" {
+		return np.ClusterLocation
+	}
+
+	return inst.zone()
+}
+
+func (np GKENodePool) clusterUID(inst Instance, projectID string) string {
+	if np.ClusterUID != "" {
+		return np.ClusterUID
+	}
+
+	sum := sha256.Sum256([]byte(projectID + "/" + np.clusterLocation(inst) + "/" + np.ClusterName))
+	return hex.EncodeToString(sum[:])
+}
+
+// groupName returns the name of the instance group manager and instance template of the node pool.
+// e.g. "gke-cluster-1-default-pool-1a2b3c4d"
+func (np GKENodePool) groupName(inst Instance, projectID string) string {
+	h := fnv.New32a()
+	h.Write([]byte(np.clusterUID(inst, projectID) + "/" + np.name()))
+
+	return fmt.Sprintf("gke-%.20s-%.20s-%08x", np.ClusterName, np.name(), h.Sum32())
+}
+
+// nodeLabels returns the Kubernetes node labels, including the labels GKE sets.
+func (np GKENodePool) nodeLabels(inst Instance) map[string]string {
+	labels := map[string]string{
+		"cloud.google.com/gke-boot-disk":         "pd-balanced",
+		"cloud.google.com/gke-container-runtime": "containerd",
+		"cloud.google.com/gke-nodepool":          np.name(),
+		"cloud.google.com/gke-os-distribution":   "cos",
+	}
+	if mt, ok := LookupMachineType(inst.MachineType); ok {
+		labels["cloud.google.com/machine-family"] = mt.Family
+	}
+	maps.Copy(labels, np.Labels)
+
+	return labels
+}
+
+// attributes returns the instance attributes of the GKE node.
+//
+// The created-by and instance-template attributes require projectNumber and the zone of inst.
+func (np GKENodePool) attributes(inst Instance, projectID, projectNumber string) map[string]string {
+	labels := np.nodeLabels(inst)
+	kubeLabels := make([]string, 0, len(labels))
+	for _, key := range slices.Sorted(maps.Keys(labels)) {
+		kubeLabels = append(kubeLabels, key+"="+labels[key])
+	}
+	taints := make([]string, len(np.Taints))
+	for i, taint := range np.Taints {
+		taints[i] = taint.String()
+	}
+
+	kubeEnv := []string{
+		"CLUSTER_NAME: " + np.ClusterName,
+		"ENABLE_NODE_PROBLEM_DETECTOR: standalone",
+		"KUBERNETES_MASTER: \"false\"",
+		"NODE_LABELS: " + strings.Join(kubeLabels, ","),
+	}
+	if len(taints) > 0 {
+		kubeEnv = append(kubeEnv, "NODE_TAINTS: "+strings.Join(taints, ","))
+	}
+	kubeEnv = append(kubeEnv,
+		fmt.Sprintf("SERVER_BINARY_TAR_URL: https://storage.googleapis.com/gke-release/kubernetes/release/v%s/kubernetes-server-linux-amd64.tar.gz", np.kubernetesVersion()),
+	)
+
+	attrs := map[string]string{
+		"cluster-location":         np.clusterLocation(inst),
+		"cluster-name":             np.ClusterName,
+		"cluster-uid":              np.clusterUID(inst, projectID),
+		"disable-legacy-endpoints": "true",
+		"gci-metrics-enabled":      "true",
+		"gci-update-strategy":      "update_disabled",
+		"kube-env":                 strings.Join(kubeEnv, "\n") + "\n",
+		"kube-labels":              strings.Join(kubeLabels, ","),
+	}
+
+	if zone := inst.zone(); zone != "" && projectNumber != "" {
+		group := np.groupName(inst, projectID)
+		attrs["created-by"] = fmt.Sprintf("projects/%s/zones/%s/instanceGroupManagers/%s-grp", projectNumber, zone, group)
+		attrs["instance-template"] = fmt.Sprintf("projects/%s/global/instanceTemplates/%s", projectNumber, group)
+	}
+
+	return attrs
+}
@@ -0,0 +1,173 @@
+// Copyright 2022 The compute-metadata-server Authors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package fakemetadata_test
+
+import (
+	"net/http"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/zchee/compute-metadata-server/fakemetadata"
+)
+
+func TestGKENodePoolValidate(t *testing.T) {
+	tests := map[string]struct {
+		np      fakemetadata.GKENodePool
+		wantErr bool
+	}{
+		"Valid": {
+			np: fakemetadata.GKENodePool{
+				ClusterName: "cluster-1",
+				Name:        "pool-1",
+				ClusterUID:  strings.Repeat("0a", 32),
+				Labels:      map[string]string{"example.com/team": "web", "env": ""},
+				Taints:      []fakemetadata.GKETaint{{Key: "dedicated", Value: "gpu", Effect: fakemetadata.TaintEffectNoSchedule}},
+			},
+		},
+		"NoClusterName": {
+			np:      fakemetadata.GKENodePool{},
+			wantErr: true,
+		},
+		"InvalidClusterName": {
+			np:      fakemetadata.GKENodePool{ClusterName: "Cluster_1"},
+			wantErr: true,
+		},
+		"InvalidName": {
+			np:      fakemetadata.GKENodePool{ClusterName: "cluster-1", Name: "1-pool"},
+			wantErr: true,
+		},
+		"InvalidClusterUID": {
+			np:      fakemetadata.GKENodePool{ClusterName: "cluster-1", ClusterUID: "not-hex"},
+			wantErr: true,
+		},
+		"InvalidLabelKey": {
+			np:      fakemetadata.GKENodePool{ClusterName: "cluster-1", Labels: map[string]string{"-env": "prod"}},
+			wantErr: true,
+		},
+		"InvalidLabelValue": {
+			np:      fakemetadata.GKENodePool{ClusterName: "cluster-1", Labels: map[string]string{"env": "prod env"}},
+			wantErr: true,
+		},
+		"InvalidTaintKey": {
+			np:      fakemetadata.GKENodePool{ClusterName: "cluster-1", Taints: []fakemetadata.GKETaint{{Key: "a b", Effect: fakemetadata.TaintEffectNoExecute}}},
+			wantErr: true,
+		},
+		"UnknownTaintEffect": {
+			np:      fakemetadata.GKENodePool{ClusterName: "cluster-1", Taints: []fakemetadata.GKETaint{{Key: "dedicated", Effect: "Evict"}}},
+			wantErr: true,
+		},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			if err := tt.np.Validate(); (err != nil) != tt.wantErr {
+				t.Fatalf("Validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+
+	srv := fakemetadata.NewServer()
+	t.Cleanup(func() { srv.Close() })
+	if err := srv.SetInstance(fakemetadata.Instance{GKENodePool: &fakemetadata.GKENodePool{}}); err == nil {
+		t.Fatal("SetInstance with the invalid GKE node pool must fail")
+	}
+}
+
+func TestGKENodeAttributes(t *testing.T) {
+	srv := startServer(t)
+
+	if err := srv.SetProject(fakemetadata.Project{ProjectID: "my-project", NumericProjectID: 123456789012}); err != nil {
+		t.Fatal(err)
+	}
+	np := &fakemetadata.GKENodePool{
+		ClusterName: "cluster-1",
+		Labels:      map[string]string{"env": "prod"},
+		Taints:      []fakemetadata.GKETaint{{Key: "dedicated", Value: "gpu", Effect: fakemetadata.TaintEffectNoSchedule}},
+	}
+	inst := fakemetadata.Instance{
+		Name:        "gke-node-1",
+		Zone:        "us-central1-a",
+		MachineType: "e2-medium",
+		GKENodePool: np,
+		Attributes:  map[string]string{"cluster-name": "overridden"},
+	}
+	if err := srv.SetInstance(inst); err != nil {
+		t.Fatal(err)
+	}
+
+	attr := func(key string) string {
+		t.Helper()
+		return getText(t, srv, "instance/attributes/"+key)
+	}
+
+	// the instance attribute shadows the derived attribute
+	if got := attr("cluster-name"); got != "overridden" {
+		t.Fatalf("cluster-name = %q, want %q", got, "overridden")
+	}
+	if got := attr("cluster-location"); got != "us-central1-a" {
+		t.Fatalf("cluster-location = %q, want the zone of the VM", got)
+	}
+
+	// the derived cluster UID is stable
+	uid := attr("cluster-uid")
+	if !regexp.MustCompile(`^[0-9a-f]{64}$`).MatchString(uid) {
+		t.Fatalf("cluster-uid = %q, want 64 hexadecimal characters", uid)
+	}
+	if again := attr("cluster-uid"); again != uid {
+		t.Fatalf("cluster-uid is not stable: %q and %q", uid, again)
+	}
+
+	wantLabels := strings.Join([]string{
+		"cloud.google.com/gke-boot-disk=pd-balanced",
+		"cloud.google.com/gke-container-runtime=containerd",
+		"cloud.google.com/gke-nodepool=" + fakemetadata.DefaultGKENodePoolName,
+		"cloud.google.com/gke-os-distribution=cos",
+		"cloud.google.com/machine-family=e2",
+		"env=prod",
+	}, ",")
+	if got := attr("kube-labels"); got != wantLabels {
+		t.Fatalf("kube-labels = %q, want %q", got, wantLabels)
+	}
+
+	kubeEnv := attr("kube-env")
+	for _, want := range []string{
+		"CLUSTER_NAME: cluster-1\n",
+		"NODE_LABELS: " + wantLabels + "\n",
+		"NODE_TAINTS: dedicated=gpu:NoSchedule\n",
+		"/release/v" + fakemetadata.DefaultGKEVersion + "/",
+	} {
+		if !strings.Contains(kubeEnv, want) {
+			t.Fatalf("kube-env = %q, want contains %q", kubeEnv, want)
+		}
+	}
+
+	createdBy := regexp.MustCompile(`^projects/123456789012/zones/us-central1-a/instanceGroupManagers/gke-cluster-1-default-pool-[0-9a-f]{8}-grp$`)
+	if got := attr("created-by"); !createdBy.MatchString(got) {
+		t.Fatalf("created-by = %q, want match %s", got, createdBy)
+	}
+	if got := attr("instance-template"); !strings.HasPrefix(got, "projects/123456789012/global/instanceTemplates/gke-cluster-1-default-pool-") {
+		t.Fatalf("instance-template = %q", got)
+	}
+
+	// the configured cluster UID and location take precedence
+	np.ClusterUID = strings.Repeat("ab", 32)
+	np.ClusterLocation = "us-central1"
+	if err := srv.SetInstance(inst); err != nil {
+		t.Fatal(err)
+	}
+	if got := attr("cluster-uid"); got != np.ClusterUID {
+		t.Fatalf("cluster-uid = %q, want %q", got, np.ClusterUID)
+	}
+	if got := attr("cluster-location"); got != "us-central1" {
+		t.Fatalf("cluster-location = %q, want %q", got, "us-central1")
+	}
+
+	// the node without the zone has no created-by
+	if err := srv.SetInstance(fakemetadata.Instance{Name: "gke-node-1", GKENodePool: np}); err != nil {
+		t.Fatal(err)
+	}
+	if resp := get(t, srv, "instance/attributes/created-by"); resp.status != http.StatusNotFound {
+		t.Fatalf("created-by status without zone = %d, want %d", resp.status, http.StatusNotFound)
+	}
+}
@@ -0,0 +1,117 @@
+// Copyright 2022 The compute-metadata-server Authors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package fakemetadata
+
+import (
+	"fmt"
+	"maps"
+	"regexp"
+	"slices"
+	"sync"
+)
+
+// List of guest attributes limits.
+//
+// See: https://cloud.google.com/compute/docs/metadata/manage-guest-attributes#limitations
+const (
+	// MaxGuestAttributeNameLen is the maximum length of the guest attribute namespace and key, in bytes.
+	MaxGuestAttributeNameLen = 128
+
+	// MaxGuestAttributeValueLen is the maximum length of the guest attribute value, in bytes.
+	MaxGuestAttributeValueLen = 256 << 10
+)
+
+// guestAttributeNameRe matches to the valid guest attribute namespace and key.
+var guestAttributeNameRe = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// validateGuestAttributeName reports an error if name is not a valid guest attribute namespace or key.
+func validateGuestAttributeName(name string) error {
+	if len(name) > MaxGuestAttributeNameLen {
+		return fmt.Errorf("%q exceeds %d bytes", name, MaxGuestAttributeNameLen)
+	}
+	if !guestAttributeNameRe.MatchString(name) {
+		return fmt.Errorf("%q must contain only letters, numbers, underscores and hyphens", name)
+	}
+
+	return nil
+}
+
+// guestAttributes stores the guest attributes published by the guest.
+//
+// The zero value is valid and ready to use.
+type guestAttributes struct {
+	mu sync.RWMutex                 // guard of m
+	m  map[string]map[string]string // map of namespace to map of key to value
+}
+
+// namespaces returns the sorted namespaces which have any attributes.
+func (g *guestAttributes) namespaces() []string {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+
+	return slices.Sorted(maps.Keys(g.m))
+}
+
+// keys returns the sorted keys of namespace.
+func (g *guestAttributes) keys(namespace string) []string {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+
+	return slices.Sorted(maps.Keys(g.m[namespace]))
+}
+
+// get returns the value of namespace/key.
+func (g *guestAttributes) get(namespace, key string) (string, bool) {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+
+	val, ok := g.m[namespace][key]
+	return val, ok
+}
+
+// list returns the copy of attributes of namespace.
+func (g *guestAttributes) list(namespace string) map[string]string {
+	g.mu.RLock()
+	defer g.mu.RUnlock()
+
+	return maps.Clone(g.m[namespace])
+}
+
+// set sets the value of namespace/key.
+func (g *guestAttributes) set(namespace, key, val string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if g.m == nil {
+		g.m = make(map[string]map[string]string)
+	}
+	if g.m[namespace] == nil {
+		g.m[namespace] = make(map[string]string)
+	}
+	g.m[namespace][key] = val
+}
+
+// deleteNamespace deletes all attributes of namespace.
+func (g *guestAttributes) deleteNamespace(namespace string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	delete(g.m, namespace)
+}
+
+// delete deletes namespace/key and reports whether namespace/key existed.
+func (g *guestAttributes) delete(namespace, key string) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if _, ok := g.m[namespace][key]; !ok {
+		return false
+	}
+	delete(g.m[namespace], key)
+	if len(g.m[namespace]) == 0 {
+		delete(g.m, namespace)
+	}
+
+	return true
+}
@@ -0,0 +1,109 @@
+// Copyright 2022 The compute-metadata-server Authors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package fakemetadata_test
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/zchee/compute-metadata-server/fakemetadata"
+)
+
+func TestGuestAttributes(t *testing.T) {
+	srv := startServer(t)
+
+	const path = "instance/guest-attributes/my-ns/my-key"
+	if resp := do(t, srv, http.MethodPut, path, "value"); resp.status != http.StatusForbidden {
+		t.Fatalf("PUT status without enable-guest-attributes = %d, want %d", resp.status, http.StatusForbidden)
+	}
+	if resp := get(t, srv, "instance/guest-attributes/"); resp.status != http.StatusForbidden {
+		t.Fatalf("GET status without enable-guest-attributes = %d, want %d", resp.status, http.StatusForbidden)
+	}
+
+	if err := srv.SetInstance(fakemetadata.Instance{Attributes: map[string]string{"enable-guest-attributes": "TRUE"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	// the value is stored and served as is
+	const value = `{"state": "<ready> & running"}`
+	if resp := do(t, srv, http.MethodPut, path, value); resp.status != http.StatusOK {
+		t.Fatalf("PUT status = %d: %s", resp.status, resp.body)
+	}
+	if got := getText(t, srv, path); got != value {
+		t.Fatalf("GET %s = %q, want %q", path, got, value)
+	}
+	if got := getText(t, srv, "instance/guest-attributes/my-ns/"); got != "my-key" {
+		t.Fatalf("keys = %q, want %q", got, "my-key")
+	}
+	if got := getText(t, srv, "instance/guest-attributes/"); !strings.Contains(got, "my-ns/") {
+		t.Fatalf("namespaces = %q, want contains %q", got, "my-ns/")
+	}
+	if got, ok, err := srv.GuestAttribute("my-ns", "my-key"); err != nil || !ok || got != value {
+		t.Fatalf("GuestAttribute = %q, %t, %v, want %q", got, ok, err, value)
+	}
+	if got, err := srv.GuestAttributes("my-ns"); err != nil || len(got) != 1 || got["my-key"] != value {
+		t.Fatalf("GuestAttributes = %v, %v", got, err)
+	}
+
+	tests := map[string]struct {
+		method     string
+		path       string
+		body       string
+		wantStatus int
+	}{
+		"NoKey": {
+			method:     http.MethodPut,
+			path:       "instance/guest-attributes/my-ns/",
+			wantStatus: http.StatusBadRequest,
+		},
+		"InvalidNamespace": {
+			method:     http.MethodPut,
+			path:       "instance/guest-attributes/my.ns/key",
+			wantStatus: http.StatusBadRequest,
+		},
+		"TooLongKey": {
+			method:     http.MethodPut,
+			path:       "instance/guest-attributes/my-ns/" + strings.Repeat("k", fakemetadata.MaxGuestAttributeNameLen+1),
+			wantStatus: http.StatusBadRequest,
+		},
+		"MaxValue": {
+			method:     http.MethodPut,
+			path:       "instance/guest-attributes/my-ns/max",
+			body:       strings.Repeat("v", fakemetadata.MaxGuestAttributeValueLen),
+			wantStatus: http.StatusOK,
+		},
+		"TooLargeValue": {
+			method:     http.MethodPut,
+			path:       "instance/guest-attributes/my-ns/large",
+			body:       strings.Repeat("v", fakemetadata.MaxGuestAttributeValueLen+1),
+			wantStatus: http.StatusRequestEntityTooLarge,
+		},
+		"DeleteUnknown": {
+			method:     http.MethodDelete,
+			path:       "instance/guest-attributes/my-ns/unknown",
+			wantStatus: http.StatusNotFound,
+		},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			if resp := do(t, srv, tt.method, tt.path, tt.body); resp.status != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", resp.status, tt.wantStatus, resp.body)
+			}
+		})
+	}
+	if _, ok, _ := srv.GuestAttribute("my-ns", "large"); ok {
+		t.Fatal("too large value is stored")
+	}
+
+	if resp := do(t, srv, http.MethodDelete, path, ""); resp.status != http.StatusOK {
+		t.Fatalf("DELETE status = %d: %s", resp.status, resp.body)
+	}
+	if resp := get(t, srv, path); resp.status != http.StatusNotFound {
+		t.Fatalf("GET status after DELETE = %d, want %d", resp.status, http.StatusNotFound)
+	}
+	if _, ok, _ := srv.GuestAttribute("my-ns", "my-key"); ok {
+		t.Fatal("deleted guest attribute is returned")
+	}
+}
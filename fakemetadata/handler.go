@@ -5,7 +5,9 @@ package fakemetadata
 
 import (
 	"fmt"
+	"maps"
 	"os"
+	"slices"
 	"strings"
 
 	"github.com/google/go-safeweb/safehttp"
@@ -37,3 +39,23 @@ func redirectHandler(to string) safehttp.Handler {
 		return w.WriteError(safehttp.StatusMovedPermanently)
 	})
 }
+
+// writeAttributes writes the sorted keys of attrs, or the JSON object of attrs if the request has recursive=true query parameter.
+func writeAttributes(w safehttp.ResponseWriter, r *safehttp.IncomingRequest, attrs map[string]string) safehttp.Result {
+	q, err := r.URL().Query()
+	if err != nil {
+		return w.WriteError(NewStatusError(err, safehttp.StatusBadRequest))
+	}
+	recursive := q.Bool("recursive", false)
+	if err := q.Err(); err != nil {
+		return w.WriteError(NewStatusError(err, safehttp.StatusBadRequest))
+	}
+	if recursive {
+		if attrs == nil {
+			attrs = map[string]string{}
+		}
+		return WriteJSON(w, attrs)
+	}
+
+	return w.Write(safehtml.HTMLEscaped(strings.Join(slices.Sorted(maps.Keys(attrs)), "\n")))
+}
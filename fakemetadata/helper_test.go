@@ -0,0 +1,116 @@
+// Copyright 2022 The compute-metadata-server Authors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package fakemetadata_test
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+
+	json "github.com/goccy/go-json"
+
+	"github.com/zchee/compute-metadata-server/fakemetadata"
+)
+
+// startServer starts the fake metadata server on the random local port, and closes it at the end of the test.
+func startServer(t testing.TB) *fakemetadata.Server {
+	t.Helper()
+
+	srv := fakemetadata.NewServer()
+	l, err := net.Listen("tcp4", srv.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.Serve(l)
+	t.Cleanup(func() { srv.Close() })
+
+	return srv
+}
+
+// response represents the response of the fake metadata server.
+type response struct {
+	status int
+	header http.Header
+	body   string
+}
+
+// metadataRequest returns the method request of the metadata path, which is relative to /computeMetadata/v1/,
+// with the Metadata-Flavor header.
+func metadataRequest(srv *fakemetadata.Server, method, path string, body io.Reader) (*http.Request, error) {
+	req, err := http.NewRequest(method, "http://"+srv.Addr()+"/computeMetadata/v1/"+path, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set(fakemetadata.MetadataFlavorHeader, fakemetadata.MetadataFlavorValue)
+
+	return req, nil
+}
+
+// fetch sends req by client and reads the response.
+//
+// Unlike do, fetch does not fail the test, so it can be called from the goroutines other than the test goroutine.
+func fetch(client *http.Client, req *http.Request) (response, error) {
+	resp, err := client.Do(req)
+	if err != nil {
+		return response{}, err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return response{}, err
+	}
+
+	return response{status: resp.StatusCode, header: resp.Header, body: string(body)}, nil
+}
+
+// do sends the method request of the metadata path to srv, and returns the response.
+func do(t testing.TB, srv *fakemetadata.Server, method, path, body string) response {
+	t.Helper()
+
+	req, err := metadataRequest(srv, method, path, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := fetch(http.DefaultClient, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return resp
+}
+
+// get sends the GET request of the metadata path to srv, and returns the response.
+func get(t testing.TB, srv *fakemetadata.Server, path string) response {
+	t.Helper()
+
+	return do(t, srv, http.MethodGet, path, "")
+}
+
+// getJSON sends the GET request of the metadata path to srv, and decodes the 200 response into v.
+func getJSON(t testing.TB, srv *fakemetadata.Server, path string, v any) {
+	t.Helper()
+
+	resp := get(t, srv, path)
+	if resp.status != http.StatusOK {
+		t.Fatalf("GET %s: status = %d: %s", path, resp.status, resp.body)
+	}
+	if err := json.Unmarshal([]byte(resp.body), v); err != nil {
+		t.Fatalf("GET %s: %v", path, err)
+	}
+}
+
+// getText sends the GET request of the metadata path to srv, and returns the body of the 200 response.
+func getText(t testing.TB, srv *fakemetadata.Server, path string) string {
+	t.Helper()
+
+	resp := get(t, srv, path)
+	if resp.status != http.StatusOK {
+		t.Fatalf("GET %s: status = %d: %s", path, resp.status, resp.body)
+	}
+
+	return resp.body
+}
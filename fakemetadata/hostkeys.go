@@ -0,0 +1,181 @@
+// Copyright 2022 The compute-metadata-server Authors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package fakemetadata
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// HostKeysNamespace is the guest attributes namespace which stores the SSH host keys.
+const HostKeysNamespace = "hostkeys"
+
+// hostKeyFiles map of SSH host key type to the public key file name in the sshd configuration directory.
+var hostKeyFiles = map[string]string{
+	ssh.KeyAlgoRSA:      "ssh_host_rsa_key.pub",
+	ssh.KeyAlgoED25519:  "ssh_host_ed25519_key.pub",
+	ssh.KeyAlgoECDSA256: "ssh_host_ecdsa_key.pub",
+}
+
+// hostKeys holds the SSH host keys published to the hostkeys guest attributes namespace.
+//
+// The zero value is valid and ready to use, and generates the host keys on first publish.
+type hostKeys struct {
+	mu        sync.Mutex        // guard of below fields
+	keys      map[string]string // map of key type to "KEY_TYPE BASE64_KEY"
+	signers   []ssh.Signer      // private keys of the generated host keys
+	published bool
+}
+
+// readHostKeys reads the ssh_host_*_key.pub files in dir, such as /etc/ssh.
+//
+// The missing key files are skipped, but at least one key file is required.
+func readHostKeys(dir string) (map[string]string, error) {
+	keys := make(map[string]string)
+	for typ, name := range hostKeyFiles {
+		data, err := os.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				continue
+			}
+			return nil, fmt.Errorf("could not read %s host key: %w", typ, err)
+		}
+
+		pub, _, _, _, err := ssh.ParseAuthorizedKey(data)
+		if err != nil {
+			return nil, fmt.Errorf("could not parse %s: %w", name, err)
+		}
+		if pub.Type() != typ {
+			return nil, fmt.Errorf("%s has %s key type, want %s", name, pub.Type(), typ)
+		}
+		keys[typ] = marshalHostKey(pub)
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("no SSH host keys in %s", dir)
+	}
+
+	return keys, nil
+}
+
+// generateHostKeys generates the ssh-rsa, ssh-ed25519 and ecdsa-sha2-nistp256 host keys.
+func generateHostKeys() (map[string]string, []ssh.Signer, error) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 3072)
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not generate RSA host key: %w", err)
+	}
+	_, ed25519Key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not generate ED25519 host key: %w", err)
+	}
+	ecdsaKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not generate ECDSA host key: %w", err)
+	}
+
+	keys := make(map[string]string)
+	signers := make([]ssh.Signer, 0, 3)
+	for _, priv := range []crypto.Signer{rsaKey, ed25519Key, ecdsaKey} {
+		signer, err := ssh.NewSignerFromSigner(priv)
+		if err != nil {
+			return nil, nil, fmt.Errorf("could not create host key signer: %w", err)
+		}
+		signers = append(signers, signer)
+		keys[signer.PublicKey().Type()] = marshalHostKey(signer.PublicKey())
+	}
+
+	return keys, signers, nil
+}
+
+// marshalHostKey returns pub in "KEY_TYPE BASE64_KEY" format which is the same as the guest agent publishes.
+func marshalHostKey(pub ssh.PublicKey) string {
+	return strings.TrimSpace(string(ssh.MarshalAuthorizedKey(pub)))
+}
+
+// ensure generates the host keys unless the host keys are already generated or read.
+//
+// The caller must hold k.mu.
+func (k *hostKeys) ensure() error {
+	if k.keys != nil {
+		return nil
+	}
+
+	keys, signers, err := generateHostKeys()
+	if err != nil {
+		return err
+	}
+	k.keys = keys
+	k.signers = signers
+
+	return nil
+}
+
+// publishHostKeys publishes the SSH host keys to the hostkeys guest attributes namespace once,
+// same as the guest agent publishes the host keys on boot.
+func (h *InstanceHandler) publishHostKeys() error {
+	h.hostKeys.mu.Lock()
+	defer h.hostKeys.mu.Unlock()
+
+	if h.hostKeys.published {
+		return nil
+	}
+	if err := h.hostKeys.ensure(); err != nil {
+		return err
+	}
+
+	h.guestAttributes.deleteNamespace(HostKeysNamespace)
+	for typ, key := range h.hostKeys.keys {
+		h.guestAttributes.set(HostKeysNamespace, typ, key)
+	}
+	h.hostKeys.published = true
+
+	return nil
+}
+
+// setHostKeysDir replaces the host keys with the public keys in dir and republishes them.
+func (h *InstanceHandler) setHostKeysDir(dir string) error {
+	keys, err := readHostKeys(dir)
+	if err != nil {
+		return err
+	}
+
+	h.hostKeys.mu.Lock()
+	h.hostKeys.keys = keys
+	h.hostKeys.signers = nil
+	h.hostKeys.published = false
+	h.hostKeys.mu.Unlock()
+
+	if h.attributeEnabled("enable-guest-attributes") {
+		return h.publishHostKeys()
+	}
+
+	return nil
+}
+
+// hostKeySigners returns the private keys of the generated host keys.
+func (h *InstanceHandler) hostKeySigners() ([]ssh.Signer, error) {
+	h.hostKeys.mu.Lock()
+	defer h.hostKeys.mu.Unlock()
+
+	if err := h.hostKeys.ensure(); err != nil {
+		return nil, err
+	}
+	if h.hostKeys.signers == nil {
+		return nil, errors.New("host keys are read from the directory, private keys are not available")
+	}
+
+	return h.hostKeys.signers, nil
+}
@@ -0,0 +1,92 @@
+// Copyright 2022 The compute-metadata-server Authors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package fakemetadata_test
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+
+	"github.com/zchee/compute-metadata-server/fakemetadata"
+)
+
+func TestHostKeys(t *testing.T) {
+	srv := startServer(t)
+
+	if err := srv.SetInstance(fakemetadata.Instance{Attributes: map[string]string{"enable-guest-attributes": "TRUE"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	signers, err := srv.HostKeySigners()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(signers) != 3 {
+		t.Fatalf("len(signers) = %d, want 3", len(signers))
+	}
+
+	// the generated host keys are published in "KEY_TYPE BASE64_KEY" format
+	for _, signer := range signers {
+		typ := signer.PublicKey().Type()
+		want := strings.TrimSpace(string(ssh.MarshalAuthorizedKey(signer.PublicKey())))
+		if got := getText(t, srv, "instance/guest-attributes/hostkeys/"+typ); got != want {
+			t.Fatalf("hostkeys/%s = %q, want %q", typ, got, want)
+		}
+		if got, ok, err := srv.GuestAttribute(fakemetadata.HostKeysNamespace, typ); err != nil || !ok || got != want {
+			t.Fatalf("GuestAttribute(hostkeys, %s) = %q, %t, %v, want %q", typ, got, ok, err, want)
+		}
+	}
+
+	// the host keys are generated once per server
+	again, err := srv.HostKeySigners()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range signers {
+		if string(again[i].PublicKey().Marshal()) != string(signers[i].PublicKey().Marshal()) {
+			t.Fatalf("host key %s was regenerated", signers[i].PublicKey().Type())
+		}
+	}
+
+	if err := srv.SetHostKeysDir(t.TempDir()); err == nil {
+		t.Fatal("SetHostKeysDir of the directory without host keys must fail")
+	}
+
+	pub, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sshPub, err := ssh.NewPublicKey(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "ssh_host_ed25519_key.pub"), ssh.MarshalAuthorizedKey(sshPub), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := srv.SetHostKeysDir(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	// the keys read from dir replace the generated host keys
+	want := strings.TrimSpace(string(ssh.MarshalAuthorizedKey(sshPub)))
+	if got := getText(t, srv, "instance/guest-attributes/hostkeys/"+ssh.KeyAlgoED25519); got != want {
+		t.Fatalf("hostkeys/%s = %q, want %q", ssh.KeyAlgoED25519, got, want)
+	}
+	got, err := srv.GuestAttributes(fakemetadata.HostKeysNamespace)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 1 {
+		t.Fatalf("hostkeys = %v, want only %s", got, ssh.KeyAlgoED25519)
+	}
+	if _, err := srv.HostKeySigners(); err == nil {
+		t.Fatal("HostKeySigners of the host keys read from the directory must fail")
+	}
+}
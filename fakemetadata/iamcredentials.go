@@ -0,0 +1,578 @@
+// Copyright 2022 The compute-metadata-server Authors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package fakemetadata
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	iamcredentials "cloud.google.com/go/iam/credentials/apiv1"
+	"cloud.google.com/go/iam/credentials/apiv1/credentialspb"
+	json "github.com/goccy/go-json"
+	"github.com/google/go-safeweb/safehttp"
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+	"google.golang.org/api/idtoken"
+	"google.golang.org/api/option"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// maxIAMAccessTokenLifetime is the maximum lifetime of the access tokens generated by the IAM Credentials service.
+const maxIAMAccessTokenLifetime = time.Hour
+
+// IAMCredentials configures the local IAM Credentials service stand-in, which serves GenerateAccessToken, GenerateIdToken,
+// SignBlob and SignJwt over gRPC without any Google APIs.
+//
+// The caller of the request is the service account of the access token issued by the fake metadata server,
+// the federated principal of the access token issued by the local STS endpoint, or Caller if the request has no authorization.
+// The request with any other authorization is rejected.
+//
+// See: https://cloud.google.com/iam/docs/reference/credentials/rest
+type IAMCredentials struct {
+	// TokenCreators is the map of the service account email to the principals which are granted
+	// roles/iam.serviceAccountTokenCreator on the service account.
+	//
+	// The principal is the email address with the optional "user:" or "serviceAccount:" prefix,
+	// or the "principal://" or "principalSet://" identifier of the workload identity federation.
+	TokenCreators map[string][]string
+
+	// Caller is the principal of the requests without the authorization metadata.
+	//
+	// If empty, the default service account of the instance is used.
+	Caller string
+}
+
+// principal returns the email address of the principal p, or p itself if p is the federated principal identifier.
+func principal(p string) string {
+	for _, prefix := range []string{"user:", "serviceAccount:"} {
+		if email, ok := strings.CutPrefix(p, prefix); ok {
+			return email
+		}
+	}
+
+	return p
+}
+
+// Validate reports an error if c is not a valid IAM Credentials configuration.
+func (c IAMCredentials) Validate() error {
+	for sa, creators := range c.TokenCreators {
+		if !validEmailRe.MatchString(sa) {
+			return fmt.Errorf("service account email %q is invalid", sa)
+		}
+		for _, creator := range creators {
+			if isFederatedPrincipal(creator) {
+				continue
+			}
+			if email := principal(creator); email == "" || !validEmailRe.MatchString(email) {
+				return fmt.Errorf("token creator %q of %s is invalid", creator, sa)
+			}
+		}
+	}
+	if c.Caller != "" && !validEmailRe.MatchString(principal(c.Caller)) {
+		return fmt.Errorf("caller %q is invalid", c.Caller)
+	}
+
+	return nil
+}
+
+// isFederatedPrincipal reports whether p is the principal or principal set identifier of the workload identity federation.
+func isFederatedPrincipal(p string) bool {
+	return strings.HasPrefix(p, "principal://iam.googleapis.com/") || strings.HasPrefix(p, "principalSet://iam.googleapis.com/")
+}
+
+// canCreateToken reports whether any of the caller members is granted roles/iam.serviceAccountTokenCreator on the service account sa.
+func (c IAMCredentials) canCreateToken(members []string, sa string) bool {
+	for _, creator := range c.TokenCreators[sa] {
+		if slices.Contains(members, principal(creator)) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// validateDelegationChains reports an error if the delegation chain of any service account of sas is broken in c.
+// The service accounts of BackendDefault use the server-wide delegation chain defaultDelegates.
+//
+// The first hop from the caller is checked on each request, since the caller is known only then.
+func (c IAMCredentials) validateDelegationChains(sas []ServiceAccount, defaultDelegates []string) error {
+	for _, sa := range sas {
+		delegates := sa.Delegates
+		if sa.Backend == BackendDefault {
+			delegates = defaultDelegates
+		}
+		if len(delegates) == 0 {
+			continue
+		}
+
+		chain := append(slices.Clone(delegates), sa.Email)
+		for i := 1; i < len(chain); i++ {
+			if !c.canCreateToken(chain[i-1:i], chain[i]) {
+				return fmt.Errorf("delegate %s of service account %s is not granted roles/iam.serviceAccountTokenCreator on %s", chain[i-1], sa.Email, chain[i])
+			}
+		}
+	}
+
+	return nil
+}
+
+// serviceAccountResourceRe matches to the resource name of the service account, and captures the email address.
+var serviceAccountResourceRe = regexp.MustCompile(`^projects/[^/]+/serviceAccounts/([^/]+)$`)
+
+// iamCredentialsServer implements credentialspb.IAMCredentialsServer.
+type iamCredentialsServer struct {
+	credentialspb.UnimplementedIAMCredentialsServer
+
+	cfg      IAMCredentials
+	instance *InstanceHandler // resolves the callers, and signs the identity tokens
+	sts      *STSHandler      // resolves the federated callers
+
+	tokens offlineTokens // access tokens generated by GenerateAccessToken
+
+	mu   sync.Mutex                // guard of keys
+	keys map[string]*idTokenSigner // system-managed keys of the service accounts
+}
+
+var _ credentialspb.IAMCredentialsServer = (*iamCredentialsServer)(nil)
+
+// newIAMCredentialsServer returns the new iamCredentialsServer of cfg.
+func newIAMCredentialsServer(cfg IAMCredentials, instance *InstanceHandler, sts *STSHandler) *iamCredentialsServer {
+	s := &iamCredentialsServer{
+		cfg:      cfg,
+		instance: instance,
+		sts:      sts,
+		keys:     make(map[string]*idTokenSigner),
+	}
+	s.tokens.configure(&OfflineTokens{})
+
+	return s
+}
+
+// caller returns the IAM members of the caller of ctx, the email address or the federated principal and its principal sets.
+//
+// The request with the authorization metadata fails with codes.Unauthenticated unless its access token was issued by
+// the fake metadata server, and only the request without the authorization metadata is made by the fallback caller.
+func (s *iamCredentialsServer) caller(ctx context.Context) ([]string, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	if auths := md.Get("authorization"); len(auths) > 0 {
+		for _, auth := range auths {
+			accessToken, ok := strings.CutPrefix(auth, "Bearer ")
+			if !ok {
+				continue
+			}
+			if tok, ok := s.tokens.lookup(accessToken); ok {
+				return []string{tok.ServiceAccount}, nil
+			}
+			if tok, ok := s.instance.lookupOfflineToken(accessToken); ok {
+				return []string{tok.ServiceAccount}, nil
+			}
+			if p, ok := s.sts.lookup(accessToken); ok {
+				return p.members(), nil
+			}
+		}
+
+		return nil, status.Error(codes.Unauthenticated, "unknown, expired or malformed access token")
+	}
+
+	if s.cfg.Caller != "" {
+		return []string{principal(s.cfg.Caller)}, nil
+	}
+
+	sa, err := s.instance.lookupServiceAccount("default")
+	if err != nil {
+		return nil, status.Errorf(codes.Unauthenticated, "could not find the caller: %v", err)
+	}
+
+	return []string{sa.Email}, nil
+}
+
+// authorize returns the email address of the service account name if the caller of ctx can act as it through delegates.
+//
+// Each principal of the delegation chain must be granted roles/iam.serviceAccountTokenCreator on the next service account.
+func (s *iamCredentialsServer) authorize(ctx context.Context, name string, delegates []string, permission string) (string, error) {
+	m := serviceAccountResourceRe.FindStringSubmatch(name)
+	if m == nil {
+		return "", status.Errorf(codes.InvalidArgument, "invalid service account name %q", name)
+	}
+	target := m[1]
+
+	caller, err := s.caller(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	chain := make([]string, 0, len(delegates)+1)
+	for _, delegate := range delegates {
+		m := serviceAccountResourceRe.FindStringSubmatch(delegate)
+		if m == nil {
+			return "", status.Errorf(codes.InvalidArgument, "invalid delegate name %q", delegate)
+		}
+		chain = append(chain, m[1])
+	}
+	chain = append(chain, target)
+
+	for _, sa := range chain {
+		if !s.cfg.canCreateToken(caller, sa) {
+			return "", status.Errorf(codes.PermissionDenied, "Permission '%s' denied on resource %s for %s", permission, sa, caller[0])
+		}
+		caller = []string{sa}
+	}
+
+	return target, nil
+}
+
+// key returns the system-managed key of the service account email.
+func (s *iamCredentialsServer) key(email string) *idTokenSigner {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key, ok := s.keys[email]
+	if !ok {
+		key = &idTokenSigner{}
+		s.keys[email] = key
+	}
+
+	return key
+}
+
+// GenerateAccessToken implements credentialspb.IAMCredentialsServer.
+func (s *iamCredentialsServer) GenerateAccessToken(ctx context.Context, req *credentialspb.GenerateAccessTokenRequest) (*credentialspb.GenerateAccessTokenResponse, error) {
+	email, err := s.authorize(ctx, req.GetName(), req.GetDelegates(), "iam.serviceAccounts.getAccessToken")
+	if err != nil {
+		return nil, err
+	}
+	if len(req.GetScope()) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "scope must not be empty")
+	}
+
+	lifetime := maxIAMAccessTokenLifetime
+	if req.GetLifetime() != nil {
+		lifetime = req.GetLifetime().AsDuration()
+	}
+	if lifetime <= 0 || lifetime > maxIAMAccessTokenLifetime {
+		return nil, status.Errorf(codes.InvalidArgument, "lifetime %s must be in (0, %s]", lifetime, maxIAMAccessTokenLifetime)
+	}
+
+	tok, err := s.tokens.issue(email, req.GetScope(), lifetime, time.Now())
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	return &credentialspb.GenerateAccessTokenResponse{
+		AccessToken: tok.AccessToken,
+		ExpireTime:  timestamppb.New(tok.Expiry),
+	}, nil
+}
+
+// GenerateIdToken implements credentialspb.IAMCredentialsServer.
+//
+// The identity token is signed by the same key as the identity tokens of the fake metadata server.
+func (s *iamCredentialsServer) GenerateIdToken(ctx context.Context, req *credentialspb.GenerateIdTokenRequest) (*credentialspb.GenerateIdTokenResponse, error) {
+	email, err := s.authorize(ctx, req.GetName(), req.GetDelegates(), "iam.serviceAccounts.getOpenIdToken")
+	if err != nil {
+		return nil, err
+	}
+	if req.GetAudience() == "" {
+		return nil, status.Error(codes.InvalidArgument, "audience must not be empty")
+	}
+
+	now := time.Now()
+	sub := serviceAccountUniqueID(email)
+	claims := IDTokenClaims{
+		Issuer:       IDTokenIssuer,
+		Audience:     req.GetAudience(),
+		AuthorizedBy: sub,
+		Subject:      sub,
+		IssuedAt:     now.Unix(),
+		Expiry:       now.Add(idTokenLifetime).Unix(),
+	}
+	if req.GetIncludeEmail() {
+		claims.Email = email
+		claims.EmailVerified = true
+	}
+
+	tok, err := s.instance.idTokenSigner.sign(claims)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	return &credentialspb.GenerateIdTokenResponse{Token: tok}, nil
+}
+
+// SignBlob implements credentialspb.IAMCredentialsServer.
+func (s *iamCredentialsServer) SignBlob(ctx context.Context, req *credentialspb.SignBlobRequest) (*credentialspb.SignBlobResponse, error) {
+	email, err := s.authorize(ctx, req.GetName(), req.GetDelegates(), "iam.serviceAccounts.signBlob")
+	if err != nil {
+		return nil, err
+	}
+
+	key := s.key(email)
+	kid, err := key.keyID()
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	sig, err := key.signBytes(req.GetPayload())
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	return &credentialspb.SignBlobResponse{
+		KeyId:      kid,
+		SignedBlob: sig,
+	}, nil
+}
+
+// SignJwt implements credentialspb.IAMCredentialsServer.
+func (s *iamCredentialsServer) SignJwt(ctx context.Context, req *credentialspb.SignJwtRequest) (*credentialspb.SignJwtResponse, error) {
+	email, err := s.authorize(ctx, req.GetName(), req.GetDelegates(), "iam.serviceAccounts.signJwt")
+	if err != nil {
+		return nil, err
+	}
+
+	var claims map[string]any
+	if err := json.Unmarshal([]byte(req.GetPayload()), &claims); err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "payload must be a JSON object: %v", err)
+	}
+
+	key := s.key(email)
+	kid, err := key.keyID()
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	jwt, err := key.sign(claims)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	return &credentialspb.SignJwtResponse{
+		KeyId:     kid,
+		SignedJwt: jwt,
+	}, nil
+}
+
+// List of the path prefixes of the public keys of the service accounts, which are same as
+// https://www.googleapis.com/service_accounts/v1/metadata/jwk/EMAIL and https://www.googleapis.com/service_accounts/v1/metadata/x509/EMAIL.
+const (
+	// ServiceAccountJWKPath is the path prefix of the JWK Set of the service account keys.
+	ServiceAccountJWKPath = "/service_accounts/v1/metadata/jwk/"
+
+	// ServiceAccountX509Path is the path prefix of the PEM encoded certificates of the service account keys.
+	ServiceAccountX509Path = "/service_accounts/v1/metadata/x509/"
+)
+
+// ServiceAccountCerts serves the public keys of the system-managed keys of the local IAM Credentials service,
+// which sign the blobs and JWTs of SignBlob and SignJwt, so that the signatures can be verified the same as Google.
+//
+// The keys are served only while the local IAM Credentials service is enabled.
+func (h *InstanceHandler) ServiceAccountCerts() safehttp.Handler {
+	return safehttp.HandlerFunc(func(w safehttp.ResponseWriter, r *safehttp.IncomingRequest) safehttp.Result {
+		l := h.localIAMCredentialsModel()
+		if l == nil {
+			return w.WriteError(NewStatusError(errors.New("local IAM Credentials service is disabled"), safehttp.StatusNotFound))
+		}
+
+		path := r.URL().Path()
+		jwkEmail, isJWK := strings.CutPrefix(path, ServiceAccountJWKPath)
+		x509Email, isX509 := strings.CutPrefix(path, ServiceAccountX509Path)
+		email := jwkEmail
+		if isX509 {
+			email = x509Email
+		}
+		if (!isJWK && !isX509) || !strings.Contains(email, "@") || strings.Contains(email, "/") {
+			return w.WriteError(safehttp.StatusNotFound)
+		}
+
+		var (
+			v   any
+			err error
+		)
+		key := l.iam.key(email)
+		if isJWK {
+			v, err = key.jwks()
+		} else {
+			v, err = key.pemCerts()
+		}
+		if err != nil {
+			return w.WriteError(NewStatusError(err, safehttp.StatusInternalServerError))
+		}
+
+		return WriteJSON(w, v)
+	})
+}
+
+// localIAMCredentials is the running local IAM Credentials service.
+type localIAMCredentials struct {
+	srv  *grpc.Server
+	iam  *iamCredentialsServer
+	addr string
+}
+
+// startLocalIAMCredentials starts the local IAM Credentials service of cfg on the random local port.
+func startLocalIAMCredentials(cfg IAMCredentials, instance *InstanceHandler, sts *STSHandler) (*localIAMCredentials, error) {
+	l, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		return nil, fmt.Errorf("could not listen IAM Credentials service: %w", err)
+	}
+
+	srv := grpc.NewServer()
+	iam := newIAMCredentialsServer(cfg, instance, sts)
+	credentialspb.RegisterIAMCredentialsServer(srv, iam)
+	go srv.Serve(l)
+
+	return &localIAMCredentials{srv: srv, iam: iam, addr: l.Addr().String()}, nil
+}
+
+// clientOptions returns the client options which connect to the local IAM Credentials service.
+func (l *localIAMCredentials) clientOptions() []option.ClientOption {
+	return []option.ClientOption{
+		option.WithEndpoint(l.addr),
+		option.WithoutAuthentication(),
+		option.WithGRPCDialOption(grpc.WithTransportCredentials(insecure.NewCredentials())),
+		option.WithTelemetryDisabled(),
+	}
+}
+
+// iamCredentialsClient returns the IAM Credentials client, which is created on first use and shared by the requests.
+//
+// The client connects to the local IAM Credentials service if enabled.
+func (h *InstanceHandler) iamCredentialsClient() (*iamcredentials.IamCredentialsClient, error) {
+	h.iamClientMu.Lock()
+	defer h.iamClientMu.Unlock()
+
+	if h.iamClient == nil {
+		opts := []option.ClientOption{option.WithTelemetryDisabled()}
+		if h.localIAM != nil {
+			opts = h.localIAM.clientOptions()
+		}
+		client, err := iamcredentials.NewIamCredentialsClient(context.Background(), opts...)
+		if err != nil {
+			return nil, fmt.Errorf("could not create iamcredentials client: %w", err)
+		}
+		h.iamClient = client
+	}
+
+	return h.iamClient, nil
+}
+
+// setLocalIAMCredentials replaces the local IAM Credentials service with l, and stops the previous one.
+// The nil l disables the local IAM Credentials service.
+func (h *InstanceHandler) setLocalIAMCredentials(l *localIAMCredentials) {
+	h.iamClientMu.Lock()
+	prev, client := h.localIAM, h.iamClient
+	h.localIAM, h.iamClient = l, nil
+	h.iamClientMu.Unlock()
+
+	if client != nil {
+		client.Close()
+	}
+	if prev != nil {
+		prev.srv.Stop()
+	}
+	h.tokenCache.flush()
+}
+
+// localIAMCredentialsModel returns the running local IAM Credentials service, or nil if disabled.
+func (h *InstanceHandler) localIAMCredentialsModel() *localIAMCredentials {
+	h.iamClientMu.Lock()
+	defer h.iamClientMu.Unlock()
+
+	return h.localIAM
+}
+
+// usesLocalIAMCredentials reports whether the local IAM Credentials service is enabled.
+func (h *InstanceHandler) usesLocalIAMCredentials() bool {
+	return h.localIAMCredentialsModel() != nil
+}
+
+// federatedContext returns ctx which authenticates the requests to the local IAM Credentials service
+// by the access token of the external_account ADC, if backend is the federation and the local IAM Credentials service is enabled.
+//
+// The access token must be issued by the local STS endpoint, otherwise the local IAM Credentials service rejects it.
+// The other ADC types are not attached, since the local IAM Credentials service falls back to IAMCredentials.Caller.
+func (h *InstanceHandler) federatedContext(ctx context.Context, backend ServiceAccountBackend) (context.Context, error) {
+	if backend != BackendFederate || !h.usesLocalIAMCredentials() {
+		return ctx, nil
+	}
+
+	creds, err := google.FindDefaultCredentials(ctx, cloudPlatformScope)
+	if err != nil {
+		return nil, fmt.Errorf("could not find default credentials: %w", err)
+	}
+	var adc struct {
+		Type string `json:"type"`
+	}
+	if err := json.Unmarshal(creds.JSON, &adc); err != nil || adc.Type != "external_account" {
+		return ctx, nil
+	}
+	tok, err := creds.TokenSource.Token()
+	if err != nil {
+		return nil, fmt.Errorf("could not exchange external account token: %w", err)
+	}
+
+	return metadata.AppendToOutgoingContext(ctx, "authorization", tok.Type()+" "+tok.AccessToken), nil
+}
+
+// generateAccessToken generates the access token of the service account email through the IAM Credentials service.
+func (h *InstanceHandler) generateAccessToken(ctx context.Context, email string, scopes, delegates []string) (*oauth2.Token, error) {
+	iamClient, err := h.iamCredentialsClient()
+	if err != nil {
+		return nil, err
+	}
+
+	req := &credentialspb.GenerateAccessTokenRequest{
+		Name:      fmt.Sprintf("projects/-/serviceAccounts/%s", email),
+		Scope:     scopes,
+		Delegates: delegateResourceNames(delegates),
+	}
+	resp, err := iamClient.GenerateAccessToken(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+
+	return &oauth2.Token{
+		AccessToken: resp.GetAccessToken(),
+		TokenType:   "Bearer",
+		Expiry:      resp.GetExpireTime().AsTime(),
+	}, nil
+}
+
+// generateIDToken generates the identity token of the service account email through the IAM Credentials service.
+func (h *InstanceHandler) generateIDToken(ctx context.Context, email, audience string, delegates []string) (*oauth2.Token, error) {
+	iamClient, err := h.iamCredentialsClient()
+	if err != nil {
+		return nil, err
+	}
+
+	req := &credentialspb.GenerateIdTokenRequest{
+		Name:         fmt.Sprintf("projects/-/serviceAccounts/%s", email),
+		Audience:     audience,
+		IncludeEmail: true,
+		Delegates:    delegateResourceNames(delegates),
+	}
+	resp, err := iamClient.GenerateIdToken(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	payload, err := idtoken.ParsePayload(resp.GetToken())
+	if err != nil {
+		return nil, fmt.Errorf("could not parse identity token: %w", err)
+	}
+
+	return &oauth2.Token{
+		AccessToken: resp.GetToken(),
+		Expiry:      time.Unix(payload.Expires, 0),
+	}, nil
+}
@@ -0,0 +1,300 @@
+// Copyright 2022 The compute-metadata-server Authors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package fakemetadata_test
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"net/http"
+	"strings"
+	"testing"
+
+	json "github.com/goccy/go-json"
+
+	iamcredentials "cloud.google.com/go/iam/credentials/apiv1"
+	"cloud.google.com/go/iam/credentials/apiv1/credentialspb"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	"github.com/zchee/compute-metadata-server/fakemetadata"
+)
+
+func TestLocalIAMCredentials(t *testing.T) {
+	const (
+		caller   = "dev@example.com"
+		delegate = "delegate@my-project.iam.gserviceaccount.com"
+		target   = "target@my-project.iam.gserviceaccount.com"
+		other    = "other@my-project.iam.gserviceaccount.com"
+		audience = "https://example.com"
+	)
+
+	srv := startServer(t)
+
+	if err := srv.SetInstance(fakemetadata.Instance{ServiceAccounts: []fakemetadata.ServiceAccount{{Email: target}}}); err != nil {
+		t.Fatal(err)
+	}
+	cfg := fakemetadata.IAMCredentials{
+		TokenCreators: map[string][]string{
+			delegate: {"user:" + caller},
+			target:   {"user:" + caller},
+			other:    {"serviceAccount:" + delegate},
+		},
+		Caller: "user:" + caller,
+	}
+	if err := srv.EnableLocalIAMCredentials(cfg); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	client, err := iamcredentials.NewIamCredentialsClient(ctx, srv.IAMCredentialsClientOptions()...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Close() })
+
+	tests := map[string]struct {
+		name      string
+		delegates []string
+		wantCode  codes.Code
+	}{
+		"Granted": {
+			name:     target,
+			wantCode: codes.OK,
+		},
+		"NotGranted": {
+			name:     other,
+			wantCode: codes.PermissionDenied,
+		},
+		"Delegated": {
+			name:      other,
+			delegates: []string{"projects/-/serviceAccounts/" + delegate},
+			wantCode:  codes.OK,
+		},
+		"BrokenDelegationChain": {
+			name:      target,
+			delegates: []string{"projects/-/serviceAccounts/" + other},
+			wantCode:  codes.PermissionDenied,
+		},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			_, err := client.GenerateAccessToken(ctx, &credentialspb.GenerateAccessTokenRequest{
+				Name:      "projects/-/serviceAccounts/" + tt.name,
+				Delegates: tt.delegates,
+				Scope:     []string{"https://www.googleapis.com/auth/cloud-platform"},
+			})
+			if code := status.Code(err); code != tt.wantCode {
+				t.Fatalf("code = %s, want %s: %v", code, tt.wantCode, err)
+			}
+
+			resp, err := client.SignBlob(ctx, &credentialspb.SignBlobRequest{
+				Name:      "projects/-/serviceAccounts/" + tt.name,
+				Delegates: tt.delegates,
+				Payload:   []byte("blob"),
+			})
+			if code := status.Code(err); code != tt.wantCode {
+				t.Fatalf("code = %s, want %s: %v", code, tt.wantCode, err)
+			}
+			if err == nil && (resp.KeyId == "" || len(resp.SignedBlob) == 0) {
+				t.Fatalf("unexpected SignBlob response: %+v", resp)
+			}
+		})
+	}
+
+	// the request with the access token which was not issued by the fake metadata server must not fall back to Caller
+	for name, auth := range map[string]string{
+		"UnknownToken": "Bearer ya29.unknown",
+		"NotBearer":    "Basic ZGV2OnNlY3JldA==",
+	} {
+		t.Run(name, func(t *testing.T) {
+			ctx := metadata.AppendToOutgoingContext(ctx, "authorization", auth)
+			_, err := client.GenerateAccessToken(ctx, &credentialspb.GenerateAccessTokenRequest{
+				Name:  "projects/-/serviceAccounts/" + target,
+				Scope: []string{"https://www.googleapis.com/auth/cloud-platform"},
+			})
+			if code := status.Code(err); code != codes.Unauthenticated {
+				t.Fatalf("code = %s, want %s: %v", code, codes.Unauthenticated, err)
+			}
+		})
+	}
+
+	// the impersonation path of the fake metadata server uses the local service
+	srv.EnableImpersonate()
+	tok := getText(t, srv, "instance/service-accounts/default/identity?audience="+audience)
+
+	validator, err := srv.NewIDTokenValidator(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload, err := validator.Validate(ctx, tok, audience)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if payload.Claims["email"] != target {
+		t.Fatalf("email = %v, want %s", payload.Claims["email"], target)
+	}
+}
+
+func TestLocalIAMCredentialsSigning(t *testing.T) {
+	const (
+		caller   = "dev@example.com"
+		delegate = "delegate@my-project.iam.gserviceaccount.com"
+		target   = "target@my-project.iam.gserviceaccount.com"
+		audience = "https://example.com"
+	)
+
+	srv := startServer(t)
+
+	certsURL := func(prefix, email string) string {
+		return "http://" + srv.Addr() + prefix + email
+	}
+	resp, err := http.Get(certsURL(fakemetadata.ServiceAccountX509Path, target))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("status of the keys without the local service = %d, want %d", resp.StatusCode, http.StatusNotFound)
+	}
+
+	cfg := fakemetadata.IAMCredentials{
+		TokenCreators: map[string][]string{
+			delegate: {"user:" + caller},
+			target:   {"serviceAccount:" + delegate},
+		},
+		Caller: "user:" + caller,
+	}
+	if err := srv.EnableLocalIAMCredentials(cfg); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	client, err := iamcredentials.NewIamCredentialsClient(ctx, srv.IAMCredentialsClientOptions()...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Close() })
+
+	delegates := []string{"projects/-/serviceAccounts/" + delegate}
+	name := "projects/-/serviceAccounts/" + target
+
+	// the certificates and JWK Set of the service account key are published same as Google
+	var certs map[string]string
+	fetchJSON(t, certsURL(fakemetadata.ServiceAccountX509Path, target), &certs)
+	var jwks fakemetadata.JWKSet
+	fetchJSON(t, certsURL(fakemetadata.ServiceAccountJWKPath, target), &jwks)
+
+	t.Run("SignJwt", func(t *testing.T) {
+		resp, err := client.SignJwt(ctx, &credentialspb.SignJwtRequest{
+			Name:      name,
+			Delegates: delegates,
+			Payload:   `{"iss":"` + target + `","sub":"` + target + `","aud":"` + audience + `"}`,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(jwks.Keys) != 1 || jwks.Keys[0].Kid != resp.KeyId {
+			t.Fatalf("JWK Set = %+v, want the key %s", jwks, resp.KeyId)
+		}
+
+		parts := strings.Split(resp.SignedJwt, ".")
+		if len(parts) != 3 {
+			t.Fatalf("malformed JWT: %q", resp.SignedJwt)
+		}
+		sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+		if err != nil {
+			t.Fatal(err)
+		}
+		verify(t, certs[resp.KeyId], []byte(parts[0]+"."+parts[1]), sig)
+
+		payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+		if err != nil {
+			t.Fatal(err)
+		}
+		var claims map[string]any
+		if err := json.Unmarshal(payload, &claims); err != nil {
+			t.Fatal(err)
+		}
+		if claims["aud"] != audience || claims["sub"] != target {
+			t.Fatalf("unexpected claims: %v", claims)
+		}
+
+		if _, err := client.SignJwt(ctx, &credentialspb.SignJwtRequest{Name: name, Delegates: delegates, Payload: "[]"}); status.Code(err) != codes.InvalidArgument {
+			t.Fatalf("SignJwt of the non-object payload: code = %s, want %s", status.Code(err), codes.InvalidArgument)
+		}
+	})
+
+	t.Run("SignBlob", func(t *testing.T) {
+		resp, err := client.SignBlob(ctx, &credentialspb.SignBlobRequest{Name: name, Delegates: delegates, Payload: []byte("blob")})
+		if err != nil {
+			t.Fatal(err)
+		}
+		verify(t, certs[resp.KeyId], []byte("blob"), resp.SignedBlob)
+	})
+
+	t.Run("GenerateIdToken", func(t *testing.T) {
+		if _, err := client.GenerateIdToken(ctx, &credentialspb.GenerateIdTokenRequest{Name: name, Audience: audience}); status.Code(err) != codes.PermissionDenied {
+			t.Fatalf("GenerateIdToken without the delegates: code = %s, want %s", status.Code(err), codes.PermissionDenied)
+		}
+
+		resp, err := client.GenerateIdToken(ctx, &credentialspb.GenerateIdTokenRequest{
+			Name:         name,
+			Delegates:    delegates,
+			Audience:     audience,
+			IncludeEmail: true,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		validator, err := srv.NewIDTokenValidator(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		payload, err := validator.Validate(ctx, resp.Token, audience)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if payload.Claims["email"] != target {
+			t.Fatalf("email = %v, want %s", payload.Claims["email"], target)
+		}
+	})
+}
+
+// fetchJSON decodes the 200 JSON response of the GET request to url into v.
+func fetchJSON(t *testing.T, url string, v any) {
+	t.Helper()
+
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("GET %s: status = %d", url, resp.StatusCode)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// verify verifies the RSASSA-PKCS1-v1_5 SHA-256 signature of data by the PEM encoded certificate.
+func verify(t *testing.T, certPEM string, data, sig []byte) {
+	t.Helper()
+
+	block, _ := pem.Decode([]byte(certPEM))
+	if block == nil {
+		t.Fatalf("no PEM certificate: %q", certPEM)
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cert.CheckSignature(x509.SHA256WithRSA, data, sig); err != nil {
+		t.Fatalf("could not verify the signature: %v", err)
+	}
+}
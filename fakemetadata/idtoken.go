@@ -0,0 +1,353 @@
+// Copyright 2022 The compute-metadata-server Authors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package fakemetadata
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"hash/fnv"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	json "github.com/goccy/go-json"
+	"github.com/google/go-safeweb/safehttp"
+)
+
+// List of the identity token claim values.
+const (
+	// IDTokenIssuer is the iss claim of the identity tokens.
+	IDTokenIssuer = "https://accounts.google.com"
+
+	// idTokenLifetime is the lifetime of the identity tokens.
+	idTokenLifetime = time.Hour
+)
+
+// List of the paths of the identity token signing certificates, which are same as the Google OAuth2 certs endpoints.
+const (
+	// JWKCertsPath is the path of the JWK Set of the signing keys, same as https://www.googleapis.com/oauth2/v3/certs.
+	JWKCertsPath = "/oauth2/v3/certs"
+
+	// PEMCertsPath is the path of the PEM encoded signing certificates, same as https://www.googleapis.com/oauth2/v1/certs.
+	PEMCertsPath = "/oauth2/v1/certs"
+)
+
+// List of the identity token formats.
+//
+// See: https://cloud.google.com/compute/docs/instances/verifying-instance-identity#token_format
+const (
+	// IDTokenFormatStandard is the identity token format without the Compute Engine claims.
+	IDTokenFormatStandard = "standard"
+
+	// IDTokenFormatFull is the identity token format with the google.compute_engine claim.
+	IDTokenFormatFull = "full"
+)
+
+// ComputeEngineClaims represents the google.compute_engine claim of the full format identity token.
+type ComputeEngineClaims struct {
+	ProjectID                 string   `json:"project_id"`
+	ProjectNumber             int64    `json:"project_number"`
+	Zone                      string   `json:"zone"`
+	InstanceID                string   `json:"instance_id"`
+	InstanceName              string   `json:"instance_name"`
+	InstanceCreationTimestamp int64    `json:"instance_creation_timestamp"`
+	InstanceConfidentiality   int      `json:"instance_confidentiality,omitempty"`
+	LicenseID                 []string `json:"license_id,omitempty"`
+}
+
+// IDTokenClaims represents the claims of the identity token.
+type IDTokenClaims struct {
+	Issuer        string `json:"iss"`
+	Audience      string `json:"aud"`
+	AuthorizedBy  string `json:"azp"`
+	Subject       string `json:"sub"`
+	Email         string `json:"email,omitempty"`
+	EmailVerified bool   `json:"email_verified,omitempty"`
+	IssuedAt      int64  `json:"iat"`
+	Expiry        int64  `json:"exp"`
+
+	Google *GoogleClaims `json:"google,omitempty"`
+}
+
+// GoogleClaims represents the google claim of the full format identity token.
+type GoogleClaims struct {
+	ComputeEngine ComputeEngineClaims `json:"compute_engine"`
+}
+
+// serviceAccountUniqueID returns the stable 21 digits unique ID of the service account, which is the sub claim of the identity token.
+func serviceAccountUniqueID(email string) string {
+	h := fnv.New64a()
+	h.Write([]byte(email))
+
+	return fmt.Sprintf("1%020d", h.Sum64())
+}
+
+// JWK represents the JSON Web Key of the identity token signing key.
+type JWK struct {
+	Kty string `json:"kty"`
+	Alg string `json:"alg"`
+	Use string `json:"use"`
+	Kid string `json:"kid"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+}
+
+// JWKSet represents the JSON Web Key Set of the identity token signing keys.
+type JWKSet struct {
+	Keys []JWK `json:"keys"`
+}
+
+// idTokenSigner signs the identity tokens with the locally generated RSA key.
+//
+// The zero value is valid and ready to use, and generates the key on first use.
+type idTokenSigner struct {
+	once sync.Once
+	key  *rsa.PrivateKey
+	kid  string
+	cert []byte // DER encoded self-signed certificate of key
+	err  error
+}
+
+// init generates the signing key.
+func (s *idTokenSigner) init() {
+	s.key, s.err = rsa.GenerateKey(rand.Reader, 2048)
+	if s.err != nil {
+		s.err = fmt.Errorf("could not generate identity token signing key: %w", s.err)
+		return
+	}
+
+	der, err := x509.MarshalPKIXPublicKey(&s.key.PublicKey)
+	if err != nil {
+		s.err = fmt.Errorf("could not marshal identity token signing key: %w", err)
+		return
+	}
+	sum := sha1.Sum(der)
+	s.kid = hex.EncodeToString(sum[:])
+
+	now := time.Now()
+	tmpl := &x509.Certificate{
+		SerialNumber: new(big.Int).SetBytes(sum[:]),
+		Subject:      pkix.Name{CommonName: "fakemetadata.iam.gserviceaccount.com"},
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.Add(365 * 24 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+	}
+	s.cert, err = x509.CreateCertificate(rand.Reader, tmpl, tmpl, &s.key.PublicKey, s.key)
+	if err != nil {
+		s.err = fmt.Errorf("could not create identity token signing certificate: %w", err)
+	}
+}
+
+// jwks returns the JWK Set of the signing key.
+func (s *idTokenSigner) jwks() (JWKSet, error) {
+	s.once.Do(s.init)
+	if s.err != nil {
+		return JWKSet{}, s.err
+	}
+
+	key := JWK{
+		Kty: "RSA",
+		Alg: "RS256",
+		Use: "sig",
+		Kid: s.kid,
+		N:   base64.RawURLEncoding.EncodeToString(s.key.N.Bytes()),
+		E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(s.key.E)).Bytes()),
+	}
+
+	return JWKSet{Keys: []JWK{key}}, nil
+}
+
+// pemCerts returns the map of the key ID to the PEM encoded certificate of the signing key.
+func (s *idTokenSigner) pemCerts() (map[string]string, error) {
+	s.once.Do(s.init)
+	if s.err != nil {
+		return nil, s.err
+	}
+
+	cert := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: s.cert})
+
+	return map[string]string{s.kid: string(cert)}, nil
+}
+
+// sign returns the RS256 signed JWT of claims.
+func (s *idTokenSigner) sign(claims any) (string, error) {
+	s.once.Do(s.init)
+	if s.err != nil {
+		return "", s.err
+	}
+
+	header, err := json.Marshal(map[string]string{"alg": "RS256", "kid": s.kid, "typ": "JWT"})
+	if err != nil {
+		return "", fmt.Errorf("could not encode identity token header: %w", err)
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", fmt.Errorf("could not encode identity token claims: %w", err)
+	}
+
+	signingInput := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	sig, err := s.signBytes([]byte(signingInput))
+	if err != nil {
+		return "", err
+	}
+
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(sig), nil
+}
+
+// signBytes returns the RSASSA-PKCS1-v1_5 SHA-256 signature of b.
+func (s *idTokenSigner) signBytes(b []byte) ([]byte, error) {
+	s.once.Do(s.init)
+	if s.err != nil {
+		return nil, s.err
+	}
+
+	sum := sha256.Sum256(b)
+	sig, err := rsa.SignPKCS1v15(rand.Reader, s.key, crypto.SHA256, sum[:])
+	if err != nil {
+		return nil, fmt.Errorf("could not sign: %w", err)
+	}
+
+	return sig, nil
+}
+
+// keyID returns the key ID of the signing key.
+func (s *idTokenSigner) keyID() (string, error) {
+	s.once.Do(s.init)
+
+	return s.kid, s.err
+}
+
+// computeEngineClaims returns the google.compute_engine claim derived from the instance and project models.
+//
+// The license_id claim is included only if licenses is true.
+func (h *InstanceHandler) computeEngineClaims(licenses bool) ComputeEngineClaims {
+	inst, proj := h.model(), h.projectModel()
+	projectID, _ := proj.projectID()
+	projectNumber, _ := proj.numericProjectID()
+	number, _ := strconv.ParseInt(projectNumber, 10, 64)
+
+	created := inst.CreationTimestamp
+	if created.IsZero() {
+		created = h.created
+	}
+
+	claims := ComputeEngineClaims{
+		ProjectID:                 projectID,
+		ProjectNumber:             number,
+		Zone:                      inst.zone(),
+		InstanceID:                inst.id(projectID),
+		InstanceName:              inst.name(),
+		InstanceCreationTimestamp: created.Unix(),
+	}
+	if inst.ConfidentialCompute {
+		claims.InstanceConfidentiality = 1
+	}
+	if licenses {
+		for _, license := range inst.licenses() {
+			claims.LicenseID = append(claims.LicenseID, license.ID)
+		}
+	}
+
+	return claims
+}
+
+// identityToken returns the identity token of the service account email in format, signed by the local signer.
+//
+// The google.compute_engine claim is included only if format is IDTokenFormatFull.
+func (h *InstanceHandler) identityToken(email, audience, format string, licenses bool, now time.Time) (string, error) {
+	sub := serviceAccountUniqueID(email)
+	claims := IDTokenClaims{
+		Issuer:        IDTokenIssuer,
+		Audience:      audience,
+		AuthorizedBy:  sub,
+		Subject:       sub,
+		Email:         email,
+		EmailVerified: true,
+		IssuedAt:      now.Unix(),
+		Expiry:        now.Add(idTokenLifetime).Unix(),
+	}
+	if format == IDTokenFormatFull {
+		claims.Google = &GoogleClaims{
+			ComputeEngine: h.computeEngineClaims(licenses),
+		}
+	}
+
+	return h.idTokenSigner.sign(claims)
+}
+
+// Certs serves the signing certificates of the identity tokens in the same shape as the Google OAuth2 certs endpoints,
+// so that the tokens can be validated by the idtoken package with NewIDTokenValidator.
+func (h *InstanceHandler) Certs() safehttp.Handler {
+	return safehttp.HandlerFunc(func(w safehttp.ResponseWriter, r *safehttp.IncomingRequest) safehttp.Result {
+		var (
+			v   any
+			err error
+		)
+		switch r.URL().Path() {
+		case JWKCertsPath:
+			v, err = h.idTokenSigner.jwks()
+		case PEMCertsPath:
+			v, err = h.idTokenSigner.pemCerts()
+		default:
+			return w.WriteError(safehttp.StatusNotFound)
+		}
+		if err != nil {
+			return w.WriteError(NewStatusError(err, safehttp.StatusInternalServerError))
+		}
+
+		w.Header().Set("Cache-Control", "public, max-age=3600")
+
+		return WriteJSON(w, v)
+	})
+}
+
+// certsTransport is the http.RoundTripper which sends the requests to the Google OAuth2 certs endpoints to the fake metadata server.
+type certsTransport struct {
+	addr string
+	base http.RoundTripper
+}
+
+var _ http.RoundTripper = (*certsTransport)(nil)
+
+// CertsTransport returns the http.RoundTripper which sends the requests to the Google OAuth2 certs endpoints
+// and the service account key endpoints to the fake metadata server of addr, and the other requests to base.
+//
+// It is for the validators of the identity tokens signed by the fake metadata server running in the other process.
+func CertsTransport(addr string, base http.RoundTripper) http.RoundTripper {
+	if base == nil {
+		base = http.DefaultTransport
+	}
+
+	return &certsTransport{addr: addr, base: base}
+}
+
+// RoundTrip implements http.RoundTripper.
+func (t *certsTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.URL.Host == "www.googleapis.com" && isCertsPath(req.URL.Path) {
+		req = req.Clone(req.Context())
+		req.URL = &url.URL{Scheme: "http", Host: t.addr, Path: req.URL.Path}
+		req.Host = t.addr
+	}
+
+	return t.base.RoundTrip(req)
+}
+
+// isCertsPath reports whether path is the path of the signing certificates served by the fake metadata server.
+func isCertsPath(path string) bool {
+	return path == JWKCertsPath || path == PEMCertsPath ||
+		strings.HasPrefix(path, ServiceAccountJWKPath) || strings.HasPrefix(path, ServiceAccountX509Path)
+}
@@ -0,0 +1,188 @@
+// Copyright 2022 The compute-metadata-server Authors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package fakemetadata_test
+
+import (
+	"context"
+	"encoding/base64"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	json "github.com/goccy/go-json"
+
+	"github.com/zchee/compute-metadata-server/fakemetadata"
+)
+
+func TestLocalIDToken(t *testing.T) {
+	const (
+		email    = "sa@my-project.iam.gserviceaccount.com"
+		audience = "https://example.com"
+	)
+	t.Setenv(fakemetadata.EnvGoogleAccountEmail, email)
+
+	srv := startServer(t)
+
+	if err := srv.SetProject(fakemetadata.Project{ProjectID: "my-project", NumericProjectID: 123456789012}); err != nil {
+		t.Fatal(err)
+	}
+	srv.EnableLocalIDToken()
+
+	validator, err := srv.NewIDTokenValidator(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, format := range []string{fakemetadata.IDTokenFormatStandard, fakemetadata.IDTokenFormatFull} {
+		t.Run(format, func(t *testing.T) {
+			tok := getText(t, srv, "instance/service-accounts/default/identity?audience="+audience+"&format="+format)
+
+			payload, err := validator.Validate(context.Background(), tok, audience)
+			if err != nil {
+				t.Fatalf("could not validate identity token: %v", err)
+			}
+			if payload.Claims["email"] != email || payload.Claims["email_verified"] != true || payload.Claims["azp"] != payload.Subject {
+				t.Fatalf("unexpected claims: %+v", payload.Claims)
+			}
+			if _, ok := payload.Claims["google"]; ok != (format == fakemetadata.IDTokenFormatFull) {
+				t.Fatalf("google claim: %+v", payload.Claims)
+			}
+		})
+	}
+}
+
+func TestIdentityTokenClaims(t *testing.T) {
+	const (
+		email    = "sa@my-project.iam.gserviceaccount.com"
+		audience = "https://example.com"
+	)
+	t.Setenv(fakemetadata.EnvGoogleAccountEmail, email)
+
+	srv := startServer(t)
+
+	if err := srv.SetProject(fakemetadata.Project{ProjectID: "my-project", NumericProjectID: 123456789012}); err != nil {
+		t.Fatal(err)
+	}
+	created := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	inst := fakemetadata.Instance{
+		ID:                  42,
+		Name:                "vm-1",
+		Zone:                "us-central1-a",
+		CreationTimestamp:   created,
+		ConfidentialCompute: true,
+		Licenses:            []fakemetadata.License{{ID: "1234567890"}, {ID: "2345678901"}},
+	}
+	if err := srv.SetInstance(inst); err != nil {
+		t.Fatal(err)
+	}
+	srv.EnableLocalIDToken()
+
+	// claims decodes the payload of the identity token without the verification, which is covered by TestLocalIDToken
+	claims := func(query string) fakemetadata.IDTokenClaims {
+		t.Helper()
+
+		tok := getText(t, srv, "instance/service-accounts/default/identity?audience="+audience+query)
+		parts := strings.Split(tok, ".")
+		if len(parts) != 3 {
+			t.Fatalf("malformed identity token: %q", tok)
+		}
+		payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+		if err != nil {
+			t.Fatal(err)
+		}
+		var c fakemetadata.IDTokenClaims
+		if err := json.Unmarshal(payload, &c); err != nil {
+			t.Fatal(err)
+		}
+
+		return c
+	}
+
+	want := fakemetadata.ComputeEngineClaims{
+		ProjectID:                 "my-project",
+		ProjectNumber:             123456789012,
+		Zone:                      "us-central1-a",
+		InstanceID:                "42",
+		InstanceName:              "vm-1",
+		InstanceCreationTimestamp: created.Unix(),
+		InstanceConfidentiality:   1,
+	}
+	c := claims("&format=" + fakemetadata.IDTokenFormatFull)
+	if c.Google == nil || !reflect.DeepEqual(c.Google.ComputeEngine, want) {
+		t.Fatalf("google claim = %+v, want %+v", c.Google, want)
+	}
+	if c.Audience != audience || c.Email != email || c.Expiry-c.IssuedAt != int64(time.Hour.Seconds()) {
+		t.Fatalf("unexpected claims: %+v", c)
+	}
+
+	// the license_id claim is included only with licenses=TRUE
+	want.LicenseID = []string{"1234567890", "2345678901"}
+	if c := claims("&format=" + fakemetadata.IDTokenFormatFull + "&licenses=TRUE"); c.Google == nil || !reflect.DeepEqual(c.Google.ComputeEngine, want) {
+		t.Fatalf("google claim with licenses = %+v, want %+v", c.Google, want)
+	}
+
+	if c := claims("&licenses=TRUE"); c.Google != nil {
+		t.Fatalf("standard format has the google claim: %+v", c.Google)
+	}
+
+	// the cached identity tokens must not outlive the model whose claims they have
+	inst.Name = "vm-2"
+	inst.Zone = "us-east1-b"
+	if err := srv.SetInstance(inst); err != nil {
+		t.Fatal(err)
+	}
+	if err := srv.SetProject(fakemetadata.Project{ProjectID: "other-project", NumericProjectID: 210987654321}); err != nil {
+		t.Fatal(err)
+	}
+	c = claims("&format=" + fakemetadata.IDTokenFormatFull)
+	if got := c.Google.ComputeEngine; got.InstanceName != "vm-2" || got.Zone != "us-east1-b" || got.ProjectID != "other-project" || got.ProjectNumber != 210987654321 {
+		t.Fatalf("google claim after SetInstance and SetProject = %+v", got)
+	}
+
+	tests := map[string]string{
+		"InvalidLicenses": "&format=full&licenses=maybe",
+		"UnknownFormat":   "&format=compact",
+	}
+	for name, query := range tests {
+		t.Run(name, func(t *testing.T) {
+			resp := get(t, srv, "instance/service-accounts/default/identity?audience="+audience+query)
+			if resp.status != http.StatusBadRequest {
+				t.Fatalf("status = %d, want %d: %s", resp.status, http.StatusBadRequest, resp.body)
+			}
+		})
+	}
+}
+
+func TestLocalIDTokenToggle(t *testing.T) {
+	const email = "sa@my-project.iam.gserviceaccount.com"
+
+	srv := startServer(t)
+
+	// the offline backend signs the identity tokens locally even if the local identity tokens are disabled
+	inst := fakemetadata.Instance{
+		ServiceAccounts: []fakemetadata.ServiceAccount{{Email: email, Aliases: []string{"default"}, Backend: fakemetadata.BackendOffline}},
+	}
+	if err := srv.SetInstance(inst); err != nil {
+		t.Fatal(err)
+	}
+
+	// toggling the local identity tokens races with the identity requests unless it is guarded, which go test -race reports
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := range 100 {
+			if i%2 == 0 {
+				srv.EnableLocalIDToken()
+			} else {
+				srv.DisableLocalIDToken()
+			}
+		}
+	}()
+	for range 20 {
+		getText(t, srv, "instance/service-accounts/default/identity?audience=https://example.com")
+	}
+	<-done
+}
@@ -4,37 +4,97 @@
 package fakemetadata
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"io"
 	"io/fs"
+	"maps"
 	"os"
 	pathpkg "path"
 	"regexp"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
-	"unsafe"
 
 	iamcredentials "cloud.google.com/go/iam/credentials/apiv1"
-	"cloud.google.com/go/iam/credentials/apiv1/credentialspb"
 	"github.com/google/go-safeweb/safehttp"
 	"github.com/google/safehtml"
-	cpuid "github.com/klauspost/cpuid/v2"
 	"golang.org/x/oauth2"
 	"golang.org/x/oauth2/google"
 	"golang.org/x/oauth2/jwt"
 	"google.golang.org/api/idtoken"
 	"google.golang.org/api/impersonate"
-	"google.golang.org/api/option"
 )
 
 // InstanceHandler holds instance metadata handlers.
 //
 // See: https://cloud.google.com/compute/docs/metadata/default-metadata-values#vm_instance_metadata
 type InstanceHandler struct {
-	useImpersonate bool
-	useFederate    bool
+	mu       sync.RWMutex // guard of instance field
+	instance Instance
+
+	project *ProjectHandler // project which the instance belongs to
+
+	driftToken       watchValue
+	maintenanceEvent watchValue
+	cpuBurst         cpuBurst
+	guestAttributes  guestAttributes
+	hostKeys         hostKeys
+	guestInventory   guestInventory
+	workloadCerts    workloadCertificates
+
+	credMu          sync.RWMutex // guard of useImpersonate, useFederate, useLocalIDToken and delegates
+	useImpersonate  bool
+	useFederate     bool
+	useLocalIDToken bool
+	delegates       []string // sequence of service accounts in a delegation chain
+
+	iamClientMu sync.Mutex // guard of iamClient and localIAM
+	iamClient   *iamcredentials.IamCredentialsClient
+	localIAM    *localIAMCredentials // local IAM Credentials service, nil if disabled
+
+	workloadIdentity *WorkloadIdentity // GKE Workload Identity emulation, nil if disabled
+	sts              *STSHandler       // issues the federated access tokens of the unbound Kubernetes service accounts
+
+	idTokenSigner        idTokenSigner
+	offlineTokens        offlineTokens
+	backendOfflineTokens offlineTokens // tokens of the service accounts of BackendOffline while the offline token mode is disabled
+	tokenCache           tokenCache
+	created              time.Time // creation time of the handler, used as the default creation time of the instance
+}
+
+// setInstance replaces the instance model with inst, and flushes the cached tokens which have the claims
+// or the credentials of the previous model.
+//
+// The CPU burst budget is reset if the machine type is changed, since it is derived from the machine type.
+func (h *InstanceHandler) setInstance(inst Instance) {
+	h.mu.Lock()
+	machineTypeChanged := h.instance.MachineType != inst.MachineType
+	h.instance = inst
+	h.mu.Unlock()
+	h.tokenCache.flush()
+	if machineTypeChanged {
+		h.cpuBurst.reset()
+	}
+}
+
+// model returns the current instance model.
+func (h *InstanceHandler) model() Instance {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	return h.instance
+}
 
-	delegates []string // sequence of service accounts in a delegation chain
+// projectModel returns the current project model which the instance belongs to.
+func (h *InstanceHandler) projectModel() Project {
+	if h.project == nil {
+		return Project{}
+	}
+
+	return h.project.model()
 }
 
 // RegisterHandlers registers instance handlers to mux.
@@ -45,18 +105,26 @@ func (h *InstanceHandler) RegisterHandlers(mux *safehttp.ServeMux) {
 	mux.Handle("/computeMetadata/v1/instance/description", safehttp.MethodGet, h.Description())
 	mux.Handle("/computeMetadata/v1/instance/disks", safehttp.MethodGet, redirectHandler("computeMetadata/v1/instance/disks/"))
 	mux.Handle("/computeMetadata/v1/instance/disks/", safehttp.MethodGet, h.Disks())
+	mux.Handle("/computeMetadata/v1/instance/gce-workload-certificates", safehttp.MethodGet, redirectHandler("computeMetadata/v1/instance/gce-workload-certificates/"))
+	mux.Handle("/computeMetadata/v1/instance/gce-workload-certificates/", safehttp.MethodGet, h.GCEWorkloadCertificates())
 	mux.Handle("/computeMetadata/v1/instance/guest-attributes", safehttp.MethodGet, redirectHandler("computeMetadata/v1/instance/guest-attributes/"))
-	mux.Handle("/computeMetadata/v1/instance/guest-attributes/", safehttp.MethodGet, h.GuestAttributes(InstanceGuestAttributeMap))
+	guestAttributes := h.GuestAttributes(InstanceGuestAttributeMap)
+	mux.Handle("/computeMetadata/v1/instance/guest-attributes/", safehttp.MethodGet, guestAttributes)
+	mux.Handle("/computeMetadata/v1/instance/guest-attributes/", safehttp.MethodPut, guestAttributes)
+	mux.Handle("/computeMetadata/v1/instance/guest-attributes/", safehttp.MethodDelete, guestAttributes)
 	mux.Handle("/computeMetadata/v1/instance/hostname", safehttp.MethodGet, h.Hostname())
 	mux.Handle("/computeMetadata/v1/instance/id", safehttp.MethodGet, h.ID())
 	mux.Handle("/computeMetadata/v1/instance/image", safehttp.MethodGet, h.Image())
 	mux.Handle("/computeMetadata/v1/instance/legacy-endpoint-access/", safehttp.MethodGet, h.LegacyEndpointAccess())
+	mux.Handle("/computeMetadata/v1/instance/licenses", safehttp.MethodGet, redirectHandler("computeMetadata/v1/instance/licenses/"))
 	mux.Handle("/computeMetadata/v1/instance/licenses/", safehttp.MethodGet, h.Licenses())
 	mux.Handle("/computeMetadata/v1/instance/machine-type", safehttp.MethodGet, h.MachineType())
 	mux.Handle("/computeMetadata/v1/instance/maintenance-event", safehttp.MethodGet, h.MaintenanceEvent())
 	mux.Handle("/computeMetadata/v1/instance/name", safehttp.MethodGet, h.Name())
 	mux.Handle("/computeMetadata/v1/instance/network-interfaces", safehttp.MethodGet, redirectHandler("computeMetadata/v1/instance/network-interfaces/"))
 	mux.Handle("/computeMetadata/v1/instance/network-interfaces/", safehttp.MethodGet, h.NetworkInterfaces())
+	mux.Handle("/computeMetadata/v1/instance/partner-attributes", safehttp.MethodGet, redirectHandler("computeMetadata/v1/instance/partner-attributes/"))
+	mux.Handle("/computeMetadata/v1/instance/partner-attributes/", safehttp.MethodGet, h.PartnerAttributes())
 	mux.Handle("/computeMetadata/v1/instance/preempted", safehttp.MethodGet, h.Preempted())
 	mux.Handle("/computeMetadata/v1/instance/remaining-cpu-time", safehttp.MethodGet, h.RemainingCPUTime())
 	mux.Handle("/computeMetadata/v1/instance/scheduling", safehttp.MethodGet, redirectHandler("computeMetadata/v1/instance/scheduling/"))
@@ -68,6 +136,10 @@ func (h *InstanceHandler) RegisterHandlers(mux *safehttp.ServeMux) {
 	mux.Handle("/computeMetadata/v1/instance/virtual-clock", safehttp.MethodGet, redirectHandler("computeMetadata/v1/instance/virtual-clock/"))
 	mux.Handle("/computeMetadata/v1/instance/virtual-clock/", safehttp.MethodGet, h.VirtualClock())
 	mux.Handle("/computeMetadata/v1/instance/zone", safehttp.MethodGet, h.Zone())
+	mux.Handle(JWKCertsPath, safehttp.MethodGet, h.Certs(), noMetadataFlavor{})
+	mux.Handle(PEMCertsPath, safehttp.MethodGet, h.Certs(), noMetadataFlavor{})
+	mux.Handle(ServiceAccountJWKPath, safehttp.MethodGet, h.ServiceAccountCerts(), noMetadataFlavor{})
+	mux.Handle(ServiceAccountX509Path, safehttp.MethodGet, h.ServiceAccountCerts(), noMetadataFlavor{})
 }
 
 // InstanceAttributeMap map of instance attributes.
@@ -77,7 +149,24 @@ func (h *InstanceHandler) RegisterHandlers(mux *safehttp.ServeMux) {
 // https://cloud.google.com/compute/docs/metadata/predefined-metadata-keys#instance-metadata
 //
 // https://cloud.google.com/kubernetes-engine/docs/concepts/workload-identity#instance_attributes
+//
+// The map lists the well-known instance attributes. Any other key can be set by Instance.Attributes.
 var InstanceAttributeMap = map[string]bool{
+	// Enables or disables guest attributes for the VM.
+	//
+	// For more information about guest attributes, see Setting and querying guest attributes.
+	"enable-guest-attributes": true,
+
+	// Enables or disables OS inventory for the VM.
+	//
+	// For more information about OS inventory, see Viewing operating system details.
+	"enable-os-inventory": true,
+
+	// Enables or disables the managed workload identity certificates of the VM.
+	//
+	// For more information about the managed workload identities, see Authenticate workloads over mTLS.
+	"enable-workload-certificate": true,
+
 	// Enables or disables SSH key management on your VM.
 	//
 	// For more information about OS Login, see Setting up OS Login.
@@ -96,6 +185,16 @@ var InstanceAttributeMap = map[string]bool{
 	// SSH keys managed by OS Login aren't visible in metadata.
 	"ssh-keys": true,
 
+	// Deprecated: Use ssh-keys instead.
+	//
+	// If set, the guest agent also ignores the project ssh-keys.
+	"sshKeys": true,
+
+	// Blocks the project ssh-keys from accessing the VM.
+	//
+	// If TRUE, the guest agent only uses the instance ssh-keys.
+	"block-project-ssh-keys": true,
+
 	// The Compute Engine zone or region of your cluster.
 	"cluster-location": true,
 
@@ -104,6 +203,24 @@ var InstanceAttributeMap = map[string]bool{
 
 	// The UID of your GKE cluster.
 	"cluster-uid": true,
+
+	// The managed instance group which created the GKE node.
+	"created-by": true,
+
+	// The instance template of the managed instance group of the GKE node.
+	"instance-template": true,
+
+	// The configuration of the kubelet and the node components of the GKE node.
+	"kube-env": true,
+
+	// The comma separated Kubernetes node labels of the GKE node.
+	"kube-labels": true,
+
+	// The update strategy of the Container-Optimized OS of the GKE node.
+	"gci-update-strategy": true,
+
+	// Enables or disables the metrics collection of the Container-Optimized OS of the GKE node.
+	"gci-metrics-enabled": true,
 }
 
 const (
@@ -117,73 +234,100 @@ const (
 // Attributes a directory of custom metadata values passed to the VM during startup or shutdown.
 // These custom values can either be Google Cloud attributes or user-created metadata values.
 //
+// The directory lists only the instance attributes. The instance attributes shadow the project attributes of the same key
+// for the guest agents, see Server.Attribute.
+//
 // For a list of instance-level Google Cloud attributes that you can set, see Instance attributes.
 //
 // For more information about setting custom metadata, see Setting custom metadata.
-func (InstanceHandler) Attributes(m map[string]bool) safehttp.Handler {
+func (h *InstanceHandler) Attributes(m map[string]bool) safehttp.Handler {
 	handler := safehttp.HandlerFunc(func(w safehttp.ResponseWriter, r *safehttp.IncomingRequest) safehttp.Result {
-		if r.URL().Path() == "" {
-			attrs := make([]string, len(m))
-			i := 0
-			for attr := range m {
-				attrs[i] = attr
-				i++
-			}
-			return w.Write(safehtml.HTMLEscaped(strings.Join(attrs, "\n")))
+		attrs := h.ownAttributes(m)
+
+		path := r.URL().Path()
+		if path == "" {
+			return writeAttributes(w, r, attrs)
 		}
 
-		if path := r.URL().Path(); m[path] {
-			switch path {
-			case "enable-oslogin":
-				// TODO(zchee): not implemented
-				return w.WriteError(safehttp.StatusNotImplemented)
+		if val, ok := attrs[path]; ok {
+			return WriteText(w, val)
+		}
 
-			case "vmdnssetting":
-				// TODO(zchee): not implemented
-				return w.WriteError(safehttp.StatusNotImplemented)
+		return w.WriteError(safehttp.StatusNotFound)
+	})
 
-			case "ssh-keys":
-				// TODO(zchee): not implemented
-				return w.WriteError(safehttp.StatusNotImplemented)
+	return safehttp.StripPrefix("/computeMetadata/v1/instance/attributes/", handler)
+}
 
-			case "cluster-location":
-				if val, ok := os.LookupEnv(EnvKubernetesEngineClusterLocation); ok {
-					return w.Write(safehtml.HTMLEscaped(val))
-				}
-				return w.WriteError(safehttp.StatusNotFound)
+// ownAttributes returns the instance attributes, the GKE node attributes derived from the GKE node pool,
+// and the well-known attributes in m configured by the environment variables.
+func (h *InstanceHandler) ownAttributes(m map[string]bool) map[string]string {
+	inst := h.model()
+	attrs := maps.Clone(inst.Attributes)
+	if attrs == nil {
+		attrs = make(map[string]string)
+	}
 
-			case "cluster-name":
-				if val, ok := os.LookupEnv(EnvKubernetesEngineClusterName); ok {
-					return w.Write(safehtml.HTMLEscaped(val))
-				}
-				return w.WriteError(safehttp.StatusNotFound)
+	if inst.GKENodePool != nil {
+		proj := h.projectModel()
+		projectID, _ := proj.projectID()
+		projectNumber, _ := proj.numericProjectID()
+		for key, val := range inst.GKENodePool.attributes(inst, projectID, projectNumber) {
+			if _, ok := attrs[key]; !ok {
+				attrs[key] = val
+			}
+		}
+	}
+
+	for key := range m {
+		if _, ok := attrs[key]; ok {
+			continue
+		}
 
-			case "cluster-uid":
-				// TODO(zchee): not implemented
-				return w.WriteError(safehttp.StatusNotImplemented)
+		switch key {
+		case "cluster-location":
+			if val, ok := os.LookupEnv(EnvKubernetesEngineClusterLocation); ok {
+				attrs[key] = val
+			}
+		case "cluster-name":
+			if val, ok := os.LookupEnv(EnvKubernetesEngineClusterName); ok {
+				attrs[key] = val
 			}
 		}
+	}
 
-		return w.WriteError(safehttp.StatusNotFound)
-	})
+	return attrs
+}
 
-	return safehttp.StripPrefix("/computeMetadata/v1/instance/attributes/", handler)
+// attribute returns the value of the key attribute which the guest agents see,
+// that is the instance attribute, or the project attribute if the instance has no attribute of the same key.
+func (h *InstanceHandler) attribute(key string) (string, bool) {
+	return lookupAttribute(h.model(), h.projectModel(), key)
+}
+
+// attributeEnabled reports whether the key attribute is TRUE.
+func (h *InstanceHandler) attributeEnabled(key string) bool {
+	val, _ := h.attribute(key)
+	enabled, _ := strconv.ParseBool(val)
+	return enabled
 }
 
 // CPUPlatform CPU platform of the VM.
 //
+// The CPU platform is derived from the machine family of the instance machine type.
+// If the instance has no machine type, the microarchitecture of the host CPU is reported.
+//
 // For information about CPU platforms, see CPU platforms.
-func (InstanceHandler) CPUPlatform() safehttp.Handler {
+func (h *InstanceHandler) CPUPlatform() safehttp.Handler {
 	return safehttp.HandlerFunc(func(w safehttp.ResponseWriter, r *safehttp.IncomingRequest) safehttp.Result {
-		return w.Write(safehtml.HTMLEscaped(detectCPUMicroarchitecture(cpuid.CPU).String()))
+		return w.Write(safehtml.HTMLEscaped(h.model().cpuPlatform()))
 	})
 }
 
 // Description is the free-text description of an instance that is assigned using the "--description" flag by using the Google Cloud CLI or the API.
-func (InstanceHandler) Description() safehttp.Handler {
+func (h *InstanceHandler) Description() safehttp.Handler {
 	return safehttp.HandlerFunc(func(w safehttp.ResponseWriter, r *safehttp.IncomingRequest) safehttp.Result {
-		// TODO(zchee): not implemented
-		return safehttp.NotWritten()
+		return WriteText(w, h.model().Description)
 	})
 }
 
@@ -206,7 +350,7 @@ var diskEndpoint = []string{
 //	type
 //
 // For more information about disks, see Storage options.
-func (InstanceHandler) Disks() safehttp.Handler {
+func (*InstanceHandler) Disks() safehttp.Handler {
 	handler := safehttp.HandlerFunc(func(w safehttp.ResponseWriter, r *safehttp.IncomingRequest) safehttp.Result {
 		switch r.URL().Path() {
 		case "":
@@ -246,44 +390,113 @@ var InstanceGuestAttributeMap = map[string]bool{
 	//
 	// Collects and stores OS details information. This includes information such as hostname, kernel version, architecture, and installed packages details.
 	//
+	// The OS inventory is derived from the local system, or configured by Server.SetGuestInventory.
+	// It is published only while the enable-os-inventory attribute is TRUE.
+	//
 	// For more information about OS inventory, see Viewing operating system details.
 	"guestInventory": true,
 
 	// Stores SSH host keys. Host keys can be used to identify a particular host or machine.
 	//
+	// The ssh-rsa, ssh-ed25519 and ecdsa-sha2-nistp256 host keys are generated once per server,
+	// or read from the directory configured by Server.SetHostKeysDir.
+	//
 	// For information host keys, see Storing host keys by enabling guest attributes.
 	"hostkeys": true,
 }
 
+// publishGuestAgentAttributes publishes the guest attributes namespaces in m which the guest agents publish on boot.
+//
+// The guestInventory namespace is published only while the enable-os-inventory attribute is TRUE,
+// and unpublished once it is turned off.
+func (h *InstanceHandler) publishGuestAgentAttributes(m map[string]bool) error {
+	if m[HostKeysNamespace] {
+		if err := h.publishHostKeys(); err != nil {
+			return err
+		}
+	}
+	if m[GuestInventoryNamespace] {
+		if !h.attributeEnabled("enable-os-inventory") {
+			h.unpublishGuestInventory()
+		} else if err := h.publishGuestInventory(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
 // GuestAttributes sets guest attributes for the VM. These custom values can either be Google Cloud attributes or user-created metadata values.
 //
+// The guest writes the attributes with PUT and deletes them with DELETE on guest-attributes/NAMESPACE/KEY.
+// All requests are rejected unless the enable-guest-attributes attribute is TRUE.
+//
 // For a list of instance-level Google Cloud attributes that you can set, see Instance guest attributes.
 //
 // Note: Any user or process on your VM instance can read and write to the namespaces and keys in guest-attributes metadata.
 //
 // For more information about guest attributes, see Setting and querying guest attributes.
-func (InstanceHandler) GuestAttributes(m map[string]bool) safehttp.Handler {
+func (h *InstanceHandler) GuestAttributes(m map[string]bool) safehttp.Handler {
 	handler := safehttp.HandlerFunc(func(w safehttp.ResponseWriter, r *safehttp.IncomingRequest) safehttp.Result {
-		if r.URL().Path() == "" {
-			attrs := make([]string, len(m))
-			i := 0
-			for attr := range m {
-				attrs[i] = attr
-				i++
+		if !h.attributeEnabled("enable-guest-attributes") {
+			return w.WriteError(NewStatusError(errors.New("guest attributes endpoint access is disabled"), safehttp.StatusForbidden))
+		}
+		if err := h.publishGuestAgentAttributes(m); err != nil {
+			return w.WriteError(NewStatusError(err, safehttp.StatusInternalServerError))
+		}
+
+		namespace, key, _ := strings.Cut(strings.TrimSuffix(r.URL().Path(), "/"), "/")
+
+		switch r.Method() {
+		case safehttp.MethodPut, safehttp.MethodDelete:
+			if namespace == "" || key == "" {
+				return w.WriteError(NewStatusError(errors.New("both of namespace and key are required"), safehttp.StatusBadRequest))
+			}
+			if err := validateGuestAttributeName(namespace); err != nil {
+				return w.WriteError(NewStatusError(fmt.Errorf("invalid namespace: %w", err), safehttp.StatusBadRequest))
+			}
+			if err := validateGuestAttributeName(key); err != nil {
+				return w.WriteError(NewStatusError(fmt.Errorf("invalid key: %w", err), safehttp.StatusBadRequest))
+			}
+
+			if r.Method() == safehttp.MethodDelete {
+				if !h.guestAttributes.delete(namespace, key) {
+					return w.WriteError(safehttp.StatusNotFound)
+				}
+				return w.Write(safehtml.HTMLEscaped(""))
 			}
-			return w.Write(safehtml.HTMLEscaped(strings.Join(attrs, "\n")))
+
+			val, err := io.ReadAll(io.LimitReader(r.Body(), MaxGuestAttributeValueLen+1))
+			if err != nil {
+				return w.WriteError(NewStatusError(err, safehttp.StatusBadRequest))
+			}
+			if len(val) > MaxGuestAttributeValueLen {
+				err := fmt.Errorf("value of %s/%s exceeds %d bytes", namespace, key, MaxGuestAttributeValueLen)
+				return w.WriteError(NewStatusError(err, safehttp.StatusRequestEntityTooLarge))
+			}
+			h.guestAttributes.set(namespace, key, string(val))
+
+			return w.Write(safehtml.HTMLEscaped(""))
 		}
 
-		if path := r.URL().Path(); m[path] {
-			switch path {
-			case "guestInventory":
-				// TODO(zchee): not implemented
-				return w.WriteError(safehttp.StatusNotImplemented)
+		if namespace == "" {
+			namespaces := h.guestAttributes.namespaces()
+			for i, ns := range namespaces {
+				namespaces[i] = ns + "/"
+			}
+			return w.Write(safehtml.HTMLEscaped(strings.Join(namespaces, "\n")))
+		}
 
-			case "hostkeys":
-				// TODO(zchee): not implemented
-				return w.WriteError(safehttp.StatusNotImplemented)
+		if key == "" {
+			keys := h.guestAttributes.keys(namespace)
+			if len(keys) == 0 {
+				return w.WriteError(safehttp.StatusNotFound)
 			}
+			return w.Write(safehtml.HTMLEscaped(strings.Join(keys, "\n")))
+		}
+
+		if val, ok := h.guestAttributes.get(namespace, key); ok {
+			return WriteText(w, val)
 		}
 
 		return w.WriteError(safehttp.StatusNotFound)
@@ -292,12 +505,29 @@ func (InstanceHandler) GuestAttributes(m map[string]bool) safehttp.Handler {
 	return safehttp.StripPrefix("/computeMetadata/v1/instance/guest-attributes/", handler)
 }
 
+// EnvInstanceName environment variable name for overrides instance name.
+const EnvInstanceName = "GOOGLE_INSTANCE_NAME"
+
 // EnvInstanceHostname environment variable name for overrides instance hostname.
+//
+// Deprecated: The hostname is derived from the instance name, zone and project ID. Use Instance.Name instead.
 const EnvInstanceHostname = "GOOGLE_INSTANCE_HOSTNAME"
 
 // Hostname is the hostname of the VM.
-func (InstanceHandler) Hostname() safehttp.Handler {
+//
+// The hostname is derived from the instance name, zone and project ID, and has one of the following formats depending on vmdnssetting:
+//
+//	NAME.ZONE.c.PROJECT_ID.internal
+//	NAME.c.PROJECT_ID.internal
+func (h *InstanceHandler) Hostname() safehttp.Handler {
 	return safehttp.HandlerFunc(func(w safehttp.ResponseWriter, r *safehttp.IncomingRequest) safehttp.Result {
+		if inst := h.model(); inst.name() != "" {
+			if projectID, ok := h.projectModel().projectID(); ok {
+				vmdnssetting, _ := h.attribute("vmdnssetting")
+				return w.Write(safehtml.HTMLEscaped(inst.hostname(projectID, vmdnssetting)))
+			}
+		}
+
 		if hostname, ok := os.LookupEnv(EnvInstanceHostname); ok {
 			return w.Write(safehtml.HTMLEscaped(hostname))
 		}
@@ -307,11 +537,18 @@ func (InstanceHandler) Hostname() safehttp.Handler {
 }
 
 // EnvInstanceID environment variable name for overrides instance id.
+//
+// Deprecated: The ID is derived from the instance name, zone and project ID. Use Instance.ID instead.
 const EnvInstanceID = "GOOGLE_INSTANCE_ID"
 
 // ID the ID of the VM. This is a unique, numerical ID that is generated by Compute Engine. This is useful for identifying VMs if you don't use VM names.
-func (InstanceHandler) ID() safehttp.Handler {
+func (h *InstanceHandler) ID() safehttp.Handler {
 	return safehttp.HandlerFunc(func(w safehttp.ResponseWriter, r *safehttp.IncomingRequest) safehttp.Result {
+		if inst := h.model(); inst.ID != 0 || inst.name() != "" {
+			projectID, _ := h.projectModel().projectID()
+			return w.Write(safehtml.HTMLEscaped(inst.id(projectID)))
+		}
+
 		if id, ok := os.LookupEnv(EnvInstanceID); ok {
 			return w.Write(safehtml.HTMLEscaped(id))
 		}
@@ -323,45 +560,109 @@ func (InstanceHandler) ID() safehttp.Handler {
 // Image is the operating system image used by the VM. This value has the following format:
 //
 //	projects/IMAGE_PROJECT/global/images/IMAGE_NAME
-func (InstanceHandler) Image() safehttp.Handler {
+func (h *InstanceHandler) Image() safehttp.Handler {
 	return safehttp.HandlerFunc(func(w safehttp.ResponseWriter, r *safehttp.IncomingRequest) safehttp.Result {
-		return safehttp.NotWritten()
+		return w.Write(safehtml.HTMLEscaped(h.model().image()))
 	})
 }
 
 // LegacyEndpointAccess stores the list of legacy endpoints. Values are 0.1 and v1beta1.
-func (InstanceHandler) LegacyEndpointAccess() safehttp.Handler {
+func (*InstanceHandler) LegacyEndpointAccess() safehttp.Handler {
 	return safehttp.HandlerFunc(func(w safehttp.ResponseWriter, r *safehttp.IncomingRequest) safehttp.Result {
 		return safehttp.NotWritten()
 	})
 }
 
 // Licenses a list of license code IDs that are used to attach the licenses to images, snapshots, and disks.
-// directory
-func (InstanceHandler) Licenses() safehttp.Handler {
-	return safehttp.HandlerFunc(func(w safehttp.ResponseWriter, r *safehttp.IncomingRequest) safehttp.Result {
-		return safehttp.NotWritten()
+//
+// For each license, the following information is available:
+//
+//	id
+func (h *InstanceHandler) Licenses() safehttp.Handler {
+	handler := safehttp.HandlerFunc(func(w safehttp.ResponseWriter, r *safehttp.IncomingRequest) safehttp.Result {
+		licenses := h.model().licenses()
+
+		path := r.URL().Path()
+		if path == "" {
+			idxs := make([]string, len(licenses))
+			for i := range licenses {
+				idxs[i] = strconv.Itoa(i) + "/"
+			}
+			return w.Write(safehtml.HTMLEscaped(strings.Join(idxs, "\n")))
+		}
+
+		idx, attr := pathpkg.Split(path)
+		i, err := strconv.Atoi(strings.TrimSuffix(idx, "/"))
+		if err != nil || i < 0 || i >= len(licenses) {
+			return w.WriteError(safehttp.StatusNotFound)
+		}
+
+		switch attr {
+		case "":
+			return w.Write(safehtml.HTMLEscaped("id"))
+		case "id":
+			return w.Write(safehtml.HTMLEscaped(licenses[i].ID))
+		}
+
+		return w.WriteError(safehttp.StatusNotFound)
 	})
+
+	return safehttp.StripPrefix("/computeMetadata/v1/instance/licenses/", handler)
 }
 
-// MachineType is the machine type for this VM. This value has the following format: projects/PROJECT_NUM/machineTypes/MACHINE_TYPE
-func (InstanceHandler) MachineType() safehttp.Handler {
+// MachineType is the machine type for this VM. This value has the following format:
+//
+//	projects/PROJECT_NUM/machineTypes/MACHINE_TYPE
+//
+// Note that when using this function, you also need to fake the GCP project number as this package emulates the behavior of the real metadata server.
+//
+// Requires sets Project.NumericProjectID, or one of the below environment variables. The first set variable in the order below takes precedence:
+//
+//	GOOGLE_CLOUD_NUMERIC_PROJECT
+//	GCP_NUMERIC_PROJECT
+//	GOOGLE_GCP_NUMERIC_PROJECT
+func (h *InstanceHandler) MachineType() safehttp.Handler {
 	return safehttp.HandlerFunc(func(w safehttp.ResponseWriter, r *safehttp.IncomingRequest) safehttp.Result {
-		return safehttp.NotWritten()
+		if mt := h.model().MachineType; mt != "" {
+			if projectNumber, ok := h.projectModel().numericProjectID(); ok {
+				val := fmt.Sprintf("projects/%s/machineTypes/%s", projectNumber, mt)
+				return w.Write(safehtml.HTMLEscaped(val))
+			}
+		}
+
+		return w.WriteError(safehttp.StatusNotFound)
 	})
 }
 
+// List of maintenance-event values.
+const (
+	// MaintenanceEventNone is the maintenance-event value when no maintenance event is affecting the VM.
+	MaintenanceEventNone = "NONE"
+
+	// MaintenanceEventMigrate is the maintenance-event value while the VM is live migrating.
+	MaintenanceEventMigrate = "MIGRATE_ON_HOST_MAINTENANCE"
+
+	// MaintenanceEventTerminate is the maintenance-event value before the VM is terminated for host maintenance.
+	MaintenanceEventTerminate = "TERMINATE_ON_HOST_MAINTENANCE"
+)
+
 // MaintenanceEvent indicates whether a maintenance event is affecting this VM. For more information, see Live migrate.
-func (InstanceHandler) MaintenanceEvent() safehttp.Handler {
+//
+// The value supports the wait_for_change query parameter.
+func (h *InstanceHandler) MaintenanceEvent() safehttp.Handler {
 	return safehttp.HandlerFunc(func(w safehttp.ResponseWriter, r *safehttp.IncomingRequest) safehttp.Result {
-		return safehttp.NotWritten()
+		return writeWatchValue(w, r, &h.maintenanceEvent, MaintenanceEventNone)
 	})
 }
 
 // Name is the name of the VM.
-func (InstanceHandler) Name() safehttp.Handler {
+func (h *InstanceHandler) Name() safehttp.Handler {
 	return safehttp.HandlerFunc(func(w safehttp.ResponseWriter, r *safehttp.IncomingRequest) safehttp.Result {
-		return safehttp.NotWritten()
+		if name := h.model().name(); name != "" {
+			return w.Write(safehtml.HTMLEscaped(name))
+		}
+
+		return w.WriteError(safehttp.StatusNotFound)
 	})
 }
 
@@ -382,22 +683,32 @@ func (InstanceHandler) Name() safehttp.Handler {
 //	target-instance-ips
 //
 // For more information about network interfaces, see Multiple network interfaces overview.
-func (InstanceHandler) NetworkInterfaces() safehttp.Handler {
+func (*InstanceHandler) NetworkInterfaces() safehttp.Handler {
 	return safehttp.HandlerFunc(func(w safehttp.ResponseWriter, r *safehttp.IncomingRequest) safehttp.Result {
 		return safehttp.NotWritten()
 	})
 }
 
 // Preempted a boolean value that indicates whether a VM is about to be preempted.
-func (InstanceHandler) Preempted() safehttp.Handler {
+func (*InstanceHandler) Preempted() safehttp.Handler {
 	return safehttp.HandlerFunc(func(w safehttp.ResponseWriter, r *safehttp.IncomingRequest) safehttp.Result {
 		return safehttp.NotWritten()
 	})
 }
 
-func (InstanceHandler) RemainingCPUTime() safehttp.Handler {
+// RemainingCPUTime is the remaining CPU time of the CPU burst budget of the shared-core machine types, in seconds.
+//
+// The budget is consumed while the instance is bursting and refilled while the instance is idle.
+// The value is not served for the non-shared-core machine types.
+func (h *InstanceHandler) RemainingCPUTime() safehttp.Handler {
 	return safehttp.HandlerFunc(func(w safehttp.ResponseWriter, r *safehttp.IncomingRequest) safehttp.Result {
-		return safehttp.NotWritten()
+		mt, ok := LookupMachineType(h.model().MachineType)
+		if !ok || !mt.SharedCPU {
+			return w.WriteError(safehttp.StatusNotFound)
+		}
+
+		remaining := h.cpuBurst.remaining(mt)
+		return w.Write(safehtml.HTMLEscaped(strconv.FormatFloat(remaining.Seconds(), 'f', 3, 64)))
 	})
 }
 
@@ -418,7 +729,7 @@ func (InstanceHandler) RemainingCPUTime() safehttp.Handler {
 // If this value is TRUE, the VM is preemptible. This value is set when you create a VM, and it can't be changed.
 //
 // For more information about scheduling options, see Setting instance availability policies.
-func (InstanceHandler) Scheduling() safehttp.Handler {
+func (*InstanceHandler) Scheduling() safehttp.Handler {
 	return safehttp.HandlerFunc(func(w safehttp.ResponseWriter, r *safehttp.IncomingRequest) safehttp.Result {
 		return safehttp.NotWritten()
 	})
@@ -479,8 +790,14 @@ var (
 // For information about access tokens, see Authenticating applications directly with access tokens.
 //
 // For more information about service accounts, see Creating and enabling service accounts for instances.
+//
+// If the GKE Workload Identity emulation is enabled, the service accounts are served per calling pod. See WorkloadIdentity.
 func (h *InstanceHandler) ServiceAccounts() safehttp.Handler {
 	handler := safehttp.HandlerFunc(func(w safehttp.ResponseWriter, r *safehttp.IncomingRequest) safehttp.Result {
+		if wi := h.workloadIdentityModel(); wi != nil {
+			return h.workloadIdentityServiceAccounts(w, r, wi)
+		}
+
 		url := r.URL()
 		q, err := url.Query()
 		if err != nil {
@@ -489,47 +806,78 @@ func (h *InstanceHandler) ServiceAccounts() safehttp.Handler {
 
 		path := url.Path()
 		if path == "" {
-			sas := []string{
-				"default/",
+			sas, err := h.serviceAccounts()
+			if err != nil {
+				return w.WriteError(NewStatusError(err, safehttp.StatusBadRequest))
 			}
-			sa, ok := os.LookupEnv(EnvGoogleAccountEmail)
-			if !ok {
-				sa, err = h.findServiceAccountEmail()
-				if err != nil {
-					return w.WriteError(NewStatusError(err, safehttp.StatusBadRequest))
+
+			var dirs []string
+			for _, sa := range sas {
+				for _, alias := range sa.Aliases {
+					dirs = append(dirs, alias+"/")
 				}
+				dirs = append(dirs, sa.Email+"/")
 			}
-			sas = append(sas, sa+"/")
 
-			return w.Write(safehtml.HTMLEscaped(strings.Join(sas, "\n")))
+			return w.Write(safehtml.HTMLEscaped(strings.Join(dirs, "\n")))
+		}
+
+		dir, attr := pathpkg.Split(path)
+		sa, err := h.lookupServiceAccount(dir)
+		if err != nil {
+			return w.WriteError(NewStatusError(err, safehttp.StatusNotFound))
 		}
 
-		sa, attr := pathpkg.Split(path)
 		switch attr {
 		case "":
 			return w.Write(safehtml.HTMLEscaped(strings.Join(serviceAccountsEndpoints, "\n")))
 
 		case "aliases":
-			return h.serviceAccountsAliasesHandler(w, r)
+			return h.serviceAccountsAliasesHandler(w, r, sa)
 
 		case "email":
-			return h.serviceAccountsEmailHandler(w, r, sa)
+			return w.Write(safehtml.HTMLEscaped(sa.Email))
 
 		case "identity":
 			audience := q.String("audience", "")
 			if audience == "" {
 				return w.WriteError(NewStatusError(errors.New("non-empty audience parameter required"), safehttp.StatusBadRequest))
 			}
+			licenses := q.Bool("licenses", false)
+			if err := q.Err(); err != nil {
+				return w.WriteError(NewStatusError(err, safehttp.StatusBadRequest))
+			}
+
+			format := q.String("format", IDTokenFormatStandard)
+			switch format {
+			case IDTokenFormatStandard:
+				if !h.localIDToken() {
+					return h.serviceAccountsIdentityHandler(w, r, sa, audience)
+				}
+			case IDTokenFormatFull:
+				// nothing to do
+			default:
+				return w.WriteError(NewStatusError(fmt.Errorf("unknown format %q", format), safehttp.StatusBadRequest))
+			}
 
-			return h.serviceAccountsIdentityHandler(w, r, sa, audience)
+			return h.serviceAccountsLocalIdentityHandler(w, r, sa, audience, format, licenses)
 
 		case "scopes":
-			return h.serviceAccountsScopesHandler(w, r)
+			return h.serviceAccountsScopesHandler(w, r, sa)
 
 		case "token":
-			scopes := strings.Split(q.String("scopes", ""), ",")
+			var scopes []string
+			if s := q.String("scopes", ""); s != "" {
+				scopes = strings.Split(s, ",")
+			}
+			if err := sa.grants(scopes); err != nil {
+				return w.WriteError(NewStatusError(err, safehttp.StatusForbidden))
+			}
+			if len(scopes) == 0 && !sa.anyScopes {
+				scopes = sa.scopes()
+			}
 
-			return h.serviceAccountsTokenHandler(w, r, scopes...)
+			return h.serviceAccountsTokenHandler(w, r, sa, scopes...)
 		}
 
 		return w.WriteError(safehttp.StatusNotFound)
@@ -538,7 +886,7 @@ func (h *InstanceHandler) ServiceAccounts() safehttp.Handler {
 	return safehttp.StripPrefix("/computeMetadata/v1/instance/service-accounts/", handler)
 }
 
-func (h InstanceHandler) findServiceAccountEmail(scopes ...string) (string, error) {
+func (h *InstanceHandler) findServiceAccountEmail(scopes ...string) (string, error) {
 	// try to find application default credentials JSON path
 	filename, ok := os.LookupEnv(EnvGoogleApplicationCredentials)
 	if !ok {
@@ -557,7 +905,7 @@ func (h InstanceHandler) findServiceAccountEmail(scopes ...string) (string, erro
 	return jwtCfg.Email, nil
 }
 
-func (h InstanceHandler) jwtConfigFromServiceAccount(filename string, scopes ...string) (*jwt.Config, error) {
+func (h *InstanceHandler) jwtConfigFromServiceAccount(filename string, scopes ...string) (*jwt.Config, error) {
 	data, err := os.ReadFile(filename)
 	if err != nil {
 		if os.IsNotExist(err) {
@@ -576,95 +924,92 @@ func (h InstanceHandler) jwtConfigFromServiceAccount(filename string, scopes ...
 	return jwtCfg, nil
 }
 
-func (h InstanceHandler) serviceAccountsAliasesHandler(w safehttp.ResponseWriter, _ *safehttp.IncomingRequest) safehttp.Result {
-	return w.Write(safehtml.HTMLEscaped("default"))
+func (h *InstanceHandler) serviceAccountsAliasesHandler(w safehttp.ResponseWriter, _ *safehttp.IncomingRequest, sa ServiceAccount) safehttp.Result {
+	return w.Write(safehtml.HTMLEscaped(strings.Join(sa.Aliases, "\n")))
 }
 
-func (h InstanceHandler) serviceAccountsEmailHandler(w safehttp.ResponseWriter, _ *safehttp.IncomingRequest, sa string) safehttp.Result {
-	saEmail, ok := os.LookupEnv(EnvGoogleAccountEmail)
-	if ok {
-		return w.Write(safehtml.HTMLEscaped(saEmail))
+func (h *InstanceHandler) serviceAccountsIdentityHandler(w safehttp.ResponseWriter, r *safehttp.IncomingRequest, sa ServiceAccount, targetAudience string) safehttp.Result {
+	backend, delegates := h.credentials(sa, true)
+	if backend == BackendOffline {
+		return h.serviceAccountsLocalIdentityHandler(w, r, sa, targetAudience, IDTokenFormatStandard, false)
 	}
 
-	switch sa {
-	case "":
-		return w.WriteError(safehttp.StatusNotFound)
-
-	case "default":
-		var err error
-		sa, err = h.findServiceAccountEmail()
-		if err != nil {
-			return w.WriteError(safehttp.StatusNotFound)
-		}
-
-	default:
-		// validates service account email address
-		if !validEmailRe.MatchString(sa) {
-			return w.WriteError(NewStatusError(fmt.Errorf("%s email address is invalid", sa), safehttp.StatusBadRequest))
-		}
+	key := tokenCacheKey{source: string(backend), serviceAccount: sa.Email, audience: targetAudience, format: IDTokenFormatStandard}
+	if backend != BackendADC {
+		key.source += ":" + strings.Join(delegates, ",")
+	}
+	tok, err := h.tokenCache.token(r.Context(), key, time.Now(), func(ctx context.Context) (*oauth2.Token, error) {
+		return h.fetchIdentityToken(ctx, sa, targetAudience, backend, delegates)
+	})
+	if err != nil {
+		return w.WriteError(NewStatusError(err, safehttp.StatusInternalServerError))
 	}
 
-	return w.Write(safehtml.HTMLEscaped(sa))
+	return w.Write(safehtml.HTMLEscaped(tok.AccessToken))
 }
 
-func (h *InstanceHandler) serviceAccountsIdentityHandler(w safehttp.ResponseWriter, r *safehttp.IncomingRequest, sa, targetAudience string) safehttp.Result {
-	var idTokenSource oauth2.TokenSource
-
+// fetchIdentityToken fetches the identity token of sa by backend from Google, or the local IAM Credentials service if enabled.
+func (h *InstanceHandler) fetchIdentityToken(ctx context.Context, sa ServiceAccount, targetAudience string, backend ServiceAccountBackend, delegates []string) (*oauth2.Token, error) {
 	switch {
-	case h.useImpersonate:
+	case backend == BackendImpersonate && !h.usesLocalIAMCredentials():
 		idTokenCfg := impersonate.IDTokenConfig{
-			TargetPrincipal: sa,
+			TargetPrincipal: sa.Email,
 			Audience:        targetAudience,
 			IncludeEmail:    true,
-		}
-		if h.delegates != nil {
-			idTokenCfg.Delegates = h.delegates
+			Delegates:       delegates,
 		}
 
-		ts, err := impersonate.IDTokenSource(r.Context(), idTokenCfg)
+		ts, err := impersonate.IDTokenSource(ctx, idTokenCfg)
 		if err != nil {
-			return w.WriteError(NewStatusError(err, safehttp.StatusInternalServerError))
+			return nil, err
 		}
-		idTokenSource = ts
 
-	case h.useFederate:
-		iamClient, err := iamcredentials.NewIamCredentialsClient(r.Context(), option.WithTelemetryDisabled())
-		if err != nil {
-			return w.WriteError(NewStatusError(err, safehttp.StatusInternalServerError))
-		}
-		defer iamClient.Close()
+		return ts.Token()
 
-		req := &credentialspb.GenerateIdTokenRequest{
-			Name:         fmt.Sprintf("projects/-/serviceAccounts/%s", sa),
-			Audience:     targetAudience,
-			IncludeEmail: true,
-		}
-		if h.delegates != nil {
-			req.Delegates = h.delegates
-		}
-
-		resp, err := iamClient.GenerateIdToken(r.Context(), req)
+	case backend == BackendImpersonate, backend == BackendFederate:
+		ctx, err := h.federatedContext(ctx, backend)
 		if err != nil {
-			return w.WriteError(NewStatusError(err, safehttp.StatusInternalServerError))
+			return nil, err
 		}
 
-		idTokenSource = oauth2.StaticTokenSource(&oauth2.Token{
-			AccessToken: resp.Token,
-		})
+		return h.generateIDToken(ctx, sa.Email, targetAudience, delegates)
 
 	default:
-		creds, err := google.FindDefaultCredentialsWithParams(r.Context(), google.CredentialsParams{})
+		creds, err := google.FindDefaultCredentialsWithParams(ctx, google.CredentialsParams{})
 		if err != nil {
-			return w.WriteError(NewStatusError(err, safehttp.StatusInternalServerError))
+			return nil, err
 		}
 
-		idTokenSource, err = idtoken.NewTokenSource(r.Context(), targetAudience, idtoken.WithCredentialsJSON(creds.JSON))
+		ts, err := idtoken.NewTokenSource(ctx, targetAudience, idtoken.WithCredentialsJSON(creds.JSON))
 		if err != nil {
-			return w.WriteError(NewStatusError(err, safehttp.StatusInternalServerError))
+			return nil, err
 		}
+
+		return ts.Token()
+	}
+}
+
+// cloudPlatformScope is the OAuth2 scope of the full access to the Google Cloud services.
+const cloudPlatformScope = "https://www.googleapis.com/auth/cloud-platform"
+
+// serviceAccountsLocalIdentityHandler writes the identity token signed by the local signer.
+//
+// The full format identity token is always signed locally, since Google issues the Compute Engine claims only to the real VMs.
+func (h *InstanceHandler) serviceAccountsLocalIdentityHandler(w safehttp.ResponseWriter, r *safehttp.IncomingRequest, sa ServiceAccount, audience, format string, licenses bool) safehttp.Result {
+	key := tokenCacheKey{source: "local", serviceAccount: sa.Email, audience: audience, format: format}
+	if licenses {
+		key.format += "+licenses"
 	}
 
-	tok, err := idTokenSource.Token()
+	now := time.Now()
+	tok, err := h.tokenCache.token(r.Context(), key, now, func(context.Context) (*oauth2.Token, error) {
+		tok, err := h.identityToken(sa.Email, audience, format, licenses, now)
+		if err != nil {
+			return nil, err
+		}
+
+		return &oauth2.Token{AccessToken: tok, Expiry: now.Add(idTokenLifetime)}, nil
+	})
 	if err != nil {
 		return w.WriteError(NewStatusError(err, safehttp.StatusInternalServerError))
 	}
@@ -672,10 +1017,8 @@ func (h *InstanceHandler) serviceAccountsIdentityHandler(w safehttp.ResponseWrit
 	return w.Write(safehtml.HTMLEscaped(tok.AccessToken))
 }
 
-func (h InstanceHandler) serviceAccountsScopesHandler(w safehttp.ResponseWriter, _ *safehttp.IncomingRequest) safehttp.Result {
-	const cloudPlatformScope = "https://www.googleapis.com/auth/cloud-platform"
-
-	return w.Write(safehtml.HTMLEscaped(cloudPlatformScope))
+func (h *InstanceHandler) serviceAccountsScopesHandler(w safehttp.ResponseWriter, _ *safehttp.IncomingRequest, sa ServiceAccount) safehttp.Result {
+	return w.Write(safehtml.HTMLEscaped(strings.Join(sa.scopes(), "\n")))
 }
 
 // TokenResponse represents a JSON response of service account token.
@@ -685,32 +1028,70 @@ type TokenResponse struct {
 	TokenType   string `json:"token_type"`
 }
 
-func (InstanceHandler) serviceAccountsTokenHandler(w safehttp.ResponseWriter, r *safehttp.IncomingRequest, scopes ...string) safehttp.Result {
+func (h *InstanceHandler) serviceAccountsTokenHandler(w safehttp.ResponseWriter, r *safehttp.IncomingRequest, sa ServiceAccount, scopes ...string) safehttp.Result {
 	now := time.Now().In(time.UTC) // for calculate tokne expires
 
-	creds, err := google.FindDefaultCredentialsWithParams(r.Context(), google.CredentialsParams{
-		Scopes: scopes,
-	})
-	if err != nil {
-		return w.Write(NewStatusError(err, safehttp.StatusInternalServerError))
+	backend, delegates := h.credentials(sa, false)
+	key := tokenCacheKey{source: string(backend), serviceAccount: sa.Email, scopes: scopesKey(scopes)}
+	if backend == BackendImpersonate || backend == BackendFederate {
+		key.source += ":" + strings.Join(delegates, ",")
 	}
 
-	tok, err := creds.TokenSource.Token()
+	tok, err := h.tokenCache.token(r.Context(), key, now, func(ctx context.Context) (*oauth2.Token, error) {
+		return h.fetchAccessToken(ctx, sa, scopes, backend, delegates, now)
+	})
 	if err != nil {
-		return w.WriteError(safehttp.StatusInternalServerError)
+		return w.WriteError(NewStatusError(err, safehttp.StatusInternalServerError))
 	}
 
-	expiresIn := tok.Expiry.In(time.UTC).Sub(now).Round(time.Second).Seconds()
-	resp := TokenResponse{
-		AccessToken: tok.AccessToken,
-		ExpiresIn:   *(*int)(unsafe.Pointer(&expiresIn)),
-		TokenType:   tok.TokenType,
-	}
+	return writeToken(w, tok, now)
+}
+
+// fetchAccessToken fetches the access token of sa by backend from Google, the local IAM Credentials service if enabled,
+// or the offline tokens.
+func (h *InstanceHandler) fetchAccessToken(ctx context.Context, sa ServiceAccount, scopes []string, backend ServiceAccountBackend, delegates []string, now time.Time) (*oauth2.Token, error) {
+	switch backend {
+	case BackendOffline:
+		return h.issueOfflineToken(sa.Email, scopes, now)
 
-	return WriteJSON(w, &resp)
+	case BackendImpersonate, BackendFederate:
+		if len(scopes) == 0 {
+			scopes = []string{cloudPlatformScope}
+		}
+		if h.usesLocalIAMCredentials() {
+			ctx, err := h.federatedContext(ctx, backend)
+			if err != nil {
+				return nil, err
+			}
+
+			return h.generateAccessToken(ctx, sa.Email, scopes, delegates)
+		}
+
+		// the federation impersonates by the external_account application default credentials
+		ts, err := impersonate.CredentialsTokenSource(ctx, impersonate.CredentialsConfig{
+			TargetPrincipal: sa.Email,
+			Scopes:          scopes,
+			Delegates:       delegates,
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		return ts.Token()
+
+	default:
+		creds, err := google.FindDefaultCredentialsWithParams(ctx, google.CredentialsParams{
+			Scopes: scopes,
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		return creds.TokenSource.Token()
+	}
 }
 
-// EnvGoogleInstanceRegion environment variable name for overrides instance region.
+// EnvGoogleInstanceRegion environment variable name for the instance region, which is used only if Instance.Zone is empty.
 const EnvGoogleInstanceRegion = "GOOGLE_INSTANCE_REGION"
 
 // Region returns a region of GCP services.
@@ -719,23 +1100,19 @@ const EnvGoogleInstanceRegion = "GOOGLE_INSTANCE_REGION"
 //
 //	projects/PROJECT-NUMBER/regions/REGION
 //
+// The region is derived from the zone of the instance model, or taken from GOOGLE_INSTANCE_REGION environment variable
+// if the model has no zone.
+//
 // Note that when using this function, you also need to fake the GCP project number as this package emulates the behavior of the real metadata server.
 //
-// Requires sets one of the below environment variables:
+// Requires sets Project.NumericProjectID, or one of the below environment variables. The first set variable in the order below takes precedence:
 // - GOOGLE_CLOUD_NUMERIC_PROJECT
 // - GCP_NUMERIC_PROJECT
 // - GOOGLE_GCP_NUMERIC_PROJECT
-func (InstanceHandler) Region() safehttp.Handler {
+func (h *InstanceHandler) Region() safehttp.Handler {
 	return safehttp.HandlerFunc(func(w safehttp.ResponseWriter, r *safehttp.IncomingRequest) safehttp.Result {
-		if region, ok := os.LookupEnv(EnvGoogleInstanceRegion); ok {
-			var projectNumber string
-			for _, env := range numericProjectEnvs {
-				if projnum, ok := os.LookupEnv(env); ok {
-					projectNumber = projnum
-				}
-			}
-
-			if projectNumber != "" {
+		if region := h.model().region(); region != "" {
+			if projectNumber, ok := h.projectModel().numericProjectID(); ok {
 				val := fmt.Sprintf("projects/%s/regions/%s", projectNumber, region)
 				return w.Write(safehtml.HTMLEscaped(val))
 			}
@@ -747,47 +1124,70 @@ func (InstanceHandler) Region() safehttp.Handler {
 
 // Tags lists any network tags associated with the VM.
 //
+// The tags are served as a JSON array. e.g. ["http-server","https-server"]
+//
 // For more information about network tags, see Configuring network tags.
-func (InstanceHandler) Tags() safehttp.Handler {
+func (h *InstanceHandler) Tags() safehttp.Handler {
 	return safehttp.HandlerFunc(func(w safehttp.ResponseWriter, r *safehttp.IncomingRequest) safehttp.Result {
-		return safehttp.NotWritten()
+		tags := h.model().Tags
+		if tags == nil {
+			tags = []string{}
+		}
+
+		return WriteJSON(w, tags)
 	})
 }
 
-func (InstanceHandler) VirtualClock() safehttp.Handler {
-	return safehttp.HandlerFunc(func(w safehttp.ResponseWriter, r *safehttp.IncomingRequest) safehttp.Result {
-		return safehttp.NotWritten()
+var virtualClockEndpoints = []string{
+	"drift-token",
+}
+
+// VirtualClock a directory of the virtual clock of the VM. The following information is available:
+//
+//	drift-token
+//
+// The token which changes when the guest clock may have drifted from the host clock, such as after a live migration.
+// Guest agents wait for changes with the wait_for_change query parameter and resync the guest clock.
+func (h *InstanceHandler) VirtualClock() safehttp.Handler {
+	handler := safehttp.HandlerFunc(func(w safehttp.ResponseWriter, r *safehttp.IncomingRequest) safehttp.Result {
+		switch r.URL().Path() {
+		case "":
+			return w.Write(safehtml.HTMLEscaped(strings.Join(virtualClockEndpoints, "\n")))
+		case "drift-token":
+			return writeWatchValue(w, r, &h.driftToken, "0")
+		}
+
+		return w.WriteError(safehttp.StatusNotFound)
 	})
+
+	return safehttp.StripPrefix("/computeMetadata/v1/instance/virtual-clock/", handler)
 }
 
-// EnvGoogleInstanceZone environment variable name for overrides instance zone.
+// EnvGoogleInstanceZone environment variable name for the instance zone, which is used only if Instance.Zone is empty.
 const EnvGoogleInstanceZone = "GOOGLE_INSTANCE_ZONE"
 
 // Zone is the zone where this VM is located.
 //
 // This value has the following format:
 //
-//	projects/PROJECT-NUMBER/zones/ZONE.
+//	projects/PROJECT-NUMBER/zones/ZONE
+//
+// The zone is taken from the instance model, or GOOGLE_INSTANCE_ZONE environment variable if the model has no zone.
+// Note that the older versions of this package served the collection "zone" instead of "zones" as the real metadata server,
+// and preferred the environment variable to the model.
 //
 // Note that when using this function, you also need to fake the GCP project number as this package emulates the behavior of the real metadata server.
 //
-// Requires sets one of the below environment variables:
+// Requires sets Project.NumericProjectID, or one of the below environment variables. The first set variable in the order below takes precedence:
 //
 //	GOOGLE_CLOUD_NUMERIC_PROJECT
 //	GCP_NUMERIC_PROJECT
 //	GOOGLE_GCP_NUMERIC_PROJECT
-func (InstanceHandler) Zone() safehttp.Handler {
+func (h *InstanceHandler) Zone() safehttp.Handler {
 	return safehttp.HandlerFunc(func(w safehttp.ResponseWriter, r *safehttp.IncomingRequest) safehttp.Result {
-		if zone, ok := os.LookupEnv(EnvGoogleInstanceZone); ok {
-			var projectNumber string
-			for _, env := range numericProjectEnvs {
-				if projnum, ok := os.LookupEnv(env); ok {
-					projectNumber = projnum
-				}
-			}
-
-			if projectNumber != "" {
-				val := fmt.Sprintf("projects/%s/zone/%s", projectNumber, zone)
+		if zone := h.model().zone(); zone != "" {
+			if projectNumber, ok := h.projectModel().numericProjectID(); ok {
+				val := fmt.Sprintf("projects/%s/zones/%s", projectNumber, zone)
 				return w.Write(safehtml.HTMLEscaped(val))
 			}
 		}
@@ -0,0 +1,177 @@
+// Copyright 2022 The compute-metadata-server Authors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package fakemetadata_test
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/zchee/compute-metadata-server/fakemetadata"
+)
+
+func TestInstanceModel(t *testing.T) {
+	// the region of the environment variable must not disagree with the zone of the model
+	t.Setenv(fakemetadata.EnvGoogleInstanceRegion, "asia-northeast1")
+
+	srv := startServer(t)
+
+	if err := srv.SetProject(fakemetadata.Project{ProjectID: "my-project", NumericProjectID: 123456789012}); err != nil {
+		t.Fatal(err)
+	}
+	inst := fakemetadata.Instance{
+		Name:        "vm-1",
+		Zone:        "us-central1-a",
+		Description: `<b>"web" & 'api'</b>`,
+		Image:       "projects/my-project/global/images/my-image",
+		Licenses:    []fakemetadata.License{{ID: "1234567890", Project: "my-project", Name: "my-license"}},
+		Tags:        []string{"http-server", "https-server"},
+	}
+	if err := srv.SetInstance(inst); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := map[string]struct {
+		path string
+		want string
+	}{
+		"Name": {
+			path: "instance/name",
+			want: "vm-1",
+		},
+		"Hostname": {
+			path: "instance/hostname",
+			want: "vm-1.us-central1-a.c.my-project.internal",
+		},
+		"Description": {
+			path: "instance/description",
+			want: inst.Description,
+		},
+		"Image": {
+			path: "instance/image",
+			want: inst.Image,
+		},
+		"Licenses": {
+			path: "instance/licenses/",
+			want: "0/",
+		},
+		"License": {
+			path: "instance/licenses/0/",
+			want: "id",
+		},
+		"LicenseID": {
+			path: "instance/licenses/0/id",
+			want: "1234567890",
+		},
+		"Tags": {
+			path: "instance/tags",
+			want: `["http-server","https-server"]`,
+		},
+		"Zone": {
+			path: "instance/zone",
+			want: "projects/123456789012/zones/us-central1-a",
+		},
+		"Region": {
+			path: "instance/region",
+			want: "projects/123456789012/regions/us-central1",
+		},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			if got := strings.TrimSpace(getText(t, srv, tt.path)); got != tt.want {
+				t.Fatalf("%s = %q, want %q", tt.path, got, tt.want)
+			}
+		})
+	}
+
+	// the derived ID is stable, and the configured ID takes precedence
+	id := getText(t, srv, "instance/id")
+	if _, err := strconv.ParseUint(id, 10, 64); err != nil {
+		t.Fatalf("id %q is not numeric: %v", id, err)
+	}
+	if again := getText(t, srv, "instance/id"); again != id {
+		t.Fatalf("derived id is not stable: %q and %q", id, again)
+	}
+	inst.ID = 42
+	inst.Attributes = map[string]string{"vmdnssetting": fakemetadata.VMDNSSettingGlobalOnly}
+	if err := srv.SetInstance(inst); err != nil {
+		t.Fatal(err)
+	}
+	if got := getText(t, srv, "instance/id"); got != "42" {
+		t.Fatalf("id = %q, want %q", got, "42")
+	}
+	if got, want := getText(t, srv, "instance/hostname"), "vm-1.c.my-project.internal"; got != want {
+		t.Fatalf("hostname of global DNS = %q, want %q", got, want)
+	}
+
+	// the image and licenses fall back to the defaults
+	if err := srv.SetInstance(fakemetadata.Instance{Name: "vm-1"}); err != nil {
+		t.Fatal(err)
+	}
+	if got := getText(t, srv, "instance/image"); got != fakemetadata.DefaultImage {
+		t.Fatalf("image = %q, want %q", got, fakemetadata.DefaultImage)
+	}
+	if got, want := getText(t, srv, "instance/licenses/0/id"), fakemetadata.DefaultLicenses[0].ID; got != want {
+		t.Fatalf("license id = %q, want %q", got, want)
+	}
+	if got := strings.TrimSpace(getText(t, srv, "instance/tags")); got != "[]" {
+		t.Fatalf("tags = %q, want %q", got, "[]")
+	}
+}
+
+func TestRemainingCPUTime(t *testing.T) {
+	srv := startServer(t)
+
+	if err := srv.SetCPUBursting(true); err == nil {
+		t.Fatal("SetCPUBursting of the instance without machine type must fail")
+	}
+
+	if err := srv.SetInstance(fakemetadata.Instance{Zone: "us-central1-a", MachineType: "n2-standard-2"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := srv.SetCPUBursting(true); err == nil {
+		t.Fatal("SetCPUBursting of the non-shared-core machine type must fail")
+	}
+	if resp := get(t, srv, "instance/remaining-cpu-time"); resp.status != http.StatusNotFound {
+		t.Fatalf("status of the non-shared-core machine type = %d, want %d", resp.status, http.StatusNotFound)
+	}
+
+	if err := srv.SetInstance(fakemetadata.Instance{Zone: "us-central1-a", MachineType: "e2-micro"}); err != nil {
+		t.Fatal(err)
+	}
+	srv.SetCPUBurst(fakemetadata.CPUBurst{Capacity: time.Minute, DrainRate: time.Second})
+	if got := getText(t, srv, "instance/remaining-cpu-time"); got != "60.000" {
+		t.Fatalf("remaining-cpu-time of the full budget = %q, want %q", got, "60.000")
+	}
+	if err := srv.SetCPUBursting(true); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	got, err := strconv.ParseFloat(getText(t, srv, "instance/remaining-cpu-time"), 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got >= 60 {
+		t.Fatalf("remaining-cpu-time = %v, want to drain while bursting", got)
+	}
+
+	// the change of the machine type refills the budget and stops bursting
+	if err := srv.SetInstance(fakemetadata.Instance{Zone: "us-central1-a", MachineType: "e2-small"}); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if got := getText(t, srv, "instance/remaining-cpu-time"); got != "60.000" {
+		t.Fatalf("remaining-cpu-time after the machine type change = %q, want %q", got, "60.000")
+	}
+
+	// and the non-shared-core machine type has no budget
+	if err := srv.SetInstance(fakemetadata.Instance{Zone: "us-central1-a", MachineType: "n2-standard-2"}); err != nil {
+		t.Fatal(err)
+	}
+	if resp := get(t, srv, "instance/remaining-cpu-time"); resp.status != http.StatusNotFound {
+		t.Fatalf("status after the change to the non-shared-core machine type = %d, want %d", resp.status, http.StatusNotFound)
+	}
+}
@@ -20,8 +20,16 @@ type metadataFlavorInterceptor struct{}
 
 var _ safehttp.Interceptor = metadataFlavorInterceptor{}
 
+// noMetadataFlavor is the configuration of metadataFlavorInterceptor for the handlers which are not the metadata,
+// such as the identity token signing certificates. The requests to them do not require the Metadata-Flavor header.
+type noMetadataFlavor struct{}
+
 // Before implements safehttp.Interceptor.Before.
 func (metadataFlavorInterceptor) Before(w safehttp.ResponseWriter, r *safehttp.IncomingRequest, cfg safehttp.InterceptorConfig) safehttp.Result {
+	if _, ok := cfg.(noMetadataFlavor); ok {
+		return safehttp.NotWritten()
+	}
+
 	metadataFlavor := r.Header.Get(MetadataFlavorHeader)
 	if !strings.EqualFold(metadataFlavor, MetadataFlavorValue) {
 		return w.Write(safehtml.HTMLEscaped(fmt.Sprintf("%s header is wrong: %s", MetadataFlavorHeader, metadataFlavor)))
@@ -32,15 +40,20 @@ func (metadataFlavorInterceptor) Before(w safehttp.ResponseWriter, r *safehttp.I
 
 // Commit claims and sets the following headers:
 //   - Metadata-Flavor: Google
-func (metadataFlavorInterceptor) Commit(w safehttp.ResponseHeadersWriter, r *safehttp.IncomingRequest, _ safehttp.Response, _ safehttp.InterceptorConfig) {
+func (metadataFlavorInterceptor) Commit(w safehttp.ResponseHeadersWriter, r *safehttp.IncomingRequest, _ safehttp.Response, cfg safehttp.InterceptorConfig) {
+	if _, ok := cfg.(noMetadataFlavor); ok {
+		return
+	}
+
 	h := w.Header()
 	setMetadataFlavor := h.Claim(MetadataFlavorHeader)
 	setMetadataFlavor([]string{MetadataFlavorValue})
 }
 
-// Match returns false since there are no supported configurations.
-func (metadataFlavorInterceptor) Match(safehttp.InterceptorConfig) bool {
-	return false
+// Match reports whether cfg is noMetadataFlavor.
+func (metadataFlavorInterceptor) Match(cfg safehttp.InterceptorConfig) bool {
+	_, ok := cfg.(noMetadataFlavor)
+	return ok
 }
 
 const (
@@ -0,0 +1,309 @@
+// Copyright 2022 The compute-metadata-server Authors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package fakemetadata
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	json "github.com/goccy/go-json"
+)
+
+// GuestInventoryNamespace is the guest attributes namespace which stores the OS inventory.
+const GuestInventoryNamespace = "guestInventory"
+
+// DefaultOSConfigAgentVersion is the OSConfigAgentVersion served when the GuestInventory has no agent version.
+const DefaultOSConfigAgentVersion = "20241003.00-g1"
+
+// List of the local system files read by the guest inventory.
+var (
+	osReleasePath  = "/etc/os-release"
+	dpkgStatusPath = "/var/lib/dpkg/status"
+)
+
+// GuestInventory represents the OS inventory which the OS Config agent publishes to the guestInventory guest attributes.
+//
+// The empty fields are derived from the local system.
+//
+// See: https://cloud.google.com/compute/docs/instances/os-inventory-management
+type GuestInventory struct {
+	// Hostname is the hostname of the VM. If empty, the Instance.Name is used, or os.Hostname if the instance has no name.
+	Hostname string
+
+	// LongName is the full name of the operating system. If empty, PRETTY_NAME of /etc/os-release is used.
+	LongName string
+
+	// ShortName is the short name of the operating system. If empty, ID of /etc/os-release is used.
+	ShortName string
+
+	// Version is the version of the operating system. If empty, VERSION_ID of /etc/os-release is used.
+	Version string
+
+	// Architecture is the architecture of the operating system. If empty, the machine of uname is used.
+	Architecture string
+
+	// KernelVersion is the kernel version. If empty, the version of uname is used.
+	KernelVersion string
+
+	// KernelRelease is the kernel release. If empty, the release of uname is used.
+	KernelRelease string
+
+	// OSConfigAgentVersion is the version of the OS Config agent. If empty, DefaultOSConfigAgentVersion is used.
+	OSConfigAgentVersion string
+
+	// InstalledPackages is the map of the package manager name, such as "deb" or "rpm", to the installed packages.
+	//
+	// If nil, the installed packages are read from the dpkg and rpm databases.
+	InstalledPackages map[string][]Package
+}
+
+// Package represents an installed package of the OS inventory.
+type Package struct {
+	Name    string
+	Arch    string
+	Version string
+}
+
+// withDefaults returns the copy of inv with the empty fields derived from the local system.
+func (inv GuestInventory) withDefaults() GuestInventory {
+	if inv.Hostname == "" {
+		inv.Hostname, _ = os.Hostname()
+	}
+
+	osRelease := readOSRelease(osReleasePath)
+	if inv.LongName == "" {
+		inv.LongName = osRelease["PRETTY_NAME"]
+	}
+	if inv.ShortName == "" {
+		inv.ShortName = osRelease["ID"]
+	}
+	if inv.Version == "" {
+		inv.Version = osRelease["VERSION_ID"]
+	}
+
+	machine, release, version := uname()
+	if inv.Architecture == "" {
+		inv.Architecture = machine
+	}
+	if inv.KernelRelease == "" {
+		inv.KernelRelease = release
+	}
+	if inv.KernelVersion == "" {
+		inv.KernelVersion = version
+	}
+
+	if inv.OSConfigAgentVersion == "" {
+		inv.OSConfigAgentVersion = DefaultOSConfigAgentVersion
+	}
+	if inv.InstalledPackages == nil {
+		inv.InstalledPackages = make(map[string][]Package)
+		if pkgs := readDpkgStatus(dpkgStatusPath); len(pkgs) > 0 {
+			inv.InstalledPackages["deb"] = pkgs
+		}
+		if pkgs := queryRPM(); len(pkgs) > 0 {
+			inv.InstalledPackages["rpm"] = pkgs
+		}
+	}
+
+	return inv
+}
+
+// attributes returns the guest attributes of inv in the same format as the OS Config agent publishes.
+func (inv GuestInventory) attributes(now time.Time) (map[string]string, error) {
+	pkgs, err := encodeInstalledPackages(inv.InstalledPackages)
+	if err != nil {
+		return nil, err
+	}
+
+	return map[string]string{
+		"Hostname":             inv.Hostname,
+		"LongName":             inv.LongName,
+		"ShortName":            inv.ShortName,
+		"Version":              inv.Version,
+		"Architecture":         inv.Architecture,
+		"KernelVersion":        inv.KernelVersion,
+		"KernelRelease":        inv.KernelRelease,
+		"OSConfigAgentVersion": inv.OSConfigAgentVersion,
+		"InstalledPackages":    pkgs,
+		"LastUpdated":          now.UTC().Format(time.RFC3339),
+	}, nil
+}
+
+// encodeInstalledPackages encodes pkgs to the gzip compressed and base64 encoded JSON.
+func encodeInstalledPackages(pkgs map[string][]Package) (string, error) {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if err := json.NewEncoder(zw).Encode(pkgs); err != nil {
+		return "", fmt.Errorf("could not encode installed packages: %w", err)
+	}
+	if err := zw.Close(); err != nil {
+		return "", fmt.Errorf("could not compress installed packages: %w", err)
+	}
+
+	return base64.StdEncoding.EncodeToString(buf.Bytes()), nil
+}
+
+// readOSRelease parses the os-release(5) file. It returns an empty map if the file is not readable.
+func readOSRelease(filename string) map[string]string {
+	m := make(map[string]string)
+
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return m
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		key, val, ok := strings.Cut(strings.TrimSpace(line), "=")
+		if !ok || strings.HasPrefix(key, "#") {
+			continue
+		}
+		if unquoted, err := strconv.Unquote(val); err == nil {
+			val = unquoted
+		} else {
+			val = strings.Trim(val, `'"`)
+		}
+		m[key] = val
+	}
+
+	return m
+}
+
+// readDpkgStatus returns the installed packages in the dpkg status database. It returns nil if the file is not readable.
+func readDpkgStatus(filename string) []Package {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+
+	var (
+		pkgs      []Package
+		pkg       Package
+		installed bool
+	)
+	flush := func() {
+		if installed && pkg.Name != "" {
+			pkgs = append(pkgs, pkg)
+		}
+		pkg, installed = Package{}, false
+	}
+
+	sc := bufio.NewScanner(f)
+	sc.Buffer(make([]byte, 64*1024), 1024*1024)
+	for sc.Scan() {
+		line := sc.Text()
+		if line == "" {
+			flush()
+			continue
+		}
+
+		key, val, ok := strings.Cut(line, ": ")
+		if !ok {
+			continue
+		}
+		switch key {
+		case "Package":
+			pkg.Name = val
+		case "Architecture":
+			pkg.Arch = val
+		case "Version":
+			pkg.Version = val
+		case "Status":
+			installed = strings.HasSuffix(val, " installed")
+		}
+	}
+	flush()
+
+	return pkgs
+}
+
+// queryRPM returns the installed packages in the rpm database. It returns nil if rpm command is not available.
+func queryRPM() []Package {
+	if _, err := exec.LookPath("rpm"); err != nil {
+		return nil
+	}
+
+	out, err := exec.Command("rpm", "--query", "--all", "--queryformat", `%{NAME} %{ARCH} %|EPOCH?{%{EPOCH}:}:{}|%{VERSION}-%{RELEASE}\n`).Output()
+	if err != nil {
+		return nil
+	}
+
+	var pkgs []Package
+	for _, line := range strings.Split(string(out), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 3 {
+			continue
+		}
+		pkgs = append(pkgs, Package{Name: fields[0], Arch: fields[1], Version: fields[2]})
+	}
+
+	return pkgs
+}
+
+// guestInventory holds the OS inventory published to the guestInventory guest attributes namespace.
+//
+// The zero value is valid and ready to use, and derives the OS inventory from the local system on first publish.
+type guestInventory struct {
+	mu        sync.Mutex // guard of below fields
+	inv       GuestInventory
+	published bool
+}
+
+// publishGuestInventory publishes the OS inventory to the guestInventory guest attributes namespace once,
+// same as the OS Config agent publishes the OS inventory on start.
+func (h *InstanceHandler) publishGuestInventory() error {
+	h.guestInventory.mu.Lock()
+	defer h.guestInventory.mu.Unlock()
+
+	if h.guestInventory.published {
+		return nil
+	}
+
+	inv := h.guestInventory.inv
+	if inv.Hostname == "" {
+		// the guest sees the instance name as its hostname
+		inv.Hostname = h.model().name()
+	}
+	attrs, err := inv.withDefaults().attributes(time.Now())
+	if err != nil {
+		return err
+	}
+
+	h.guestAttributes.deleteNamespace(GuestInventoryNamespace)
+	for key, val := range attrs {
+		h.guestAttributes.set(GuestInventoryNamespace, key, val)
+	}
+	h.guestInventory.published = true
+
+	return nil
+}
+
+// unpublishGuestInventory deletes the published OS inventory from the guestInventory guest attributes namespace,
+// same as the OS inventory disappears after the OS Config agent stops reporting it.
+func (h *InstanceHandler) unpublishGuestInventory() {
+	h.guestInventory.mu.Lock()
+	defer h.guestInventory.mu.Unlock()
+
+	if !h.guestInventory.published {
+		return
+	}
+	h.guestAttributes.deleteNamespace(GuestInventoryNamespace)
+	h.guestInventory.published = false
+}
+
+// setGuestInventory replaces the OS inventory with inv and republishes it on next access.
+func (h *InstanceHandler) setGuestInventory(inv GuestInventory) {
+	h.guestInventory.mu.Lock()
+	h.guestInventory.inv = inv
+	h.guestInventory.published = false
+	h.guestInventory.mu.Unlock()
+}
@@ -0,0 +1,17 @@
+// Copyright 2022 The compute-metadata-server Authors
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build !unix
+
+package fakemetadata
+
+import (
+	"runtime"
+)
+
+// uname returns the machine, release and version of the running kernel.
+//
+// Only the machine is available on non-unix systems.
+func uname() (machine, release, version string) {
+	return runtime.GOARCH, "", ""
+}
@@ -0,0 +1,177 @@
+// Copyright 2022 The compute-metadata-server Authors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package fakemetadata
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	json "github.com/goccy/go-json"
+)
+
+func TestReadOSRelease(t *testing.T) {
+	const osRelease = `# comment
+PRETTY_NAME="Debian GNU/Linux 12 (bookworm)"
+NAME='Debian GNU/Linux'
+VERSION_ID="12"
+ID=debian
+HOME_URL="https://www.debian.org/"
+
+INVALID LINE
+`
+	filename := filepath.Join(t.TempDir(), "os-release")
+	if err := os.WriteFile(filename, []byte(osRelease), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]string{
+		"PRETTY_NAME": "Debian GNU/Linux 12 (bookworm)",
+		"NAME":        "Debian GNU/Linux",
+		"VERSION_ID":  "12",
+		"ID":          "debian",
+		"HOME_URL":    "https://www.debian.org/",
+	}
+	if got := readOSRelease(filename); !reflect.DeepEqual(got, want) {
+		t.Fatalf("readOSRelease = %v, want %v", got, want)
+	}
+
+	if got := readOSRelease(filepath.Join(t.TempDir(), "missing")); len(got) != 0 {
+		t.Fatalf("readOSRelease of the missing file = %v, want empty", got)
+	}
+}
+
+func TestReadDpkgStatus(t *testing.T) {
+	const status = `Package: bash
+Status: install ok installed
+Priority: required
+Architecture: amd64
+Version: 5.2.15-2+b7
+Description: GNU Bourne Again SHell
+ Bash is an sh-compatible command language interpreter.
+
+Package: removed
+Status: deinstall ok config-files
+Architecture: amd64
+Version: 1.0-1
+
+Package: tzdata
+Status: install ok installed
+Architecture: all
+Version: 2024a-0+deb12u1`
+	filename := filepath.Join(t.TempDir(), "status")
+	if err := os.WriteFile(filename, []byte(status), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []Package{
+		{Name: "bash", Arch: "amd64", Version: "5.2.15-2+b7"},
+		{Name: "tzdata", Arch: "all", Version: "2024a-0+deb12u1"},
+	}
+	if got := readDpkgStatus(filename); !reflect.DeepEqual(got, want) {
+		t.Fatalf("readDpkgStatus = %v, want %v", got, want)
+	}
+
+	if got := readDpkgStatus(filepath.Join(t.TempDir(), "missing")); got != nil {
+		t.Fatalf("readDpkgStatus of the missing file = %v, want nil", got)
+	}
+}
+
+func TestEncodeInstalledPackages(t *testing.T) {
+	pkgs := map[string][]Package{
+		"deb": {{Name: "bash", Arch: "amd64", Version: "5.2.15-2+b7"}},
+		"rpm": {{Name: "kernel", Arch: "x86_64", Version: "5.14.0-362.el9"}},
+	}
+	encoded, err := encodeInstalledPackages(pkgs)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the value is gzip compressed and base64 encoded JSON, same as the OS Config agent publishes
+	data, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	zr, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got map[string][]Package
+	if err := json.NewDecoder(zr).Decode(&got); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, pkgs) {
+		t.Fatalf("decoded installed packages = %v, want %v", got, pkgs)
+	}
+}
+
+func TestGuestInventoryHostname(t *testing.T) {
+	srv := NewServer()
+	t.Cleanup(func() { srv.Close() })
+
+	inst := Instance{
+		Name:       "vm-1",
+		Attributes: map[string]string{"enable-guest-attributes": "TRUE", "enable-os-inventory": "TRUE"},
+	}
+	if err := srv.SetInstance(inst); err != nil {
+		t.Fatal(err)
+	}
+	srv.SetGuestInventory(GuestInventory{InstalledPackages: map[string][]Package{}})
+
+	check := func(want string) {
+		t.Helper()
+
+		got, ok, err := srv.GuestAttribute(GuestInventoryNamespace, "Hostname")
+		if err != nil || !ok || got != want {
+			t.Fatalf("Hostname = %q, %t, %v, want %q", got, ok, err, want)
+		}
+	}
+
+	// the instance name is the hostname of the guest
+	check("vm-1")
+
+	// and the configured hostname takes precedence
+	srv.SetGuestInventory(GuestInventory{Hostname: "my-host", InstalledPackages: map[string][]Package{}})
+	check("my-host")
+}
+
+func TestGuestInventoryToggle(t *testing.T) {
+	srv := NewServer()
+	t.Cleanup(func() { srv.Close() })
+
+	setOSInventory := func(enabled string) {
+		t.Helper()
+
+		inst := Instance{
+			Name:       "vm-1",
+			Attributes: map[string]string{"enable-guest-attributes": "TRUE", "enable-os-inventory": enabled},
+		}
+		if err := srv.SetInstance(inst); err != nil {
+			t.Fatal(err)
+		}
+	}
+	check := func(want bool) {
+		t.Helper()
+
+		if _, ok, err := srv.GuestAttribute(GuestInventoryNamespace, "Hostname"); err != nil || ok != want {
+			t.Fatalf("Hostname published = %t, %v, want %t", ok, err, want)
+		}
+	}
+	srv.SetGuestInventory(GuestInventory{InstalledPackages: map[string][]Package{}})
+
+	setOSInventory("TRUE")
+	check(true)
+
+	// the OS inventory is unpublished once enable-os-inventory is turned off
+	setOSInventory("FALSE")
+	check(false)
+
+	// and republished once it is turned on again
+	setOSInventory("TRUE")
+	check(true)
+}
@@ -0,0 +1,20 @@
+// Copyright 2022 The compute-metadata-server Authors
+// SPDX-License-Identifier: BSD-3-Clause
+
+//go:build unix
+
+package fakemetadata
+
+import (
+	"golang.org/x/sys/unix"
+)
+
+// uname returns the machine, release and version of the running kernel.
+func uname() (machine, release, version string) {
+	var uts unix.Utsname
+	if err := unix.Uname(&uts); err != nil {
+		return "", "", ""
+	}
+
+	return unix.ByteSliceToString(uts.Machine[:]), unix.ByteSliceToString(uts.Release[:]), unix.ByteSliceToString(uts.Version[:])
+}
@@ -0,0 +1,115 @@
+// Copyright 2022 The compute-metadata-server Authors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package fakemetadata
+
+import (
+	_ "embed"
+	"fmt"
+	"slices"
+	"sync"
+
+	json "github.com/goccy/go-json"
+)
+
+// machineTypesJSON is the embedded machine type catalog.
+//
+// The catalog is a subset of the output of "gcloud compute machine-types list".
+//
+//go:embed machinetypes.json
+var machineTypesJSON []byte
+
+// MachineFamily represents a machine family such as "e2" or "n2".
+type MachineFamily struct {
+	// Name is the machine family name.
+	Name string `json:"name"`
+
+	// CPUPlatforms is the list of CPU platforms the machine family is available on.
+	// The first element is the default CPU platform of the family.
+	CPUPlatforms []string `json:"cpuPlatforms"`
+
+	// Zones is the list of zones that offer the machine family.
+	Zones []string `json:"zones"`
+
+	// MachineTypes is the list of predefined machine types of the family.
+	MachineTypes []MachineTypeInfo `json:"machineTypes"`
+}
+
+// MachineTypeInfo represents a predefined machine type.
+type MachineTypeInfo struct {
+	// Name is the machine type name. e.g. "e2-standard-2".
+	Name string `json:"name"`
+
+	// Family is the machine family name. e.g. "e2".
+	Family string `json:"-"`
+
+	// GuestCPUs is the number of virtual CPUs that are available to the instance.
+	GuestCPUs int `json:"guestCpus"`
+
+	// MemoryMB is the amount of physical memory available to the instance, defined in MB.
+	MemoryMB int `json:"memoryMb"`
+
+	// SharedCPU reports whether the machine type is a shared-core machine type.
+	SharedCPU bool `json:"sharedCpu,omitempty"`
+
+	// BaselineCPUs is the sustained number of vCPUs of the shared-core machine type.
+	// The shared-core machine type can burst up to GuestCPUs while the CPU burst budget remains.
+	BaselineCPUs float64 `json:"baselineCpus,omitempty"`
+
+	// CPUPlatforms is the list of CPU platforms the machine type is available on.
+	CPUPlatforms []string `json:"-"`
+
+	// Zones is the list of zones that offer the machine type.
+	Zones []string `json:"-"`
+}
+
+// AvailableIn reports whether the zone offers the machine type.
+func (mt MachineTypeInfo) AvailableIn(zone string) bool {
+	return slices.Contains(mt.Zones, zone)
+}
+
+// SupportsCPUPlatform reports whether the machine type is available on the platform CPU platform.
+func (mt MachineTypeInfo) SupportsCPUPlatform(platform string) bool {
+	return slices.Contains(mt.CPUPlatforms, platform)
+}
+
+var (
+	machineTypesOnce sync.Once
+	machineFamilies  []MachineFamily
+	machineTypes     map[string]MachineTypeInfo
+)
+
+func loadMachineTypes() {
+	var catalog struct {
+		Families []MachineFamily `json:"families"`
+	}
+	if err := json.Unmarshal(machineTypesJSON, &catalog); err != nil {
+		panic(fmt.Sprintf("could not parse embedded machine type catalog: %v", err))
+	}
+
+	machineFamilies = catalog.Families
+	machineTypes = make(map[string]MachineTypeInfo)
+	for _, fam := range machineFamilies {
+		for _, mt := range fam.MachineTypes {
+			mt.Family = fam.Name
+			mt.CPUPlatforms = fam.CPUPlatforms
+			mt.Zones = fam.Zones
+			machineTypes[mt.Name] = mt
+		}
+	}
+}
+
+// MachineFamilies returns the machine families of the embedded machine type catalog.
+func MachineFamilies() []MachineFamily {
+	machineTypesOnce.Do(loadMachineTypes)
+
+	return slices.Clone(machineFamilies)
+}
+
+// LookupMachineType returns the machine type named name from the embedded machine type catalog.
+func LookupMachineType(name string) (MachineTypeInfo, bool) {
+	machineTypesOnce.Do(loadMachineTypes)
+
+	mt, ok := machineTypes[name]
+	return mt, ok
+}
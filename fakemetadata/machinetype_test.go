@@ -0,0 +1,106 @@
+// Copyright 2022 The compute-metadata-server Authors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package fakemetadata_test
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/zchee/compute-metadata-server/fakemetadata"
+)
+
+func TestLookupMachineType(t *testing.T) {
+	mt, ok := fakemetadata.LookupMachineType("e2-micro")
+	if !ok {
+		t.Fatal("e2-micro not found")
+	}
+	if mt.Family != "e2" || !mt.SharedCPU || mt.GuestCPUs != 2 {
+		t.Fatalf("unexpected e2-micro: %+v", mt)
+	}
+
+	if _, ok := fakemetadata.LookupMachineType("e2-unknown-1"); ok {
+		t.Fatal("expected e2-unknown-1 not found")
+	}
+}
+
+func TestCPUPlatforms(t *testing.T) {
+	platforms := make(map[string]bool)
+	for arch := fakemetadata.X86_UNKNOWN; arch <= fakemetadata.AMD_ZEN4; arch++ {
+		if p := arch.Platform(); p != "" {
+			platforms[p] = true
+		}
+	}
+
+	// every x86 CPU platform of the catalog can be derived from the host CPU
+	for _, fam := range fakemetadata.MachineFamilies() {
+		for _, p := range fam.CPUPlatforms {
+			if strings.HasPrefix(p, "Ampere ") {
+				continue
+			}
+			if !platforms[p] {
+				t.Errorf("CPU platform %q of %s family has no microarchitecture", p, fam.Name)
+			}
+		}
+	}
+}
+
+func TestMachineTypeHandler(t *testing.T) {
+	srv := startServer(t)
+
+	if resp := get(t, srv, "instance/machine-type"); resp.status != http.StatusNotFound {
+		t.Fatalf("status without machine type = %d, want %d", resp.status, http.StatusNotFound)
+	}
+
+	if err := srv.SetProject(fakemetadata.Project{ProjectID: "my-project", NumericProjectID: 123456789012}); err != nil {
+		t.Fatal(err)
+	}
+	if err := srv.SetInstance(fakemetadata.Instance{Zone: "us-central1-a", MachineType: "c2-standard-4"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if got, want := getText(t, srv, "instance/machine-type"), "projects/123456789012/machineTypes/c2-standard-4"; got != want {
+		t.Fatalf("machine-type = %q, want %q", got, want)
+	}
+	// c2 family is offered only on Cascade Lake
+	if got, want := getText(t, srv, "instance/cpu-platform"), "Intel Cascade Lake"; got != want {
+		t.Fatalf("cpu-platform = %q, want %q", got, want)
+	}
+}
+
+func TestInstanceValidate(t *testing.T) {
+	tests := map[string]struct {
+		inst    fakemetadata.Instance
+		wantErr bool
+	}{
+		"Empty": {
+			inst: fakemetadata.Instance{},
+		},
+		"Available": {
+			inst: fakemetadata.Instance{Zone: "us-central1-a", MachineType: "n2-standard-4"},
+		},
+		"UnknownMachineType": {
+			inst:    fakemetadata.Instance{Zone: "us-central1-a", MachineType: "n9-standard-4"},
+			wantErr: true,
+		},
+		"UnavailableZone": {
+			inst:    fakemetadata.Instance{Zone: "us-central1-f", MachineType: "n2-standard-4"},
+			wantErr: true,
+		},
+		"CPUPlatform": {
+			inst: fakemetadata.Instance{Zone: "us-central1-a", MachineType: "n2d-standard-2", CPUPlatform: "AMD Milan"},
+		},
+		"MismatchCPUPlatform": {
+			inst:    fakemetadata.Instance{Zone: "us-central1-a", MachineType: "n2d-standard-2", CPUPlatform: "Intel Ice Lake"},
+			wantErr: true,
+		},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			if err := tt.inst.Validate(); (err != nil) != tt.wantErr {
+				t.Fatalf("Validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
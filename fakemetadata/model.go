@@ -0,0 +1,368 @@
+// Copyright 2022 The compute-metadata-server Authors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package fakemetadata
+
+import (
+	"fmt"
+	"hash/fnv"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	cpuid "github.com/klauspost/cpuid/v2"
+)
+
+// List of vmdnssetting attribute values.
+//
+// See: https://cloud.google.com/compute/docs/internal-dns
+const (
+	// VMDNSSettingZonalOnly uses zonal DNS names only.
+	VMDNSSettingZonalOnly = "ZonalOnly"
+
+	// VMDNSSettingZonalPreferred uses zonal DNS names and falls back to global DNS names.
+	VMDNSSettingZonalPreferred = "ZonalPreferred"
+
+	// VMDNSSettingGlobalOnly uses global DNS names only.
+	VMDNSSettingGlobalOnly = "GlobalOnly"
+
+	// VMDNSSettingGlobalDefault uses global DNS names, which is the default of the projects created before September 6, 2018.
+	VMDNSSettingGlobalDefault = "GlobalDefault"
+)
+
+// DefaultImage is the image served when the Instance has no image.
+const DefaultImage = "projects/debian-cloud/global/images/debian-12-bookworm-v20241009"
+
+// DefaultLicenses is the licenses served when the Instance has neither image nor licenses.
+var DefaultLicenses = []License{
+	{ID: "2147286739765738111", Project: "debian-cloud", Name: "debian-12-bookworm"},
+}
+
+// License represents a license attached to the boot disk of the VM.
+type License struct {
+	// ID is the numeric license code. e.g. "2147286739765738111".
+	ID string
+
+	// Project is the project that owns the license. e.g. "debian-cloud".
+	Project string
+
+	// Name is the license name. e.g. "debian-12-bookworm".
+	Name string
+}
+
+// rfc1035Re matches to the RFC 1035 label which is used for the VM name and network tags.
+var rfc1035Re = regexp.MustCompile(`^[a-z]([-a-z0-9]{0,61}[a-z0-9])?$`)
+
+// Instance represents the VM instance model served by the InstanceHandler.
+//
+// The empty fields fall back to the corresponding environment variables, if any.
+type Instance struct {
+	// Name is the name of the VM. It must be a RFC 1035 label. e.g. "instance-1".
+	//
+	// If empty, the value of GOOGLE_INSTANCE_NAME environment variable is used instead.
+	Name string
+
+	// ID is the unique numerical ID of the VM.
+	//
+	// If zero, the ID is derived from the project ID, zone and Name so that it is stable across server restarts.
+	ID uint64
+
+	// Description is the free-text description of the VM.
+	Description string
+
+	// Image is the operating system image used by the VM. e.g. "projects/debian-cloud/global/images/debian-12-bookworm-v20241009".
+	//
+	// If empty, DefaultImage is used instead.
+	Image string
+
+	// Licenses is the list of licenses attached to the boot disk of the VM.
+	//
+	// If nil and Image is empty, DefaultLicenses is used instead.
+	Licenses []License
+
+	// Tags is the list of network tags associated with the VM.
+	Tags []string
+
+	// Attributes is the custom metadata attributes of the VM. e.g. {"enable-guest-attributes": "TRUE"}
+	//
+	// The instance attributes shadow the project attributes of the same key.
+	Attributes map[string]string
+
+	// Zone is the zone name where the VM is located. e.g. "us-central1-a".
+	//
+	// If empty, the value of GOOGLE_INSTANCE_ZONE environment variable is used instead.
+	Zone string
+
+	// MachineType is the machine type name of the VM. e.g. "e2-standard-2".
+	//
+	// The machine type must be listed in the embedded machine type catalog and be offered in Zone.
+	MachineType string
+
+	// CPUPlatform is the CPU platform of the VM. e.g. "Intel Cascade Lake".
+	//
+	// If empty, the CPU platform is derived from the machine family of MachineType.
+	CPUPlatform string
+
+	// GKENodePool is the GKE node pool which the VM belongs to, if the VM is a GKE node.
+	//
+	// The GKE node attributes are derived from the node pool. The same key of Attributes shadows the derived attribute.
+	GKENodePool *GKENodePool
+
+	// CreationTimestamp is the creation time of the VM.
+	//
+	// If zero, the creation time of the fake metadata server is used.
+	CreationTimestamp time.Time
+
+	// ConfidentialCompute reports whether the VM is a Confidential VM.
+	ConfidentialCompute bool
+
+	// PartnerMetadata is the map of the partner metadata namespace to the entries of the namespace.
+	// e.g. {"test.compute.googleapis.com": {"config": {"enabled": true}}}
+	//
+	// The namespace must be a subdomain of googleapis.com, and the entry values must be encodable to JSON.
+	PartnerMetadata map[string]map[string]any
+
+	// ServiceAccounts is the list of the service accounts attached to the VM.
+	//
+	// If empty, the default service account is taken from GOOGLE_ACCOUNT_EMAIL environment variable,
+	// the application default credentials, or the Compute Engine default service account of the project.
+	ServiceAccounts []ServiceAccount
+}
+
+// Validate reports an error if inst is not a valid instance configuration.
+func (inst Instance) Validate() error {
+	if inst.Name != "" && !rfc1035Re.MatchString(inst.Name) {
+		return fmt.Errorf("name %q must be a RFC 1035 label", inst.Name)
+	}
+	for _, tag := range inst.Tags {
+		if !rfc1035Re.MatchString(tag) {
+			return fmt.Errorf("network tag %q must be a RFC 1035 label", tag)
+		}
+	}
+	if err := validateAttributes(inst.Attributes); err != nil {
+		return err
+	}
+	if err := validatePartnerMetadata(inst.PartnerMetadata); err != nil {
+		return err
+	}
+	if err := validateServiceAccounts(inst.ServiceAccounts); err != nil {
+		return err
+	}
+	if inst.GKENodePool != nil {
+		if err := inst.GKENodePool.Validate(); err != nil {
+			return fmt.Errorf("invalid GKE node pool: %w", err)
+		}
+	}
+
+	if inst.MachineType == "" {
+		if inst.CPUPlatform != "" {
+			return fmt.Errorf("cpu platform %q requires machine type", inst.CPUPlatform)
+		}
+		return nil
+	}
+
+	mt, ok := LookupMachineType(inst.MachineType)
+	if !ok {
+		return fmt.Errorf("unknown machine type %q", inst.MachineType)
+	}
+	if zone := inst.zone(); zone != "" && !mt.AvailableIn(zone) {
+		return fmt.Errorf("machine type %q is not available in zone %q", mt.Name, zone)
+	}
+	if inst.CPUPlatform != "" && !mt.SupportsCPUPlatform(inst.CPUPlatform) {
+		return fmt.Errorf("cpu platform %q is not available for %s machine family", inst.CPUPlatform, mt.Family)
+	}
+
+	return nil
+}
+
+func (inst Instance) name() string {
+	if inst.Name != "" {
+		return inst.Name
+	}
+
+	return os.Getenv(EnvInstanceName)
+}
+
+// id returns the numerical ID of the instance.
+//
+// If inst has no ID, the ID is derived from the FNV-1a hash of projectID, zone and name.
+func (inst Instance) id(projectID string) string {
+	if inst.ID != 0 {
+		return strconv.FormatUint(inst.ID, 10)
+	}
+
+	h := fnv.New64a()
+	h.Write([]byte(projectID + "/" + inst.zone() + "/" + inst.name()))
+	return strconv.FormatUint(h.Sum64(), 10)
+}
+
+// hostname returns the internal DNS name of the instance.
+//
+// The format of the hostname depends on vmdnssetting, and the zonal DNS name is used if vmdnssetting is empty:
+//
+//	ZonalOnly, ZonalPreferred: NAME.ZONE.c.PROJECT_ID.internal
+//	GlobalOnly, GlobalDefault: NAME.c.PROJECT_ID.internal
+func (inst Instance) hostname(projectID, vmdnssetting string) string {
+	switch vmdnssetting {
+	case VMDNSSettingGlobalOnly, VMDNSSettingGlobalDefault:
+		return fmt.Sprintf("%s.c.%s.internal", inst.name(), projectID)
+	}
+
+	return fmt.Sprintf("%s.%s.c.%s.internal", inst.name(), inst.zone(), projectID)
+}
+
+func (inst Instance) image() string {
+	if inst.Image != "" {
+		return inst.Image
+	}
+
+	return DefaultImage
+}
+
+func (inst Instance) licenses() []License {
+	if inst.Licenses == nil && inst.Image == "" {
+		return DefaultLicenses
+	}
+
+	return inst.Licenses
+}
+
+// region returns the region of the instance which is derived from the zone.
+//
+// The EnvGoogleInstanceRegion environment variable is used only if the model has no zone, so the zone and region never disagree.
+func (inst Instance) region() string {
+	if region, ok := os.LookupEnv(EnvGoogleInstanceRegion); ok && inst.Zone == "" {
+		return region
+	}
+
+	zone := inst.zone()
+	if i := strings.LastIndexByte(zone, '-'); i > 0 {
+		return zone[:i]
+	}
+
+	return ""
+}
+
+func (inst Instance) zone() string {
+	if inst.Zone != "" {
+		return inst.Zone
+	}
+
+	return os.Getenv(EnvGoogleInstanceZone)
+}
+
+// cpuPlatform returns the CPU platform of the instance.
+//
+// If the host CPU platform is available for the machine family it is used, otherwise the default CPU platform of the machine family is used.
+func (inst Instance) cpuPlatform() string {
+	if inst.CPUPlatform != "" {
+		return inst.CPUPlatform
+	}
+
+	arch := detectCPUMicroarchitecture(cpuid.CPU)
+	mt, ok := LookupMachineType(inst.MachineType)
+	if !ok {
+		return arch.String()
+	}
+	if platform := arch.Platform(); mt.SupportsCPUPlatform(platform) {
+		return platform
+	}
+
+	return mt.CPUPlatforms[0]
+}
+
+// projectIDRe matches to the project ID, including the domain-scoped project ID. e.g. "example.com:my-project"
+var projectIDRe = regexp.MustCompile(`^([a-z0-9.-]+:)?[a-z][-a-z0-9]{4,28}[a-z0-9]$`)
+
+// Project represents the project model served by the ProjectHandler.
+//
+// The empty fields fall back to the corresponding environment variables, if any.
+type Project struct {
+	// ProjectID is the project ID. e.g. "my-project".
+	//
+	// If empty, the value of GOOGLE_CLOUD_PROJECT, GCP_PROJECT or GOOGLE_GCP_PROJECT environment variable is used instead.
+	ProjectID string
+
+	// NumericProjectID is the numeric project ID (project number).
+	//
+	// If zero, the value of GOOGLE_CLOUD_NUMERIC_PROJECT, GCP_NUMERIC_PROJECT or GOOGLE_GCP_NUMERIC_PROJECT environment variable is used instead.
+	NumericProjectID int64
+
+	// Attributes is the custom metadata attributes of the project. e.g. {"enable-oslogin": "TRUE"}
+	//
+	// The project attributes are inherited by the instance unless the instance has the attribute of the same key.
+	Attributes map[string]string
+}
+
+// Validate reports an error if p is not a valid project configuration.
+func (p Project) Validate() error {
+	if p.ProjectID != "" && !projectIDRe.MatchString(p.ProjectID) {
+		return fmt.Errorf("invalid project ID %q", p.ProjectID)
+	}
+	if p.NumericProjectID < 0 {
+		return fmt.Errorf("invalid numeric project ID %d", p.NumericProjectID)
+	}
+
+	return validateAttributes(p.Attributes)
+}
+
+func (p Project) projectID() (string, bool) {
+	if p.ProjectID != "" {
+		return p.ProjectID, true
+	}
+
+	return lookupEnvs(projectEnvs)
+}
+
+func (p Project) numericProjectID() (string, bool) {
+	if p.NumericProjectID != 0 {
+		return strconv.FormatInt(p.NumericProjectID, 10), true
+	}
+
+	return lookupEnvs(numericProjectEnvs)
+}
+
+// MaxAttributeValueLen is the maximum length of the metadata attribute value, in bytes.
+//
+// See: https://cloud.google.com/compute/docs/metadata/setting-custom-metadata#limitations
+const MaxAttributeValueLen = 256 << 10
+
+// attributeKeyRe matches to the valid metadata attribute key.
+var attributeKeyRe = regexp.MustCompile(`^[a-zA-Z0-9_-]{1,128}$`)
+
+// validateAttributes reports an error if attrs has an invalid key or value.
+func validateAttributes(attrs map[string]string) error {
+	for key, val := range attrs {
+		if !attributeKeyRe.MatchString(key) {
+			return fmt.Errorf("attribute key %q must be 1 to 128 letters, numbers, underscores and hyphens", key)
+		}
+		if len(val) > MaxAttributeValueLen {
+			return fmt.Errorf("value of %q attribute exceeds %d bytes", key, MaxAttributeValueLen)
+		}
+	}
+
+	if val, ok := attrs["vmdnssetting"]; ok {
+		switch val {
+		case VMDNSSettingZonalOnly, VMDNSSettingZonalPreferred, VMDNSSettingGlobalOnly, VMDNSSettingGlobalDefault:
+			// nothing to do
+		default:
+			return fmt.Errorf("unknown vmdnssetting %q", val)
+		}
+	}
+
+	return nil
+}
+
+// lookupAttribute returns the value of the key attribute which the guest agents see.
+//
+// The instance attribute shadows the project attribute of the same key.
+func lookupAttribute(inst Instance, proj Project, key string) (string, bool) {
+	if val, ok := inst.Attributes[key]; ok {
+		return val, true
+	}
+
+	val, ok := proj.Attributes[key]
+	return val, ok
+}
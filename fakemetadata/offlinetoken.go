@@ -0,0 +1,213 @@
+// Copyright 2022 The compute-metadata-server Authors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package fakemetadata
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+// DefaultOfflineTokenLifetime is the default lifetime of the offline access tokens.
+const DefaultOfflineTokenLifetime = time.Hour
+
+// OfflineTokens configures the offline token mode, which issues the opaque ya29. access tokens locally
+// instead of fetching them from Google.
+//
+// The offline tokens are not accepted by the Google APIs, but the applications can fetch them and proceed
+// without any Google credentials on the machine.
+type OfflineTokens struct {
+	// Lifetime is the lifetime of the access tokens.
+	//
+	// If zero, DefaultOfflineTokenLifetime is used.
+	Lifetime time.Duration
+
+	// TokenType is the token type of the access tokens.
+	//
+	// If empty, "Bearer" is used.
+	TokenType string
+
+	// Scopes is the list of the scopes granted to the access tokens which are requested without the scopes query parameter.
+	//
+	// If empty, the cloud-platform scope is used.
+	Scopes []string
+}
+
+// Validate reports an error if c is not a valid offline token configuration.
+func (c OfflineTokens) Validate() error {
+	if c.Lifetime < 0 {
+		return fmt.Errorf("lifetime %s must not be negative", c.Lifetime)
+	}
+
+	return nil
+}
+
+func (c OfflineTokens) lifetime() time.Duration {
+	if c.Lifetime != 0 {
+		return c.Lifetime
+	}
+
+	return DefaultOfflineTokenLifetime
+}
+
+func (c OfflineTokens) tokenType() string {
+	if c.TokenType != "" {
+		return c.TokenType
+	}
+
+	return "Bearer"
+}
+
+func (c OfflineTokens) scopes() []string {
+	if len(c.Scopes) != 0 {
+		return c.Scopes
+	}
+
+	return []string{cloudPlatformScope}
+}
+
+// OfflineToken represents the access token issued by the offline token mode.
+type OfflineToken struct {
+	// AccessToken is the opaque access token. e.g. "ya29.XXXX".
+	AccessToken string
+
+	// TokenType is the token type. e.g. "Bearer".
+	TokenType string
+
+	// ServiceAccount is the email address of the service account which the token belongs to.
+	ServiceAccount string
+
+	// Scopes is the list of the scopes granted to the token.
+	Scopes []string
+
+	// Expiry is the expiration time of the token.
+	Expiry time.Time
+}
+
+// offlineTokens issues and records the offline access tokens.
+//
+// The zero value is valid and ready to use, and the offline token mode is disabled.
+type offlineTokens struct {
+	mu     sync.Mutex // guard of below fields
+	cfg    *OfflineTokens
+	issued map[string]OfflineToken // map of the access token to the issued token
+}
+
+// configure enables the offline token mode with cfg, or disables it if cfg is nil.
+func (o *offlineTokens) configure(cfg *OfflineTokens) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	o.cfg = cfg
+	if cfg == nil {
+		o.issued = nil
+	}
+}
+
+// configureIfDisabled configures the offline tokens by cfg only if they are disabled, which is atomic unlike
+// the pair of enabled and configure.
+func (o *offlineTokens) configureIfDisabled(cfg *OfflineTokens) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if o.cfg == nil {
+		o.cfg = cfg
+	}
+}
+
+// enabled reports whether the offline token mode is enabled.
+func (o *offlineTokens) enabled() bool {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	return o.cfg != nil
+}
+
+// errOfflineTokensDisabled is the error of issuing the offline access token while the offline token mode is disabled.
+var errOfflineTokensDisabled = errors.New("offline token mode is disabled")
+
+// issue issues the access token of the service account email with scopes.
+// If scopes is empty, the default scopes of the configuration are granted. If lifetime is zero, the configured lifetime is used.
+func (o *offlineTokens) issue(email string, scopes []string, lifetime time.Duration, now time.Time) (*oauth2.Token, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	cfg := o.cfg
+	if cfg == nil {
+		return nil, errOfflineTokensDisabled
+	}
+
+	b := make([]byte, 48)
+	if _, err := rand.Read(b); err != nil {
+		return nil, fmt.Errorf("could not generate access token: %w", err)
+	}
+	if len(scopes) == 0 {
+		scopes = cfg.scopes()
+	}
+	if lifetime == 0 {
+		lifetime = cfg.lifetime()
+	}
+	tok := OfflineToken{
+		AccessToken:    "ya29." + base64.RawURLEncoding.EncodeToString(b),
+		TokenType:      cfg.tokenType(),
+		ServiceAccount: email,
+		Scopes:         slices.Clone(scopes),
+		Expiry:         now.Add(lifetime),
+	}
+
+	if o.issued == nil {
+		o.issued = make(map[string]OfflineToken)
+	}
+	for key, issued := range o.issued {
+		if !now.Before(issued.Expiry) {
+			delete(o.issued, key)
+		}
+	}
+	o.issued[tok.AccessToken] = tok
+
+	return &oauth2.Token{
+		AccessToken: tok.AccessToken,
+		TokenType:   tok.TokenType,
+		Expiry:      tok.Expiry,
+	}, nil
+}
+
+// lookup returns the issued token of the access token.
+func (o *offlineTokens) lookup(accessToken string) (OfflineToken, bool) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	tok, ok := o.issued[accessToken]
+	return tok, ok
+}
+
+// issueOfflineToken issues the access token of the service account email of BackendOffline with scopes.
+//
+// The token follows the server-wide configuration of the offline token mode if enabled, or the default configuration.
+func (h *InstanceHandler) issueOfflineToken(email string, scopes []string, now time.Time) (*oauth2.Token, error) {
+	tok, err := h.offlineTokens.issue(email, scopes, 0, now)
+	if !errors.Is(err, errOfflineTokensDisabled) {
+		return tok, err
+	}
+
+	h.backendOfflineTokens.configureIfDisabled(&OfflineTokens{})
+
+	return h.backendOfflineTokens.issue(email, scopes, 0, now)
+}
+
+// lookupOfflineToken returns the issued token of the access token, which is issued by the offline token mode
+// or for the service accounts of BackendOffline.
+func (h *InstanceHandler) lookupOfflineToken(accessToken string) (OfflineToken, bool) {
+	if tok, ok := h.offlineTokens.lookup(accessToken); ok {
+		return tok, true
+	}
+
+	return h.backendOfflineTokens.lookup(accessToken)
+}
@@ -0,0 +1,49 @@
+// Copyright 2022 The compute-metadata-server Authors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package fakemetadata_test
+
+import (
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/zchee/compute-metadata-server/fakemetadata"
+)
+
+func TestOfflineTokens(t *testing.T) {
+	t.Setenv("GOOGLE_ACCOUNT_EMAIL", "")
+	t.Setenv("GOOGLE_APPLICATION_CREDENTIALS", "/nonexistent")
+
+	srv := startServer(t)
+
+	if err := srv.SetProject(fakemetadata.Project{ProjectID: "my-project", NumericProjectID: 123456789012}); err != nil {
+		t.Fatal(err)
+	}
+	if err := srv.EnableOfflineTokens(fakemetadata.OfflineTokens{Lifetime: 10 * time.Minute}); err != nil {
+		t.Fatal(err)
+	}
+
+	var tok fakemetadata.TokenResponse
+	getJSON(t, srv, "instance/service-accounts/default/token?scopes=scope1,scope2", &tok)
+	if !strings.HasPrefix(tok.AccessToken, "ya29.") || tok.TokenType != "Bearer" || tok.ExpiresIn != 600 {
+		t.Fatalf("unexpected token: %+v", tok)
+	}
+
+	issued, ok := srv.LookupOfflineToken(tok.AccessToken)
+	if !ok {
+		t.Fatal("issued token is not recorded")
+	}
+	if want := "123456789012-compute@developer.gserviceaccount.com"; issued.ServiceAccount != want {
+		t.Fatalf("ServiceAccount = %q, want %q", issued.ServiceAccount, want)
+	}
+	if want := []string{"scope1", "scope2"}; !slices.Equal(issued.Scopes, want) {
+		t.Fatalf("Scopes = %v, want %v", issued.Scopes, want)
+	}
+
+	srv.DisableOfflineTokens()
+	if _, ok := srv.LookupOfflineToken(tok.AccessToken); ok {
+		t.Fatal("issued token is recorded after disabled")
+	}
+}
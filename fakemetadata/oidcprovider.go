@@ -0,0 +1,444 @@
+// Copyright 2022 The compute-metadata-server Authors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package fakemetadata
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	json "github.com/goccy/go-json"
+	"github.com/google/go-safeweb/safehttp"
+)
+
+// List of the paths of the local OIDC identity provider.
+const (
+	// OIDCProviderPath is the path prefix of the local OIDC identity provider, which is the issuer by default.
+	OIDCProviderPath = "/oidc"
+
+	// OIDCDiscoveryPath is the path of the OpenID Provider Configuration document.
+	OIDCDiscoveryPath = OIDCProviderPath + "/.well-known/openid-configuration"
+
+	// OIDCJWKSPath is the path of the JWK Set of the local OIDC identity provider.
+	OIDCJWKSPath = OIDCProviderPath + "/jwks"
+
+	// OIDCTokenPath is the path of the subject token endpoint, which mints the subject token of the sub, audience and
+	// claims query parameters in the same JSON shape as the GitHub Actions ID token endpoint, {"value": "TOKEN"}.
+	OIDCTokenPath = OIDCProviderPath + "/token"
+)
+
+// List of the defaults of the local OIDC identity provider.
+const (
+	// subjectTokenLifetime is the default lifetime of the subject tokens.
+	subjectTokenLifetime = time.Hour
+
+	// subjectTokenRefreshRatio is the ratio of the lifetime after which the subject token files are rotated, same as kubelet.
+	subjectTokenRefreshRatio = 0.8
+
+	// minSubjectTokenRefresh is the minimum interval of the subject token file rotations and retries,
+	// which keeps the very short lifetimes from spinning the rotation.
+	minSubjectTokenRefresh = time.Second
+
+	// subjectTokenFileName is the name of the subject token file in the directory of SubjectTokenFile.
+	subjectTokenFileName = "token"
+)
+
+// OIDCProvider configures the local OIDC identity provider, which mints the subject tokens of the workload identity federation
+// instead of the external identity providers, such as GitHub Actions or the Kubernetes projected service account tokens.
+//
+// The subject tokens are signed by the key of the local OIDC identity provider, which is regenerated on every enable.
+type OIDCProvider struct {
+	// Issuer is the iss claim of the subject tokens.
+	//
+	// If empty, the issuer is the OIDCProviderPath of the fake metadata server, which serves the discovery document.
+	Issuer string
+
+	// DefaultAudience is the aud claim of the subject tokens which have no audience.
+	DefaultAudience []string
+
+	// Lifetime is the default lifetime of the subject tokens. If zero, one hour is used.
+	Lifetime time.Duration
+}
+
+// Validate reports an error if p is not a valid local OIDC identity provider configuration.
+func (p OIDCProvider) Validate() error {
+	if p.Issuer != "" {
+		u, err := url.Parse(p.Issuer)
+		if err != nil {
+			return fmt.Errorf("could not parse issuer: %w", err)
+		}
+		if (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+			return fmt.Errorf("issuer %q must be the absolute http or https URL", p.Issuer)
+		}
+	}
+	if p.Lifetime < 0 {
+		return fmt.Errorf("lifetime %s must not be negative", p.Lifetime)
+	}
+
+	return nil
+}
+
+// SubjectToken represents the subject token minted by the local OIDC identity provider.
+type SubjectToken struct {
+	// Subject is the sub claim. e.g. "repo:org/repo:ref:refs/heads/main" or "system:serviceaccount:default:app".
+	Subject string
+
+	// Audience is the aud claim. If empty, OIDCProvider.DefaultAudience is used.
+	Audience []string
+
+	// Lifetime is the lifetime of the token. If zero, OIDCProvider.Lifetime is used.
+	Lifetime time.Duration
+
+	// Claims is the custom claims, such as "repository" of GitHub Actions or "kubernetes.io" of Kubernetes.
+	// The registered claims iss, sub, aud, iat, nbf and exp cannot be overridden.
+	Claims map[string]any
+}
+
+// reservedSubjectTokenClaims is the list of the registered claims which SubjectToken.Claims cannot override.
+var reservedSubjectTokenClaims = []string{"iss", "sub", "aud", "iat", "nbf", "exp"}
+
+// OIDCHandler serves the local OIDC identity provider.
+type OIDCHandler struct {
+	addr string // address of the fake metadata server, which the default issuer points to
+
+	mu     sync.RWMutex // guard of below fields
+	cfg    *OIDCProvider
+	signer *idTokenSigner
+}
+
+// RegisterHandlers registers the local OIDC identity provider handlers to mux.
+func (h *OIDCHandler) RegisterHandlers(mux *safehttp.ServeMux) {
+	mux.Handle(OIDCDiscoveryPath, safehttp.MethodGet, h.Discovery(), noMetadataFlavor{})
+	mux.Handle(OIDCJWKSPath, safehttp.MethodGet, h.JWKS(), noMetadataFlavor{})
+	mux.Handle(OIDCTokenPath, safehttp.MethodGet, h.Token(), noMetadataFlavor{})
+}
+
+// configure enables the local OIDC identity provider with cfg and the new signing key, or disables it if cfg is nil.
+func (h *OIDCHandler) configure(cfg *OIDCProvider) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.cfg = cfg
+	h.signer = nil
+	if cfg != nil {
+		h.signer = &idTokenSigner{}
+	}
+}
+
+// model returns the configuration and signer of the local OIDC identity provider, or nil if disabled.
+func (h *OIDCHandler) model() (*OIDCProvider, *idTokenSigner) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	return h.cfg, h.signer
+}
+
+// issuer returns the iss claim of cfg.
+func (h *OIDCHandler) issuer(cfg *OIDCProvider) string {
+	if cfg.Issuer != "" {
+		return cfg.Issuer
+	}
+
+	return "http://" + h.addr + OIDCProviderPath
+}
+
+// errOIDCProviderDisabled is the error of the requests to the disabled local OIDC identity provider.
+var errOIDCProviderDisabled = errors.New("local OIDC identity provider is disabled")
+
+// providerConfig returns the OIDC workload identity pool provider configuration which trusts the local OIDC identity provider.
+func (h *OIDCHandler) providerConfig() (*OIDCProviderConfig, error) {
+	cfg, signer := h.model()
+	if cfg == nil {
+		return nil, errOIDCProviderDisabled
+	}
+	jwks, err := signer.jwks()
+	if err != nil {
+		return nil, err
+	}
+
+	return &OIDCProviderConfig{
+		IssuerURI:        h.issuer(cfg),
+		AllowedAudiences: cfg.DefaultAudience,
+		JWKS:             jwks,
+	}, nil
+}
+
+// mint mints the subject token of tok, and returns it and its expiry.
+func (h *OIDCHandler) mint(tok SubjectToken, now time.Time) (string, time.Time, error) {
+	cfg, signer := h.model()
+	if cfg == nil {
+		return "", time.Time{}, errOIDCProviderDisabled
+	}
+
+	if tok.Subject == "" {
+		return "", time.Time{}, errors.New("subject token requires subject")
+	}
+	aud := tok.Audience
+	if len(aud) == 0 {
+		aud = cfg.DefaultAudience
+	}
+	if len(aud) == 0 {
+		return "", time.Time{}, errors.New("subject token requires audience")
+	}
+	lifetime := tok.Lifetime
+	if lifetime == 0 {
+		lifetime = cfg.Lifetime
+	}
+	if lifetime == 0 {
+		lifetime = subjectTokenLifetime
+	}
+	if lifetime < 0 {
+		return "", time.Time{}, fmt.Errorf("lifetime %s must not be negative", lifetime)
+	}
+
+	claims := make(map[string]any, len(tok.Claims)+len(reservedSubjectTokenClaims))
+	for name, v := range tok.Claims {
+		if slices.Contains(reservedSubjectTokenClaims, name) {
+			return "", time.Time{}, fmt.Errorf("custom claim %q cannot override the registered claim", name)
+		}
+		claims[name] = v
+	}
+	expiry := now.Add(lifetime)
+	claims["iss"] = h.issuer(cfg)
+	claims["sub"] = tok.Subject
+	claims["iat"] = now.Unix()
+	claims["nbf"] = now.Unix()
+	claims["exp"] = expiry.Unix()
+	if len(aud) == 1 {
+		claims["aud"] = aud[0]
+	} else {
+		claims["aud"] = aud
+	}
+
+	signed, err := signer.sign(claims)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+
+	return signed, expiry, nil
+}
+
+// oidcDiscovery represents the OpenID Provider Configuration document.
+type oidcDiscovery struct {
+	Issuer                           string   `json:"issuer"`
+	JWKSURI                          string   `json:"jwks_uri"`
+	ResponseTypesSupported           []string `json:"response_types_supported"`
+	SubjectTypesSupported            []string `json:"subject_types_supported"`
+	IDTokenSigningAlgValuesSupported []string `json:"id_token_signing_alg_values_supported"`
+	ClaimsSupported                  []string `json:"claims_supported"`
+}
+
+// Discovery serves the OpenID Provider Configuration document of the local OIDC identity provider.
+func (h *OIDCHandler) Discovery() safehttp.Handler {
+	return safehttp.HandlerFunc(func(w safehttp.ResponseWriter, r *safehttp.IncomingRequest) safehttp.Result {
+		cfg, _ := h.model()
+		if cfg == nil {
+			return w.WriteError(NewStatusError(errOIDCProviderDisabled, safehttp.StatusNotFound))
+		}
+
+		doc := oidcDiscovery{
+			Issuer:                           h.issuer(cfg),
+			JWKSURI:                          "http://" + h.addr + OIDCJWKSPath,
+			ResponseTypesSupported:           []string{"id_token"},
+			SubjectTypesSupported:            []string{"public"},
+			IDTokenSigningAlgValuesSupported: []string{"RS256"},
+			ClaimsSupported:                  reservedSubjectTokenClaims,
+		}
+
+		return WriteJSON(w, &doc)
+	})
+}
+
+// JWKS serves the JWK Set of the signing key of the local OIDC identity provider.
+func (h *OIDCHandler) JWKS() safehttp.Handler {
+	return safehttp.HandlerFunc(func(w safehttp.ResponseWriter, r *safehttp.IncomingRequest) safehttp.Result {
+		cfg, signer := h.model()
+		if cfg == nil {
+			return w.WriteError(NewStatusError(errOIDCProviderDisabled, safehttp.StatusNotFound))
+		}
+		jwks, err := signer.jwks()
+		if err != nil {
+			return w.WriteError(NewStatusError(err, safehttp.StatusInternalServerError))
+		}
+
+		return WriteJSON(w, &jwks)
+	})
+}
+
+// subjectTokenResponse represents the JSON response of the subject token endpoint.
+type subjectTokenResponse struct {
+	Value string `json:"value"`
+}
+
+// Token mints the subject token of the sub, audience, lifetime and claims query parameters.
+//
+// The audience parameter can be repeated, and the claims parameter is the JSON object of the custom claims.
+func (h *OIDCHandler) Token() safehttp.Handler {
+	return safehttp.HandlerFunc(func(w safehttp.ResponseWriter, r *safehttp.IncomingRequest) safehttp.Result {
+		query, err := r.URL().Query()
+		if err != nil {
+			return w.WriteError(NewStatusError(err, safehttp.StatusBadRequest))
+		}
+
+		tok := SubjectToken{Subject: query.String("sub", "")}
+		query.Slice("audience", &tok.Audience)
+		if err := query.Err(); err != nil {
+			return w.WriteError(NewStatusError(err, safehttp.StatusBadRequest))
+		}
+		if lifetime := query.String("lifetime", ""); lifetime != "" {
+			if tok.Lifetime, err = time.ParseDuration(lifetime); err != nil {
+				return w.WriteError(NewStatusError(fmt.Errorf("invalid lifetime %q: %w", lifetime, err), safehttp.StatusBadRequest))
+			}
+		}
+		if claims := query.String("claims", ""); claims != "" {
+			if err := json.Unmarshal([]byte(claims), &tok.Claims); err != nil {
+				return w.WriteError(NewStatusError(fmt.Errorf("could not decode claims: %w", err), safehttp.StatusBadRequest))
+			}
+		}
+
+		signed, _, err := h.mint(tok, time.Now())
+		switch {
+		case errors.Is(err, errOIDCProviderDisabled):
+			return w.WriteError(NewStatusError(err, safehttp.StatusNotFound))
+		case err != nil:
+			return w.WriteError(NewStatusError(err, safehttp.StatusBadRequest))
+		}
+
+		return WriteJSON(w, &subjectTokenResponse{Value: signed})
+	})
+}
+
+// SubjectTokenFile is the subject token file which is rotated before it expires, the same way as the kubelet rotates
+// the projected service account tokens.
+//
+// The token is written to the timestamped directory, and the "token" file is the symlink through the "..data" symlink
+// which is atomically swapped to the new directory, so the readers never see the partially written token.
+type SubjectTokenFile struct {
+	dir  string
+	tok  SubjectToken
+	mint func(SubjectToken, time.Time) (string, time.Time, error)
+
+	mu  sync.Mutex // guard of err
+	err error      // error of the last rotation
+
+	stopOnce sync.Once
+	stop     chan struct{}
+	done     chan struct{}
+}
+
+// writeSubjectTokenFile writes the subject token of tok minted by mint to dir, and starts the rotation.
+func writeSubjectTokenFile(dir string, tok SubjectToken, mint func(SubjectToken, time.Time) (string, time.Time, error)) (*SubjectTokenFile, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("could not create subject token directory: %w", err)
+	}
+
+	f := &SubjectTokenFile{
+		dir:  dir,
+		tok:  tok,
+		mint: mint,
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+	refresh, err := f.rotate(time.Now())
+	if err != nil {
+		return nil, err
+	}
+	go f.run(max(refresh, minSubjectTokenRefresh))
+
+	return f, nil
+}
+
+// Path returns the path of the subject token file, which can be the credential_source file of the external_account credentials.
+func (f *SubjectTokenFile) Path() string {
+	return filepath.Join(f.dir, subjectTokenFileName)
+}
+
+// Err returns the error of the last rotation, or nil if the last rotation succeeded.
+//
+// The failed rotation is retried while the current subject token is still valid.
+func (f *SubjectTokenFile) Err() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.err
+}
+
+// Close stops the rotation. The subject token file is left on disk.
+func (f *SubjectTokenFile) Close() error {
+	f.stopOnce.Do(func() { close(f.stop) })
+	<-f.done
+
+	return nil
+}
+
+// run rotates the subject token file after refresh until f is closed.
+func (f *SubjectTokenFile) run(refresh time.Duration) {
+	defer close(f.done)
+
+	timer := time.NewTimer(refresh)
+	defer timer.Stop()
+	for {
+		select {
+		case <-f.stop:
+			return
+		case <-timer.C:
+		}
+
+		next, err := f.rotate(time.Now())
+		if err != nil {
+			next = refresh / 10 // retry while the current token is still valid
+		}
+		f.mu.Lock()
+		f.err = err
+		f.mu.Unlock()
+		timer.Reset(max(next, minSubjectTokenRefresh))
+	}
+}
+
+// rotate writes the new subject token, and returns the duration after which it should be rotated again.
+func (f *SubjectTokenFile) rotate(now time.Time) (time.Duration, error) {
+	tok, expiry, err := f.mint(f.tok, now)
+	if err != nil {
+		return 0, fmt.Errorf("could not mint subject token: %w", err)
+	}
+
+	tsDir, err := os.MkdirTemp(f.dir, now.UTC().Format("..2006_01_02_15_04_05."))
+	if err != nil {
+		return 0, fmt.Errorf("could not create subject token directory: %w", err)
+	}
+	if err := os.WriteFile(filepath.Join(tsDir, subjectTokenFileName), []byte(tok), 0o600); err != nil {
+		os.RemoveAll(tsDir)
+		return 0, fmt.Errorf("could not write subject token: %w", err)
+	}
+
+	dataLink := filepath.Join(f.dir, "..data")
+	prev, _ := os.Readlink(dataLink)
+	tmpLink := filepath.Join(f.dir, "..data_tmp")
+	os.Remove(tmpLink)
+	if err := os.Symlink(filepath.Base(tsDir), tmpLink); err != nil {
+		os.RemoveAll(tsDir)
+		return 0, fmt.Errorf("could not link subject token directory: %w", err)
+	}
+	if err := os.Rename(tmpLink, dataLink); err != nil {
+		os.RemoveAll(tsDir)
+		return 0, fmt.Errorf("could not swap subject token directory: %w", err)
+	}
+
+	if _, err := os.Lstat(f.Path()); errors.Is(err, os.ErrNotExist) {
+		if err := os.Symlink(filepath.Join("..data", subjectTokenFileName), f.Path()); err != nil {
+			return 0, fmt.Errorf("could not link subject token file: %w", err)
+		}
+	}
+	if prev != "" && strings.HasPrefix(prev, "..") && prev != filepath.Base(tsDir) {
+		os.RemoveAll(filepath.Join(f.dir, prev))
+	}
+
+	return time.Duration(float64(expiry.Sub(now)) * subjectTokenRefreshRatio), nil
+}
@@ -0,0 +1,143 @@
+// Copyright 2022 The compute-metadata-server Authors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package fakemetadata_test
+
+import (
+	"net/http"
+	"net/url"
+	"os"
+	"testing"
+	"time"
+
+	json "github.com/goccy/go-json"
+
+	"github.com/zchee/compute-metadata-server/fakemetadata"
+)
+
+func TestLocalOIDCProvider(t *testing.T) {
+	const provider = "projects/123456789012/locations/global/workloadIdentityPools/my-pool/providers/local-oidc"
+
+	srv := startServer(t)
+
+	if err := srv.EnableLocalOIDCProvider(fakemetadata.OIDCProvider{DefaultAudience: []string{"https://iam.googleapis.com/" + provider}}); err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := http.Get("http://" + srv.Addr() + fakemetadata.OIDCDiscoveryPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var discovery struct {
+		Issuer  string `json:"issuer"`
+		JWKSURI string `json:"jwks_uri"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&discovery); err != nil {
+		t.Fatal(err)
+	}
+	if want := "http://" + srv.Addr() + fakemetadata.OIDCProviderPath; discovery.Issuer != want {
+		t.Fatalf("issuer = %q, want %q", discovery.Issuer, want)
+	}
+
+	// the subject token file is rotated at 80% of the lifetime
+	f, err := srv.WriteSubjectTokenFile(t.TempDir(), fakemetadata.SubjectToken{Subject: "system:serviceaccount:default:app", Lifetime: time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { f.Close() })
+	first, err := os.ReadFile(f.Path())
+	if err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		tok, err := os.ReadFile(f.Path())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(tok) != string(first) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("subject token file is not rotated")
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	// the minted subject token is accepted by the local STS endpoint which trusts the local OIDC identity provider
+	oidc, err := srv.LocalOIDCProviderConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := srv.SetWorkloadIdentityPoolProviders(fakemetadata.WorkloadIdentityPoolProvider{Name: provider, OIDC: oidc}); err != nil {
+		t.Fatal(err)
+	}
+	tok, err := srv.MintSubjectToken(fakemetadata.SubjectToken{
+		Subject: "repo:org/repo:ref:refs/heads/main",
+		Claims:  map[string]any{"repository": "org/repo"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err = http.PostForm("http://"+srv.Addr()+fakemetadata.STSTokenPath, url.Values{
+		"grant_type":         {"urn:ietf:params:oauth:grant-type:token-exchange"},
+		"audience":           {"//iam.googleapis.com/" + provider},
+		"subject_token_type": {fakemetadata.TokenTypeJWT},
+		"subject_token":      {tok},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d", resp.StatusCode)
+	}
+}
+
+func TestSubjectTokenFileErr(t *testing.T) {
+	srv := fakemetadata.NewServer()
+	t.Cleanup(func() { srv.Close() })
+
+	if err := srv.EnableLocalOIDCProvider(fakemetadata.OIDCProvider{DefaultAudience: []string{"https://example.com"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	// the very short lifetime is rotated at the minimum interval instead of spinning
+	f, err := srv.WriteSubjectTokenFile(t.TempDir(), fakemetadata.SubjectToken{Subject: "app", Lifetime: time.Nanosecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { f.Close() })
+	first, err := os.ReadFile(f.Path())
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(500 * time.Millisecond)
+	if tok, err := os.ReadFile(f.Path()); err != nil || string(tok) != string(first) {
+		t.Fatalf("subject token file is rotated before the minimum interval: %v", err)
+	}
+
+	waitFor := func(cond func() bool, msg string) {
+		t.Helper()
+
+		deadline := time.Now().Add(5 * time.Second)
+		for !cond() {
+			if time.Now().After(deadline) {
+				t.Fatal(msg)
+			}
+			time.Sleep(100 * time.Millisecond)
+		}
+	}
+
+	// the rotation fails while the local OIDC identity provider is disabled, and recovers after it is enabled again
+	srv.DisableLocalOIDCProvider()
+	waitFor(func() bool { return f.Err() != nil }, "rotation error is not reported")
+	if err := srv.EnableLocalOIDCProvider(fakemetadata.OIDCProvider{DefaultAudience: []string{"https://example.com"}}); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(func() bool { return f.Err() == nil }, "rotation error is not cleared")
+	if tok, err := os.ReadFile(f.Path()); err != nil || string(tok) == string(first) {
+		t.Fatalf("subject token file is not rotated: %v", err)
+	}
+}
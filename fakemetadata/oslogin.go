@@ -0,0 +1,565 @@
+// Copyright 2022 The compute-metadata-server Authors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package fakemetadata
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	json "github.com/goccy/go-json"
+	"github.com/google/go-safeweb/safehttp"
+	"github.com/google/safehtml"
+	"golang.org/x/crypto/ssh"
+	"gopkg.in/yaml.v3"
+)
+
+// List of the IAM roles which grant the OS Login policies.
+const (
+	// RoleOSLogin grants the login policy.
+	RoleOSLogin = "roles/compute.osLogin"
+
+	// RoleOSAdminLogin grants the login and adminLogin policies.
+	RoleOSAdminLogin = "roles/compute.osAdminLogin"
+)
+
+// EnvOSLoginDirectory environment variable name for the path of the OS Login directory JSON or YAML file.
+//
+// The file is used unless the OS Login directory is set by SetOSLoginDirectory.
+const EnvOSLoginDirectory = "GOOGLE_OSLOGIN_DIRECTORY"
+
+// OSLoginDirectory represents the directory of the OS Login users and groups.
+//
+// The directory JSON file has the following format, and the YAML file has the same structure:
+//
+//	{
+//	  "users": [
+//	    {
+//	      "email": "alice@example.com",
+//	      "uid": 1001,
+//	      "sshPublicKeys": [{"key": "ssh-ed25519 AAAA... alice@example.com"}],
+//	      "roles": ["roles/compute.osAdminLogin"]
+//	    }
+//	  ],
+//	  "groups": [
+//	    {"name": "developers", "gid": 2001, "members": ["alice_example_com"]}
+//	  ]
+//	}
+//
+// See: https://cloud.google.com/compute/docs/oslogin
+type OSLoginDirectory struct {
+	// Users is the list of the OS Login users.
+	Users []OSLoginUser `json:"users"`
+
+	// Groups is the list of the OS Login POSIX groups.
+	Groups []OSLoginGroup `json:"groups"`
+}
+
+// OSLoginUser represents the OS Login user which has a POSIX account, SSH public keys and IAM role grants.
+type OSLoginUser struct {
+	// Email is the email address of the Google account. e.g. "alice@example.com".
+	Email string `json:"email"`
+
+	// Username is the POSIX username. If empty, it is derived from Email same as OS Login. e.g. "alice_example_com".
+	Username string `json:"username,omitempty"`
+
+	// UID is the POSIX user ID.
+	UID int64 `json:"uid"`
+
+	// GID is the POSIX primary group ID. If zero, UID is used.
+	GID int64 `json:"gid,omitempty"`
+
+	// HomeDirectory is the home directory. If empty, "/home/USERNAME" is used.
+	HomeDirectory string `json:"homeDirectory,omitempty"`
+
+	// Shell is the login shell. If empty, "/bin/bash" is used.
+	Shell string `json:"shell,omitempty"`
+
+	// Gecos is the GECOS field of the POSIX account.
+	Gecos string `json:"gecos,omitempty"`
+
+	// SSHPublicKeys is the list of the SSH public keys of the user.
+	SSHPublicKeys []OSLoginSSHPublicKey `json:"sshPublicKeys,omitempty"`
+
+	// Roles is the list of the IAM roles granted to the user. e.g. ["roles/compute.osLogin"].
+	Roles []string `json:"roles,omitempty"`
+}
+
+// OSLoginSSHPublicKey represents the SSH public key of the OS Login user.
+type OSLoginSSHPublicKey struct {
+	// Key is the public key in the authorized_keys format.
+	Key string `json:"key"`
+
+	// ExpireOn is the expiration time of the key. It is zero if the key never expires.
+	ExpireOn time.Time `json:"expireOn,omitempty"`
+}
+
+// OSLoginGroup represents the OS Login POSIX group.
+type OSLoginGroup struct {
+	// Name is the POSIX group name.
+	Name string `json:"name"`
+
+	// GID is the POSIX group ID.
+	GID int64 `json:"gid"`
+
+	// Members is the list of the POSIX usernames of the group members.
+	Members []string `json:"members,omitempty"`
+}
+
+// posixUsernameRe matches to the invalid characters of the POSIX username derived from the email address.
+var posixUsernameRe = regexp.MustCompile(`[^a-z0-9_-]`)
+
+// username returns the POSIX username of u.
+func (u OSLoginUser) username() string {
+	if u.Username != "" {
+		return u.Username
+	}
+
+	return posixUsernameRe.ReplaceAllString(strings.ToLower(u.Email), "_")
+}
+
+func (u OSLoginUser) gid() int64 {
+	if u.GID != 0 {
+		return u.GID
+	}
+
+	return u.UID
+}
+
+func (u OSLoginUser) homeDirectory() string {
+	if u.HomeDirectory != "" {
+		return u.HomeDirectory
+	}
+
+	return "/home/" + u.username()
+}
+
+func (u OSLoginUser) shell() string {
+	if u.Shell != "" {
+		return u.Shell
+	}
+
+	return "/bin/bash"
+}
+
+// authorized reports whether u is granted policy, which is "login" or "adminLogin".
+func (u OSLoginUser) authorized(policy string) bool {
+	if slices.Contains(u.Roles, RoleOSAdminLogin) {
+		return true
+	}
+
+	return policy == "login" && slices.Contains(u.Roles, RoleOSLogin)
+}
+
+// Validate reports an error if d is not a valid OS Login directory.
+func (d OSLoginDirectory) Validate() error {
+	emails := make(map[string]bool)
+	usernames := make(map[string]bool)
+	uids := make(map[int64]bool)
+	for _, u := range d.Users {
+		if u.Email == "" {
+			return errors.New("user email is empty")
+		}
+		if emails[u.Email] {
+			return fmt.Errorf("duplicate user email %q", u.Email)
+		}
+		emails[u.Email] = true
+
+		if usernames[u.username()] {
+			return fmt.Errorf("duplicate username %q", u.username())
+		}
+		usernames[u.username()] = true
+
+		if u.UID <= 0 {
+			return fmt.Errorf("uid of %q must be positive", u.Email)
+		}
+		if uids[u.UID] {
+			return fmt.Errorf("duplicate uid %d", u.UID)
+		}
+		uids[u.UID] = true
+
+		for _, key := range u.SSHPublicKeys {
+			if _, _, _, _, err := ssh.ParseAuthorizedKey([]byte(key.Key)); err != nil {
+				return fmt.Errorf("could not parse SSH public key of %q: %w", u.Email, err)
+			}
+		}
+		for _, role := range u.Roles {
+			if role != RoleOSLogin && role != RoleOSAdminLogin {
+				return fmt.Errorf("unknown role %q of %q", role, u.Email)
+			}
+		}
+	}
+
+	names := make(map[string]bool)
+	gids := make(map[int64]bool)
+	for _, g := range d.Groups {
+		if g.Name == "" {
+			return errors.New("group name is empty")
+		}
+		if names[g.Name] {
+			return fmt.Errorf("duplicate group name %q", g.Name)
+		}
+		names[g.Name] = true
+
+		if g.GID <= 0 {
+			return fmt.Errorf("gid of %q must be positive", g.Name)
+		}
+		if gids[g.GID] {
+			return fmt.Errorf("duplicate gid %d", g.GID)
+		}
+		gids[g.GID] = true
+
+		for _, member := range g.Members {
+			if !usernames[member] {
+				return fmt.Errorf("unknown member %q of %q", member, g.Name)
+			}
+		}
+	}
+
+	return nil
+}
+
+// LoadOSLoginDirectory reads and validates the OS Login directory JSON file, or the YAML file if filename has
+// the .yaml or .yml extension.
+func LoadOSLoginDirectory(filename string) (OSLoginDirectory, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return OSLoginDirectory{}, fmt.Errorf("could not read OS Login directory: %w", err)
+	}
+
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".yaml", ".yml":
+		// the YAML file is converted to JSON so that the field names follow the JSON tags
+		var v any
+		if err := yaml.Unmarshal(data, &v); err != nil {
+			return OSLoginDirectory{}, fmt.Errorf("could not parse OS Login directory: %w", err)
+		}
+		if data, err = json.Marshal(v); err != nil {
+			return OSLoginDirectory{}, fmt.Errorf("could not convert OS Login directory: %w", err)
+		}
+	}
+
+	var d OSLoginDirectory
+	if err := json.Unmarshal(data, &d); err != nil {
+		return OSLoginDirectory{}, fmt.Errorf("could not parse OS Login directory: %w", err)
+	}
+	if err := d.Validate(); err != nil {
+		return OSLoginDirectory{}, fmt.Errorf("invalid OS Login directory: %w", err)
+	}
+
+	return d, nil
+}
+
+// loginProfile is the JSON representation of the OS Login LoginProfile.
+type loginProfile struct {
+	Name          string                  `json:"name"`
+	PosixAccounts []posixAccount          `json:"posixAccounts"`
+	SSHPublicKeys map[string]sshPublicKey `json:"sshPublicKeys,omitempty"`
+}
+
+// posixAccount is the JSON representation of the OS Login PosixAccount.
+type posixAccount struct {
+	Primary             bool   `json:"primary"`
+	Username            string `json:"username"`
+	UID                 int64  `json:"uid,string"`
+	GID                 int64  `json:"gid,string"`
+	HomeDirectory       string `json:"homeDirectory"`
+	Shell               string `json:"shell"`
+	Gecos               string `json:"gecos"`
+	SystemID            string `json:"systemId"`
+	AccountID           string `json:"accountId"`
+	OperatingSystemType string `json:"operatingSystemType"`
+	Name                string `json:"name"`
+}
+
+// sshPublicKey is the JSON representation of the OS Login SshPublicKey.
+type sshPublicKey struct {
+	Key                string `json:"key"`
+	ExpirationTimeUsec int64  `json:"expirationTimeUsec,string,omitempty"`
+	Fingerprint        string `json:"fingerprint"`
+	Name               string `json:"name"`
+}
+
+// posixGroup is the JSON representation of the OS Login PosixGroup.
+type posixGroup struct {
+	Name string `json:"name"`
+	GID  int64  `json:"gid,string"`
+}
+
+// profile returns the login profile of u in the project.
+func (u OSLoginUser) profile(projectID string) loginProfile {
+	p := loginProfile{
+		Name: u.Email,
+		PosixAccounts: []posixAccount{
+			{
+				Primary:             true,
+				Username:            u.username(),
+				UID:                 u.UID,
+				GID:                 u.gid(),
+				HomeDirectory:       u.homeDirectory(),
+				Shell:               u.shell(),
+				Gecos:               u.Gecos,
+				AccountID:           projectID,
+				OperatingSystemType: "LINUX",
+				Name:                fmt.Sprintf("users/%s/projects/%s", u.Email, projectID),
+			},
+		},
+	}
+
+	for _, key := range u.SSHPublicKeys {
+		pub, _, _, _, err := ssh.ParseAuthorizedKey([]byte(key.Key))
+		if err != nil {
+			continue // already validated
+		}
+		sum := sha256.Sum256(pub.Marshal())
+		fingerprint := hex.EncodeToString(sum[:])
+
+		if p.SSHPublicKeys == nil {
+			p.SSHPublicKeys = make(map[string]sshPublicKey)
+		}
+		k := sshPublicKey{
+			Key:         key.Key,
+			Fingerprint: fingerprint,
+			Name:        fmt.Sprintf("users/%s/sshPublicKeys/%s", u.Email, fingerprint),
+		}
+		if !key.ExpireOn.IsZero() {
+			k.ExpirationTimeUsec = key.ExpireOn.UnixMicro()
+		}
+		p.SSHPublicKeys[fingerprint] = k
+	}
+
+	return p
+}
+
+// lastPageToken is the nextPageToken of the last page, same as the real metadata server.
+const lastPageToken = "0"
+
+// paginate returns the page of items and the next page token.
+//
+// The page token is the offset of the page. If pageSize is zero, all items are returned.
+func paginate[T any](items []T, pageSize int64, pageToken string) ([]T, string, error) {
+	var offset int
+	if pageToken != "" {
+		var err error
+		offset, err = strconv.Atoi(pageToken)
+		if err != nil || offset < 0 || offset > len(items) {
+			return nil, "", fmt.Errorf("invalid pagetoken %q", pageToken)
+		}
+	}
+	if pageSize <= 0 || offset+int(pageSize) >= len(items) {
+		return items[offset:], lastPageToken, nil
+	}
+
+	end := offset + int(pageSize)
+	return items[offset:end], strconv.Itoa(end), nil
+}
+
+// OSLoginHandler holds OS Login metadata handlers.
+//
+// OS Login metadata entries are stored under the following directory:
+//
+//	http://metadata.google.internal/computeMetadata/v1/oslogin/
+//
+// The entries are served only if the enable-oslogin attribute of the instance or project is TRUE.
+type OSLoginHandler struct {
+	mu        sync.RWMutex // guard of directory field
+	directory *OSLoginDirectory
+
+	instance *InstanceHandler // instance which reads the OS Login entries
+}
+
+// setDirectory replaces the OS Login directory with d.
+func (h *OSLoginHandler) setDirectory(d OSLoginDirectory) {
+	h.mu.Lock()
+	h.directory = &d
+	h.mu.Unlock()
+}
+
+// model returns the current OS Login directory, or the directory read from EnvOSLoginDirectory file.
+func (h *OSLoginHandler) model() (OSLoginDirectory, error) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	if h.directory != nil {
+		return *h.directory, nil
+	}
+	if filename, ok := os.LookupEnv(EnvOSLoginDirectory); ok {
+		return LoadOSLoginDirectory(filename)
+	}
+
+	return OSLoginDirectory{}, nil
+}
+
+// RegisterHandlers registers OS Login handlers to mux.
+func (h *OSLoginHandler) RegisterHandlers(mux *safehttp.ServeMux) {
+	mux.Handle("/computeMetadata/v1/oslogin", safehttp.MethodGet, redirectHandler("computeMetadata/v1/oslogin/"))
+	mux.Handle("/computeMetadata/v1/oslogin/", safehttp.MethodGet, h.OSLogin())
+}
+
+var osLoginEndpoints = []string{
+	"authorize",
+	"groups",
+	"users",
+}
+
+// OSLogin a directory of the OS Login entries which the OS Login NSS and PAM modules read. The following information is available:
+//
+//	users?username=USERNAME
+//	users?uid=UID
+//	users?groupname=GROUPNAME
+//	users?pagesize=N&pagetoken=TOKEN
+//
+// The login profiles of the users, or the usernames of the group members if groupname is specified.
+//
+//	groups?groupname=GROUPNAME
+//	groups?gid=GID
+//	groups?pagesize=N&pagetoken=TOKEN
+//
+// The POSIX groups.
+//
+//	authorize?email=EMAIL&policy=login|adminLogin
+//
+// Whether the user is granted the policy. The email parameter also accepts the POSIX username or uid.
+func (h *OSLoginHandler) OSLogin() safehttp.Handler {
+	handler := safehttp.HandlerFunc(func(w safehttp.ResponseWriter, r *safehttp.IncomingRequest) safehttp.Result {
+		if !h.instance.attributeEnabled("enable-oslogin") {
+			return w.WriteError(safehttp.StatusNotFound)
+		}
+
+		path := r.URL().Path()
+		if path == "" {
+			return w.Write(safehtml.HTMLEscaped(strings.Join(osLoginEndpoints, "\n")))
+		}
+		if !slices.Contains(osLoginEndpoints, path) {
+			return w.WriteError(safehttp.StatusNotFound)
+		}
+
+		d, err := h.model()
+		if err != nil {
+			return w.WriteError(NewStatusError(err, safehttp.StatusInternalServerError))
+		}
+		q, err := r.URL().Query()
+		if err != nil {
+			return w.WriteError(NewStatusError(err, safehttp.StatusBadRequest))
+		}
+
+		switch path {
+		case "users":
+			return h.users(w, d, q)
+		case "groups":
+			return h.groups(w, d, q)
+		default: // "authorize"
+			return h.authorize(w, d, q)
+		}
+	})
+
+	return safehttp.StripPrefix("/computeMetadata/v1/oslogin/", handler)
+}
+
+func (h *OSLoginHandler) users(w safehttp.ResponseWriter, d OSLoginDirectory, q safehttp.Form) safehttp.Result {
+	projectID, _ := h.instance.projectModel().projectID()
+
+	if groupname := q.String("groupname", ""); groupname != "" {
+		idx := slices.IndexFunc(d.Groups, func(g OSLoginGroup) bool { return g.Name == groupname })
+		if idx < 0 {
+			return w.WriteError(safehttp.StatusNotFound)
+		}
+		members, next, err := paginate(d.Groups[idx].Members, q.Int64("pagesize", 0), q.String("pagetoken", ""))
+		if err != nil {
+			return w.WriteError(NewStatusError(err, safehttp.StatusBadRequest))
+		}
+		if members == nil {
+			members = []string{}
+		}
+
+		return WriteJSON(w, map[string]any{"usernames": members, "nextPageToken": next})
+	}
+
+	users := d.Users
+	username, uid := q.String("username", ""), q.Int64("uid", 0)
+	if err := q.Err(); err != nil {
+		return w.WriteError(NewStatusError(err, safehttp.StatusBadRequest))
+	}
+	if username != "" || uid != 0 {
+		idx := slices.IndexFunc(users, func(u OSLoginUser) bool {
+			return (username != "" && u.username() == username) || (uid != 0 && u.UID == uid)
+		})
+		if idx < 0 {
+			return w.WriteError(safehttp.StatusNotFound)
+		}
+
+		return WriteJSON(w, map[string]any{"loginProfiles": []loginProfile{users[idx].profile(projectID)}})
+	}
+
+	page, next, err := paginate(users, q.Int64("pagesize", 0), q.String("pagetoken", ""))
+	if err != nil {
+		return w.WriteError(NewStatusError(err, safehttp.StatusBadRequest))
+	}
+	profiles := make([]loginProfile, len(page))
+	for i, u := range page {
+		profiles[i] = u.profile(projectID)
+	}
+
+	return WriteJSON(w, map[string]any{"loginProfiles": profiles, "nextPageToken": next})
+}
+
+func (h *OSLoginHandler) groups(w safehttp.ResponseWriter, d OSLoginDirectory, q safehttp.Form) safehttp.Result {
+	toPosixGroup := func(g OSLoginGroup) posixGroup {
+		return posixGroup{Name: g.Name, GID: g.GID}
+	}
+
+	groupname, gid := q.String("groupname", ""), q.Int64("gid", 0)
+	if err := q.Err(); err != nil {
+		return w.WriteError(NewStatusError(err, safehttp.StatusBadRequest))
+	}
+	if groupname != "" || gid != 0 {
+		idx := slices.IndexFunc(d.Groups, func(g OSLoginGroup) bool {
+			return (groupname != "" && g.Name == groupname) || (gid != 0 && g.GID == gid)
+		})
+		if idx < 0 {
+			return w.WriteError(safehttp.StatusNotFound)
+		}
+
+		return WriteJSON(w, map[string]any{"posixGroups": []posixGroup{toPosixGroup(d.Groups[idx])}})
+	}
+
+	page, next, err := paginate(d.Groups, q.Int64("pagesize", 0), q.String("pagetoken", ""))
+	if err != nil {
+		return w.WriteError(NewStatusError(err, safehttp.StatusBadRequest))
+	}
+	groups := make([]posixGroup, len(page))
+	for i, g := range page {
+		groups[i] = toPosixGroup(g)
+	}
+
+	return WriteJSON(w, map[string]any{"posixGroups": groups, "nextPageToken": next})
+}
+
+func (h *OSLoginHandler) authorize(w safehttp.ResponseWriter, d OSLoginDirectory, q safehttp.Form) safehttp.Result {
+	email, policy := q.String("email", ""), q.String("policy", "")
+	switch policy {
+	case "login", "adminLogin":
+		// nothing to do
+	default:
+		return w.WriteError(NewStatusError(fmt.Errorf("unknown policy %q", policy), safehttp.StatusBadRequest))
+	}
+
+	idx := slices.IndexFunc(d.Users, func(u OSLoginUser) bool {
+		return u.Email == email || u.username() == email || strconv.FormatInt(u.UID, 10) == email
+	})
+	if idx < 0 {
+		return w.WriteError(safehttp.StatusNotFound)
+	}
+
+	return WriteJSON(w, map[string]bool{"success": d.Users[idx].authorized(policy)})
+}
@@ -0,0 +1,180 @@
+// Copyright 2022 The compute-metadata-server Authors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package fakemetadata_test
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/zchee/compute-metadata-server/fakemetadata"
+)
+
+func TestOSLogin(t *testing.T) {
+	srv := startServer(t)
+
+	dir := fakemetadata.OSLoginDirectory{
+		Users: []fakemetadata.OSLoginUser{
+			{Email: "alice@example.com", UID: 1001, Roles: []string{fakemetadata.RoleOSAdminLogin}},
+			{Email: "bob@example.com", UID: 1002, Roles: []string{fakemetadata.RoleOSLogin}},
+		},
+		Groups: []fakemetadata.OSLoginGroup{
+			{Name: "developers", GID: 2001, Members: []string{"alice_example_com", "bob_example_com"}},
+		},
+	}
+	if err := srv.SetOSLoginDirectory(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	if resp := get(t, srv, "oslogin/users?username=alice_example_com"); resp.status != http.StatusNotFound {
+		t.Fatalf("status without enable-oslogin = %d, want %d", resp.status, http.StatusNotFound)
+	}
+	if err := srv.SetProject(fakemetadata.Project{Attributes: map[string]string{"enable-oslogin": "TRUE"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := map[string]struct {
+		path     string
+		wantCode int
+		wantBody string
+	}{
+		"UserByName": {
+			path:     "users?username=alice_example_com",
+			wantCode: http.StatusOK,
+			wantBody: `"uid":"1001"`,
+		},
+		"UserByUID": {
+			path:     "users?uid=1002",
+			wantCode: http.StatusOK,
+			wantBody: `"username":"bob_example_com"`,
+		},
+		"UnknownUser": {
+			path:     "users?username=carol",
+			wantCode: http.StatusNotFound,
+		},
+		"UsersFirstPage": {
+			path:     "users?pagesize=1",
+			wantCode: http.StatusOK,
+			wantBody: `"nextPageToken":"1"`,
+		},
+		"UsersLastPage": {
+			path:     "users?pagesize=1&pagetoken=1",
+			wantCode: http.StatusOK,
+			wantBody: `"nextPageToken":"0"`,
+		},
+		"GroupMembers": {
+			path:     "users?groupname=developers",
+			wantCode: http.StatusOK,
+			wantBody: `"usernames":["alice_example_com","bob_example_com"]`,
+		},
+		"GroupByGID": {
+			path:     "groups?gid=2001",
+			wantCode: http.StatusOK,
+			wantBody: `{"posixGroups":[{"name":"developers","gid":"2001"}]}`,
+		},
+		"AuthorizeLogin": {
+			path:     "authorize?email=bob@example.com&policy=login",
+			wantCode: http.StatusOK,
+			wantBody: `{"success":true}`,
+		},
+		"AuthorizeAdminLogin": {
+			path:     "authorize?email=bob@example.com&policy=adminLogin",
+			wantCode: http.StatusOK,
+			wantBody: `{"success":false}`,
+		},
+		"AuthorizeByUID": {
+			path:     "authorize?email=1001&policy=adminLogin",
+			wantCode: http.StatusOK,
+			wantBody: `{"success":true}`,
+		},
+		"UnknownPolicy": {
+			path:     "authorize?email=bob@example.com&policy=root",
+			wantCode: http.StatusBadRequest,
+		},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			resp := get(t, srv, "oslogin/"+tt.path)
+			if resp.status != tt.wantCode {
+				t.Fatalf("status = %d, want %d: %s", resp.status, tt.wantCode, resp.body)
+			}
+			if !strings.Contains(resp.body, tt.wantBody) {
+				t.Fatalf("body = %s, want contains %s", resp.body, tt.wantBody)
+			}
+		})
+	}
+}
+
+func TestLoadOSLoginDirectory(t *testing.T) {
+	key := newAuthorizedKey(t)
+	want := fakemetadata.OSLoginDirectory{
+		Users: []fakemetadata.OSLoginUser{
+			{
+				Email:         "alice@example.com",
+				UID:           1001,
+				SSHPublicKeys: []fakemetadata.OSLoginSSHPublicKey{{Key: key, ExpireOn: time.Date(2030, 1, 2, 3, 4, 5, 0, time.UTC)}},
+				Roles:         []string{fakemetadata.RoleOSAdminLogin},
+			},
+		},
+		Groups: []fakemetadata.OSLoginGroup{
+			{Name: "developers", GID: 2001, Members: []string{"alice_example_com"}},
+		},
+	}
+
+	files := map[string]string{
+		"directory.json": `{
+  "users": [
+    {
+      "email": "alice@example.com",
+      "uid": 1001,
+      "sshPublicKeys": [{"key": "` + key + `", "expireOn": "2030-01-02T03:04:05Z"}],
+      "roles": ["roles/compute.osAdminLogin"]
+    }
+  ],
+  "groups": [{"name": "developers", "gid": 2001, "members": ["alice_example_com"]}]
+}`,
+		"directory.yaml": `users:
+  - email: alice@example.com
+    uid: 1001
+    sshPublicKeys:
+      - key: ` + key + `
+        expireOn: 2030-01-02T03:04:05Z
+    roles: [roles/compute.osAdminLogin]
+groups:
+  - name: developers
+    gid: 2001
+    members: [alice_example_com]
+`,
+	}
+	for name, data := range files {
+		t.Run(name, func(t *testing.T) {
+			filename := filepath.Join(t.TempDir(), name)
+			if err := os.WriteFile(filename, []byte(data), 0o644); err != nil {
+				t.Fatal(err)
+			}
+
+			got, err := fakemetadata.LoadOSLoginDirectory(filename)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Fatalf("LoadOSLoginDirectory = %+v, want %+v", got, want)
+			}
+		})
+	}
+
+	t.Run("InvalidYAML", func(t *testing.T) {
+		filename := filepath.Join(t.TempDir(), "directory.yml")
+		if err := os.WriteFile(filename, []byte("users: [\n"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := fakemetadata.LoadOSLoginDirectory(filename); err == nil {
+			t.Fatal("expected invalid YAML error")
+		}
+	})
+}
@@ -0,0 +1,118 @@
+// Copyright 2022 The compute-metadata-server Authors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package fakemetadata
+
+import (
+	"fmt"
+	"maps"
+	"regexp"
+	"slices"
+	"strings"
+
+	json "github.com/goccy/go-json"
+	"github.com/google/go-safeweb/safehttp"
+	"github.com/google/safehtml"
+)
+
+var (
+	// partnerNamespaceRe matches to the partner metadata namespace, which is a subdomain of googleapis.com. e.g. "test.compute.googleapis.com".
+	partnerNamespaceRe = regexp.MustCompile(`^([a-z]([-a-z0-9]{0,61}[a-z0-9])?\.)+googleapis\.com$`)
+
+	// partnerKeyRe matches to the partner metadata key.
+	partnerKeyRe = regexp.MustCompile(`^[a-zA-Z0-9_-]{1,128}$`)
+)
+
+// validatePartnerMetadata reports an error if md has an invalid namespace, key or value.
+func validatePartnerMetadata(md map[string]map[string]any) error {
+	for ns, entries := range md {
+		if !partnerNamespaceRe.MatchString(ns) {
+			return fmt.Errorf("partner metadata namespace %q must be a subdomain of googleapis.com", ns)
+		}
+		for key, val := range entries {
+			if !partnerKeyRe.MatchString(key) {
+				return fmt.Errorf("partner metadata key %q of %s must be 1 to 128 letters, numbers, underscores and hyphens", key, ns)
+			}
+			if _, err := json.Marshal(val); err != nil {
+				return fmt.Errorf("could not encode partner metadata %s/%s: %w", ns, key, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// PartnerAttributes a directory of the partner metadata of the VM, which is the structured metadata set by the partners
+// under their googleapis.com namespace. The following information is available:
+//
+//	NAMESPACE/KEY
+//
+// The JSON value of the KEY entry of the NAMESPACE. The object value is a directory of its fields.
+//
+// The directory lists the namespaces, keys or fields, or returns the JSON object of them if the request has recursive=true query parameter.
+// The directory path without the trailing slash is redirected to the directory.
+//
+// See: https://cloud.google.com/compute/docs/metadata/overview#partner_attributes
+func (h *InstanceHandler) PartnerAttributes() safehttp.Handler {
+	handler := safehttp.HandlerFunc(func(w safehttp.ResponseWriter, r *safehttp.IncomingRequest) safehttp.Result {
+		q, err := r.URL().Query()
+		if err != nil {
+			return w.WriteError(NewStatusError(err, safehttp.StatusBadRequest))
+		}
+
+		// normalize the entries to the JSON values to walk into the nested objects
+		data, err := json.Marshal(h.model().PartnerMetadata)
+		if err != nil {
+			return w.WriteError(NewStatusError(err, safehttp.StatusInternalServerError))
+		}
+		var val any = map[string]any{}
+		if err := json.Unmarshal(data, &val); err != nil {
+			return w.WriteError(NewStatusError(err, safehttp.StatusInternalServerError))
+		}
+		if val == nil {
+			val = map[string]any{}
+		}
+
+		path := r.URL().Path()
+		isDir := path == "" || strings.HasSuffix(path, "/")
+		for _, elem := range strings.Split(strings.TrimSuffix(path, "/"), "/") {
+			if elem == "" {
+				continue
+			}
+			obj, ok := val.(map[string]any)
+			if !ok {
+				return w.WriteError(safehttp.StatusNotFound)
+			}
+			if val, ok = obj[elem]; !ok {
+				return w.WriteError(safehttp.StatusNotFound)
+			}
+		}
+
+		recursive := q.Bool("recursive", false)
+		if err := q.Err(); err != nil {
+			return w.WriteError(NewStatusError(err, safehttp.StatusBadRequest))
+		}
+
+		obj, ok := val.(map[string]any)
+		switch {
+		case !ok:
+			return WriteJSON(w, val)
+		case recursive:
+			return WriteJSON(w, obj)
+		case !isDir:
+			return redirectHandler("computeMetadata/v1/instance/partner-attributes/"+path+"/").ServeHTTP(w, r)
+		}
+
+		keys := make([]string, 0, len(obj))
+		for _, key := range slices.Sorted(maps.Keys(obj)) {
+			if _, ok := obj[key].(map[string]any); ok {
+				key += "/"
+			}
+			keys = append(keys, key)
+		}
+
+		return w.Write(safehtml.HTMLEscaped(strings.Join(keys, "\n")))
+	})
+
+	return safehttp.StripPrefix("/computeMetadata/v1/instance/partner-attributes/", handler)
+}
@@ -0,0 +1,151 @@
+// Copyright 2022 The compute-metadata-server Authors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package fakemetadata_test
+
+import (
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/zchee/compute-metadata-server/fakemetadata"
+)
+
+func TestPartnerMetadataValidate(t *testing.T) {
+	tests := map[string]struct {
+		md      map[string]map[string]any
+		wantErr bool
+	}{
+		"Valid": {
+			md: map[string]map[string]any{"test.compute.googleapis.com": {"config": map[string]any{"enabled": true}}},
+		},
+		"InvalidNamespace": {
+			md:      map[string]map[string]any{"example.com": {"config": "x"}},
+			wantErr: true,
+		},
+		"InvalidKey": {
+			md:      map[string]map[string]any{"test.compute.googleapis.com": {"my.config": "x"}},
+			wantErr: true,
+		},
+		"UnencodableValue": {
+			md:      map[string]map[string]any{"test.compute.googleapis.com": {"config": make(chan int)}},
+			wantErr: true,
+		},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			inst := fakemetadata.Instance{PartnerMetadata: tt.md}
+			if err := inst.Validate(); (err != nil) != tt.wantErr {
+				t.Fatalf("Validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestPartnerAttributes(t *testing.T) {
+	srv := startServer(t)
+
+	inst := fakemetadata.Instance{
+		PartnerMetadata: map[string]map[string]any{
+			"test.compute.googleapis.com": {
+				"config": map[string]any{"enabled": true, "name": "my-config"},
+				"count":  3,
+			},
+		},
+	}
+	if err := srv.SetInstance(inst); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := map[string]struct {
+		path       string
+		wantStatus int
+		want       string
+	}{
+		"Namespaces": {
+			path:       "instance/partner-attributes/",
+			wantStatus: http.StatusOK,
+			want:       "test.compute.googleapis.com/",
+		},
+		"Keys": {
+			path:       "instance/partner-attributes/test.compute.googleapis.com/",
+			wantStatus: http.StatusOK,
+			want:       "config/\ncount",
+		},
+		"Fields": {
+			path:       "instance/partner-attributes/test.compute.googleapis.com/config/",
+			wantStatus: http.StatusOK,
+			want:       "enabled\nname",
+		},
+		"Value": {
+			path:       "instance/partner-attributes/test.compute.googleapis.com/count",
+			wantStatus: http.StatusOK,
+			want:       "3",
+		},
+		"NestedValue": {
+			path:       "instance/partner-attributes/test.compute.googleapis.com/config/name",
+			wantStatus: http.StatusOK,
+			want:       `"my-config"`,
+		},
+		"UnknownKey": {
+			path:       "instance/partner-attributes/test.compute.googleapis.com/unknown",
+			wantStatus: http.StatusNotFound,
+		},
+		"BelowValue": {
+			path:       "instance/partner-attributes/test.compute.googleapis.com/count/x",
+			wantStatus: http.StatusNotFound,
+		},
+		"InvalidRecursive": {
+			path:       "instance/partner-attributes/?recursive=maybe",
+			wantStatus: http.StatusBadRequest,
+		},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			resp := get(t, srv, tt.path)
+			if resp.status != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", resp.status, tt.wantStatus, resp.body)
+			}
+			if got := strings.TrimSpace(resp.body); tt.wantStatus == http.StatusOK && got != tt.want {
+				t.Fatalf("%s = %q, want %q", tt.path, got, tt.want)
+			}
+		})
+	}
+
+	t.Run("Recursive", func(t *testing.T) {
+		var got map[string]any
+		getJSON(t, srv, "instance/partner-attributes/test.compute.googleapis.com/?recursive=true", &got)
+		want := map[string]any{
+			"config": map[string]any{"enabled": true, "name": "my-config"},
+			"count":  float64(3),
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Fatalf("recursive = %v, want %v", got, want)
+		}
+	})
+
+	t.Run("Redirect", func(t *testing.T) {
+		t.Setenv(fakemetadata.MetadataHostEnv, srv.Addr())
+
+		// the directory path without the trailing slash is redirected to the directory
+		client := &http.Client{
+			CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+		}
+		req, err := metadataRequest(srv, http.MethodGet, "instance/partner-attributes/test.compute.googleapis.com/config", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := fetch(client, req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.status != http.StatusMovedPermanently {
+			t.Fatalf("status = %d, want %d", resp.status, http.StatusMovedPermanently)
+		}
+		want := "http://" + srv.Addr() + "/computeMetadata/v1/instance/partner-attributes/test.compute.googleapis.com/config/"
+		if got := resp.header.Get("Location"); got != want {
+			t.Fatalf("Location = %q, want %q", got, want)
+		}
+	})
+}
@@ -4,8 +4,9 @@
 package fakemetadata
 
 import (
+	"maps"
 	"os"
-	"strings"
+	"sync"
 
 	"github.com/google/go-safeweb/safehttp"
 	"github.com/google/safehtml"
@@ -18,10 +19,28 @@ import (
 //	http://metadata.google.internal/computeMetadata/v1/project/
 //
 // See: https://cloud.google.com/compute/docs/metadata/predefined-metadata-keys#project-metadata
-type ProjectHandler struct{}
+type ProjectHandler struct {
+	mu      sync.RWMutex // guard of project field
+	project Project
+}
+
+// setProject replaces the project model with p.
+func (h *ProjectHandler) setProject(p Project) {
+	h.mu.Lock()
+	h.project = p
+	h.mu.Unlock()
+}
+
+// model returns the current project model.
+func (h *ProjectHandler) model() Project {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	return h.project
+}
 
 // RegisterHandlers registers project handlers to mux.
-func (h ProjectHandler) RegisterHandlers(mux *safehttp.ServeMux) {
+func (h *ProjectHandler) RegisterHandlers(mux *safehttp.ServeMux) {
 	mux.Handle("/computeMetadata/v1/project/attributes", safehttp.MethodGet, redirectHandler("computeMetadata/v1/project/attributes/"))
 	mux.Handle("/computeMetadata/v1/project/attributes/", safehttp.MethodGet, h.Attributes(ProjectAttributeMap))
 	mux.Handle("/computeMetadata/v1/project/numeric-project-id", safehttp.MethodGet, h.NumericProjectID())
@@ -30,6 +49,8 @@ func (h ProjectHandler) RegisterHandlers(mux *safehttp.ServeMux) {
 
 // ProjectAttributeMap map of porject attributes.
 //
+// The map lists the well-known project attributes. Any other key can be set by Project.Attributes.
+//
 // The project attributes are stored under the following directory:
 //
 //	http://metadata.google.internal/computeMetadata/v1/project/attributes/
@@ -95,55 +116,23 @@ const EnvGoogleProjectDefaultZone = "GOOGLE_PROJECT_DEFAULT_ZONE"
 // Attributes a directory of custom metadata values passed to the VMs in your project during startup or shutdown.
 // These custom values can either be Google Cloud attributes or user-created metadata values.
 //
+// The directory lists only the project attributes. The instances inherit the project attributes unless
+// the instance has the attribute of the same key, see Server.Attribute.
+//
 // For a list of project-level Google Cloud attributes that you can set, see Project attributes.
 //
 // For more information about setting custom metadata, see Setting VM metadata.
-func (ProjectHandler) Attributes(m map[string]bool) safehttp.Handler {
+func (h *ProjectHandler) Attributes(m map[string]bool) safehttp.Handler {
 	handler := safehttp.HandlerFunc(func(w safehttp.ResponseWriter, r *safehttp.IncomingRequest) safehttp.Result {
-		if r.URL().Path() == "" {
-			attrs := make([]string, len(m))
-			i := 0
-			for attr := range m {
-				attrs[i] = attr
-				i++
-			}
-			return w.Write(safehtml.HTMLEscaped(strings.Join(attrs, "\n")))
+		attrs := h.ownAttributes(m)
+
+		path := r.URL().Path()
+		if path == "" {
+			return writeAttributes(w, r, attrs)
 		}
 
-		if path := r.URL().Path(); m[path] {
-			switch path {
-			case "disable-legacy-endpoints":
-				// TODO(zchee): not implemented
-				return w.WriteError(safehttp.StatusNotImplemented)
-
-			case "enable-guest-attributes":
-				// TODO(zchee): not implemented
-				return w.WriteError(safehttp.StatusNotImplemented)
-
-			case "enable-os-inventory":
-				// TODO(zchee): not implemented
-				return w.WriteError(safehttp.StatusNotImplemented)
-
-			case "enable-oslogin":
-				// TODO(zchee): not implemented
-				return w.WriteError(safehttp.StatusNotImplemented)
-
-			case "google-compute-default-region":
-				// TODO(zchee): not implemented
-				return w.WriteError(safehttp.StatusNotImplemented)
-
-			case "google-compute-default-zone":
-				if zone, ok := os.LookupEnv(EnvGoogleProjectDefaultZone); ok {
-					return w.Write(safehtml.HTMLEscaped(zone))
-				}
-			case "ssh-keys", "sshKeys":
-				// TODO(zchee): not implemented
-				return w.WriteError(safehttp.StatusNotImplemented)
-
-			case "vmdnssetting":
-				// TODO(zchee): not implemented
-				return w.WriteError(safehttp.StatusNotImplemented)
-			}
+		if val, ok := attrs[path]; ok {
+			return WriteText(w, val)
 		}
 
 		return w.WriteError(safehttp.StatusNotFound)
@@ -152,6 +141,29 @@ func (ProjectHandler) Attributes(m map[string]bool) safehttp.Handler {
 	return safehttp.StripPrefix("/computeMetadata/v1/project/attributes/", handler)
 }
 
+// ownAttributes returns the project attributes, and the well-known attributes in m configured by the environment variables.
+func (h *ProjectHandler) ownAttributes(m map[string]bool) map[string]string {
+	attrs := maps.Clone(h.model().Attributes)
+	if attrs == nil {
+		attrs = make(map[string]string)
+	}
+
+	for key := range m {
+		if _, ok := attrs[key]; ok {
+			continue
+		}
+
+		switch key {
+		case "google-compute-default-zone":
+			if zone, ok := os.LookupEnv(EnvGoogleProjectDefaultZone); ok {
+				attrs[key] = zone
+			}
+		}
+	}
+
+	return attrs
+}
+
 const (
 	// EnvGoogleCloudNumericProject one of environment variable name for overrides numeric project id.
 	EnvGoogleCloudNumericProject = "GOOGLE_CLOUD_NUMERIC_PROJECT"
@@ -163,16 +175,25 @@ const (
 	EnvGoogleGCPNumericProject = "GOOGLE_GCP_NUMERIC_PROJECT"
 )
 
+// lookupEnvs returns the value of the first environment variable in envs that is present.
+func lookupEnvs(envs []string) (string, bool) {
+	for _, env := range envs {
+		if val, ok := os.LookupEnv(env); ok {
+			return val, true
+		}
+	}
+
+	return "", false
+}
+
 var numericProjectEnvs = []string{EnvGoogleCloudNumericProject, EnvGCPNumericProject, EnvGoogleGCPNumericProject}
 
 // NumericProjectID is the numeric project ID (project number) of the instance, which is not the same as the project name that is visible in the Google Cloud console.
 // This value is different from the project-id metadata entry value.
-func (ProjectHandler) NumericProjectID() safehttp.Handler {
+func (h *ProjectHandler) NumericProjectID() safehttp.Handler {
 	return safehttp.HandlerFunc(func(w safehttp.ResponseWriter, r *safehttp.IncomingRequest) safehttp.Result {
-		for _, env := range numericProjectEnvs {
-			if proj, ok := os.LookupEnv(env); ok {
-				return w.Write(safehtml.HTMLEscaped(proj))
-			}
+		if proj, ok := h.model().numericProjectID(); ok {
+			return w.Write(safehtml.HTMLEscaped(proj))
 		}
 
 		return w.WriteError(safehttp.StatusNotFound)
@@ -193,12 +214,10 @@ const (
 var projectEnvs = []string{EnvGoogleCloudProject, EnvGCPProject, EnvGoogleGCPProject}
 
 // ProjectID is the project ID.
-func (ProjectHandler) ProjectID() safehttp.Handler {
+func (h *ProjectHandler) ProjectID() safehttp.Handler {
 	return safehttp.HandlerFunc(func(w safehttp.ResponseWriter, r *safehttp.IncomingRequest) safehttp.Result {
-		for _, env := range projectEnvs {
-			if proj, ok := os.LookupEnv(env); ok {
-				return w.Write(safehtml.HTMLEscaped(proj))
-			}
+		if proj, ok := h.model().projectID(); ok {
+			return w.Write(safehtml.HTMLEscaped(proj))
 		}
 
 		return w.WriteError(safehttp.StatusNotFound)
@@ -7,12 +7,14 @@ import (
 	"context"
 	"crypto/tls"
 	"errors"
+	"fmt"
 	"log"
 	"math/rand"
 	"net"
 	"net/http"
 	"os"
 	"reflect"
+	"slices"
 	"strconv"
 	"sync"
 	"sync/atomic"
@@ -20,16 +22,23 @@ import (
 	"unsafe"
 
 	"github.com/google/go-safeweb/safehttp"
+	"golang.org/x/crypto/ssh"
 	"golang.org/x/net/http2"
+	"google.golang.org/api/idtoken"
+	"google.golang.org/api/option"
 )
 
 // Server represents a fake metadata server.
 type Server struct {
 	srv *safehttp.Server
 
-	mu       sync.Mutex // guard of below fields
-	project  *ProjectHandler
-	instance *InstanceHandler
+	mu        sync.Mutex // guard of below fields, and serializes the validation and update of the model and credentials
+	project   *ProjectHandler
+	instance  *InstanceHandler
+	osLogin   *OSLoginHandler
+	sts       *STSHandler
+	oidc      *OIDCHandler
+	tokeninfo *TokenInfoHandler
 }
 
 // NewServer returns the new fake metadata server.
@@ -69,11 +78,20 @@ func newServer(port string) *Server {
 			Addr: addr,
 			Mux:  mux,
 		},
-		project:  &ProjectHandler{},
-		instance: &InstanceHandler{},
+		project: &ProjectHandler{},
 	}
+	s.instance = &InstanceHandler{project: s.project, created: time.Now()}
+	s.osLogin = &OSLoginHandler{instance: s.instance}
+	s.sts = &STSHandler{instance: s.instance}
+	s.instance.sts = s.sts
+	s.oidc = &OIDCHandler{addr: addr}
+	s.tokeninfo = &TokenInfoHandler{instance: s.instance, sts: s.sts}
 	s.instance.RegisterHandlers(s.srv.Mux)
 	s.project.RegisterHandlers(s.srv.Mux)
+	s.osLogin.RegisterHandlers(s.srv.Mux)
+	s.sts.RegisterHandlers(s.srv.Mux)
+	s.oidc.RegisterHandlers(s.srv.Mux)
+	s.tokeninfo.RegisterHandlers(s.srv.Mux)
 
 	return s
 }
@@ -114,11 +132,12 @@ func buildStd(s *safehttp.Server) error {
 
 	srv := &http.Server{
 		Addr:           s.Addr,
-		Handler:        s.Mux,
+		Handler:        waitForChangeHandler(s.Mux),
 		ReadTimeout:    5 * time.Second,
 		WriteTimeout:   5 * time.Second,
 		IdleTimeout:    120 * time.Second,
 		MaxHeaderBytes: 10 * 1024,
+		ConnContext:    withRemoteAddr,
 	}
 	if s.ReadTimeout != 0 {
 		srv.ReadTimeout = s.ReadTimeout
@@ -187,46 +206,411 @@ func (s *Server) ServeTLS(l net.Listener, certFile, keyFile string) error {
 	return s.srv.ServeTLS(l, certFile, keyFile)
 }
 
+// SetInstance validates inst and replaces the instance model served by s.
+func (s *Server) SetInstance(inst Instance) error {
+	if err := inst.Validate(); err != nil {
+		return fmt.Errorf("invalid instance: %w", err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if l := s.instance.localIAMCredentialsModel(); l != nil {
+		if err := l.iam.cfg.validateDelegationChains(inst.ServiceAccounts, s.instance.defaultDelegates()); err != nil {
+			return fmt.Errorf("invalid instance: %w", err)
+		}
+	}
+	s.instance.setInstance(inst)
+
+	return nil
+}
+
+// SetProject validates p and replaces the project model served by s.
+func (s *Server) SetProject(p Project) error {
+	if err := p.Validate(); err != nil {
+		return fmt.Errorf("invalid project: %w", err)
+	}
+
+	s.mu.Lock()
+	s.project.setProject(p)
+	s.mu.Unlock()
+	// the full format identity tokens have the project claims
+	s.instance.tokenCache.flush()
+
+	return nil
+}
+
+// Attribute returns the value of the key attribute which the guest agents see.
+//
+// The instance attribute shadows the project attribute of the same key.
+func (s *Server) Attribute(key string) (string, bool) {
+	return s.instance.attribute(key)
+}
+
+// SSHKeys returns the SSH keys which the guest agent provisions to the VM, and the expired keys which the guest agent skips.
+//
+// The instance ssh-keys are merged with the project ssh-keys, unless the instance has the block-project-ssh-keys attribute.
+// The invalid lines are skipped same as the guest agent skips them, and reported by err together with the valid keys.
+func (s *Server) SSHKeys() (keys, expired []SSHKey, err error) {
+	return sshKeys(s.instance.model(), s.instance.projectModel(), time.Now())
+}
+
+// SetOSLoginDirectory validates d and replaces the OS Login directory served by s.
+func (s *Server) SetOSLoginDirectory(d OSLoginDirectory) error {
+	if err := d.Validate(); err != nil {
+		return fmt.Errorf("invalid OS Login directory: %w", err)
+	}
+
+	s.osLogin.setDirectory(d)
+
+	return nil
+}
+
+// SetWorkloadIdentityPoolProviders validates providers and replaces the workload identity pool providers
+// which the local STS token exchange endpoint trusts.
+func (s *Server) SetWorkloadIdentityPoolProviders(providers ...WorkloadIdentityPoolProvider) error {
+	for _, p := range providers {
+		if err := p.Validate(); err != nil {
+			return fmt.Errorf("invalid workload identity pool provider: %w", err)
+		}
+	}
+
+	s.sts.setProviders(slices.Clone(providers))
+
+	return nil
+}
+
+// WriteExternalAccountCredentials writes the external_account credential JSON of cfg to filename.
+//
+// The credentials exchange the subject token at the local STS endpoint of s, and impersonate cfg.ServiceAccount
+// through the local IAM Credentials service if not empty. Set the filename to GOOGLE_APPLICATION_CREDENTIALS to use it as ADC.
+func (s *Server) WriteExternalAccountCredentials(filename string, cfg ExternalAccount) error {
+	return writeExternalAccountCredentials(filename, s.Addr(), cfg)
+}
+
+// EnableLocalOIDCProvider validates cfg and enables the local OIDC identity provider with the new signing key.
+func (s *Server) EnableLocalOIDCProvider(cfg OIDCProvider) error {
+	if err := cfg.Validate(); err != nil {
+		return fmt.Errorf("invalid OIDC provider: %w", err)
+	}
+
+	s.oidc.configure(&cfg)
+
+	return nil
+}
+
+// DisableLocalOIDCProvider disables the local OIDC identity provider.
+func (s *Server) DisableLocalOIDCProvider() {
+	s.oidc.configure(nil)
+}
+
+// LocalOIDCProviderConfig returns the OIDC workload identity pool provider configuration which trusts
+// the local OIDC identity provider, for SetWorkloadIdentityPoolProviders.
+func (s *Server) LocalOIDCProviderConfig() (*OIDCProviderConfig, error) {
+	return s.oidc.providerConfig()
+}
+
+// MintSubjectToken mints the subject token of tok by the local OIDC identity provider.
+func (s *Server) MintSubjectToken(tok SubjectToken) (string, error) {
+	signed, _, err := s.oidc.mint(tok, time.Now())
+	return signed, err
+}
+
+// WriteSubjectTokenFile writes the subject token of tok to the "token" file in dir, and rotates it before it expires
+// until the returned SubjectTokenFile is closed.
+func (s *Server) WriteSubjectTokenFile(dir string, tok SubjectToken) (*SubjectTokenFile, error) {
+	return writeSubjectTokenFile(dir, tok, s.oidc.mint)
+}
+
+// SetWorkloadIdentity validates wi and enables the GKE Workload Identity emulation.
+// The nil wi disables the emulation.
+func (s *Server) SetWorkloadIdentity(wi *WorkloadIdentity) error {
+	if wi != nil {
+		if err := wi.Validate(); err != nil {
+			return fmt.Errorf("invalid workload identity: %w", err)
+		}
+	}
+
+	s.instance.setWorkloadIdentity(wi)
+
+	return nil
+}
+
+// SetWorkloadCertificates validates cfg and replaces the managed workload identity certificates configuration.
+// The nil cfg disables the gce-workload-certificates endpoints.
+//
+// The CA and the workload certificates are reissued on next access.
+func (s *Server) SetWorkloadCertificates(cfg *WorkloadCertificates) error {
+	if cfg != nil {
+		if err := cfg.Validate(); err != nil {
+			return fmt.Errorf("invalid workload certificates: %w", err)
+		}
+	}
+
+	s.instance.workloadCerts.configure(cfg)
+
+	return nil
+}
+
+// RotateWorkloadCertificates reissues the workload certificates on next access regardless of the rotation interval.
+// If rotateCA is true, the CA is also rotated and the previous CA remains in the trust anchors until it expires.
+func (s *Server) RotateWorkloadCertificates(rotateCA bool) {
+	s.instance.workloadCerts.rotate(rotateCA)
+}
+
+// SetDriftToken sets the virtual-clock drift-token and wakes up the wait_for_change requests.
+func (s *Server) SetDriftToken(token string) {
+	s.instance.driftToken.store(token)
+}
+
+// SetMaintenanceEvent sets the maintenance-event and wakes up the wait_for_change requests.
+func (s *Server) SetMaintenanceEvent(event string) {
+	s.instance.maintenanceEvent.store(event)
+}
+
+// SimulateLiveMigration simulates a live migration of the VM.
+//
+// It sets maintenance-event to MIGRATE_ON_HOST_MAINTENANCE, waits for d, changes the virtual-clock drift-token
+// and then sets maintenance-event back to NONE, in the same order as the real host maintenance.
+func (s *Server) SimulateLiveMigration(ctx context.Context, d time.Duration) error {
+	s.SetMaintenanceEvent(MaintenanceEventMigrate)
+	defer s.SetMaintenanceEvent(MaintenanceEventNone)
+
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	s.SetDriftToken(strconv.FormatUint(rand.Uint64(), 10))
+
+	return nil
+}
+
+// SetCPUBurst configures the CPU burst budget of the shared-core machine types and refills the budget.
+func (s *Server) SetCPUBurst(cfg CPUBurst) {
+	s.instance.cpuBurst.configure(cfg)
+}
+
+// SetCPUBursting marks the instance as bursting or idle.
+//
+// The remaining-cpu-time falls while the instance is bursting and refills while the instance is idle.
+// It returns an error if the instance machine type is not a shared-core machine type.
+func (s *Server) SetCPUBursting(bursting bool) error {
+	name := s.instance.model().MachineType
+	mt, ok := LookupMachineType(name)
+	if !ok || !mt.SharedCPU {
+		return fmt.Errorf("machine type %q is not a shared-core machine type", name)
+	}
+
+	s.instance.cpuBurst.setBursting(mt, bursting)
+
+	return nil
+}
+
+// GuestAttribute returns the value of namespace/key guest attribute published by the guest.
+//
+// It returns an error if the guest attributes which the guest agent publishes on boot could not be published.
+func (s *Server) GuestAttribute(namespace, key string) (string, bool, error) {
+	if err := s.publishGuestAttributes(); err != nil {
+		return "", false, err
+	}
+	val, ok := s.instance.guestAttributes.get(namespace, key)
+
+	return val, ok, nil
+}
+
+// GuestAttributes returns the guest attributes of namespace published by the guest.
+//
+// It returns an error if the guest attributes which the guest agent publishes on boot could not be published.
+func (s *Server) GuestAttributes(namespace string) (map[string]string, error) {
+	if err := s.publishGuestAttributes(); err != nil {
+		return nil, err
+	}
+
+	return s.instance.guestAttributes.list(namespace), nil
+}
+
+// publishGuestAttributes publishes the guest attributes which the guest agent publishes on boot, if guest attributes are enabled.
+func (s *Server) publishGuestAttributes() error {
+	if !s.instance.attributeEnabled("enable-guest-attributes") {
+		return nil
+	}
+	if err := s.instance.publishGuestAgentAttributes(InstanceGuestAttributeMap); err != nil {
+		return fmt.Errorf("could not publish guest attributes: %w", err)
+	}
+
+	return nil
+}
+
+// SetGuestInventory replaces the OS inventory published to the guestInventory guest attributes with inv.
+//
+// The empty fields of inv are derived from the local system.
+func (s *Server) SetGuestInventory(inv GuestInventory) {
+	s.instance.setGuestInventory(inv)
+}
+
+// SetHostKeysDir reads the SSH host public keys from the ssh_host_*_key.pub files in dir, such as /etc/ssh,
+// and publishes them to the hostkeys guest attributes instead of the generated host keys.
+func (s *Server) SetHostKeysDir(dir string) error {
+	return s.instance.setHostKeysDir(dir)
+}
+
+// HostKeySigners returns the private keys of the SSH host keys generated by s.
+//
+// The signers can be used as the host keys of the SSH server under test, so that the clients can verify the host keys
+// published to the hostkeys guest attributes. It returns an error if the host keys are read by SetHostKeysDir.
+func (s *Server) HostKeySigners() ([]ssh.Signer, error) {
+	return s.instance.hostKeySigners()
+}
+
 // EnableImpersonate enable impersonate service account.
 func (s *Server) EnableImpersonate() {
 	s.mu.Lock()
-	s.instance.useImpersonate = true
+	s.instance.setImpersonate(true)
 	s.mu.Unlock()
 }
 
 // DisableImpersonate disable impersonate service account.
 func (s *Server) DisableImpersonate() {
 	s.mu.Lock()
-	s.instance.useImpersonate = false
-	s.instance.delegates = nil
+	s.instance.setImpersonate(false)
 	s.mu.Unlock()
 }
 
 // EnableWorkloadIdentityFederation enable Workload Identity Federation ADC.
 func (s *Server) EnableWorkloadIdentityFederation() {
 	s.mu.Lock()
-	s.instance.useFederate = true
+	s.instance.setFederate(true)
 	s.mu.Unlock()
 }
 
 // DisableWorkloadIdentityFederation disable Workload Identity Federation ADC.
 func (s *Server) DisableWorkloadIdentityFederation() {
 	s.mu.Lock()
-	s.instance.useFederate = false
-	s.instance.delegates = nil
+	s.instance.setFederate(false)
 	s.mu.Unlock()
 }
 
-// SetDelegateServiceAccount sets sequence of service accounts in a delegation chain.
-func (s *Server) SetDelegateServiceAccount(delegates []string) {
+// EnableLocalIDToken enables the identity tokens signed by the local signer instead of Google.
+//
+// The tokens can be validated by the idtoken package with NewIDTokenValidator.
+func (s *Server) EnableLocalIDToken() {
+	s.instance.setLocalIDToken(true)
+}
+
+// DisableLocalIDToken disables the identity tokens signed by the local signer.
+func (s *Server) DisableLocalIDToken() {
+	s.instance.setLocalIDToken(false)
+}
+
+// NewIDTokenValidator returns the idtoken.Validator which fetches the signing certificates from s instead of Google,
+// to validate the identity tokens signed by the local signer.
+func (s *Server) NewIDTokenValidator(ctx context.Context) (*idtoken.Validator, error) {
+	client := &http.Client{
+		Transport: CertsTransport(s.Addr(), http.DefaultTransport),
+	}
+
+	return idtoken.NewValidator(ctx, option.WithHTTPClient(client))
+}
+
+// EnableLocalIAMCredentials validates cfg and starts the local IAM Credentials service on the random local port.
+//
+// The impersonation and the Workload Identity Federation paths of s use the local service instead of Google.
+// The applications can connect to it with IAMCredentialsClientOptions.
+func (s *Server) EnableLocalIAMCredentials(cfg IAMCredentials) error {
+	if err := cfg.Validate(); err != nil {
+		return fmt.Errorf("invalid IAM credentials: %w", err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := cfg.validateDelegationChains(s.instance.model().ServiceAccounts, s.instance.defaultDelegates()); err != nil {
+		return fmt.Errorf("invalid IAM credentials: %w", err)
+	}
+	l, err := startLocalIAMCredentials(cfg, s.instance, s.sts)
+	if err != nil {
+		return err
+	}
+	s.instance.setLocalIAMCredentials(l)
+
+	return nil
+}
+
+// DisableLocalIAMCredentials stops the local IAM Credentials service.
+func (s *Server) DisableLocalIAMCredentials() {
 	s.mu.Lock()
-	s.instance.delegates = delegates
+	s.instance.setLocalIAMCredentials(nil)
 	s.mu.Unlock()
 }
 
+// IAMCredentialsClientOptions returns the client options which connect to the local IAM Credentials service,
+// or nil if the service is disabled.
+func (s *Server) IAMCredentialsClientOptions() []option.ClientOption {
+	l := s.instance.localIAMCredentialsModel()
+	if l == nil {
+		return nil
+	}
+
+	return l.clientOptions()
+}
+
+// EnableOfflineTokens validates cfg and enables the offline token mode, which issues the access tokens locally
+// without any Google credentials.
+func (s *Server) EnableOfflineTokens(cfg OfflineTokens) error {
+	if err := cfg.Validate(); err != nil {
+		return fmt.Errorf("invalid offline tokens: %w", err)
+	}
+
+	s.instance.offlineTokens.configure(&cfg)
+	s.instance.tokenCache.flush()
+
+	return nil
+}
+
+// DisableOfflineTokens disables the offline token mode and forgets the issued tokens.
+func (s *Server) DisableOfflineTokens() {
+	s.instance.offlineTokens.configure(nil)
+	s.instance.tokenCache.flush()
+}
+
+// LookupOfflineToken returns the access token issued by the offline token mode or for the service accounts of BackendOffline,
+// which records the service account and scopes.
+func (s *Server) LookupOfflineToken(accessToken string) (OfflineToken, bool) {
+	return s.instance.lookupOfflineToken(accessToken)
+}
+
+// SetDelegateServiceAccount validates and sets sequence of service accounts in a delegation chain,
+// which the service accounts of BackendDefault use.
+//
+// The delegates are either the email addresses or the resource names of the service accounts, such as
+// "projects/-/serviceAccounts/EMAIL". If the local IAM Credentials service is enabled, the chain must be granted in it.
+func (s *Server) SetDelegateServiceAccount(delegates []string) error {
+	delegates = delegateEmails(delegates)
+	if err := validateDelegates("", delegates); err != nil {
+		return fmt.Errorf("invalid delegates: %w", err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if l := s.instance.localIAMCredentialsModel(); l != nil {
+		if err := l.iam.cfg.validateDelegationChains(s.instance.model().ServiceAccounts, delegates); err != nil {
+			return fmt.Errorf("invalid delegates: %w", err)
+		}
+	}
+	s.instance.setDelegates(delegates)
+
+	return nil
+}
+
 // Shutdown is a wrapper for https://pkg.go.dev/pkg/net/http/#Server.Shutdown
 func (s *Server) Shutdown(ctx context.Context) error {
 	defer os.Unsetenv(MetadataHostEnv)
+	defer s.instance.setLocalIAMCredentials(nil)
 
 	return s.srv.Shutdown(ctx)
 }
@@ -234,6 +618,7 @@ func (s *Server) Shutdown(ctx context.Context) error {
 // Close is a wrapper for https://pkg.go.dev/pkg/net/http/#Server.Close
 func (s *Server) Close() error {
 	defer os.Unsetenv(MetadataHostEnv)
+	defer s.instance.setLocalIAMCredentials(nil)
 
 	return s.srv.Close()
 }
@@ -253,31 +638,201 @@ func StartServer() {
 	atomic.StorePointer(&server, unsafe.Pointer(srv))
 }
 
+// SetInstance validates inst and replaces the instance model served by the fake metadata server.
+func SetInstance(inst Instance) error {
+	return (*Server)(atomic.LoadPointer(&server)).SetInstance(inst)
+}
+
+// SetProject validates p and replaces the project model served by the fake metadata server.
+func SetProject(p Project) error {
+	return (*Server)(atomic.LoadPointer(&server)).SetProject(p)
+}
+
+// Attribute returns the value of the key attribute which the guest agents see on the fake metadata server.
+func Attribute(key string) (string, bool) {
+	return (*Server)(atomic.LoadPointer(&server)).Attribute(key)
+}
+
+// SSHKeys returns the SSH keys which the guest agent provisions to the VM of the fake metadata server, and the expired keys.
+func SSHKeys() (keys, expired []SSHKey, err error) {
+	return (*Server)(atomic.LoadPointer(&server)).SSHKeys()
+}
+
+// SetOSLoginDirectory validates d and replaces the OS Login directory served by the fake metadata server.
+func SetOSLoginDirectory(d OSLoginDirectory) error {
+	return (*Server)(atomic.LoadPointer(&server)).SetOSLoginDirectory(d)
+}
+
+// SetWorkloadIdentityPoolProviders validates providers and replaces the workload identity pool providers
+// which the local STS token exchange endpoint of the fake metadata server trusts.
+func SetWorkloadIdentityPoolProviders(providers ...WorkloadIdentityPoolProvider) error {
+	return (*Server)(atomic.LoadPointer(&server)).SetWorkloadIdentityPoolProviders(providers...)
+}
+
+// WriteExternalAccountCredentials writes the external_account credential JSON of cfg, which uses the fake metadata server, to filename.
+func WriteExternalAccountCredentials(filename string, cfg ExternalAccount) error {
+	return (*Server)(atomic.LoadPointer(&server)).WriteExternalAccountCredentials(filename, cfg)
+}
+
+// EnableLocalOIDCProvider validates cfg and enables the local OIDC identity provider of the fake metadata server.
+func EnableLocalOIDCProvider(cfg OIDCProvider) error {
+	return (*Server)(atomic.LoadPointer(&server)).EnableLocalOIDCProvider(cfg)
+}
+
+// DisableLocalOIDCProvider disables the local OIDC identity provider of the fake metadata server.
+func DisableLocalOIDCProvider() {
+	(*Server)(atomic.LoadPointer(&server)).DisableLocalOIDCProvider()
+}
+
+// LocalOIDCProviderConfig returns the OIDC workload identity pool provider configuration which trusts
+// the local OIDC identity provider of the fake metadata server.
+func LocalOIDCProviderConfig() (*OIDCProviderConfig, error) {
+	return (*Server)(atomic.LoadPointer(&server)).LocalOIDCProviderConfig()
+}
+
+// MintSubjectToken mints the subject token of tok by the local OIDC identity provider of the fake metadata server.
+func MintSubjectToken(tok SubjectToken) (string, error) {
+	return (*Server)(atomic.LoadPointer(&server)).MintSubjectToken(tok)
+}
+
+// WriteSubjectTokenFile writes the subject token of tok minted by the fake metadata server to dir, and rotates it.
+func WriteSubjectTokenFile(dir string, tok SubjectToken) (*SubjectTokenFile, error) {
+	return (*Server)(atomic.LoadPointer(&server)).WriteSubjectTokenFile(dir, tok)
+}
+
+// SetWorkloadIdentity validates wi and enables the GKE Workload Identity emulation of the fake metadata server.
+func SetWorkloadIdentity(wi *WorkloadIdentity) error {
+	return (*Server)(atomic.LoadPointer(&server)).SetWorkloadIdentity(wi)
+}
+
+// SetWorkloadCertificates validates cfg and replaces the managed workload identity certificates configuration of the fake metadata server.
+func SetWorkloadCertificates(cfg *WorkloadCertificates) error {
+	return (*Server)(atomic.LoadPointer(&server)).SetWorkloadCertificates(cfg)
+}
+
+// RotateWorkloadCertificates reissues the workload certificates of the fake metadata server on next access.
+func RotateWorkloadCertificates(rotateCA bool) {
+	(*Server)(atomic.LoadPointer(&server)).RotateWorkloadCertificates(rotateCA)
+}
+
+// SetDriftToken sets the virtual-clock drift-token of the fake metadata server.
+func SetDriftToken(token string) {
+	(*Server)(atomic.LoadPointer(&server)).SetDriftToken(token)
+}
+
+// SetMaintenanceEvent sets the maintenance-event of the fake metadata server.
+func SetMaintenanceEvent(event string) {
+	(*Server)(atomic.LoadPointer(&server)).SetMaintenanceEvent(event)
+}
+
+// SimulateLiveMigration simulates a live migration of the fake metadata server VM.
+func SimulateLiveMigration(ctx context.Context, d time.Duration) error {
+	return (*Server)(atomic.LoadPointer(&server)).SimulateLiveMigration(ctx, d)
+}
+
+// SetCPUBurst configures the CPU burst budget of the fake metadata server.
+func SetCPUBurst(cfg CPUBurst) {
+	(*Server)(atomic.LoadPointer(&server)).SetCPUBurst(cfg)
+}
+
+// SetCPUBursting marks the fake metadata server instance as bursting or idle.
+func SetCPUBursting(bursting bool) error {
+	return (*Server)(atomic.LoadPointer(&server)).SetCPUBursting(bursting)
+}
+
+// GuestAttribute returns the value of namespace/key guest attribute published to the fake metadata server.
+func GuestAttribute(namespace, key string) (string, bool, error) {
+	return (*Server)(atomic.LoadPointer(&server)).GuestAttribute(namespace, key)
+}
+
+// GuestAttributes returns the guest attributes of namespace published to the fake metadata server.
+func GuestAttributes(namespace string) (map[string]string, error) {
+	return (*Server)(atomic.LoadPointer(&server)).GuestAttributes(namespace)
+}
+
+// SetHostKeysDir reads the SSH host public keys of the fake metadata server from dir.
+func SetHostKeysDir(dir string) error {
+	return (*Server)(atomic.LoadPointer(&server)).SetHostKeysDir(dir)
+}
+
+// SetGuestInventory replaces the OS inventory of the fake metadata server with inv.
+func SetGuestInventory(inv GuestInventory) {
+	(*Server)(atomic.LoadPointer(&server)).SetGuestInventory(inv)
+}
+
+// HostKeySigners returns the private keys of the SSH host keys generated by the fake metadata server.
+func HostKeySigners() ([]ssh.Signer, error) {
+	return (*Server)(atomic.LoadPointer(&server)).HostKeySigners()
+}
+
 // EnableImpersonate enable impersonate service account.
 func EnableImpersonate() {
-	(*Server)(atomic.LoadPointer(&server)).instance.useImpersonate = true
+	(*Server)(atomic.LoadPointer(&server)).EnableImpersonate()
 }
 
 // DisableImpersonate disable impersonate service account.
 func DisableImpersonate() {
-	(*Server)(atomic.LoadPointer(&server)).instance.useImpersonate = false
-	(*Server)(atomic.LoadPointer(&server)).instance.delegates = nil
+	(*Server)(atomic.LoadPointer(&server)).DisableImpersonate()
 }
 
 // EnableWorkloadIdentityFederation enable Workload Identity Federation ADC.
 func EnableWorkloadIdentityFederation() {
-	(*Server)(atomic.LoadPointer(&server)).instance.useFederate = true
+	(*Server)(atomic.LoadPointer(&server)).EnableWorkloadIdentityFederation()
 }
 
 // DisableWorkloadIdentityFederation disable Workload Identity Federation ADC.
 func DisableWorkloadIdentityFederation() {
-	(*Server)(atomic.LoadPointer(&server)).instance.useFederate = false
-	(*Server)(atomic.LoadPointer(&server)).instance.delegates = nil
+	(*Server)(atomic.LoadPointer(&server)).DisableWorkloadIdentityFederation()
+}
+
+// SetDelegateServiceAccount validates and sets sequence of service accounts in a delegation chain of the fake metadata server.
+func SetDelegateServiceAccount(delegates []string) error {
+	return (*Server)(atomic.LoadPointer(&server)).SetDelegateServiceAccount(delegates)
+}
+
+// EnableLocalIDToken enables the identity tokens signed by the local signer instead of Google.
+func EnableLocalIDToken() {
+	(*Server)(atomic.LoadPointer(&server)).EnableLocalIDToken()
+}
+
+// DisableLocalIDToken disables the identity tokens signed by the local signer.
+func DisableLocalIDToken() {
+	(*Server)(atomic.LoadPointer(&server)).DisableLocalIDToken()
+}
+
+// NewIDTokenValidator returns the idtoken.Validator which fetches the signing certificates from the fake metadata server.
+func NewIDTokenValidator(ctx context.Context) (*idtoken.Validator, error) {
+	return (*Server)(atomic.LoadPointer(&server)).NewIDTokenValidator(ctx)
+}
+
+// EnableLocalIAMCredentials validates cfg and starts the local IAM Credentials service.
+func EnableLocalIAMCredentials(cfg IAMCredentials) error {
+	return (*Server)(atomic.LoadPointer(&server)).EnableLocalIAMCredentials(cfg)
+}
+
+// DisableLocalIAMCredentials stops the local IAM Credentials service.
+func DisableLocalIAMCredentials() {
+	(*Server)(atomic.LoadPointer(&server)).DisableLocalIAMCredentials()
+}
+
+// IAMCredentialsClientOptions returns the client options which connect to the local IAM Credentials service.
+func IAMCredentialsClientOptions() []option.ClientOption {
+	return (*Server)(atomic.LoadPointer(&server)).IAMCredentialsClientOptions()
+}
+
+// EnableOfflineTokens validates cfg and enables the offline token mode.
+func EnableOfflineTokens(cfg OfflineTokens) error {
+	return (*Server)(atomic.LoadPointer(&server)).EnableOfflineTokens(cfg)
+}
+
+// DisableOfflineTokens disables the offline token mode.
+func DisableOfflineTokens() {
+	(*Server)(atomic.LoadPointer(&server)).DisableOfflineTokens()
 }
 
-// SetDelegateServiceAccount sets sequence of service accounts in a delegation chain.
-func SetDelegateServiceAccount(delegates []string) {
-	(*Server)(atomic.LoadPointer(&server)).instance.delegates = delegates
+// LookupOfflineToken returns the access token issued by the offline token mode or for the service accounts of BackendOffline.
+func LookupOfflineToken(accessToken string) (OfflineToken, bool) {
+	return (*Server)(atomic.LoadPointer(&server)).LookupOfflineToken(accessToken)
 }
 
 // IsRunning reports whether the fake metadata server running.
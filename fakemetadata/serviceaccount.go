@@ -0,0 +1,335 @@
+// Copyright 2022 The compute-metadata-server Authors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package fakemetadata
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+)
+
+// ServiceAccountBackend is the credential strategy which issues the tokens of the service account.
+type ServiceAccountBackend string
+
+// List of the ServiceAccountBackend.
+const (
+	// BackendDefault follows the server-wide configuration of EnableOfflineTokens for the access tokens,
+	// and EnableImpersonate, EnableWorkloadIdentityFederation and SetDelegateServiceAccount for the identity tokens.
+	BackendDefault ServiceAccountBackend = ""
+
+	// BackendADC issues the tokens of the application default credentials.
+	BackendADC ServiceAccountBackend = "adc"
+
+	// BackendImpersonate impersonates the service account by the application default credentials through the IAM Credentials service.
+	BackendImpersonate ServiceAccountBackend = "impersonate"
+
+	// BackendFederate impersonates the service account by the external_account application default credentials
+	// of the Workload Identity Federation through the IAM Credentials service.
+	BackendFederate ServiceAccountBackend = "federate"
+
+	// BackendOffline issues the locally minted tokens without any Google APIs, same as EnableOfflineTokens.
+	BackendOffline ServiceAccountBackend = "offline"
+)
+
+// ServiceAccount represents the service account attached to the VM.
+type ServiceAccount struct {
+	// Email is the email address of the service account. e.g. "sa@my-project.iam.gserviceaccount.com".
+	Email string
+
+	// Aliases is the list of the aliases of the service account, which can be used instead of Email in the path.
+	//
+	// If empty, the first service account of the VM has the "default" alias.
+	Aliases []string
+
+	// Scopes is the list of the access scopes granted to the service account.
+	//
+	// The token of the service account can be requested only for the granted scopes.
+	// If empty, the cloud-platform scope is granted.
+	Scopes []string
+
+	// Backend is the credential strategy which issues the tokens of the service account.
+	Backend ServiceAccountBackend
+
+	// Delegates is the delegation chain of the email addresses of the service accounts, from the caller to the service account.
+	// Each service account of the chain must be granted roles/iam.serviceAccountTokenCreator on the next one.
+	//
+	// It is used only by BackendImpersonate and BackendFederate.
+	Delegates []string
+
+	anyScopes bool // whether the token of any scopes can be requested
+}
+
+// scopes returns the access scopes granted to the service account.
+func (sa ServiceAccount) scopes() []string {
+	if len(sa.Scopes) != 0 {
+		return sa.Scopes
+	}
+
+	return []string{cloudPlatformScope}
+}
+
+// grants reports an error if any of scopes is not granted to the service account.
+func (sa ServiceAccount) grants(scopes []string) error {
+	if sa.anyScopes {
+		return nil
+	}
+
+	granted := sa.scopes()
+	for _, scope := range scopes {
+		if !slices.Contains(granted, scope) {
+			return fmt.Errorf("scope %q is not granted to %s", scope, sa.Email)
+		}
+	}
+
+	return nil
+}
+
+// validateServiceAccounts reports an error if sas has the invalid or duplicated service account.
+func validateServiceAccounts(sas []ServiceAccount) error {
+	names := make(map[string]bool)
+	for _, sa := range sas {
+		if sa.Email == "" || !validEmailRe.MatchString(sa.Email) {
+			return fmt.Errorf("service account email %q is invalid", sa.Email)
+		}
+		if names[sa.Email] {
+			return fmt.Errorf("duplicate service account %q", sa.Email)
+		}
+		names[sa.Email] = true
+
+		for _, alias := range sa.Aliases {
+			if alias == "" || strings.Contains(alias, "/") {
+				return fmt.Errorf("alias %q of service account %s is invalid", alias, sa.Email)
+			}
+			if names[alias] {
+				return fmt.Errorf("duplicate service account alias %q", alias)
+			}
+			names[alias] = true
+		}
+
+		for _, scope := range sa.Scopes {
+			if scope == "" || strings.ContainsAny(scope, ", \t\n") {
+				return fmt.Errorf("scope %q of service account %s is invalid", scope, sa.Email)
+			}
+		}
+
+		switch sa.Backend {
+		case BackendDefault, BackendADC, BackendOffline:
+			if len(sa.Delegates) != 0 {
+				return fmt.Errorf("backend %q of service account %s does not support delegates", sa.Backend, sa.Email)
+			}
+		case BackendImpersonate, BackendFederate:
+			if err := validateDelegates(sa.Email, sa.Delegates); err != nil {
+				return fmt.Errorf("invalid delegates of service account %s: %w", sa.Email, err)
+			}
+		default:
+			return fmt.Errorf("unknown backend %q of service account %s", sa.Backend, sa.Email)
+		}
+	}
+
+	return nil
+}
+
+// validateDelegates reports an error if delegates is not a valid delegation chain to the service account target.
+//
+// The chain must consist of the email addresses, and must not have the loop. The empty target skips the loop check of target.
+func validateDelegates(target string, delegates []string) error {
+	seen := make(map[string]bool, len(delegates))
+	for _, delegate := range delegates {
+		if delegate == "" || !validEmailRe.MatchString(delegate) {
+			return fmt.Errorf("delegate %q is not a service account email", delegate)
+		}
+		if delegate == target {
+			return fmt.Errorf("delegate %q is the target service account", delegate)
+		}
+		if seen[delegate] {
+			return fmt.Errorf("delegate %q appears twice in the delegation chain", delegate)
+		}
+		seen[delegate] = true
+	}
+
+	return nil
+}
+
+// delegateEmails returns the email addresses of delegates, which are either the email addresses or the resource names
+// of the service accounts.
+func delegateEmails(delegates []string) []string {
+	if len(delegates) == 0 {
+		return nil
+	}
+
+	emails := make([]string, len(delegates))
+	for i, delegate := range delegates {
+		if m := serviceAccountResourceRe.FindStringSubmatch(delegate); m != nil {
+			delegate = m[1]
+		}
+		emails[i] = delegate
+	}
+
+	return emails
+}
+
+// delegateResourceNames returns the resource names of the delegates which the IAM Credentials service requires.
+func delegateResourceNames(delegates []string) []string {
+	if len(delegates) == 0 {
+		return nil
+	}
+
+	names := make([]string, len(delegates))
+	for i, delegate := range delegates {
+		names[i] = "projects/-/serviceAccounts/" + delegate
+	}
+
+	return names
+}
+
+// errServiceAccountNotFound is returned if the service account is not attached to the VM.
+var errServiceAccountNotFound = errors.New("service account is not attached to the instance")
+
+// serviceAccounts returns the service accounts attached to the VM.
+//
+// If the instance model has no service accounts, the default service account is taken from GOOGLE_ACCOUNT_EMAIL
+// environment variable, the application default credentials, or the Compute Engine default service account of the project.
+func (h *InstanceHandler) serviceAccounts() ([]ServiceAccount, error) {
+	if sas := h.model().ServiceAccounts; len(sas) != 0 {
+		sas = slices.Clone(sas)
+		if len(sas[0].Aliases) == 0 {
+			sas[0].Aliases = []string{"default"}
+		}
+
+		return sas, nil
+	}
+
+	email, err := h.defaultServiceAccountEmail()
+	if err != nil {
+		return nil, err
+	}
+
+	// the default service account without the instance model grants any scopes for the backward compatibility
+	sa := ServiceAccount{
+		Email:     email,
+		Aliases:   []string{"default"},
+		anyScopes: true,
+	}
+
+	return []ServiceAccount{sa}, nil
+}
+
+// defaultServiceAccountEmail returns the email address of the default service account if the instance model has no service accounts.
+func (h *InstanceHandler) defaultServiceAccountEmail() (string, error) {
+	if email := os.Getenv(EnvGoogleAccountEmail); email != "" {
+		return email, nil
+	}
+
+	email, err := h.findServiceAccountEmail()
+	if err == nil {
+		return email, nil
+	}
+
+	if projectNumber, ok := h.projectModel().numericProjectID(); ok {
+		return projectNumber + "-compute@developer.gserviceaccount.com", nil
+	}
+
+	return "", err
+}
+
+// lookupServiceAccount returns the attached service account of the sa directory, which is the email address or the alias.
+func (h *InstanceHandler) lookupServiceAccount(sa string) (ServiceAccount, error) {
+	sa = strings.TrimSuffix(sa, "/")
+
+	sas, err := h.serviceAccounts()
+	if err != nil {
+		return ServiceAccount{}, err
+	}
+	for _, acct := range sas {
+		if acct.Email == sa || slices.Contains(acct.Aliases, sa) {
+			return acct, nil
+		}
+	}
+
+	return ServiceAccount{}, fmt.Errorf("%s: %w", sa, errServiceAccountNotFound)
+}
+
+// credentials returns the backend and delegation chain of the service account sa.
+//
+// The BackendDefault of sa is resolved to the server-wide configuration, which differs between the access tokens and
+// the identity tokens for the backward compatibility.
+func (h *InstanceHandler) credentials(sa ServiceAccount, identity bool) (ServiceAccountBackend, []string) {
+	if sa.Backend != BackendDefault {
+		return sa.Backend, sa.Delegates
+	}
+
+	if !identity {
+		if h.offlineTokens.enabled() {
+			return BackendOffline, nil
+		}
+		return BackendADC, nil
+	}
+
+	h.credMu.RLock()
+	defer h.credMu.RUnlock()
+
+	switch {
+	case h.useImpersonate:
+		return BackendImpersonate, h.delegates
+	case h.useFederate:
+		return BackendFederate, h.delegates
+	}
+
+	return BackendADC, nil
+}
+
+// setImpersonate enables or disables the server-wide impersonation. Disabling it clears the delegation chain.
+func (h *InstanceHandler) setImpersonate(enabled bool) {
+	h.credMu.Lock()
+	h.useImpersonate = enabled
+	if !enabled {
+		h.delegates = nil
+	}
+	h.credMu.Unlock()
+	h.tokenCache.flush()
+}
+
+// setFederate enables or disables the server-wide Workload Identity Federation. Disabling it clears the delegation chain.
+func (h *InstanceHandler) setFederate(enabled bool) {
+	h.credMu.Lock()
+	h.useFederate = enabled
+	if !enabled {
+		h.delegates = nil
+	}
+	h.credMu.Unlock()
+	h.tokenCache.flush()
+}
+
+// defaultDelegates returns the server-wide delegation chain.
+func (h *InstanceHandler) defaultDelegates() []string {
+	h.credMu.RLock()
+	defer h.credMu.RUnlock()
+
+	return h.delegates
+}
+
+// setDelegates replaces the server-wide delegation chain with delegates, and flushes the cached tokens of the previous chain.
+func (h *InstanceHandler) setDelegates(delegates []string) {
+	h.credMu.Lock()
+	h.delegates = slices.Clone(delegates)
+	h.credMu.Unlock()
+	h.tokenCache.flush()
+}
+
+// setLocalIDToken enables or disables the standard format identity tokens signed by the local signer.
+func (h *InstanceHandler) setLocalIDToken(enabled bool) {
+	h.credMu.Lock()
+	h.useLocalIDToken = enabled
+	h.credMu.Unlock()
+}
+
+// localIDToken reports whether the standard format identity tokens are signed by the local signer.
+func (h *InstanceHandler) localIDToken() bool {
+	h.credMu.RLock()
+	defer h.credMu.RUnlock()
+
+	return h.useLocalIDToken
+}
@@ -0,0 +1,244 @@
+// Copyright 2022 The compute-metadata-server Authors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package fakemetadata_test
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	json "github.com/goccy/go-json"
+
+	"github.com/zchee/compute-metadata-server/fakemetadata"
+)
+
+func TestServiceAccounts(t *testing.T) {
+	srv := startServer(t)
+
+	const (
+		defaultSA = "default-sa@my-project.iam.gserviceaccount.com"
+		readerSA  = "reader@my-project.iam.gserviceaccount.com"
+		readOnly  = "https://www.googleapis.com/auth/devstorage.read_only"
+		logging   = "https://www.googleapis.com/auth/logging.write"
+	)
+	inst := fakemetadata.Instance{
+		ServiceAccounts: []fakemetadata.ServiceAccount{
+			{Email: defaultSA},
+			{Email: readerSA, Aliases: []string{"reader"}, Scopes: []string{readOnly, logging}},
+		},
+	}
+	if err := srv.SetInstance(inst); err != nil {
+		t.Fatal(err)
+	}
+	if err := srv.EnableOfflineTokens(fakemetadata.OfflineTokens{}); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := map[string]struct {
+		path       string
+		wantStatus int
+		wantBody   string
+	}{
+		"Directory": {
+			path:       "",
+			wantStatus: http.StatusOK,
+			wantBody:   "default/\n" + defaultSA + "/\nreader/\n" + readerSA + "/",
+		},
+		"DefaultEmail": {
+			path:       "default/email",
+			wantStatus: http.StatusOK,
+			wantBody:   defaultSA,
+		},
+		"AliasEmail": {
+			path:       "reader/email",
+			wantStatus: http.StatusOK,
+			wantBody:   readerSA,
+		},
+		"Aliases": {
+			path:       readerSA + "/aliases",
+			wantStatus: http.StatusOK,
+			wantBody:   "reader",
+		},
+		"Scopes": {
+			path:       "reader/scopes",
+			wantStatus: http.StatusOK,
+			wantBody:   readOnly + "\n" + logging,
+		},
+		"Unattached": {
+			path:       "other@my-project.iam.gserviceaccount.com/email",
+			wantStatus: http.StatusNotFound,
+		},
+		"NotGrantedScope": {
+			path:       "reader/token?scopes=https://www.googleapis.com/auth/cloud-platform",
+			wantStatus: http.StatusForbidden,
+		},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			resp := get(t, srv, "instance/service-accounts/"+tt.path)
+			if resp.status != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", resp.status, tt.wantStatus, resp.body)
+			}
+			if tt.wantBody != "" && resp.body != tt.wantBody {
+				t.Fatalf("body = %q, want %q", resp.body, tt.wantBody)
+			}
+		})
+	}
+
+	var tok fakemetadata.TokenResponse
+	getJSON(t, srv, "instance/service-accounts/reader/token", &tok)
+	issued, ok := srv.LookupOfflineToken(tok.AccessToken)
+	if !ok || issued.ServiceAccount != readerSA || len(issued.Scopes) != 2 {
+		t.Fatalf("unexpected issued token: %+v", issued)
+	}
+}
+
+func TestServiceAccountBackends(t *testing.T) {
+	const (
+		caller    = "dev@example.com"
+		delegate  = "delegate@my-project.iam.gserviceaccount.com"
+		offlineSA = "offline@my-project.iam.gserviceaccount.com"
+		impSA     = "impersonated@my-project.iam.gserviceaccount.com"
+		defaultSA = "default-backend@my-project.iam.gserviceaccount.com"
+	)
+
+	srv := startServer(t)
+
+	inst := fakemetadata.Instance{
+		ServiceAccounts: []fakemetadata.ServiceAccount{
+			{Email: offlineSA, Backend: fakemetadata.BackendOffline},
+			{Email: impSA, Aliases: []string{"imp"}, Backend: fakemetadata.BackendImpersonate, Delegates: []string{delegate}},
+			{Email: defaultSA},
+		},
+	}
+	if err := srv.SetInstance(inst); err != nil {
+		t.Fatal(err)
+	}
+
+	// the delegation chain is validated when the local IAM Credentials service is configured
+	broken := fakemetadata.IAMCredentials{
+		TokenCreators: map[string][]string{delegate: {"user:" + caller}},
+		Caller:        "user:" + caller,
+	}
+	if err := srv.EnableLocalIAMCredentials(broken); err == nil {
+		t.Fatal("broken delegation chain is accepted")
+	}
+	cfg := fakemetadata.IAMCredentials{
+		TokenCreators: map[string][]string{
+			delegate:  {"user:" + caller},
+			impSA:     {"serviceAccount:" + delegate},
+			defaultSA: {"serviceAccount:" + delegate},
+		},
+		Caller: "user:" + caller,
+	}
+	if err := srv.EnableLocalIAMCredentials(cfg); err != nil {
+		t.Fatal(err)
+	}
+
+	token := func(sa string) string {
+		t.Helper()
+
+		var tok fakemetadata.TokenResponse
+		getJSON(t, srv, "instance/service-accounts/"+sa+"/token", &tok)
+		return tok.AccessToken
+	}
+
+	if issued, ok := srv.LookupOfflineToken(token("default")); !ok || issued.ServiceAccount != offlineSA {
+		t.Fatalf("token of the offline backend is not issued offline: %+v", issued)
+	}
+
+	// the token of the impersonate backend is generated by the local IAM Credentials service through the delegate
+	resp, err := http.PostForm("http://"+srv.Addr()+fakemetadata.TokenInfoPath, url.Values{"access_token": {token("imp")}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var info map[string]string
+	if err := json.NewDecoder(resp.Body).Decode(&info); err != nil {
+		t.Fatal(err)
+	}
+	if info["email"] != impSA {
+		t.Fatalf("email = %q, want %q: %v", info["email"], impSA, info)
+	}
+
+	// the server-wide delegation chain of BackendDefault is validated the same way, and accepts the resource names
+	if err := srv.SetDelegateServiceAccount([]string{"projects/-/serviceAccounts/" + delegate}); err != nil {
+		t.Fatal(err)
+	}
+	if err := srv.SetDelegateServiceAccount([]string{impSA}); err == nil {
+		t.Fatal("broken server-wide delegation chain is accepted")
+	}
+	withoutDefault := fakemetadata.IAMCredentials{
+		TokenCreators: map[string][]string{
+			delegate: {"user:" + caller},
+			impSA:    {"serviceAccount:" + delegate},
+		},
+		Caller: "user:" + caller,
+	}
+	if err := srv.EnableLocalIAMCredentials(withoutDefault); err == nil {
+		t.Fatal("broken server-wide delegation chain is accepted")
+	}
+
+	// the offline backend follows the offline token mode if enabled, and keeps issuing the tokens after it is disabled
+	if err := srv.EnableOfflineTokens(fakemetadata.OfflineTokens{Lifetime: 10 * time.Minute}); err != nil {
+		t.Fatal(err)
+	}
+	var tok fakemetadata.TokenResponse
+	getJSON(t, srv, "instance/service-accounts/default/token", &tok)
+	if tok.ExpiresIn != 600 {
+		t.Fatalf("expires_in = %d, want the lifetime of the offline token mode", tok.ExpiresIn)
+	}
+	srv.DisableOfflineTokens()
+	getJSON(t, srv, "instance/service-accounts/default/token", &tok)
+	if issued, ok := srv.LookupOfflineToken(tok.AccessToken); !ok || issued.ServiceAccount != offlineSA || tok.ExpiresIn <= 600 {
+		t.Fatalf("token of the offline backend is not issued by the default configuration: %+v, %+v", tok, issued)
+	}
+}
+
+func TestServiceAccountValidate(t *testing.T) {
+	tests := map[string]struct {
+		sas     []fakemetadata.ServiceAccount
+		wantErr bool
+	}{
+		"Delegates": {
+			sas: []fakemetadata.ServiceAccount{{
+				Email:     "a@my-project.iam.gserviceaccount.com",
+				Backend:   fakemetadata.BackendImpersonate,
+				Delegates: []string{"b@my-project.iam.gserviceaccount.com"},
+			}},
+		},
+		"DuplicateServiceAccountAlias": {
+			sas: []fakemetadata.ServiceAccount{
+				{Email: "a@my-project.iam.gserviceaccount.com"},
+				{Email: "b@my-project.iam.gserviceaccount.com", Aliases: []string{"a@my-project.iam.gserviceaccount.com"}},
+			},
+			wantErr: true,
+		},
+		"DelegationLoop": {
+			sas: []fakemetadata.ServiceAccount{{
+				Email:     "a@my-project.iam.gserviceaccount.com",
+				Backend:   fakemetadata.BackendImpersonate,
+				Delegates: []string{"b@my-project.iam.gserviceaccount.com", "a@my-project.iam.gserviceaccount.com"},
+			}},
+			wantErr: true,
+		},
+		"DelegatesOfOfflineBackend": {
+			sas: []fakemetadata.ServiceAccount{{
+				Email:     "a@my-project.iam.gserviceaccount.com",
+				Backend:   fakemetadata.BackendOffline,
+				Delegates: []string{"b@my-project.iam.gserviceaccount.com"},
+			}},
+			wantErr: true,
+		},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			inst := fakemetadata.Instance{ServiceAccounts: tt.sas}
+			if err := inst.Validate(); (err != nil) != tt.wantErr {
+				t.Fatalf("Validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
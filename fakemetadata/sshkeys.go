@@ -0,0 +1,184 @@
+// Copyright 2022 The compute-metadata-server Authors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package fakemetadata
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	json "github.com/goccy/go-json"
+	"golang.org/x/crypto/ssh"
+)
+
+// googleSSHExpireOnLayout is the layout of expireOn of the google-ssh comment.
+const googleSSHExpireOnLayout = "2006-01-02T15:04:05-0700"
+
+// SSHKey represents a line of the ssh-keys metadata attribute.
+//
+// The line format is:
+//
+//	USERNAME:KEY_TYPE KEY_VALUE [COMMENT]
+//
+// or, for the expiring key:
+//
+//	USERNAME:KEY_TYPE KEY_VALUE google-ssh {"userName":"USERNAME@EXAMPLE.COM","expireOn":"2006-01-02T15:04:05+0000"}
+//
+// See: https://cloud.google.com/compute/docs/connect/add-ssh-keys#metadata
+type SSHKey struct {
+	// User is the Linux user name of the key.
+	User string
+
+	// Type is the key type. e.g. "ssh-ed25519".
+	Type string
+
+	// Key is the base64 encoded public key.
+	Key string
+
+	// Comment is the comment of the key. It is empty if the key is an expiring key.
+	Comment string
+
+	// UserName is the userName of the google-ssh expiring key.
+	UserName string
+
+	// ExpireOn is the expiration time of the google-ssh expiring key. It is zero if the key never expires.
+	ExpireOn time.Time
+}
+
+// Expired reports whether the key is expired at now.
+func (k SSHKey) Expired(now time.Time) bool {
+	return !k.ExpireOn.IsZero() && !now.Before(k.ExpireOn)
+}
+
+// AuthorizedKey returns the key in the authorized_keys format without the user name.
+func (k SSHKey) AuthorizedKey() string {
+	if k.Comment == "" {
+		return k.Type + " " + k.Key
+	}
+
+	return k.Type + " " + k.Key + " " + k.Comment
+}
+
+// ParseSSHKey parses a line of the ssh-keys metadata attribute.
+func ParseSSHKey(line string) (SSHKey, error) {
+	user, rest, ok := strings.Cut(strings.TrimSpace(line), ":")
+	if !ok || user == "" || strings.ContainsAny(user, " \t") {
+		return SSHKey{}, errors.New("line must be USERNAME:KEY_TYPE KEY_VALUE [COMMENT] format")
+	}
+
+	fields := strings.Fields(rest)
+	if len(fields) < 2 {
+		return SSHKey{}, fmt.Errorf("key of %q must be KEY_TYPE KEY_VALUE [COMMENT] format", user)
+	}
+	pub, _, _, _, err := ssh.ParseAuthorizedKey([]byte(fields[0] + " " + fields[1]))
+	if err != nil {
+		return SSHKey{}, fmt.Errorf("could not parse key of %q: %w", user, err)
+	}
+	if pub.Type() != fields[0] {
+		return SSHKey{}, fmt.Errorf("key of %q has %s key type, want %s", user, pub.Type(), fields[0])
+	}
+
+	key := SSHKey{
+		User: user,
+		Type: fields[0],
+		Key:  fields[1],
+	}
+	if len(fields) == 2 {
+		return key, nil
+	}
+	if fields[2] != "google-ssh" {
+		key.Comment = strings.Join(fields[2:], " ")
+		return key, nil
+	}
+
+	var meta struct {
+		UserName string `json:"userName"`
+		ExpireOn string `json:"expireOn"`
+	}
+	if err := json.Unmarshal([]byte(strings.Join(fields[3:], " ")), &meta); err != nil {
+		return SSHKey{}, fmt.Errorf("could not parse google-ssh of %q: %w", user, err)
+	}
+	key.UserName = meta.UserName
+	if meta.ExpireOn != "" {
+		expireOn, err := parseExpireOn(meta.ExpireOn)
+		if err != nil {
+			return SSHKey{}, fmt.Errorf("could not parse expireOn of %q: %w", user, err)
+		}
+		key.ExpireOn = expireOn
+	}
+
+	return key, nil
+}
+
+// parseExpireOn parses expireOn of the google-ssh comment, same as the guest agent accepts.
+func parseExpireOn(s string) (time.Time, error) {
+	if t, err := time.Parse(googleSSHExpireOnLayout, s); err == nil {
+		return t, nil
+	}
+
+	return time.Parse(time.RFC3339, s)
+}
+
+// ParseSSHKeys parses the value of the ssh-keys metadata attribute. The empty lines are skipped.
+//
+// The invalid lines are skipped same as the guest agent skips them, and reported by the returned error
+// together with the keys of the valid lines.
+func ParseSSHKeys(val string) ([]SSHKey, error) {
+	var (
+		keys []SSHKey
+		errs []error
+	)
+	for i, line := range strings.Split(val, "\n") {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+
+		key, err := ParseSSHKey(line)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("line %d: %w", i+1, err))
+			continue
+		}
+		keys = append(keys, key)
+	}
+
+	return keys, errors.Join(errs...)
+}
+
+// sshKeys returns the SSH keys which the guest agent provisions to the VM, and the expired keys which the guest agent skips.
+//
+// The guest agent merges the instance ssh-keys and sshKeys with the project ssh-keys and sshKeys,
+// unless the instance has the block-project-ssh-keys attribute or the deprecated sshKeys attribute.
+//
+// The invalid lines are skipped, and reported by err together with the keys of the valid lines.
+func sshKeys(inst Instance, proj Project, now time.Time) (keys, expired []SSHKey, err error) {
+	type source struct {
+		name string
+		val  string
+	}
+	srcs := []source{{"instance ssh-keys", inst.Attributes["ssh-keys"]}, {"instance sshKeys", inst.Attributes["sshKeys"]}}
+
+	blocked, _ := strconv.ParseBool(inst.Attributes["block-project-ssh-keys"])
+	if _, ok := inst.Attributes["sshKeys"]; !ok && !blocked {
+		srcs = append(srcs, source{"project ssh-keys", proj.Attributes["ssh-keys"]}, source{"project sshKeys", proj.Attributes["sshKeys"]})
+	}
+
+	var errs []error
+	for _, src := range srcs {
+		parsed, err := ParseSSHKeys(src.val)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("invalid %s attribute: %w", src.name, err))
+		}
+		for _, key := range parsed {
+			if key.Expired(now) {
+				expired = append(expired, key)
+				continue
+			}
+			keys = append(keys, key)
+		}
+	}
+
+	return keys, expired, errors.Join(errs...)
+}
@@ -0,0 +1,188 @@
+// Copyright 2022 The compute-metadata-server Authors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package fakemetadata_test
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+
+	"github.com/zchee/compute-metadata-server/fakemetadata"
+)
+
+func newAuthorizedKey(t *testing.T) string {
+	t.Helper()
+
+	pub, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sshPub, err := ssh.NewPublicKey(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return strings.TrimSpace(string(ssh.MarshalAuthorizedKey(sshPub)))
+}
+
+func TestParseSSHKeys(t *testing.T) {
+	val := strings.Join([]string{"alice:" + newAuthorizedKey(t), "", "invalid", "bob:ssh-ed25519 AAAA", "carol:" + newAuthorizedKey(t)}, "\n")
+
+	keys, err := fakemetadata.ParseSSHKeys(val)
+	if got := users(keys); strings.Join(got, ",") != "alice,carol" {
+		t.Fatalf("keys = %v, want [alice carol]", got)
+	}
+	if err == nil || !strings.Contains(err.Error(), "line 3") || !strings.Contains(err.Error(), "line 4") {
+		t.Fatalf("ParseSSHKeys() error = %v, want the errors of line 3 and 4", err)
+	}
+}
+
+func TestParseSSHKey(t *testing.T) {
+	key := newAuthorizedKey(t)
+
+	tests := map[string]struct {
+		line         string
+		wantComment  string
+		wantExpireOn time.Time
+		wantErr      bool
+	}{
+		"NoComment": {
+			line: "alice:" + key,
+		},
+		"Comment": {
+			line:        "alice:" + key + " alice@example.com",
+			wantComment: "alice@example.com",
+		},
+		"GoogleSSH": {
+			line:         "alice:" + key + ` google-ssh {"userName":"alice@example.com","expireOn":"2024-01-02T03:04:05+0000"}`,
+			wantExpireOn: time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC),
+		},
+		"GoogleSSHRFC3339": {
+			line:         "alice:" + key + ` google-ssh {"userName":"alice@example.com","expireOn":"2024-01-02T03:04:05Z"}`,
+			wantExpireOn: time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC),
+		},
+		"NoUser": {
+			line:    key,
+			wantErr: true,
+		},
+		"NoKey": {
+			line:    "alice:ssh-ed25519",
+			wantErr: true,
+		},
+		"InvalidKey": {
+			line:    "alice:ssh-ed25519 AAAA",
+			wantErr: true,
+		},
+		"InvalidGoogleSSH": {
+			line:    "alice:" + key + " google-ssh {",
+			wantErr: true,
+		},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			got, err := fakemetadata.ParseSSHKey(tt.line)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseSSHKey() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if got.User != "alice" || got.Comment != tt.wantComment || !got.ExpireOn.Equal(tt.wantExpireOn) {
+				t.Fatalf("unexpected key: %+v", got)
+			}
+		})
+	}
+}
+
+func TestSSHKeys(t *testing.T) {
+	expiring := func(user string, expireOn time.Time) string {
+		return user + ":" + newAuthorizedKey(t) + ` google-ssh {"userName":"` + user + `@example.com","expireOn":"` + expireOn.Format("2006-01-02T15:04:05-0700") + `"}`
+	}
+	project := fakemetadata.Project{
+		Attributes: map[string]string{
+			"ssh-keys": strings.Join([]string{
+				"project:" + newAuthorizedKey(t),
+				expiring("expired", time.Now().Add(-time.Hour)),
+			}, "\n"),
+		},
+	}
+
+	tests := map[string]struct {
+		attrs       map[string]string
+		wantUsers   []string
+		wantExpired []string
+	}{
+		"Merge": {
+			attrs:       map[string]string{"ssh-keys": "instance:" + newAuthorizedKey(t)},
+			wantUsers:   []string{"instance", "project"},
+			wantExpired: []string{"expired"},
+		},
+		"BlockProjectSSHKeys": {
+			attrs:     map[string]string{"ssh-keys": expiring("instance", time.Now().Add(time.Hour)), "block-project-ssh-keys": "TRUE"},
+			wantUsers: []string{"instance"},
+		},
+		"LegacySSHKeys": {
+			attrs:     map[string]string{"sshKeys": "legacy:" + newAuthorizedKey(t)},
+			wantUsers: []string{"legacy"},
+		},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			srv := fakemetadata.NewServer()
+			t.Cleanup(func() { srv.Close() })
+			if err := srv.SetProject(project); err != nil {
+				t.Fatal(err)
+			}
+			if err := srv.SetInstance(fakemetadata.Instance{Attributes: tt.attrs}); err != nil {
+				t.Fatal(err)
+			}
+
+			keys, expired, err := srv.SSHKeys()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := users(keys); strings.Join(got, ",") != strings.Join(tt.wantUsers, ",") {
+				t.Fatalf("keys = %v, want %v", got, tt.wantUsers)
+			}
+			if got := users(expired); strings.Join(got, ",") != strings.Join(tt.wantExpired, ",") {
+				t.Fatalf("expired = %v, want %v", got, tt.wantExpired)
+			}
+		})
+	}
+
+	t.Run("InvalidLine", func(t *testing.T) {
+		srv := fakemetadata.NewServer()
+		t.Cleanup(func() { srv.Close() })
+
+		// the invalid line is kept in the attribute, and skipped by the guest agent
+		val := "invalid\n" + "valid:" + newAuthorizedKey(t)
+		if err := srv.SetInstance(fakemetadata.Instance{Attributes: map[string]string{"ssh-keys": val, "block-project-ssh-keys": "TRUE"}}); err != nil {
+			t.Fatal(err)
+		}
+		if got, _ := srv.Attribute("ssh-keys"); got != val {
+			t.Fatalf("ssh-keys = %q, want %q", got, val)
+		}
+
+		keys, _, err := srv.SSHKeys()
+		if err == nil || !strings.Contains(err.Error(), "line 1") {
+			t.Fatalf("SSHKeys() error = %v, want the error of line 1", err)
+		}
+		if got := users(keys); strings.Join(got, ",") != "valid" {
+			t.Fatalf("keys = %v, want [valid]", got)
+		}
+	})
+}
+
+func users(keys []fakemetadata.SSHKey) []string {
+	var users []string
+	for _, key := range keys {
+		users = append(users, key.User)
+	}
+
+	return users
+}
@@ -0,0 +1,784 @@
+// Copyright 2022 The compute-metadata-server Authors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package fakemetadata
+
+import (
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"os"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/iam/credentials/apiv1/credentialspb"
+	json "github.com/goccy/go-json"
+	"github.com/google/go-safeweb/safehttp"
+	"golang.org/x/oauth2"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/durationpb"
+)
+
+// STSTokenPath is the path of the local STS token exchange endpoint, same as https://sts.googleapis.com/v1/token.
+const STSTokenPath = "/v1/token"
+
+// List of the token types of the STS token exchange.
+const (
+	tokenExchangeGrantType = "urn:ietf:params:oauth:grant-type:token-exchange"
+
+	// TokenTypeAccessToken is the token type of the federated access token.
+	TokenTypeAccessToken = "urn:ietf:params:oauth:token-type:access_token"
+
+	// TokenTypeJWT is the subject token type of the OIDC token.
+	TokenTypeJWT = "urn:ietf:params:oauth:token-type:jwt"
+
+	// TokenTypeIDToken is the subject token type of the OIDC ID token.
+	TokenTypeIDToken = "urn:ietf:params:oauth:token-type:id_token"
+
+	// TokenTypeSAML2 is the subject token type of the base64 encoded SAML 2.0 assertion or response.
+	TokenTypeSAML2 = "urn:ietf:params:oauth:token-type:saml2"
+)
+
+// serviceAccountImpersonationPath is the path prefix of the REST generateAccessToken endpoint of the local IAM Credentials service,
+// which the external_account credentials use as the service_account_impersonation_url.
+const serviceAccountImpersonationPath = "/v1/projects/-/serviceAccounts/"
+
+// federatedTokenLifetime is the lifetime of the federated access tokens.
+const federatedTokenLifetime = time.Hour
+
+// WorkloadIdentityPoolProvider represents the workload identity pool provider which the local STS endpoint trusts.
+//
+// See: https://cloud.google.com/iam/docs/workload-identity-federation
+type WorkloadIdentityPoolProvider struct {
+	// Name is the resource name of the provider.
+	// e.g. "projects/123456789012/locations/global/workloadIdentityPools/my-pool/providers/my-provider".
+	Name string
+
+	// OIDC is the OIDC provider configuration. Either OIDC or SAML is required.
+	OIDC *OIDCProviderConfig
+
+	// SAML is the SAML provider configuration. Either OIDC or SAML is required.
+	SAML *SAMLProviderConfig
+
+	// AttributeMapping is the map of the Google attribute to the expression on the assertion.
+	// e.g. {"google.subject": "assertion.sub", "attribute.repository": "assertion.repository"}
+	//
+	// The expressions support the subset of CEL, the string literals and the selectors of assertion.
+	// If empty, google.subject is mapped from assertion.sub for OIDC, and assertion.subject for SAML.
+	AttributeMapping map[string]string
+
+	// AttributeCondition is the condition which the mapped attributes must satisfy. e.g. "attribute.repository == 'org/repo'".
+	//
+	// The condition supports the subset of CEL, the comparisons by == and != joined by && and ||.
+	AttributeCondition string
+}
+
+// OIDCProviderConfig configures the OIDC workload identity pool provider.
+type OIDCProviderConfig struct {
+	// IssuerURI is the iss claim of the subject tokens.
+	IssuerURI string
+
+	// AllowedAudiences is the list of the aud claims of the subject tokens.
+	//
+	// If empty, the full resource name of the provider with "https:" prefix is allowed, same as Google.
+	AllowedAudiences []string
+
+	// JWKS is the JWK Set of the keys which sign the subject tokens.
+	JWKS JWKSet
+}
+
+// SAMLProviderConfig configures the SAML workload identity pool provider.
+//
+// The local STS endpoint verifies the enveloped XML signature of the assertion or response by IdPCertificates,
+// and checks the issuer, audience and validity period of the assertion.
+// The signature must use the Exclusive XML Canonicalization and the RSA signature, and the encrypted assertions are not supported.
+type SAMLProviderConfig struct {
+	// IdPEntityID is the Issuer of the assertions.
+	IdPEntityID string
+
+	// IdPCertificates is the list of the X.509 certificates of the IdP which sign the assertions or responses.
+	IdPCertificates []*x509.Certificate
+}
+
+// workloadIdentityPoolProviderRe matches to the resource name of the workload identity pool provider.
+var workloadIdentityPoolProviderRe = regexp.MustCompile(`^(projects/\d+/locations/global/workloadIdentityPools/[a-z0-9-]{4,32})/providers/[a-z0-9-]{4,32}$`)
+
+// Validate reports an error if p is not a valid workload identity pool provider.
+func (p WorkloadIdentityPoolProvider) Validate() error {
+	if !workloadIdentityPoolProviderRe.MatchString(p.Name) {
+		return fmt.Errorf("provider name %q must be projects/NUMBER/locations/global/workloadIdentityPools/POOL/providers/PROVIDER format", p.Name)
+	}
+
+	switch {
+	case (p.OIDC == nil) == (p.SAML == nil):
+		return fmt.Errorf("provider %s requires either OIDC or SAML", p.Name)
+	case p.OIDC != nil:
+		if p.OIDC.IssuerURI == "" {
+			return fmt.Errorf("provider %s requires issuer URI", p.Name)
+		}
+		if len(p.OIDC.JWKS.Keys) == 0 {
+			return fmt.Errorf("provider %s requires JWKS", p.Name)
+		}
+	case p.SAML != nil:
+		if p.SAML.IdPEntityID == "" {
+			return fmt.Errorf("provider %s requires IdP entity ID", p.Name)
+		}
+		if len(p.SAML.IdPCertificates) == 0 {
+			return fmt.Errorf("provider %s requires IdP certificates", p.Name)
+		}
+	}
+
+	if _, _, err := p.compile(); err != nil {
+		return fmt.Errorf("provider %s: %w", p.Name, err)
+	}
+
+	return nil
+}
+
+// pool returns the resource name of the workload identity pool of p.
+func (p WorkloadIdentityPoolProvider) pool() string {
+	return workloadIdentityPoolProviderRe.FindStringSubmatch(p.Name)[1]
+}
+
+// audience returns the audience of the token exchange request for p.
+func (p WorkloadIdentityPoolProvider) audience() string {
+	return "//iam.googleapis.com/" + p.Name
+}
+
+// compile compiles the attribute mapping and condition of p.
+func (p WorkloadIdentityPoolProvider) compile() (map[string]attrExpr, attrExpr, error) {
+	mapping := p.AttributeMapping
+	if len(mapping) == 0 {
+		mapping = map[string]string{"google.subject": "assertion.sub"}
+		if p.SAML != nil {
+			mapping = map[string]string{"google.subject": "assertion.subject"}
+		}
+	}
+	if _, ok := mapping["google.subject"]; !ok {
+		return nil, nil, errors.New("attribute mapping requires google.subject")
+	}
+
+	exprs := make(map[string]attrExpr, len(mapping))
+	for attr, src := range mapping {
+		if attr != "google.subject" && attr != "google.groups" && !strings.HasPrefix(attr, "attribute.") {
+			return nil, nil, fmt.Errorf("invalid attribute %q", attr)
+		}
+		e, err := compileAttrExpr(src)
+		if err != nil {
+			return nil, nil, err
+		}
+		exprs[attr] = e
+	}
+
+	var cond attrExpr
+	if p.AttributeCondition != "" {
+		var err error
+		if cond, err = compileAttrExpr(p.AttributeCondition); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	return exprs, cond, nil
+}
+
+// federatedPrincipal is the principal of the federated access token.
+type federatedPrincipal struct {
+	pool       string // resource name of the workload identity pool
+	subject    string
+	groups     []string
+	attributes map[string]string
+}
+
+// members returns the IAM members which match to the principal.
+func (p federatedPrincipal) members() []string {
+	prefix := "//iam.googleapis.com/" + p.pool
+	members := []string{
+		"principal:" + prefix + "/subject/" + p.subject,
+		"principalSet:" + prefix + "/*",
+	}
+	for _, group := range p.groups {
+		members = append(members, "principalSet:"+prefix+"/group/"+group)
+	}
+	for name, value := range p.attributes {
+		members = append(members, "principalSet:"+prefix+"/attribute."+name+"/"+value)
+	}
+
+	return members
+}
+
+// STSHandler serves the local STS token exchange endpoint, which exchanges the OIDC or SAML subject tokens of
+// the workload identity pool providers to the federated access tokens.
+//
+// See: https://cloud.google.com/iam/docs/reference/sts/rest/v1/TopLevel/token
+type STSHandler struct {
+	instance *InstanceHandler // serves the service account impersonation through the local IAM Credentials service
+
+	mu        sync.RWMutex // guard of providers and principals
+	providers []WorkloadIdentityPoolProvider
+
+	tokens     offlineTokens                 // issued federated access tokens
+	principals map[string]federatedPrincipal // map of the federated access token to the principal
+}
+
+// RegisterHandlers registers the STS handlers to mux.
+func (h *STSHandler) RegisterHandlers(mux *safehttp.ServeMux) {
+	mux.Handle(STSTokenPath, safehttp.MethodPost, h.Token(), noMetadataFlavor{})
+	mux.Handle(serviceAccountImpersonationPath, safehttp.MethodPost, h.GenerateAccessToken(), noMetadataFlavor{})
+}
+
+// setProviders replaces the trusted workload identity pool providers with providers.
+func (h *STSHandler) setProviders(providers []WorkloadIdentityPoolProvider) {
+	h.mu.Lock()
+	h.providers = providers
+	h.mu.Unlock()
+}
+
+// provider returns the trusted provider of the audience.
+func (h *STSHandler) provider(audience string) (WorkloadIdentityPoolProvider, bool) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	for _, p := range h.providers {
+		if p.audience() == audience {
+			return p, true
+		}
+	}
+
+	return WorkloadIdentityPoolProvider{}, false
+}
+
+// lookup returns the principal of the federated access token.
+func (h *STSHandler) lookup(accessToken string) (federatedPrincipal, bool) {
+	if tok, ok := h.tokens.lookup(accessToken); !ok || !time.Now().Before(tok.Expiry) {
+		return federatedPrincipal{}, false
+	}
+
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	p, ok := h.principals[accessToken]
+	return p, ok
+}
+
+// stsTokenResponse represents the JSON response of the STS token exchange.
+type stsTokenResponse struct {
+	AccessToken     string `json:"access_token"`
+	IssuedTokenType string `json:"issued_token_type"`
+	TokenType       string `json:"token_type"`
+	ExpiresIn       int    `json:"expires_in"`
+}
+
+// Token exchanges the subject token to the federated access token.
+func (h *STSHandler) Token() safehttp.Handler {
+	return safehttp.HandlerFunc(func(w safehttp.ResponseWriter, r *safehttp.IncomingRequest) safehttp.Result {
+		form, err := r.PostForm()
+		if err != nil {
+			return w.WriteError(NewOAuthError("invalid_request", err.Error(), safehttp.StatusBadRequest))
+		}
+
+		if grantType := form.String("grant_type", ""); grantType != tokenExchangeGrantType {
+			return w.WriteError(NewOAuthError("unsupported_grant_type", fmt.Sprintf("unsupported grant type %q", grantType), safehttp.StatusBadRequest))
+		}
+		if tokenType := form.String("requested_token_type", TokenTypeAccessToken); tokenType != TokenTypeAccessToken {
+			return w.WriteError(NewOAuthError("invalid_request", fmt.Sprintf("unsupported requested token type %q", tokenType), safehttp.StatusBadRequest))
+		}
+
+		provider, ok := h.provider(form.String("audience", ""))
+		if !ok {
+			return w.WriteError(NewOAuthError("invalid_target", "the audience is not a trusted workload identity pool provider", safehttp.StatusBadRequest))
+		}
+
+		now := time.Now()
+		assertion, err := verifySubjectToken(provider, form.String("subject_token_type", ""), form.String("subject_token", ""), now)
+		if err != nil {
+			return w.WriteError(NewOAuthError("invalid_grant", err.Error(), safehttp.StatusBadRequest))
+		}
+		principal, err := mapAttributes(provider, assertion)
+		if err != nil {
+			return w.WriteError(NewOAuthError("invalid_grant", err.Error(), safehttp.StatusBadRequest))
+		}
+
+		scopes := strings.Fields(form.String("scope", ""))
+		tok, err := h.issue(principal, scopes, now)
+		if err != nil {
+			return w.WriteError(NewOAuthError("server_error", err.Error(), safehttp.StatusInternalServerError))
+		}
+
+		resp := stsTokenResponse{
+			AccessToken:     tok.AccessToken,
+			IssuedTokenType: TokenTypeAccessToken,
+			TokenType:       "Bearer",
+			ExpiresIn:       int(federatedTokenLifetime.Seconds()),
+		}
+
+		return WriteJSON(w, &resp)
+	})
+}
+
+// generateAccessTokenRequest represents the JSON request of the REST generateAccessToken.
+type generateAccessTokenRequest struct {
+	Delegates []string `json:"delegates"`
+	Scope     []string `json:"scope"`
+	Lifetime  string   `json:"lifetime"`
+}
+
+// generateAccessTokenResponse represents the JSON response of the REST generateAccessToken.
+type generateAccessTokenResponse struct {
+	AccessToken string `json:"accessToken"`
+	ExpireTime  string `json:"expireTime"`
+}
+
+// GenerateAccessToken serves the REST generateAccessToken of the local IAM Credentials service,
+// which exchanges the federated access token to the access token of the service account.
+func (h *STSHandler) GenerateAccessToken() safehttp.Handler {
+	return safehttp.HandlerFunc(func(w safehttp.ResponseWriter, r *safehttp.IncomingRequest) safehttp.Result {
+		l := h.instance.localIAMCredentialsModel()
+		if l == nil {
+			return w.WriteError(NewStatusError(errors.New("local IAM Credentials service is disabled"), safehttp.StatusNotFound))
+		}
+		email, ok := strings.CutSuffix(strings.TrimPrefix(r.URL().Path(), serviceAccountImpersonationPath), ":generateAccessToken")
+		if !ok {
+			return w.WriteError(NewStatusError(fmt.Errorf("unknown method %s", r.URL().Path()), safehttp.StatusNotFound))
+		}
+
+		var req generateAccessTokenRequest
+		if err := json.NewDecoder(io.LimitReader(r.Body(), 1<<20)).Decode(&req); err != nil {
+			return w.WriteError(NewStatusError(fmt.Errorf("could not decode request: %w", err), safehttp.StatusBadRequest))
+		}
+		pbReq := &credentialspb.GenerateAccessTokenRequest{
+			Name:      "projects/-/serviceAccounts/" + email,
+			Delegates: req.Delegates,
+			Scope:     req.Scope,
+		}
+		if req.Lifetime != "" {
+			lifetime, err := time.ParseDuration(req.Lifetime)
+			if err != nil {
+				return w.WriteError(NewStatusError(fmt.Errorf("invalid lifetime %q: %w", req.Lifetime, err), safehttp.StatusBadRequest))
+			}
+			pbReq.Lifetime = durationpb.New(lifetime)
+		}
+
+		ctx := r.Context()
+		if auth := r.Header.Get("Authorization"); auth != "" {
+			ctx = metadata.NewIncomingContext(ctx, metadata.Pairs("authorization", auth))
+		}
+		resp, err := l.iam.GenerateAccessToken(ctx, pbReq)
+		if err != nil {
+			code := safehttp.StatusInternalServerError
+			switch status.Code(err) {
+			case codes.InvalidArgument:
+				code = safehttp.StatusBadRequest
+			case codes.Unauthenticated:
+				code = safehttp.StatusUnauthorized
+			case codes.PermissionDenied:
+				code = safehttp.StatusForbidden
+			}
+			return w.WriteError(NewStatusError(errors.New(status.Convert(err).Message()), code))
+		}
+
+		return WriteJSON(w, &generateAccessTokenResponse{
+			AccessToken: resp.GetAccessToken(),
+			ExpireTime:  resp.GetExpireTime().AsTime().Format(time.RFC3339Nano),
+		})
+	})
+}
+
+// issue issues the federated access token of principal.
+func (h *STSHandler) issue(principal federatedPrincipal, scopes []string, now time.Time) (*oauth2.Token, error) {
+	h.tokens.configureIfDisabled(&OfflineTokens{Lifetime: federatedTokenLifetime})
+	subject := "principal://iam.googleapis.com/" + principal.pool + "/subject/" + principal.subject
+	tok, err := h.tokens.issue(subject, scopes, 0, now)
+	if err != nil {
+		return nil, err
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.principals == nil {
+		h.principals = make(map[string]federatedPrincipal)
+	}
+	for accessToken := range h.principals {
+		if _, ok := h.tokens.lookup(accessToken); !ok {
+			delete(h.principals, accessToken)
+		}
+	}
+	h.principals[tok.AccessToken] = principal
+
+	return tok, nil
+}
+
+// verifySubjectToken verifies the subject token of tokenType for provider, and returns the assertion.
+func verifySubjectToken(provider WorkloadIdentityPoolProvider, tokenType, token string, now time.Time) (map[string]any, error) {
+	switch tokenType {
+	case TokenTypeJWT, TokenTypeIDToken:
+		if provider.OIDC == nil {
+			return nil, fmt.Errorf("provider %s does not accept OIDC tokens", provider.Name)
+		}
+		return verifyOIDCToken(provider, token, now)
+
+	case TokenTypeSAML2:
+		if provider.SAML == nil {
+			return nil, fmt.Errorf("provider %s does not accept SAML assertions", provider.Name)
+		}
+		return verifySAMLAssertion(provider, token, now)
+	}
+
+	return nil, fmt.Errorf("unsupported subject token type %q", tokenType)
+}
+
+// allowedAudiences returns the allowed audiences of the subject tokens of provider.
+func allowedAudiences(provider WorkloadIdentityPoolProvider) []string {
+	if provider.OIDC != nil && len(provider.OIDC.AllowedAudiences) != 0 {
+		return provider.OIDC.AllowedAudiences
+	}
+
+	return []string{"https://iam.googleapis.com/" + provider.Name, provider.audience()}
+}
+
+// verifyOIDCToken verifies the RS256 signed OIDC token by the JWKS of provider, and returns the claims.
+func verifyOIDCToken(provider WorkloadIdentityPoolProvider, token string, now time.Time) (map[string]any, error) {
+	_, claims, err := verifyRS256JWT(token, provider.OIDC.JWKS)
+	if err != nil {
+		return nil, fmt.Errorf("invalid subject token: %w", err)
+	}
+	if iss, _ := claims["iss"].(string); iss != provider.OIDC.IssuerURI {
+		return nil, fmt.Errorf("subject token issuer %q is not %q", iss, provider.OIDC.IssuerURI)
+	}
+	var auds []string
+	switch aud := claims["aud"].(type) {
+	case string:
+		auds = []string{aud}
+	case []any:
+		for _, a := range aud {
+			if s, ok := a.(string); ok {
+				auds = append(auds, s)
+			}
+		}
+	}
+	allowed := allowedAudiences(provider)
+	if !slices.ContainsFunc(auds, func(aud string) bool { return slices.Contains(allowed, aud) }) {
+		return nil, fmt.Errorf("subject token audience %v is not allowed", auds)
+	}
+	if exp, ok := claims["exp"].(float64); !ok || !now.Before(time.Unix(int64(exp), 0)) {
+		return nil, errors.New("subject token is expired")
+	}
+
+	return claims, nil
+}
+
+// verifyRS256JWT verifies the signature of the RS256 signed JWT by jwks, and returns the key ID and claims.
+func verifyRS256JWT(token string, jwks JWKSet) (string, map[string]any, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return "", nil, errors.New("not a JWT")
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeJWTPart(parts[0], &header); err != nil {
+		return "", nil, fmt.Errorf("could not decode header: %w", err)
+	}
+	if header.Alg != "RS256" {
+		return "", nil, fmt.Errorf("unsupported algorithm %q", header.Alg)
+	}
+
+	idx := slices.IndexFunc(jwks.Keys, func(k JWK) bool { return k.Kid == header.Kid })
+	if idx < 0 {
+		return "", nil, fmt.Errorf("no JWK of key ID %q", header.Kid)
+	}
+	key, err := jwks.Keys[idx].rsaPublicKey()
+	if err != nil {
+		return "", nil, err
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return "", nil, fmt.Errorf("could not decode signature: %w", err)
+	}
+	sum := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if err := rsa.VerifyPKCS1v15(key, crypto.SHA256, sum[:], sig); err != nil {
+		return "", nil, fmt.Errorf("invalid signature: %w", err)
+	}
+
+	var claims map[string]any
+	if err := decodeJWTPart(parts[1], &claims); err != nil {
+		return "", nil, fmt.Errorf("could not decode claims: %w", err)
+	}
+
+	return header.Kid, claims, nil
+}
+
+// decodeJWTPart decodes the base64url encoded JSON part of the JWT to v.
+func decodeJWTPart(part string, v any) error {
+	b, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(b, v)
+}
+
+// rsaPublicKey returns the RSA public key of k.
+func (k JWK) rsaPublicKey() (*rsa.PublicKey, error) {
+	if k.Kty != "RSA" {
+		return nil, fmt.Errorf("unsupported JWK key type %q", k.Kty)
+	}
+	n, err := base64.RawURLEncoding.DecodeString(k.N)
+	if err != nil {
+		return nil, fmt.Errorf("could not decode JWK modulus: %w", err)
+	}
+	e, err := base64.RawURLEncoding.DecodeString(k.E)
+	if err != nil {
+		return nil, fmt.Errorf("could not decode JWK exponent: %w", err)
+	}
+
+	return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+}
+
+// samlAssertion represents the SAML 2.0 assertion.
+type samlAssertion struct {
+	Issuer  string `xml:"Issuer"`
+	Subject struct {
+		NameID string `xml:"NameID"`
+	} `xml:"Subject"`
+	Conditions struct {
+		NotBefore    string   `xml:"NotBefore,attr"`
+		NotOnOrAfter string   `xml:"NotOnOrAfter,attr"`
+		Audiences    []string `xml:"AudienceRestriction>Audience"`
+	} `xml:"Conditions"`
+	Attributes []struct {
+		Name   string   `xml:"Name,attr"`
+		Values []string `xml:"AttributeValue"`
+	} `xml:"AttributeStatement>Attribute"`
+}
+
+// List of the namespaces of SAML 2.0.
+const (
+	samlAssertionNamespace = "urn:oasis:names:tc:SAML:2.0:assertion"
+	samlProtocolNamespace  = "urn:oasis:names:tc:SAML:2.0:protocol"
+)
+
+// verifySAMLAssertion verifies the base64 encoded SAML 2.0 assertion or response for provider, and returns the assertion
+// which has the subject and attributes keys.
+//
+// Either the response or the assertion must be signed by the IdP.
+func verifySAMLAssertion(provider WorkloadIdentityPoolProvider, token string, now time.Time) (map[string]any, error) {
+	b, err := base64.StdEncoding.DecodeString(token)
+	if err != nil {
+		if b, err = base64.RawURLEncoding.DecodeString(token); err != nil {
+			return nil, fmt.Errorf("could not decode SAML assertion: %w", err)
+		}
+	}
+
+	root, err := parseXML(b)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse SAML assertion: %w", err)
+	}
+	signed := root
+	switch {
+	case root.is(samlProtocolNamespace, "Response"):
+		assertion, err := root.element(samlAssertionNamespace, "Assertion")
+		if err != nil {
+			return nil, fmt.Errorf("invalid SAML response: %w", err)
+		}
+		if len(root.elements(xmlDSigNamespace, "Signature")) == 0 {
+			signed = assertion
+		}
+	case root.is(samlAssertionNamespace, "Assertion"):
+	default:
+		return nil, fmt.Errorf("unexpected SAML element %s", root.local)
+	}
+	canonical, err := verifyEnvelopedSignature(signed, provider.SAML.IdPCertificates)
+	if err != nil {
+		return nil, fmt.Errorf("invalid SAML signature: %w", err)
+	}
+
+	// the assertion is decoded from the signed content, so the unsigned elements around it are never used
+	var doc struct {
+		XMLName xml.Name
+		samlAssertion
+		Assertion *samlAssertion `xml:"urn:oasis:names:tc:SAML:2.0:assertion Assertion"`
+	}
+	if err := xml.Unmarshal(canonical, &doc); err != nil {
+		return nil, fmt.Errorf("could not parse SAML assertion: %w", err)
+	}
+	assertion := &doc.samlAssertion
+	if doc.XMLName.Local == "Response" {
+		assertion = doc.Assertion
+	}
+
+	if assertion.Issuer != provider.SAML.IdPEntityID {
+		return nil, fmt.Errorf("SAML assertion issuer %q is not %q", assertion.Issuer, provider.SAML.IdPEntityID)
+	}
+	allowed := allowedAudiences(provider)
+	if !slices.ContainsFunc(assertion.Conditions.Audiences, func(aud string) bool { return slices.Contains(allowed, aud) }) {
+		return nil, fmt.Errorf("SAML assertion audience %v is not allowed", assertion.Conditions.Audiences)
+	}
+	notBefore, err := time.Parse(time.RFC3339, assertion.Conditions.NotBefore)
+	if err != nil {
+		return nil, fmt.Errorf("invalid SAML assertion NotBefore: %w", err)
+	}
+	notOnOrAfter, err := time.Parse(time.RFC3339, assertion.Conditions.NotOnOrAfter)
+	if err != nil {
+		return nil, fmt.Errorf("invalid SAML assertion NotOnOrAfter: %w", err)
+	}
+	if now.Before(notBefore) {
+		return nil, errors.New("SAML assertion is not yet valid")
+	}
+	if !now.Before(notOnOrAfter) {
+		return nil, errors.New("SAML assertion is expired")
+	}
+
+	attrs := make(map[string]any, len(assertion.Attributes))
+	for _, attr := range assertion.Attributes {
+		values := make([]any, len(attr.Values))
+		for i, v := range attr.Values {
+			values[i] = v
+		}
+		attrs[attr.Name] = values
+	}
+
+	return map[string]any{
+		"subject":    assertion.Subject.NameID,
+		"attributes": attrs,
+	}, nil
+}
+
+// mapAttributes maps assertion to the principal by the attribute mapping of provider, and checks the attribute condition.
+func mapAttributes(provider WorkloadIdentityPoolProvider, assertion map[string]any) (federatedPrincipal, error) {
+	mapping, cond, err := provider.compile()
+	if err != nil {
+		return federatedPrincipal{}, err
+	}
+
+	principal := federatedPrincipal{
+		pool:       provider.pool(),
+		attributes: make(map[string]string),
+	}
+	google := make(map[string]any)
+	attribute := make(map[string]any)
+	for attr, e := range mapping {
+		v, err := e.eval(map[string]any{"assertion": assertion})
+		if err != nil {
+			if attr == "google.subject" {
+				return federatedPrincipal{}, fmt.Errorf("could not map google.subject: %w", err)
+			}
+			continue // the missing optional attributes are not mapped
+		}
+
+		switch attr {
+		case "google.subject":
+			principal.subject = fmt.Sprint(v)
+			google["subject"] = principal.subject
+		case "google.groups":
+			if groups, ok := v.([]any); ok {
+				for _, g := range groups {
+					principal.groups = append(principal.groups, fmt.Sprint(g))
+				}
+			} else {
+				principal.groups = []string{fmt.Sprint(v)}
+			}
+			google["groups"] = v
+		default:
+			name := strings.TrimPrefix(attr, "attribute.")
+			principal.attributes[name] = fmt.Sprint(v)
+			attribute[name] = principal.attributes[name]
+		}
+	}
+	if principal.subject == "" || len(principal.subject) > 127 {
+		return federatedPrincipal{}, fmt.Errorf("google.subject %q must be 1 to 127 characters", principal.subject)
+	}
+
+	if cond != nil {
+		ok, err := cond.eval(map[string]any{"assertion": assertion, "google": google, "attribute": attribute})
+		if err != nil {
+			return federatedPrincipal{}, fmt.Errorf("could not evaluate attribute condition: %w", err)
+		}
+		if ok != true {
+			return federatedPrincipal{}, errors.New("the attribute condition is not satisfied")
+		}
+	}
+
+	return principal, nil
+}
+
+// ExternalAccount configures the external_account credential JSON written by WriteExternalAccountCredentials.
+type ExternalAccount struct {
+	// Provider is the resource name of the workload identity pool provider.
+	Provider string
+
+	// SubjectTokenFile is the path of the file which has the subject token.
+	SubjectTokenFile string
+
+	// SubjectTokenType is the type of the subject token. If empty, TokenTypeJWT is used.
+	SubjectTokenType string
+
+	// ServiceAccount is the email address of the service account to impersonate through the local IAM Credentials service.
+	//
+	// If empty, the federated access token is used directly.
+	ServiceAccount string
+}
+
+// externalAccountJSON represents the external_account credential JSON.
+type externalAccountJSON struct {
+	Type                           string `json:"type"`
+	Audience                       string `json:"audience"`
+	SubjectTokenType               string `json:"subject_token_type"`
+	TokenURL                       string `json:"token_url"`
+	ServiceAccountImpersonationURL string `json:"service_account_impersonation_url,omitempty"`
+	CredentialSource               struct {
+		File string `json:"file"`
+	} `json:"credential_source"`
+}
+
+// writeExternalAccountCredentials writes the external_account credential JSON of cfg, which exchanges the subject token
+// at the local STS endpoint of addr, to filename.
+func writeExternalAccountCredentials(filename, addr string, cfg ExternalAccount) error {
+	if !workloadIdentityPoolProviderRe.MatchString(cfg.Provider) {
+		return fmt.Errorf("provider name %q is invalid", cfg.Provider)
+	}
+	if cfg.SubjectTokenFile == "" {
+		return errors.New("subject token file is required")
+	}
+
+	creds := externalAccountJSON{
+		Type:             "external_account",
+		Audience:         "//iam.googleapis.com/" + cfg.Provider,
+		SubjectTokenType: cfg.SubjectTokenType,
+		TokenURL:         "http://" + addr + STSTokenPath,
+	}
+	if creds.SubjectTokenType == "" {
+		creds.SubjectTokenType = TokenTypeJWT
+	}
+	if cfg.ServiceAccount != "" {
+		if !validEmailRe.MatchString(cfg.ServiceAccount) {
+			return fmt.Errorf("service account email %q is invalid", cfg.ServiceAccount)
+		}
+		creds.ServiceAccountImpersonationURL = "http://" + addr + serviceAccountImpersonationPath + cfg.ServiceAccount + ":generateAccessToken"
+	}
+	creds.CredentialSource.File = cfg.SubjectTokenFile
+
+	data, err := json.MarshalIndent(creds, "", "  ")
+	if err != nil {
+		return fmt.Errorf("could not encode external account credentials: %w", err)
+	}
+	if err := os.WriteFile(filename, data, 0o600); err != nil {
+		return fmt.Errorf("could not write external account credentials: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,437 @@
+// Copyright 2022 The compute-metadata-server Authors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package fakemetadata_test
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"math/big"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	json "github.com/goccy/go-json"
+	"golang.org/x/oauth2/google"
+
+	"github.com/zchee/compute-metadata-server/fakemetadata"
+)
+
+func TestSTS(t *testing.T) {
+	const (
+		provider = "projects/123456789012/locations/global/workloadIdentityPools/my-pool/providers/my-provider"
+		issuer   = "https://token.actions.example.com"
+		target   = "target@my-project.iam.gserviceaccount.com"
+	)
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signJWT := func(claims map[string]any) string {
+		enc := func(v any) string {
+			b, err := json.Marshal(v)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return base64.RawURLEncoding.EncodeToString(b)
+		}
+		signed := enc(map[string]string{"alg": "RS256", "kid": "key1", "typ": "JWT"}) + "." + enc(claims)
+		sum := sha256.Sum256([]byte(signed))
+		sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, sum[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+	}
+
+	srv := startServer(t)
+
+	err = srv.SetWorkloadIdentityPoolProviders(fakemetadata.WorkloadIdentityPoolProvider{
+		Name: provider,
+		OIDC: &fakemetadata.OIDCProviderConfig{
+			IssuerURI: issuer,
+			JWKS: fakemetadata.JWKSet{Keys: []fakemetadata.JWK{{
+				Kty: "RSA",
+				Alg: "RS256",
+				Use: "sig",
+				Kid: "key1",
+				N:   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+				E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+			}}},
+		},
+		AttributeMapping: map[string]string{
+			"google.subject":       "assertion.sub",
+			"attribute.repository": "assertion.repository",
+		},
+		AttributeCondition: "assertion.ref == 'refs/heads/main'",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	claims := func(ref string, exp time.Time) map[string]any {
+		return map[string]any{
+			"iss":        issuer,
+			"aud":        "https://iam.googleapis.com/" + provider,
+			"sub":        "repo:org/repo:ref:" + ref,
+			"repository": "org/repo",
+			"ref":        ref,
+			"exp":        exp.Unix(),
+		}
+	}
+	tests := map[string]struct {
+		subjectToken string
+		wantStatus   int
+	}{
+		"Valid": {
+			subjectToken: signJWT(claims("refs/heads/main", time.Now().Add(time.Hour))),
+			wantStatus:   http.StatusOK,
+		},
+		"Expired": {
+			subjectToken: signJWT(claims("refs/heads/main", time.Now().Add(-time.Hour))),
+			wantStatus:   http.StatusBadRequest,
+		},
+		"ConditionNotSatisfied": {
+			subjectToken: signJWT(claims("refs/heads/topic", time.Now().Add(time.Hour))),
+			wantStatus:   http.StatusBadRequest,
+		},
+		"InvalidSignature": {
+			subjectToken: signJWT(claims("refs/heads/main", time.Now().Add(time.Hour)))[:100] + "x",
+			wantStatus:   http.StatusBadRequest,
+		},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			resp, err := http.PostForm("http://"+srv.Addr()+fakemetadata.STSTokenPath, url.Values{
+				"grant_type":         {"urn:ietf:params:oauth:grant-type:token-exchange"},
+				"audience":           {"//iam.googleapis.com/" + provider},
+				"scope":              {"https://www.googleapis.com/auth/cloud-platform"},
+				"subject_token_type": {fakemetadata.TokenTypeJWT},
+				"subject_token":      {tt.subjectToken},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			if resp.StatusCode != tt.wantStatus {
+				t.Fatalf("status = %d, want %d", resp.StatusCode, tt.wantStatus)
+			}
+		})
+	}
+
+	// the external_account credentials exchange the subject token, and impersonate the service account
+	// through the local IAM Credentials service which grants the federated principal set
+	cfg := fakemetadata.IAMCredentials{
+		TokenCreators: map[string][]string{
+			target: {"principalSet://iam.googleapis.com/projects/123456789012/locations/global/workloadIdentityPools/my-pool/attribute.repository/org/repo"},
+		},
+	}
+	if err := srv.EnableLocalIAMCredentials(cfg); err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	tokenFile := filepath.Join(dir, "token")
+	if err := os.WriteFile(tokenFile, []byte(signJWT(claims("refs/heads/main", time.Now().Add(time.Hour)))), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	credsFile := filepath.Join(dir, "credentials.json")
+	err = srv.WriteExternalAccountCredentials(credsFile, fakemetadata.ExternalAccount{
+		Provider:         provider,
+		SubjectTokenFile: tokenFile,
+		ServiceAccount:   target,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(credsFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	creds, err := google.CredentialsFromJSON(context.Background(), data, "https://www.googleapis.com/auth/cloud-platform")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tok, err := creds.TokenSource.Token()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(tok.AccessToken, "ya29.") {
+		t.Fatalf("unexpected access token: %q", tok.AccessToken)
+	}
+
+	// the federation path of the fake metadata server authenticates by the federated access token of ADC
+	err = srv.WriteExternalAccountCredentials(credsFile, fakemetadata.ExternalAccount{
+		Provider:         provider,
+		SubjectTokenFile: tokenFile,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("GOOGLE_APPLICATION_CREDENTIALS", credsFile)
+	if err := srv.SetInstance(fakemetadata.Instance{ServiceAccounts: []fakemetadata.ServiceAccount{{Email: target}}}); err != nil {
+		t.Fatal(err)
+	}
+	srv.EnableWorkloadIdentityFederation()
+
+	getText(t, srv, "instance/service-accounts/default/identity?audience=https://example.com")
+}
+
+func TestSTSSAML(t *testing.T) {
+	const (
+		provider  = "projects/123456789012/locations/global/workloadIdentityPools/my-pool/providers/my-saml"
+		idp       = "https://idp.example.com"
+		dsig      = "http://www.w3.org/2000/09/xmldsig#"
+		assertion = `<saml:Assertion xmlns:saml="urn:oasis:names:tc:SAML:2.0:assertion" ID="_a1" IssueInstant="2024-01-02T03:04:05Z" Version="2.0">`
+	)
+
+	newKey := func() (*rsa.PrivateKey, *x509.Certificate) {
+		key, err := rsa.GenerateKey(rand.Reader, 2048)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tmpl := &x509.Certificate{SerialNumber: big.NewInt(1), NotBefore: time.Now(), NotAfter: time.Now().Add(time.Hour)}
+		der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cert, err := x509.ParseCertificate(der)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return key, cert
+	}
+	key, cert := newKey()
+	otherKey, _ := newKey()
+
+	// newAssertion returns the assertion in the canonical form, which the IdP signs as is
+	newAssertion := func(subject, team, notBefore, notOnOrAfter string) string {
+		var validity string
+		if notBefore != "" {
+			validity += ` NotBefore="` + notBefore + `"`
+		}
+		if notOnOrAfter != "" {
+			validity += ` NotOnOrAfter="` + notOnOrAfter + `"`
+		}
+		return assertion +
+			`<saml:Issuer>` + idp + `</saml:Issuer>` + "\n  " +
+			`<saml:Subject><saml:NameID>` + subject + `</saml:NameID></saml:Subject>` +
+			`<saml:Conditions` + validity + `><saml:AudienceRestriction><saml:Audience>https://iam.googleapis.com/` + provider + `</saml:Audience></saml:AudienceRestriction></saml:Conditions>` +
+			`<saml:AttributeStatement><saml:Attribute Name="team"><saml:AttributeValue>` + team + `</saml:AttributeValue></saml:Attribute></saml:AttributeStatement>` +
+			`</saml:Assertion>`
+	}
+	// sign inserts the enveloped signature of the canonical assertion by key next to the Issuer
+	sign := func(key *rsa.PrivateKey, assertion string) string {
+		digest := sha256.Sum256([]byte(assertion))
+		signedInfo := `<ds:SignedInfo xmlns:ds="` + dsig + `">` +
+			`<ds:CanonicalizationMethod Algorithm="http://www.w3.org/2001/10/xml-exc-c14n#"></ds:CanonicalizationMethod>` +
+			`<ds:SignatureMethod Algorithm="http://www.w3.org/2001/04/xmldsig-more#rsa-sha256"></ds:SignatureMethod>` +
+			`<ds:Reference URI="#_a1"><ds:Transforms>` +
+			`<ds:Transform Algorithm="http://www.w3.org/2000/09/xmldsig#enveloped-signature"></ds:Transform>` +
+			`<ds:Transform Algorithm="http://www.w3.org/2001/10/xml-exc-c14n#"></ds:Transform>` +
+			`</ds:Transforms><ds:DigestMethod Algorithm="http://www.w3.org/2001/04/xmlenc#sha256"></ds:DigestMethod>` +
+			`<ds:DigestValue>` + base64.StdEncoding.EncodeToString(digest[:]) + `</ds:DigestValue></ds:Reference></ds:SignedInfo>`
+		sum := sha256.Sum256([]byte(signedInfo))
+		sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, sum[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// the canonical SignedInfo declares the ds namespace by itself, which the Signature declares in the document
+		signature := `<ds:Signature xmlns:ds="` + dsig + `">` + strings.Replace(signedInfo, ` xmlns:ds="`+dsig+`"`, "", 1) +
+			`<ds:SignatureValue>` + base64.StdEncoding.EncodeToString(sig) + `</ds:SignatureValue></ds:Signature>`
+		i := strings.Index(assertion, "</saml:Issuer>") + len("</saml:Issuer>")
+		return assertion[:i] + signature + assertion[i:]
+	}
+	response := func(assertions ...string) string {
+		return `<samlp:Response xmlns:samlp="urn:oasis:names:tc:SAML:2.0:protocol" ID="_r1" Version="2.0">` + "\n  " +
+			strings.Join(assertions, "\n  ") + "\n</samlp:Response>"
+	}
+
+	srv := startServer(t)
+
+	err := srv.SetWorkloadIdentityPoolProviders(fakemetadata.WorkloadIdentityPoolProvider{
+		Name: provider,
+		SAML: &fakemetadata.SAMLProviderConfig{
+			IdPEntityID:     idp,
+			IdPCertificates: []*x509.Certificate{cert},
+		},
+		AttributeMapping: map[string]string{
+			"google.subject": "assertion.subject",
+			"attribute.team": "assertion.attributes['team'][0]",
+		},
+		AttributeCondition: "attribute.team == 'dev'",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	exchange := func(subjectToken string) *http.Response {
+		t.Helper()
+
+		resp, err := http.PostForm("http://"+srv.Addr()+fakemetadata.STSTokenPath, url.Values{
+			"grant_type":         {"urn:ietf:params:oauth:grant-type:token-exchange"},
+			"audience":           {"//iam.googleapis.com/" + provider},
+			"scope":              {"https://www.googleapis.com/auth/cloud-platform"},
+			"subject_token_type": {fakemetadata.TokenTypeSAML2},
+			"subject_token":      {base64.StdEncoding.EncodeToString([]byte(subjectToken))},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { resp.Body.Close() })
+
+		return resp
+	}
+
+	now := time.Now()
+	notBefore, notOnOrAfter := now.Add(-time.Hour).Format(time.RFC3339), now.Add(time.Hour).Format(time.RFC3339)
+	valid := newAssertion("alice", "dev", notBefore, notOnOrAfter)
+	tests := map[string]struct {
+		subjectToken string
+		wantStatus   int
+	}{
+		"Valid": {
+			subjectToken: sign(key, valid),
+			wantStatus:   http.StatusOK,
+		},
+		"SignedAssertionInResponse": {
+			subjectToken: response(sign(key, valid)),
+			wantStatus:   http.StatusOK,
+		},
+		"Unsigned": {
+			subjectToken: valid,
+			wantStatus:   http.StatusBadRequest,
+		},
+		"UnsignedResponse": {
+			subjectToken: response(valid),
+			wantStatus:   http.StatusBadRequest,
+		},
+		"UntrustedKey": {
+			subjectToken: sign(otherKey, valid),
+			wantStatus:   http.StatusBadRequest,
+		},
+		"Tampered": {
+			subjectToken: strings.Replace(sign(key, valid), "alice", "mallory", 1),
+			wantStatus:   http.StatusBadRequest,
+		},
+		// the response which wraps the unsigned assertion next to the signed one
+		"WrappedAssertion": {
+			subjectToken: response(sign(key, valid), newAssertion("mallory", "dev", notBefore, notOnOrAfter)),
+			wantStatus:   http.StatusBadRequest,
+		},
+		"WrappedAssertionFirst": {
+			subjectToken: response(newAssertion("mallory", "dev", notBefore, notOnOrAfter), sign(key, valid)),
+			wantStatus:   http.StatusBadRequest,
+		},
+		// the unsigned assertion which wraps the signed one as its descendant
+		"AssertionWrappingSignedAssertion": {
+			subjectToken: strings.Replace(strings.Replace(newAssertion("mallory", "dev", notBefore, notOnOrAfter), `ID="_a1"`, `ID="_a2"`, 1),
+				"</saml:Subject>", "</saml:Subject>"+sign(key, valid), 1),
+			wantStatus: http.StatusBadRequest,
+		},
+		// the signature reference could resolve to the other element of the same ID
+		"DuplicateID": {
+			subjectToken: strings.Replace(response(sign(key, valid)), `ID="_r1"`, `ID="_a1"`, 1),
+			wantStatus:   http.StatusBadRequest,
+		},
+		// the exclusive canonicalization without comments drops the comments of the signed content
+		"CommentInSignedContent": {
+			subjectToken: strings.Replace(sign(key, valid), "<saml:NameID>alice", "<saml:NameID>al<!-- comment -->ice", 1),
+			wantStatus:   http.StatusOK,
+		},
+		"WhitespaceInSignedContent": {
+			subjectToken: strings.Replace(sign(key, valid), "\n  <saml:Subject>", "\n    <saml:Subject>", 1),
+			wantStatus:   http.StatusBadRequest,
+		},
+		"WhitespaceOutsideSignedContent": {
+			subjectToken: strings.Replace(response(sign(key, valid)), "\n</samlp:Response>", "\n\n\t</samlp:Response>", 1),
+			wantStatus:   http.StatusOK,
+		},
+		"ConditionNotSatisfied": {
+			subjectToken: sign(key, newAssertion("alice", "ops", notBefore, notOnOrAfter)),
+			wantStatus:   http.StatusBadRequest,
+		},
+		"Expired": {
+			subjectToken: sign(key, newAssertion("alice", "dev", notBefore, now.Add(-time.Minute).Format(time.RFC3339))),
+			wantStatus:   http.StatusBadRequest,
+		},
+		"NotYetValid": {
+			subjectToken: sign(key, newAssertion("alice", "dev", now.Add(time.Minute).Format(time.RFC3339), notOnOrAfter)),
+			wantStatus:   http.StatusBadRequest,
+		},
+		"MissingNotBefore": {
+			subjectToken: sign(key, newAssertion("alice", "dev", "", notOnOrAfter)),
+			wantStatus:   http.StatusBadRequest,
+		},
+		"MissingNotOnOrAfter": {
+			subjectToken: sign(key, newAssertion("alice", "dev", notBefore, "")),
+			wantStatus:   http.StatusBadRequest,
+		},
+		"MalformedNotOnOrAfter": {
+			subjectToken: sign(key, newAssertion("alice", "dev", notBefore, "tomorrow")),
+			wantStatus:   http.StatusBadRequest,
+		},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			if resp := exchange(tt.subjectToken); resp.StatusCode != tt.wantStatus {
+				t.Fatalf("status = %d, want %d", resp.StatusCode, tt.wantStatus)
+			}
+		})
+	}
+
+	// subject returns the subject of the federated access token issued for subjectToken
+	subject := func(subjectToken string) string {
+		t.Helper()
+
+		var tok fakemetadata.TokenResponse
+		if err := json.NewDecoder(exchange(subjectToken).Body).Decode(&tok); err != nil {
+			t.Fatal(err)
+		}
+		infoResp, err := http.PostForm("http://"+srv.Addr()+fakemetadata.TokenInfoPath, url.Values{"access_token": {tok.AccessToken}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer infoResp.Body.Close()
+		var info map[string]string
+		if err := json.NewDecoder(infoResp.Body).Decode(&info); err != nil {
+			t.Fatal(err)
+		}
+
+		return info["sub"]
+	}
+	const subjectPrefix = "principal://iam.googleapis.com/projects/123456789012/locations/global/workloadIdentityPools/my-pool/subject/"
+
+	// the federated access token is issued for the subject of the signed assertion
+	if got, want := subject(sign(key, valid)), subjectPrefix+"alice"; got != want {
+		t.Fatalf("sub = %q, want %q", got, want)
+	}
+
+	// the comment which splits the subject must not truncate it to the prefix
+	signed := sign(key, newAssertion("alice@example.com.evil.example", "dev", notBefore, notOnOrAfter))
+	signed = strings.Replace(signed, "alice@example.com", "alice@example.com<!---->", 1)
+	if got, want := subject(signed), subjectPrefix+"alice@example.com.evil.example"; got != want {
+		t.Fatalf("sub = %q, want %q", got, want)
+	}
+
+	// the SAML provider requires the IdP certificates to verify the signature
+	err = srv.SetWorkloadIdentityPoolProviders(fakemetadata.WorkloadIdentityPoolProvider{
+		Name: provider,
+		SAML: &fakemetadata.SAMLProviderConfig{IdPEntityID: idp},
+	})
+	if err == nil {
+		t.Fatal("SetWorkloadIdentityPoolProviders without IdP certificates succeeded")
+	}
+}
@@ -0,0 +1,124 @@
+// Copyright 2022 The compute-metadata-server Authors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package fakemetadata
+
+import (
+	"context"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+// tokenRefreshMargin is the remaining lifetime of the cached token which triggers the refresh,
+// same as the real metadata server.
+const tokenRefreshMargin = 5 * time.Minute
+
+// tokenFetchTimeout is the timeout of fetching the token, which is detached from the request of the leading caller
+// so that the waiting callers do not fail with the canceled request.
+const tokenFetchTimeout = 30 * time.Second
+
+// tokenCacheKey is the key of the cached tokens.
+type tokenCacheKey struct {
+	source         string // where the token comes from. e.g. "adc", "impersonate"
+	serviceAccount string
+	scopes         string // sorted and comma separated scopes of the access token
+	audience       string // audience of the identity token
+	format         string // format of the identity token
+}
+
+// scopesKey returns the cache key of scopes, which does not depend on the order of scopes.
+func scopesKey(scopes []string) string {
+	scopes = slices.Clone(scopes)
+	slices.Sort(scopes)
+
+	return strings.Join(slices.Compact(scopes), ",")
+}
+
+// cachedToken is the cached token of the tokenCacheKey.
+type cachedToken struct {
+	mu      sync.Mutex // guard of below fields, and held while refreshing the token
+	tok     *oauth2.Token
+	fetched time.Time
+}
+
+// valid reports whether the cached token can be served at now.
+func (c *cachedToken) valid(now time.Time) bool {
+	if c.tok == nil || c.tok.Expiry.IsZero() {
+		return false
+	}
+
+	margin := min(tokenRefreshMargin, c.tok.Expiry.Sub(c.fetched)/4)
+
+	return now.Before(c.tok.Expiry.Add(-margin))
+}
+
+// tokenCache caches the access and identity tokens, and collapses the concurrent refreshes of the same key into one.
+//
+// The zero value is valid and ready to use.
+type tokenCache struct {
+	mu      sync.Mutex // guard of entries
+	entries map[tokenCacheKey]*cachedToken
+}
+
+// token returns the cached token of key, or the token fetched by fetch if no valid token is cached.
+//
+// The concurrent calls of the same key wait for the single fetch. The fetch context keeps the values of ctx,
+// but is not canceled with ctx and times out after tokenFetchTimeout.
+// The expired tokens of the other keys are removed from the cache.
+func (c *tokenCache) token(ctx context.Context, key tokenCacheKey, now time.Time, fetch func(ctx context.Context) (*oauth2.Token, error)) (*oauth2.Token, error) {
+	c.mu.Lock()
+	if c.entries == nil {
+		c.entries = make(map[tokenCacheKey]*cachedToken)
+	}
+	c.pruneLocked(key, now)
+	entry, ok := c.entries[key]
+	if !ok {
+		entry = &cachedToken{}
+		c.entries[key] = entry
+	}
+	c.mu.Unlock()
+
+	entry.mu.Lock()
+	defer entry.mu.Unlock()
+
+	if entry.valid(now) {
+		return entry.tok, nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), tokenFetchTimeout)
+	defer cancel()
+
+	tok, err := fetch(ctx)
+	if err != nil {
+		return nil, err
+	}
+	entry.tok, entry.fetched = tok, now
+
+	return tok, nil
+}
+
+// pruneLocked removes the expired tokens other than key at now. The entries being fetched are kept.
+//
+// The caller must hold c.mu.
+func (c *tokenCache) pruneLocked(key tokenCacheKey, now time.Time) {
+	for k, entry := range c.entries {
+		if k == key || !entry.mu.TryLock() {
+			continue
+		}
+		if entry.tok != nil && !now.Before(entry.tok.Expiry) {
+			delete(c.entries, k)
+		}
+		entry.mu.Unlock()
+	}
+}
+
+// flush removes all of the cached tokens.
+func (c *tokenCache) flush() {
+	c.mu.Lock()
+	c.entries = nil
+	c.mu.Unlock()
+}
@@ -0,0 +1,159 @@
+// Copyright 2022 The compute-metadata-server Authors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package fakemetadata
+
+import (
+	"context"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+func TestCachedTokenValid(t *testing.T) {
+	fetched := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	tests := map[string]struct {
+		tok  *oauth2.Token
+		now  time.Time
+		want bool
+	}{
+		"NoToken": {
+			now: fetched,
+		},
+		"NoExpiry": {
+			tok: &oauth2.Token{AccessToken: "tok"},
+			now: fetched,
+		},
+		"Fresh": {
+			tok:  &oauth2.Token{AccessToken: "tok", Expiry: fetched.Add(time.Hour)},
+			now:  fetched,
+			want: true,
+		},
+		"BeforeRefreshMargin": {
+			tok:  &oauth2.Token{AccessToken: "tok", Expiry: fetched.Add(time.Hour)},
+			now:  fetched.Add(time.Hour - tokenRefreshMargin - time.Nanosecond),
+			want: true,
+		},
+		"AtRefreshMargin": {
+			tok: &oauth2.Token{AccessToken: "tok", Expiry: fetched.Add(time.Hour)},
+			now: fetched.Add(time.Hour - tokenRefreshMargin),
+		},
+		"Expired": {
+			tok: &oauth2.Token{AccessToken: "tok", Expiry: fetched.Add(time.Hour)},
+			now: fetched.Add(time.Hour),
+		},
+		// the short-lived token is refreshed at the last quarter of the lifetime instead of tokenRefreshMargin
+		"ShortLivedBeforeMargin": {
+			tok:  &oauth2.Token{AccessToken: "tok", Expiry: fetched.Add(4 * time.Minute)},
+			now:  fetched.Add(3*time.Minute - time.Nanosecond),
+			want: true,
+		},
+		"ShortLivedAtMargin": {
+			tok: &oauth2.Token{AccessToken: "tok", Expiry: fetched.Add(4 * time.Minute)},
+			now: fetched.Add(3 * time.Minute),
+		},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			c := &cachedToken{tok: tt.tok, fetched: fetched}
+			if got := c.valid(tt.now); got != tt.want {
+				t.Fatalf("valid(%s) = %t, want %t", tt.now.Sub(fetched), got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTokenCache(t *testing.T) {
+	now := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	var (
+		c       tokenCache
+		fetches atomic.Int32
+	)
+	fetch := func(context.Context) (*oauth2.Token, error) {
+		n := fetches.Add(1)
+		return &oauth2.Token{AccessToken: "tok" + strconv.Itoa(int(n)), Expiry: now.Add(time.Hour)}, nil
+	}
+	key := tokenCacheKey{source: "offline", serviceAccount: "sa@my-project.iam.gserviceaccount.com", scopes: scopesKey([]string{"scope2", "scope1"})}
+
+	// the concurrent calls of the same key wait for the single fetch
+	const n = 10
+	toks := make([]*oauth2.Token, n)
+	var wg sync.WaitGroup
+	for i := range n {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			toks[i], _ = c.token(context.Background(), key, now, fetch)
+		}()
+	}
+	wg.Wait()
+	if got := fetches.Load(); got != 1 {
+		t.Fatalf("fetches = %d, want 1", got)
+	}
+	for _, tok := range toks {
+		if tok == nil || tok.AccessToken != "tok1" {
+			t.Fatalf("token = %+v, want tok1", tok)
+		}
+	}
+
+	// the order of scopes does not matter
+	sameKey := key
+	sameKey.scopes = scopesKey([]string{"scope1", "scope2", "scope1"})
+	if tok, _ := c.token(context.Background(), sameKey, now.Add(time.Minute), fetch); tok.AccessToken != "tok1" {
+		t.Fatalf("token of the same scopes = %q, want tok1", tok.AccessToken)
+	}
+	otherKey := key
+	otherKey.scopes = scopesKey([]string{"scope1"})
+	if tok, _ := c.token(context.Background(), otherKey, now, fetch); tok.AccessToken == "tok1" {
+		t.Fatal("token of the different scopes is shared")
+	}
+
+	// the token is refreshed in the refresh margin
+	if tok, _ := c.token(context.Background(), key, now.Add(time.Hour-tokenRefreshMargin), fetch); tok.AccessToken == "tok1" {
+		t.Fatal("token in the refresh margin is served")
+	}
+
+	// the expired tokens of the other keys are removed
+	later := now.Add(2 * time.Hour)
+	if _, err := c.token(context.Background(), key, later, fetch); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := c.entries[otherKey]; ok {
+		t.Fatal("expired token is not removed from the cache")
+	}
+	if _, ok := c.entries[key]; !ok {
+		t.Fatal("token of the requested key is removed from the cache")
+	}
+}
+
+func TestTokenCacheFetchContext(t *testing.T) {
+	type ctxKey struct{}
+
+	ctx, cancel := context.WithCancel(context.WithValue(context.Background(), ctxKey{}, "value"))
+	cancel()
+
+	// the fetch is not canceled with the request of the leading caller, but keeps its values and has a deadline
+	var c tokenCache
+	_, err := c.token(ctx, tokenCacheKey{source: "test"}, time.Now(), func(ctx context.Context) (*oauth2.Token, error) {
+		if err := ctx.Err(); err != nil {
+			t.Errorf("fetch context is canceled: %v", err)
+		}
+		if got := ctx.Value(ctxKey{}); got != "value" {
+			t.Errorf("fetch context value = %v, want %q", got, "value")
+		}
+		if deadline, ok := ctx.Deadline(); !ok || time.Until(deadline) > tokenFetchTimeout {
+			t.Errorf("fetch context deadline = %v, %t, want within %s", deadline, ok, tokenFetchTimeout)
+		}
+
+		return &oauth2.Token{AccessToken: "tok"}, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
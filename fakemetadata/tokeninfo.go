@@ -0,0 +1,167 @@
+// Copyright 2022 The compute-metadata-server Authors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package fakemetadata
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	json "github.com/goccy/go-json"
+	"github.com/google/go-safeweb/safehttp"
+)
+
+// List of the paths of the tokeninfo endpoints.
+const (
+	// TokenInfoPath is the path of the tokeninfo endpoint, same as https://oauth2.googleapis.com/tokeninfo.
+	TokenInfoPath = "/tokeninfo"
+
+	// LegacyTokenInfoPath is the path of the tokeninfo endpoint, same as https://www.googleapis.com/oauth2/v3/tokeninfo.
+	LegacyTokenInfoPath = "/oauth2/v3/tokeninfo"
+)
+
+// TokenInfoHandler serves the tokeninfo endpoint, which introspects the access tokens and identity tokens
+// issued by the fake metadata server, the local IAM Credentials service and the local STS endpoint.
+//
+// As Google does, all values of the response are the strings, and the invalid tokens are reported by
+// the 400 response of the invalid_token error.
+//
+// See: https://developers.google.com/identity/sign-in/web/backend-auth#calling-the-tokeninfo-endpoint
+type TokenInfoHandler struct {
+	instance *InstanceHandler
+	sts      *STSHandler
+}
+
+// RegisterHandlers registers the tokeninfo handlers to mux.
+func (h *TokenInfoHandler) RegisterHandlers(mux *safehttp.ServeMux) {
+	for _, path := range []string{TokenInfoPath, LegacyTokenInfoPath} {
+		mux.Handle(path, safehttp.MethodGet, h.TokenInfo(), noMetadataFlavor{})
+		mux.Handle(path, safehttp.MethodPost, h.TokenInfo(), noMetadataFlavor{})
+	}
+}
+
+// TokenInfo returns the information of the access_token or id_token parameter.
+func (h *TokenInfoHandler) TokenInfo() safehttp.Handler {
+	return safehttp.HandlerFunc(func(w safehttp.ResponseWriter, r *safehttp.IncomingRequest) safehttp.Result {
+		query, err := r.URL().Query()
+		form := &query
+		if r.Method() == safehttp.MethodPost {
+			form, err = r.PostForm()
+		}
+		if err != nil {
+			return w.WriteError(NewOAuthError("invalid_request", err.Error(), safehttp.StatusBadRequest))
+		}
+
+		now := time.Now()
+		var (
+			info map[string]string
+			oerr safehttp.ErrorResponse
+		)
+		switch accessToken, idToken := form.String("access_token", ""), form.String("id_token", ""); {
+		case accessToken != "":
+			info, oerr = h.accessTokenInfo(accessToken, now)
+		case idToken != "":
+			info, oerr = h.idTokenInfo(idToken, now)
+		default:
+			return w.WriteError(NewOAuthError("invalid_request", "either access_token or id_token is required", safehttp.StatusBadRequest))
+		}
+		if oerr != nil {
+			return w.WriteError(oerr)
+		}
+
+		return WriteJSON(w, info)
+	})
+}
+
+// List of the tokeninfo errors.
+var (
+	errInvalidToken = NewOAuthError("invalid_token", "Invalid Value", safehttp.StatusBadRequest)
+	errExpiredToken = NewOAuthError("invalid_token", "Token has been expired or revoked.", safehttp.StatusBadRequest)
+)
+
+// lookupAccessToken returns the issued access token of accessToken.
+func (h *TokenInfoHandler) lookupAccessToken(accessToken string) (OfflineToken, bool) {
+	if tok, ok := h.instance.lookupOfflineToken(accessToken); ok {
+		return tok, true
+	}
+	if l := h.instance.localIAMCredentialsModel(); l != nil {
+		if tok, ok := l.iam.tokens.lookup(accessToken); ok {
+			return tok, true
+		}
+	}
+
+	return h.sts.tokens.lookup(accessToken)
+}
+
+// accessTokenInfo returns the tokeninfo of the access token.
+func (h *TokenInfoHandler) accessTokenInfo(accessToken string, now time.Time) (map[string]string, safehttp.ErrorResponse) {
+	tok, ok := h.lookupAccessToken(accessToken)
+	if !ok {
+		return nil, errInvalidToken
+	}
+	if !now.Before(tok.Expiry) {
+		return nil, errExpiredToken
+	}
+
+	info := map[string]string{
+		"scope":       strings.Join(tok.Scopes, " "),
+		"exp":         strconv.FormatInt(tok.Expiry.Unix(), 10),
+		"expires_in":  strconv.FormatInt(int64(tok.Expiry.Sub(now).Seconds()), 10),
+		"access_type": "online",
+	}
+	if strings.HasPrefix(tok.ServiceAccount, "principal://") {
+		// the federated access tokens have no email and client
+		info["sub"] = tok.ServiceAccount
+		return info, nil
+	}
+
+	id := serviceAccountUniqueID(tok.ServiceAccount)
+	info["azp"] = id
+	info["aud"] = id
+	info["sub"] = id
+	info["email"] = tok.ServiceAccount
+	info["email_verified"] = "true"
+
+	return info, nil
+}
+
+// idTokenInfo returns the tokeninfo of the identity token signed by the fake metadata server.
+func (h *TokenInfoHandler) idTokenInfo(idToken string, now time.Time) (map[string]string, safehttp.ErrorResponse) {
+	jwks, err := h.instance.idTokenSigner.jwks()
+	if err != nil {
+		return nil, NewOAuthError("server_error", err.Error(), safehttp.StatusInternalServerError)
+	}
+	kid, claims, err := verifyRS256JWT(idToken, jwks)
+	if err != nil {
+		return nil, errInvalidToken
+	}
+	if exp, ok := claims["exp"].(float64); !ok || !now.Before(time.Unix(int64(exp), 0)) {
+		return nil, errExpiredToken
+	}
+
+	info := map[string]string{
+		"alg": "RS256",
+		"kid": kid,
+		"typ": "JWT",
+	}
+	for name, v := range claims {
+		switch v := v.(type) {
+		case string:
+			info[name] = v
+		case float64:
+			info[name] = strconv.FormatInt(int64(v), 10)
+		case bool:
+			info[name] = strconv.FormatBool(v)
+		default:
+			b, err := json.Marshal(v)
+			if err != nil {
+				return nil, NewOAuthError("server_error", fmt.Sprintf("could not encode %s claim: %v", name, err), safehttp.StatusInternalServerError)
+			}
+			info[name] = string(b)
+		}
+	}
+
+	return info, nil
+}
@@ -0,0 +1,200 @@
+// Copyright 2022 The compute-metadata-server Authors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package fakemetadata_test
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	json "github.com/goccy/go-json"
+
+	iamcredentials "cloud.google.com/go/iam/credentials/apiv1"
+	"cloud.google.com/go/iam/credentials/apiv1/credentialspb"
+
+	"github.com/zchee/compute-metadata-server/fakemetadata"
+)
+
+func TestTokenInfo(t *testing.T) {
+	const (
+		email    = "sa@my-project.iam.gserviceaccount.com"
+		target   = "target@my-project.iam.gserviceaccount.com"
+		caller   = "dev@example.com"
+		provider = "projects/123456789012/locations/global/workloadIdentityPools/my-pool/providers/local-oidc"
+		audience = "https://example.com"
+	)
+	t.Setenv("GOOGLE_ACCOUNT_EMAIL", email)
+
+	srv := startServer(t)
+
+	if err := srv.SetProject(fakemetadata.Project{ProjectID: "my-project", NumericProjectID: 123456789012}); err != nil {
+		t.Fatal(err)
+	}
+	inst := fakemetadata.Instance{
+		ID:                42,
+		Name:              "vm-1",
+		Zone:              "us-central1-a",
+		CreationTimestamp: time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC),
+	}
+	if err := srv.SetInstance(inst); err != nil {
+		t.Fatal(err)
+	}
+	if err := srv.EnableOfflineTokens(fakemetadata.OfflineTokens{}); err != nil {
+		t.Fatal(err)
+	}
+	srv.EnableLocalIDToken()
+
+	var tok fakemetadata.TokenResponse
+	getJSON(t, srv, "instance/service-accounts/default/token?scopes=scope1,scope2", &tok)
+	idToken := getText(t, srv, "instance/service-accounts/default/identity?audience="+audience)
+	fullIDToken := getText(t, srv, "instance/service-accounts/default/identity?audience="+audience+"&format=full")
+
+	// the access token of the local IAM Credentials service
+	cfg := fakemetadata.IAMCredentials{
+		TokenCreators: map[string][]string{target: {"user:" + caller}},
+		Caller:        "user:" + caller,
+	}
+	if err := srv.EnableLocalIAMCredentials(cfg); err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	client, err := iamcredentials.NewIamCredentialsClient(ctx, srv.IAMCredentialsClientOptions()...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Close() })
+	iamTok, err := client.GenerateAccessToken(ctx, &credentialspb.GenerateAccessTokenRequest{
+		Name:  "projects/-/serviceAccounts/" + target,
+		Scope: []string{"scope3"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the federated access token of the local STS endpoint
+	if err := srv.EnableLocalOIDCProvider(fakemetadata.OIDCProvider{DefaultAudience: []string{"https://iam.googleapis.com/" + provider}}); err != nil {
+		t.Fatal(err)
+	}
+	oidc, err := srv.LocalOIDCProviderConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := srv.SetWorkloadIdentityPoolProviders(fakemetadata.WorkloadIdentityPoolProvider{Name: provider, OIDC: oidc}); err != nil {
+		t.Fatal(err)
+	}
+	subjectToken, err := srv.MintSubjectToken(fakemetadata.SubjectToken{Subject: "repo:org/repo"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var stsTok struct {
+		AccessToken string `json:"access_token"`
+	}
+	postForm(t, srv, fakemetadata.STSTokenPath, url.Values{
+		"grant_type":         {"urn:ietf:params:oauth:grant-type:token-exchange"},
+		"audience":           {"//iam.googleapis.com/" + provider},
+		"scope":              {"scope4"},
+		"subject_token_type": {fakemetadata.TokenTypeJWT},
+		"subject_token":      {subjectToken},
+	}, http.StatusOK, &stsTok)
+
+	tests := map[string]struct {
+		params     url.Values
+		wantStatus int
+		want       map[string]string
+	}{
+		"AccessToken": {
+			params:     url.Values{"access_token": {tok.AccessToken}},
+			wantStatus: http.StatusOK,
+			want:       map[string]string{"email": email, "scope": "scope1 scope2"},
+		},
+		"IAMCredentialsAccessToken": {
+			params:     url.Values{"access_token": {iamTok.GetAccessToken()}},
+			wantStatus: http.StatusOK,
+			want:       map[string]string{"email": target, "email_verified": "true", "scope": "scope3"},
+		},
+		"FederatedAccessToken": {
+			params:     url.Values{"access_token": {stsTok.AccessToken}},
+			wantStatus: http.StatusOK,
+			want: map[string]string{
+				"sub":   "principal://iam.googleapis.com/projects/123456789012/locations/global/workloadIdentityPools/my-pool/subject/repo:org/repo",
+				"scope": "scope4",
+				"email": "",
+			},
+		},
+		"IDToken": {
+			params:     url.Values{"id_token": {idToken}},
+			wantStatus: http.StatusOK,
+			want:       map[string]string{"email": email, "aud": audience, "iss": fakemetadata.IDTokenIssuer, "google": ""},
+		},
+		// the google claim is encoded as the JSON string, as all values of the tokeninfo are the strings
+		"FullIDToken": {
+			params:     url.Values{"id_token": {fullIDToken}},
+			wantStatus: http.StatusOK,
+			want: map[string]string{
+				"email":  email,
+				"google": `{"compute_engine":{"instance_creation_timestamp":1704164645,"instance_id":"42","instance_name":"vm-1","project_id":"my-project","project_number":123456789012,"zone":"us-central1-a"}}`,
+			},
+		},
+		"ForeignToken": {
+			params:     url.Values{"access_token": {"ya29.foreign"}},
+			wantStatus: http.StatusBadRequest,
+			want:       map[string]string{"error": "invalid_token", "error_description": "Invalid Value"},
+		},
+		"NoToken": {
+			params:     url.Values{},
+			wantStatus: http.StatusBadRequest,
+			want:       map[string]string{"error": "invalid_request"},
+		},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			var info map[string]string
+			postForm(t, srv, fakemetadata.TokenInfoPath, tt.params, tt.wantStatus, &info)
+			for k, v := range tt.want {
+				if info[k] != v {
+					t.Fatalf("%s = %q, want %q: %v", k, info[k], v, info)
+				}
+			}
+		})
+	}
+}
+
+func TestTokenInfoExpired(t *testing.T) {
+	t.Setenv("GOOGLE_ACCOUNT_EMAIL", "sa@my-project.iam.gserviceaccount.com")
+
+	srv := startServer(t)
+
+	if err := srv.EnableOfflineTokens(fakemetadata.OfflineTokens{Lifetime: time.Second}); err != nil {
+		t.Fatal(err)
+	}
+
+	var tok fakemetadata.TokenResponse
+	getJSON(t, srv, "instance/service-accounts/default/token", &tok)
+	time.Sleep(time.Second + 100*time.Millisecond)
+
+	var info map[string]string
+	postForm(t, srv, fakemetadata.TokenInfoPath, url.Values{"access_token": {tok.AccessToken}}, http.StatusBadRequest, &info)
+	if info["error"] != "invalid_token" || info["error_description"] != "Token has been expired or revoked." {
+		t.Fatalf("unexpected error response: %v", info)
+	}
+}
+
+// postForm posts params to path of srv, and decodes the JSON response of wantStatus to v.
+func postForm(t *testing.T, srv *fakemetadata.Server, path string, params url.Values, wantStatus int, v any) {
+	t.Helper()
+
+	resp, err := http.PostForm("http://"+srv.Addr()+path, params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != wantStatus {
+		t.Fatalf("status = %d, want %d", resp.StatusCode, wantStatus)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		t.Fatal(err)
+	}
+}
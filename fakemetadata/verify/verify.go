@@ -0,0 +1,290 @@
+// Copyright 2022 The compute-metadata-server Authors
+// SPDX-License-Identifier: BSD-3-Clause
+
+// Package verify provides the validator of the identity tokens issued by the fake metadata server,
+// and the HTTP middleware and gRPC interceptors for the services which receive them.
+//
+// The Validator has the same API shape as the idtoken.Validator used in production, so the same test can drive
+// both the callers fetching the identity tokens from the fake metadata server and the services validating them.
+package verify
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+
+	json "github.com/goccy/go-json"
+	"google.golang.org/api/idtoken"
+	"google.golang.org/api/option"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	"github.com/zchee/compute-metadata-server/fakemetadata"
+)
+
+// List of the validation errors.
+var (
+	// ErrNoToken is the error of the requests without the bearer token.
+	ErrNoToken = errors.New("no bearer token")
+
+	// ErrEmailNotAllowed is the error of the identity tokens whose email is not in Config.AllowedEmails.
+	ErrEmailNotAllowed = errors.New("email is not allowed")
+
+	// ErrComputeEngineClaims is the error of the identity tokens whose google.compute_engine claim does not satisfy Config.
+	ErrComputeEngineClaims = errors.New("compute engine claims are not satisfied")
+)
+
+// Config configures the Validator.
+type Config struct {
+	// Addr is the address of the fake metadata server which signs the identity tokens.
+	//
+	// If empty, the GCE_METADATA_HOST environment variable, which the fake metadata server sets, is used.
+	Addr string
+
+	// AllowedEmails is the list of the email claims of the allowed callers. If empty, any email is allowed.
+	AllowedEmails []string
+
+	// RequireComputeEngine requires the google.compute_engine claim of the full format identity tokens.
+	RequireComputeEngine bool
+
+	// ProjectID is the project_id of the google.compute_engine claim if not empty. It implies RequireComputeEngine.
+	ProjectID string
+
+	// AllowedProjectNumbers is the list of the allowed project_number of the google.compute_engine claim.
+	// If empty, any project number is allowed, otherwise it implies RequireComputeEngine.
+	AllowedProjectNumbers []int64
+
+	// AllowedZones is the list of the allowed zone of the google.compute_engine claim.
+	// If empty, any zone is allowed, otherwise it implies RequireComputeEngine.
+	AllowedZones []string
+
+	// AllowedInstanceIDs is the list of the allowed instance_id of the google.compute_engine claim.
+	// If empty, any instance ID is allowed, otherwise it implies RequireComputeEngine.
+	AllowedInstanceIDs []string
+
+	// AllowedInstanceNames is the list of the allowed instance_name of the google.compute_engine claim.
+	// If empty, any instance name is allowed, otherwise it implies RequireComputeEngine.
+	AllowedInstanceNames []string
+}
+
+// requiresComputeEngine reports whether c checks the google.compute_engine claim.
+func (c Config) requiresComputeEngine() bool {
+	return c.RequireComputeEngine || c.ProjectID != "" || len(c.AllowedProjectNumbers) > 0 ||
+		len(c.AllowedZones) > 0 || len(c.AllowedInstanceIDs) > 0 || len(c.AllowedInstanceNames) > 0
+}
+
+// Validator validates the identity tokens issued by the fake metadata server.
+type Validator struct {
+	cfg       Config
+	validator *idtoken.Validator
+}
+
+// NewValidator returns the new Validator of cfg.
+func NewValidator(ctx context.Context, cfg Config) (*Validator, error) {
+	if cfg.Addr == "" {
+		cfg.Addr = os.Getenv(fakemetadata.MetadataHostEnv)
+	}
+	if cfg.Addr == "" {
+		return nil, fmt.Errorf("could not find the fake metadata server: %s is not set", fakemetadata.MetadataHostEnv)
+	}
+
+	client := &http.Client{
+		Transport: fakemetadata.CertsTransport(cfg.Addr, http.DefaultTransport),
+	}
+	validator, err := idtoken.NewValidator(ctx, option.WithHTTPClient(client))
+	if err != nil {
+		return nil, fmt.Errorf("could not create idtoken validator: %w", err)
+	}
+
+	return &Validator{cfg: cfg, validator: validator}, nil
+}
+
+// Validate validates the identity token of audience, and returns its payload.
+//
+// In addition to the signature, issuer, audience and expiry, the email and google.compute_engine claims are checked by Config.
+func (v *Validator) Validate(ctx context.Context, idToken, audience string) (*idtoken.Payload, error) {
+	payload, err := v.validator.Validate(ctx, idToken, audience)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(v.cfg.AllowedEmails) > 0 {
+		email, _ := payload.Claims["email"].(string)
+		if !slices.Contains(v.cfg.AllowedEmails, email) {
+			return nil, fmt.Errorf("%w: %q", ErrEmailNotAllowed, email)
+		}
+	}
+
+	if v.cfg.requiresComputeEngine() {
+		claims, err := computeEngineClaims(payload)
+		if err != nil {
+			return nil, err
+		}
+		switch {
+		case v.cfg.ProjectID != "" && claims.ProjectID != v.cfg.ProjectID:
+			return nil, fmt.Errorf("%w: project_id %q is not %q", ErrComputeEngineClaims, claims.ProjectID, v.cfg.ProjectID)
+		case len(v.cfg.AllowedProjectNumbers) > 0 && !slices.Contains(v.cfg.AllowedProjectNumbers, claims.ProjectNumber):
+			return nil, fmt.Errorf("%w: project_number %d is not allowed", ErrComputeEngineClaims, claims.ProjectNumber)
+		case len(v.cfg.AllowedZones) > 0 && !slices.Contains(v.cfg.AllowedZones, claims.Zone):
+			return nil, fmt.Errorf("%w: zone %q is not allowed", ErrComputeEngineClaims, claims.Zone)
+		case len(v.cfg.AllowedInstanceIDs) > 0 && !slices.Contains(v.cfg.AllowedInstanceIDs, claims.InstanceID):
+			return nil, fmt.Errorf("%w: instance_id %q is not allowed", ErrComputeEngineClaims, claims.InstanceID)
+		case len(v.cfg.AllowedInstanceNames) > 0 && !slices.Contains(v.cfg.AllowedInstanceNames, claims.InstanceName):
+			return nil, fmt.Errorf("%w: instance_name %q is not allowed", ErrComputeEngineClaims, claims.InstanceName)
+		}
+	}
+
+	return payload, nil
+}
+
+// computeEngineClaims returns the google.compute_engine claim of payload.
+func computeEngineClaims(payload *idtoken.Payload) (*fakemetadata.ComputeEngineClaims, error) {
+	google, ok := payload.Claims["google"]
+	if !ok {
+		return nil, fmt.Errorf("%w: no google claim", ErrComputeEngineClaims)
+	}
+	b, err := json.Marshal(google)
+	if err != nil {
+		return nil, fmt.Errorf("could not encode google claim: %w", err)
+	}
+
+	var claims fakemetadata.GoogleClaims
+	if err := json.Unmarshal(b, &claims); err != nil {
+		return nil, fmt.Errorf("%w: could not decode google claim: %v", ErrComputeEngineClaims, err)
+	}
+	if claims.ComputeEngine.InstanceID == "" {
+		return nil, fmt.Errorf("%w: no compute_engine claim", ErrComputeEngineClaims)
+	}
+
+	return &claims.ComputeEngine, nil
+}
+
+// payloadKey is the context key of the validated payload.
+type payloadKey struct{}
+
+// PayloadFromContext returns the payload of the identity token validated by the middleware or interceptors.
+func PayloadFromContext(ctx context.Context) (*idtoken.Payload, bool) {
+	payload, ok := ctx.Value(payloadKey{}).(*idtoken.Payload)
+	return payload, ok
+}
+
+// bearerToken returns the bearer token of the authorization header value.
+func bearerToken(auth string) (string, error) {
+	scheme, token, ok := strings.Cut(auth, " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") || token == "" {
+		return "", ErrNoToken
+	}
+
+	return token, nil
+}
+
+// mustAudience panics if audience is empty, because idtoken.Validator accepts the tokens of any audience for it.
+func mustAudience(audience string) {
+	if audience == "" {
+		panic("verify: audience must not be empty")
+	}
+}
+
+// Handler returns the http.Handler which calls next only if the request has the valid identity token of audience
+// in the Authorization header. The validated payload is available by PayloadFromContext.
+//
+// The requests without the valid token are responded with 401, and the disallowed callers with 403.
+// It panics if audience is empty.
+func (v *Validator) Handler(audience string, next http.Handler) http.Handler {
+	mustAudience(audience)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, err := bearerToken(r.Header.Get("Authorization"))
+		if err != nil {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+
+		payload, err := v.Validate(r.Context(), token, audience)
+		switch {
+		case errors.Is(err, ErrEmailNotAllowed), errors.Is(err, ErrComputeEngineClaims):
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		case err != nil:
+			w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), payloadKey{}, payload)))
+	})
+}
+
+// authorize validates the identity token of audience in the authorization metadata of ctx, and returns the context
+// which has the validated payload.
+func (v *Validator) authorize(ctx context.Context, audience string) (context.Context, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	auth := md.Get("authorization")
+	if len(auth) == 0 {
+		return nil, status.Error(codes.Unauthenticated, ErrNoToken.Error())
+	}
+	token, err := bearerToken(auth[0])
+	if err != nil {
+		return nil, status.Error(codes.Unauthenticated, err.Error())
+	}
+
+	payload, err := v.Validate(ctx, token, audience)
+	switch {
+	case errors.Is(err, ErrEmailNotAllowed), errors.Is(err, ErrComputeEngineClaims):
+		return nil, status.Error(codes.PermissionDenied, err.Error())
+	case err != nil:
+		return nil, status.Error(codes.Unauthenticated, err.Error())
+	}
+
+	return context.WithValue(ctx, payloadKey{}, payload), nil
+}
+
+// UnaryServerInterceptor returns the grpc.UnaryServerInterceptor which validates the identity token of audience
+// in the authorization metadata. The validated payload is available by PayloadFromContext.
+// It panics if audience is empty.
+func (v *Validator) UnaryServerInterceptor(audience string) grpc.UnaryServerInterceptor {
+	mustAudience(audience)
+
+	return func(ctx context.Context, req any, _ *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		ctx, err := v.authorize(ctx, audience)
+		if err != nil {
+			return nil, err
+		}
+
+		return handler(ctx, req)
+	}
+}
+
+// StreamServerInterceptor returns the grpc.StreamServerInterceptor which validates the identity token of audience
+// in the authorization metadata. The validated payload is available by PayloadFromContext of the stream context.
+// It panics if audience is empty.
+func (v *Validator) StreamServerInterceptor(audience string) grpc.StreamServerInterceptor {
+	mustAudience(audience)
+
+	return func(srv any, ss grpc.ServerStream, _ *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		ctx, err := v.authorize(ss.Context(), audience)
+		if err != nil {
+			return err
+		}
+
+		return handler(srv, &serverStream{ServerStream: ss, ctx: ctx})
+	}
+}
+
+// serverStream is the grpc.ServerStream which has the context of the validated payload.
+type serverStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+// Context implements grpc.ServerStream.
+func (s *serverStream) Context() context.Context {
+	return s.ctx
+}
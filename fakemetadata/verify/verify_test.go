@@ -0,0 +1,195 @@
+// Copyright 2022 The compute-metadata-server Authors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package verify_test
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	"github.com/zchee/compute-metadata-server/fakemetadata"
+	"github.com/zchee/compute-metadata-server/fakemetadata/verify"
+)
+
+func TestValidator(t *testing.T) {
+	const (
+		email    = "caller@my-project.iam.gserviceaccount.com"
+		audience = "https://service.example.com"
+	)
+	t.Setenv("GOOGLE_ACCOUNT_EMAIL", email)
+
+	srv := fakemetadata.NewServer()
+	l, err := net.Listen("tcp", srv.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.Serve(l)
+	t.Cleanup(func() { srv.Close() })
+
+	if err := srv.SetProject(fakemetadata.Project{ProjectID: "my-project", NumericProjectID: 123456789012}); err != nil {
+		t.Fatal(err)
+	}
+	if err := srv.SetInstance(fakemetadata.Instance{ID: 42, Name: "vm-1", Zone: "us-central1-a"}); err != nil {
+		t.Fatal(err)
+	}
+	srv.EnableLocalIDToken()
+
+	req, err := http.NewRequest(http.MethodGet, "http://"+srv.Addr()+"/computeMetadata/v1/instance/service-accounts/default/identity?format=full&audience="+audience, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set(fakemetadata.MetadataFlavorHeader, fakemetadata.MetadataFlavorValue)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d: %s", resp.StatusCode, b)
+	}
+	idToken := string(b)
+
+	tests := map[string]struct {
+		cfg        verify.Config
+		token      string
+		wantStatus int
+		wantCode   codes.Code
+	}{
+		"Allowed": {
+			cfg:        verify.Config{AllowedEmails: []string{email}, ProjectID: "my-project"},
+			token:      idToken,
+			wantStatus: http.StatusOK,
+			wantCode:   codes.OK,
+		},
+		"EmailNotAllowed": {
+			cfg:        verify.Config{AllowedEmails: []string{"other@my-project.iam.gserviceaccount.com"}},
+			token:      idToken,
+			wantStatus: http.StatusForbidden,
+			wantCode:   codes.PermissionDenied,
+		},
+		"ProjectMismatch": {
+			cfg:        verify.Config{ProjectID: "other-project"},
+			token:      idToken,
+			wantStatus: http.StatusForbidden,
+			wantCode:   codes.PermissionDenied,
+		},
+		"InstanceAllowed": {
+			cfg: verify.Config{
+				AllowedProjectNumbers: []int64{123456789012},
+				AllowedZones:          []string{"us-east1-b", "us-central1-a"},
+				AllowedInstanceIDs:    []string{"42"},
+				AllowedInstanceNames:  []string{"vm-1"},
+			},
+			token:      idToken,
+			wantStatus: http.StatusOK,
+			wantCode:   codes.OK,
+		},
+		"ProjectNumberNotAllowed": {
+			cfg:        verify.Config{AllowedProjectNumbers: []int64{210987654321}},
+			token:      idToken,
+			wantStatus: http.StatusForbidden,
+			wantCode:   codes.PermissionDenied,
+		},
+		"ZoneNotAllowed": {
+			cfg:        verify.Config{AllowedZones: []string{"us-east1-b"}},
+			token:      idToken,
+			wantStatus: http.StatusForbidden,
+			wantCode:   codes.PermissionDenied,
+		},
+		"InstanceIDNotAllowed": {
+			cfg:        verify.Config{AllowedInstanceIDs: []string{"43"}},
+			token:      idToken,
+			wantStatus: http.StatusForbidden,
+			wantCode:   codes.PermissionDenied,
+		},
+		"InstanceNameNotAllowed": {
+			cfg:        verify.Config{AllowedInstanceNames: []string{"vm-2"}},
+			token:      idToken,
+			wantStatus: http.StatusForbidden,
+			wantCode:   codes.PermissionDenied,
+		},
+		"NoToken": {
+			wantStatus: http.StatusUnauthorized,
+			wantCode:   codes.Unauthenticated,
+		},
+		"InvalidToken": {
+			token:      idToken[:len(idToken)-4] + "AAAA",
+			wantStatus: http.StatusUnauthorized,
+			wantCode:   codes.Unauthenticated,
+		},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			v, err := verify.NewValidator(ctx, tt.cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			h := v.Handler(audience, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if _, ok := verify.PayloadFromContext(r.Context()); !ok {
+					t.Error("no payload in the request context")
+				}
+			}))
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			if tt.token != "" {
+				r.Header.Set("Authorization", "Bearer "+tt.token)
+			}
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, r)
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", rec.Code, tt.wantStatus, rec.Body)
+			}
+
+			if tt.token != "" {
+				ctx = metadata.NewIncomingContext(ctx, metadata.Pairs("authorization", "Bearer "+tt.token))
+			}
+			_, err = v.UnaryServerInterceptor(audience)(ctx, nil, &grpc.UnaryServerInfo{}, func(ctx context.Context, _ any) (any, error) {
+				if _, ok := verify.PayloadFromContext(ctx); !ok {
+					t.Error("no payload in the handler context")
+				}
+				return nil, nil
+			})
+			if code := status.Code(err); code != tt.wantCode {
+				t.Fatalf("code = %s, want %s: %v", code, tt.wantCode, err)
+			}
+		})
+	}
+}
+
+func TestEmptyAudience(t *testing.T) {
+	// the validator does not reach the fake metadata server until it validates the tokens
+	v, err := verify.NewValidator(context.Background(), verify.Config{Addr: "127.0.0.1:0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := map[string]func(){
+		"Handler":                 func() { v.Handler("", http.NotFoundHandler()) },
+		"UnaryServerInterceptor":  func() { v.UnaryServerInterceptor("") },
+		"StreamServerInterceptor": func() { v.StreamServerInterceptor("") },
+	}
+	for name, build := range tests {
+		t.Run(name, func(t *testing.T) {
+			defer func() {
+				if recover() == nil {
+					t.Fatal("empty audience is accepted")
+				}
+			}()
+			build()
+		})
+	}
+}
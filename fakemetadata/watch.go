@@ -0,0 +1,125 @@
+// Copyright 2022 The compute-metadata-server Authors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package fakemetadata
+
+import (
+	"fmt"
+	"hash/fnv"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/google/go-safeweb/safehttp"
+	"github.com/google/safehtml"
+)
+
+// ETagHeader is the http header which holds the hash of the metadata value.
+//
+// See: https://cloud.google.com/compute/docs/metadata/querying-metadata#etags
+const ETagHeader = "ETag"
+
+// watchValue is a metadata value which can be waited for changes with the wait_for_change query parameter.
+//
+// The zero value is valid and ready to use.
+type watchValue struct {
+	mu      sync.Mutex    // guard of below fields
+	val     string        // current value, empty means the default value
+	changed chan struct{} // closed and replaced when val is changed
+}
+
+// load returns the current value, or def if the value has never been stored,
+// and the channel which is closed on next change.
+func (v *watchValue) load(def string) (string, <-chan struct{}) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	if v.changed == nil {
+		v.changed = make(chan struct{})
+	}
+	if v.val == "" {
+		return def, v.changed
+	}
+
+	return v.val, v.changed
+}
+
+// store stores val and wakes up the waiters if the value is changed.
+func (v *watchValue) store(val string) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	if v.val == val {
+		return
+	}
+	v.val = val
+	if v.changed != nil {
+		close(v.changed)
+	}
+	v.changed = make(chan struct{})
+}
+
+// etag returns the ETag of val.
+func etag(val string) string {
+	h := fnv.New64a()
+	h.Write([]byte(val))
+	return fmt.Sprintf("%016x", h.Sum64())
+}
+
+// writeWatchValue writes the value of v, or def if the value has never been stored.
+//
+// If the request has wait_for_change=true query parameter, writeWatchValue blocks until the value is changed.
+// The last_etag query parameter returns immediately if it does not match the current ETag, and
+// the timeout_sec query parameter returns the current value after the given seconds.
+//
+// See: https://cloud.google.com/compute/docs/metadata/querying-metadata#waitforchange
+func writeWatchValue(w safehttp.ResponseWriter, r *safehttp.IncomingRequest, v *watchValue, def string) safehttp.Result {
+	q, err := r.URL().Query()
+	if err != nil {
+		return w.WriteError(NewStatusError(err, safehttp.StatusBadRequest))
+	}
+	waitForChange := q.Bool("wait_for_change", false)
+	lastETag := q.String("last_etag", "")
+	timeoutSec := q.Int64("timeout_sec", 0)
+	if err := q.Err(); err != nil {
+		return w.WriteError(NewStatusError(err, safehttp.StatusBadRequest))
+	}
+
+	val, changed := v.load(def)
+	if waitForChange && (lastETag == "" || lastETag == etag(val)) {
+		var timeout <-chan time.Time
+		if timeoutSec > 0 {
+			timer := time.NewTimer(time.Duration(timeoutSec) * time.Second)
+			defer timer.Stop()
+			timeout = timer.C
+		}
+
+		select {
+		case <-changed:
+			val, _ = v.load(def)
+		case <-timeout:
+			// returns the current value
+		case <-r.Context().Done():
+			return w.WriteError(NewStatusError(r.Context().Err(), safehttp.StatusServiceUnavailable))
+		}
+	}
+
+	w.Header().Set(ETagHeader, etag(val))
+	return w.Write(safehtml.HTMLEscaped(val))
+}
+
+// waitForChangeHandler returns the handler which lifts the write deadline of the wait_for_change requests before calling next.
+//
+// The wait_for_change requests block until the value is changed, so they are exempted from the write timeout of the server,
+// which still applies to all other requests.
+func waitForChangeHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if wait, _ := strconv.ParseBool(r.URL.Query().Get("wait_for_change")); wait {
+			// the error is reported only by the connections without the deadline support, which have no write timeout either
+			_ = http.NewResponseController(w).SetWriteDeadline(time.Time{})
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,75 @@
+// Copyright 2022 The compute-metadata-server Authors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package fakemetadata_test
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/zchee/compute-metadata-server/fakemetadata"
+)
+
+func TestDriftTokenWaitForChange(t *testing.T) {
+	srv := startServer(t)
+
+	const path = "instance/virtual-clock/drift-token"
+	resp := get(t, srv, path)
+	if resp.body != "0" {
+		t.Fatalf("initial drift-token = %q, want %q", resp.body, "0")
+	}
+	etag := resp.header.Get(fakemetadata.ETagHeader)
+
+	done := make(chan response, 1)
+	go func() {
+		defer close(done)
+
+		req, err := metadataRequest(srv, http.MethodGet, path+"?wait_for_change=true&last_etag="+etag, nil)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		resp, err := fetch(http.DefaultClient, req)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		done <- resp
+	}()
+
+	if err := srv.SimulateLiveMigration(context.Background(), 10*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case got, ok := <-done:
+		if !ok {
+			t.Fatal("wait_for_change request failed")
+		}
+		if got.body == "0" || got.header.Get(fakemetadata.ETagHeader) == etag {
+			t.Fatalf("drift-token was not changed: %+v", got)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("wait_for_change request was not woken up")
+	}
+
+	if resp := get(t, srv, path+"?wait_for_change=true&timeout_sec=1&last_etag="+etag); resp.body == "0" {
+		t.Fatalf("mismatched last_etag must return the current drift-token immediately: %q", resp.body)
+	}
+}
+
+func TestWaitForChangeWriteTimeout(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping the wait_for_change request longer than the write timeout in short mode")
+	}
+
+	srv := startServer(t)
+
+	// the wait_for_change request outlives the 5 seconds write timeout of the server
+	resp := get(t, srv, "instance/maintenance-event?wait_for_change=true&timeout_sec=6")
+	if resp.status != http.StatusOK || resp.body != fakemetadata.MaintenanceEventNone {
+		t.Fatalf("status = %d, body = %q", resp.status, resp.body)
+	}
+}
@@ -0,0 +1,402 @@
+// Copyright 2022 The compute-metadata-server Authors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package fakemetadata
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/go-safeweb/safehttp"
+	"github.com/google/safehtml"
+)
+
+// List of the default durations of the workload certificates.
+const (
+	// DefaultWorkloadCertificateLifetime is the default lifetime of the workload certificates.
+	DefaultWorkloadCertificateLifetime = 24 * time.Hour
+
+	// DefaultWorkloadCALifetime is the default lifetime of the CA which issues the workload certificates.
+	DefaultWorkloadCALifetime = 365 * 24 * time.Hour
+)
+
+// WorkloadCredsDirPath is the directory which the guest agent writes the workload credentials to.
+const WorkloadCredsDirPath = "/var/run/secrets/workload-spiffe-credentials"
+
+// WorkloadCertificates configures the managed workload identity certificates served under gce-workload-certificates.
+//
+// The certificates are issued by the locally generated CA, and served only if the enable-workload-certificate attribute is TRUE.
+//
+// See: https://cloud.google.com/compute/docs/access/authenticate-workloads-over-mtls
+type WorkloadCertificates struct {
+	// TrustDomain is the SPIFFE trust domain. e.g. "my-pool.global.123456789012.workload.id.goog".
+	//
+	// If empty, PROJECT_ID.global.PROJECT_NUMBER.workload.id.goog is used.
+	TrustDomain string
+
+	// Identities is the list of the SPIFFE ID paths of the managed workload identities. e.g. "ns/my-namespace/sa/my-identity".
+	//
+	// If empty, "ns/default/sa/default" is used.
+	Identities []string
+
+	// Lifetime is the lifetime of the workload certificates.
+	//
+	// If zero, DefaultWorkloadCertificateLifetime is used.
+	Lifetime time.Duration
+
+	// RotationInterval is the interval to reissue the workload certificates.
+	//
+	// If zero, the half of Lifetime is used.
+	RotationInterval time.Duration
+
+	// CARotationInterval is the interval to rotate the CA. The trust anchors include the previous CA until it expires.
+	//
+	// If zero, the CA is not rotated.
+	CARotationInterval time.Duration
+}
+
+// spiffeIDPathRe matches to the SPIFFE ID path of the managed workload identity.
+var spiffeIDPathRe = regexp.MustCompile(`^ns/[a-z0-9]([-a-z0-9]{0,61}[a-z0-9])?/sa/[a-z0-9]([-a-z0-9]{0,61}[a-z0-9])?$`)
+
+// trustDomainRe matches to the trust domain of the workload identity pool.
+var trustDomainRe = regexp.MustCompile(`^[a-z0-9]([-a-z0-9.]{0,251}[a-z0-9])?\.global\.[0-9]+\.workload\.id\.goog$`)
+
+// Validate reports an error if c is not a valid workload certificates configuration.
+func (c WorkloadCertificates) Validate() error {
+	if c.TrustDomain != "" && !trustDomainRe.MatchString(c.TrustDomain) {
+		return fmt.Errorf("trust domain %q must be POOL_ID.global.PROJECT_NUMBER.workload.id.goog format", c.TrustDomain)
+	}
+	for _, id := range c.Identities {
+		if !spiffeIDPathRe.MatchString(id) {
+			return fmt.Errorf("identity %q must be ns/NAMESPACE/sa/NAME format", id)
+		}
+	}
+	if c.Lifetime < 0 || c.RotationInterval < 0 || c.CARotationInterval < 0 {
+		return errors.New("durations must not be negative")
+	}
+	if c.RotationInterval > c.lifetime() {
+		return fmt.Errorf("rotation interval %s exceeds lifetime %s", c.RotationInterval, c.lifetime())
+	}
+
+	return nil
+}
+
+func (c WorkloadCertificates) lifetime() time.Duration {
+	if c.Lifetime != 0 {
+		return c.Lifetime
+	}
+
+	return DefaultWorkloadCertificateLifetime
+}
+
+func (c WorkloadCertificates) rotationInterval() time.Duration {
+	if c.RotationInterval != 0 {
+		return c.RotationInterval
+	}
+
+	return c.lifetime() / 2
+}
+
+func (c WorkloadCertificates) identities() []string {
+	if len(c.Identities) != 0 {
+		return c.Identities
+	}
+
+	return []string{"ns/default/sa/default"}
+}
+
+// caLifetime returns the lifetime of the CA, which outlives the certificates issued just before the CA rotation.
+func (c WorkloadCertificates) caLifetime() time.Duration {
+	if c.CARotationInterval != 0 {
+		return c.CARotationInterval + c.lifetime()
+	}
+
+	return DefaultWorkloadCALifetime
+}
+
+// workloadCA is the CA which issues the workload certificates.
+type workloadCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pem  string
+}
+
+// workloadCredential is the issued workload certificate and its private key.
+type workloadCredential struct {
+	certPEM string
+	keyPEM  string
+}
+
+// workloadCertificates holds the CA and the issued workload certificates.
+//
+// The zero value is valid and ready to use, and the certificates are issued on first access.
+type workloadCertificates struct {
+	mu          sync.Mutex // guard of below fields
+	cfg         *WorkloadCertificates
+	cas         []*workloadCA // the current CA, followed by the previous CAs which are not expired yet
+	caIssued    time.Time
+	creds       map[string]workloadCredential // map of SPIFFE ID to the credential
+	credsIssued time.Time
+	trustDomain string
+}
+
+// newWorkloadCA generates the self-signed CA for the trust domain.
+func newWorkloadCA(trustDomain string, now time.Time, lifetime time.Duration) (*workloadCA, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("could not generate CA key: %w", err)
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, fmt.Errorf("could not generate CA serial number: %w", err)
+	}
+
+	tmpl := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{Organization: []string{"fakemetadata"}, CommonName: trustDomain},
+		NotBefore:             now.Add(-time.Minute),
+		NotAfter:              now.Add(lifetime),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		URIs:                  []*url.URL{{Scheme: "spiffe", Host: trustDomain}},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, key.Public(), key)
+	if err != nil {
+		return nil, fmt.Errorf("could not create CA certificate: %w", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse CA certificate: %w", err)
+	}
+
+	return &workloadCA{
+		cert: cert,
+		key:  key,
+		pem:  string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})),
+	}, nil
+}
+
+// issue issues the workload certificate of the SPIFFE ID signed by ca.
+func (ca *workloadCA) issue(spiffeID *url.URL, now time.Time, lifetime time.Duration) (workloadCredential, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return workloadCredential{}, fmt.Errorf("could not generate workload key: %w", err)
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return workloadCredential{}, fmt.Errorf("could not generate workload serial number: %w", err)
+	}
+
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		NotBefore:    now.Add(-time.Minute),
+		NotAfter:     now.Add(lifetime),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		URIs:         []*url.URL{spiffeID},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, key.Public(), ca.key)
+	if err != nil {
+		return workloadCredential{}, fmt.Errorf("could not create workload certificate: %w", err)
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return workloadCredential{}, fmt.Errorf("could not marshal workload key: %w", err)
+	}
+
+	return workloadCredential{
+		certPEM: string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})),
+		keyPEM:  string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER})),
+	}, nil
+}
+
+// configure replaces the configuration and discards the CA and the issued certificates.
+func (wc *workloadCertificates) configure(cfg *WorkloadCertificates) {
+	wc.mu.Lock()
+	defer wc.mu.Unlock()
+
+	wc.cfg = cfg
+	wc.cas = nil
+	wc.creds = nil
+}
+
+// rotate forces to reissue the workload certificates, and also rotates the CA if rotateCA is true.
+func (wc *workloadCertificates) rotate(rotateCA bool) {
+	wc.mu.Lock()
+	defer wc.mu.Unlock()
+
+	if rotateCA {
+		wc.caIssued = time.Time{}
+	}
+	wc.creds = nil
+}
+
+// ensure rotates the CA and reissues the workload certificates if their rotation intervals are elapsed.
+//
+// The caller must hold wc.mu.
+func (wc *workloadCertificates) ensure(trustDomain string, now time.Time) error {
+	cfg := *wc.cfg
+	if trustDomain != wc.trustDomain {
+		wc.cas = nil
+		wc.creds = nil
+		wc.trustDomain = trustDomain
+	}
+
+	// drop the expired previous CAs
+	for i := 1; i < len(wc.cas); i++ {
+		if !now.Before(wc.cas[i].cert.NotAfter) {
+			wc.cas = wc.cas[:i]
+			break
+		}
+	}
+
+	if len(wc.cas) == 0 || wc.caIssued.IsZero() || (cfg.CARotationInterval != 0 && now.Sub(wc.caIssued) >= cfg.CARotationInterval) {
+		ca, err := newWorkloadCA(trustDomain, now, cfg.caLifetime())
+		if err != nil {
+			return err
+		}
+		wc.cas = append([]*workloadCA{ca}, wc.cas...)
+		wc.caIssued = now
+		wc.creds = nil
+	}
+
+	if wc.creds != nil && now.Sub(wc.credsIssued) < cfg.rotationInterval() {
+		return nil
+	}
+
+	creds := make(map[string]workloadCredential)
+	for _, id := range cfg.identities() {
+		spiffeID := &url.URL{Scheme: "spiffe", Host: trustDomain, Path: "/" + id}
+		cred, err := wc.cas[0].issue(spiffeID, now, cfg.lifetime())
+		if err != nil {
+			return err
+		}
+		creds[spiffeID.String()] = cred
+	}
+	wc.creds = creds
+	wc.credsIssued = now
+
+	return nil
+}
+
+// workloadTrustDomain returns the SPIFFE trust domain of the workload certificates.
+func (h *InstanceHandler) workloadTrustDomain(cfg *WorkloadCertificates) (string, error) {
+	if cfg.TrustDomain != "" {
+		return cfg.TrustDomain, nil
+	}
+
+	proj := h.projectModel()
+	projectID, ok := proj.projectID()
+	if !ok {
+		return "", errors.New("trust domain requires the project ID")
+	}
+	projectNumber, ok := proj.numericProjectID()
+	if !ok {
+		return "", errors.New("trust domain requires the numeric project ID")
+	}
+
+	return fmt.Sprintf("%s.global.%s.workload.id.goog", strings.ReplaceAll(projectID, ":", "-"), projectNumber), nil
+}
+
+var gceWorkloadCertificatesEndpoints = []string{
+	"config-status",
+	"trust-anchors",
+	"workload-identities",
+}
+
+// GCEWorkloadCertificates a directory of the managed workload identity credentials of the VM. The following information is available:
+//
+//	config-status
+//
+// The errors of the workload identity configuration.
+//
+//	trust-anchors
+//
+// The PEM encoded CA certificates of the trust domain, to verify the peer workload certificates.
+//
+//	workload-identities
+//
+// The PEM encoded workload certificates and private keys of the managed workload identities with SPIFFE IDs.
+//
+// The directory is served only if the enable-workload-certificate attribute is TRUE and the workload certificates are configured.
+func (h *InstanceHandler) GCEWorkloadCertificates() safehttp.Handler {
+	handler := safehttp.HandlerFunc(func(w safehttp.ResponseWriter, r *safehttp.IncomingRequest) safehttp.Result {
+		if !h.attributeEnabled("enable-workload-certificate") {
+			return w.WriteError(safehttp.StatusNotFound)
+		}
+
+		wc := &h.workloadCerts
+		wc.mu.Lock()
+		defer wc.mu.Unlock()
+
+		if wc.cfg == nil {
+			return w.WriteError(safehttp.StatusNotFound)
+		}
+
+		path := r.URL().Path()
+		switch path {
+		case "":
+			return w.Write(safehtml.HTMLEscaped(strings.Join(gceWorkloadCertificatesEndpoints, "\n")))
+
+		case "config-status":
+			return WriteJSON(w, map[string]any{
+				"partnerMetadataConfigsErrors": map[string]any{"errors": map[string]any{}},
+			})
+		}
+
+		trustDomain, err := h.workloadTrustDomain(wc.cfg)
+		if err != nil {
+			return w.WriteError(NewStatusError(err, safehttp.StatusInternalServerError))
+		}
+		if err := wc.ensure(trustDomain, time.Now()); err != nil {
+			return w.WriteError(NewStatusError(err, safehttp.StatusInternalServerError))
+		}
+
+		switch path {
+		case "trust-anchors":
+			var bundle strings.Builder
+			for _, ca := range wc.cas {
+				bundle.WriteString(ca.pem)
+			}
+
+			return WriteJSON(w, map[string]any{
+				"status": "OK",
+				"trustAnchors": map[string]any{
+					trustDomain: map[string]string{"trustAnchorsPem": bundle.String()},
+				},
+			})
+
+		case "workload-identities":
+			creds := make(map[string]any, len(wc.creds))
+			for id, cred := range wc.creds {
+				creds[id] = map[string]any{
+					"metadata":       map[string]string{"workload_creds_dir_path": WorkloadCredsDirPath},
+					"certificatePem": cred.certPEM,
+					"privateKeyPem":  cred.keyPEM,
+				}
+			}
+
+			return WriteJSON(w, map[string]any{
+				"status":              "OK",
+				"workloadCredentials": creds,
+			})
+		}
+
+		return w.WriteError(safehttp.StatusNotFound)
+	})
+
+	return safehttp.StripPrefix("/computeMetadata/v1/instance/gce-workload-certificates/", handler)
+}
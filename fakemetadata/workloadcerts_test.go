@@ -0,0 +1,109 @@
+// Copyright 2022 The compute-metadata-server Authors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package fakemetadata_test
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"testing"
+
+	"github.com/zchee/compute-metadata-server/fakemetadata"
+)
+
+func TestWorkloadCertificates(t *testing.T) {
+	srv := startServer(t)
+
+	const (
+		trustDomain = "my-pool.global.123456789012.workload.id.goog"
+		spiffeID    = "spiffe://" + trustDomain + "/ns/my-ns/sa/my-sa"
+	)
+	if err := srv.SetInstance(fakemetadata.Instance{Attributes: map[string]string{"enable-workload-certificate": "TRUE"}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := srv.SetWorkloadCertificates(&fakemetadata.WorkloadCertificates{TrustDomain: trustDomain, Identities: []string{"ns/my-ns/sa/my-sa"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	type result struct {
+		leaf  *x509.Certificate
+		roots *x509.CertPool
+		nroot int
+	}
+	fetch := func() result {
+		t.Helper()
+
+		var identities struct {
+			WorkloadCredentials map[string]struct {
+				CertificatePem string `json:"certificatePem"`
+			} `json:"workloadCredentials"`
+		}
+		getJSON(t, srv, "instance/gce-workload-certificates/workload-identities", &identities)
+		block, _ := pem.Decode([]byte(identities.WorkloadCredentials[spiffeID].CertificatePem))
+		if block == nil {
+			t.Fatalf("no certificate of %s: %+v", spiffeID, identities)
+		}
+		leaf, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var anchors struct {
+			TrustAnchors map[string]struct {
+				TrustAnchorsPem string `json:"trustAnchorsPem"`
+			} `json:"trustAnchors"`
+		}
+		getJSON(t, srv, "instance/gce-workload-certificates/trust-anchors", &anchors)
+		roots := x509.NewCertPool()
+		rest := []byte(anchors.TrustAnchors[trustDomain].TrustAnchorsPem)
+		var nroot int
+		for {
+			block, rest = pem.Decode(rest)
+			if block == nil {
+				break
+			}
+			cert, err := x509.ParseCertificate(block.Bytes)
+			if err != nil {
+				t.Fatal(err)
+			}
+			roots.AddCert(cert)
+			nroot++
+		}
+
+		return result{leaf: leaf, roots: roots, nroot: nroot}
+	}
+
+	verify := func(leaf *x509.Certificate, roots *x509.CertPool) {
+		t.Helper()
+
+		if _, err := leaf.Verify(x509.VerifyOptions{Roots: roots, KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}}); err != nil {
+			t.Fatalf("could not verify workload certificate: %v", err)
+		}
+	}
+
+	first := fetch()
+	if len(first.leaf.URIs) != 1 || first.leaf.URIs[0].String() != spiffeID {
+		t.Fatalf("SPIFFE ID = %v, want %s", first.leaf.URIs, spiffeID)
+	}
+	verify(first.leaf, first.roots)
+
+	if again := fetch(); again.leaf.SerialNumber.Cmp(first.leaf.SerialNumber) != 0 {
+		t.Fatal("workload certificate is reissued before the rotation interval")
+	}
+
+	srv.RotateWorkloadCertificates(false)
+	rotated := fetch()
+	if rotated.leaf.SerialNumber.Cmp(first.leaf.SerialNumber) == 0 {
+		t.Fatal("workload certificate is not reissued")
+	}
+	verify(rotated.leaf, first.roots)
+
+	srv.RotateWorkloadCertificates(true)
+	caRotated := fetch()
+	if caRotated.nroot != 2 {
+		t.Fatalf("trust anchors = %d, want the new and previous CAs", caRotated.nroot)
+	}
+	// the peers which have the new trust anchors still accept the certificates issued by the previous CA
+	verify(caRotated.leaf, caRotated.roots)
+	verify(rotated.leaf, caRotated.roots)
+}
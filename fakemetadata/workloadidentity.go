@@ -0,0 +1,360 @@
+// Copyright 2022 The compute-metadata-server Authors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package fakemetadata
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	pathpkg "path"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/google/go-safeweb/safehttp"
+	"github.com/google/safehtml"
+	"golang.org/x/oauth2"
+	"google.golang.org/api/impersonate"
+)
+
+// ClientIdentityHeader is the request header which identifies the calling pod instead of the source address.
+//
+// It is not sent by the real clients, and is useful when the pods can not have the own source address.
+const ClientIdentityHeader = "Fake-Metadata-Client-Identity"
+
+// WorkloadIdentity configures the GKE Workload Identity emulation, which serves the service accounts per pod
+// the same as the gke-metadata-server.
+//
+// The calling pod is identified by ClientIdentityHeader, or the source address of the request.
+// The Kubernetes service account of the pod is mapped to the bound Google service account by Bindings.
+//
+// See: https://cloud.google.com/kubernetes-engine/docs/concepts/workload-identity
+type WorkloadIdentity struct {
+	// WorkloadPool is the workload identity pool of the cluster. e.g. "my-project.svc.id.goog".
+	//
+	// If empty, PROJECT_ID.svc.id.goog is used.
+	WorkloadPool string
+
+	// Pods is the list of the pods on the node.
+	Pods []WorkloadIdentityPod
+
+	// Bindings is the map of the Kubernetes service account "NAMESPACE/NAME" to the bound Google service account email,
+	// which is the iam.gke.io/gcp-service-account annotation of the Kubernetes service account.
+	//
+	// The pods which Kubernetes service account is not bound use the workload identity pool as the email,
+	// and get the federated access token of the workload identity pool principal, which requires Project.NumericProjectID.
+	Bindings map[string]string
+}
+
+// WorkloadIdentityPod represents the pod which calls the metadata server.
+type WorkloadIdentityPod struct {
+	// Name is the name of the pod.
+	Name string
+
+	// Namespace is the namespace of the pod. If empty, "default" is used.
+	Namespace string
+
+	// ServiceAccount is the name of the Kubernetes service account of the pod. If empty, "default" is used.
+	ServiceAccount string
+
+	// Addr is the source address of the pod. e.g. 127.0.0.2.
+	Addr netip.Addr
+
+	// ClientIdentity is the value of ClientIdentityHeader which the pod sends.
+	ClientIdentity string
+}
+
+func (pod WorkloadIdentityPod) namespace() string {
+	if pod.Namespace != "" {
+		return pod.Namespace
+	}
+
+	return "default"
+}
+
+func (pod WorkloadIdentityPod) serviceAccount() string {
+	if pod.ServiceAccount != "" {
+		return pod.ServiceAccount
+	}
+
+	return "default"
+}
+
+// kubernetesServiceAccount returns the Kubernetes service account of the pod in "NAMESPACE/NAME" format.
+func (pod WorkloadIdentityPod) kubernetesServiceAccount() string {
+	return pod.namespace() + "/" + pod.serviceAccount()
+}
+
+// workloadPoolRe matches to the workload identity pool.
+var workloadPoolRe = regexp.MustCompile(`^([a-z0-9.-]+:)?[a-z][-a-z0-9]{4,28}[a-z0-9]\.svc\.id\.goog$`)
+
+// Validate reports an error if wi is not a valid Workload Identity configuration.
+func (wi WorkloadIdentity) Validate() error {
+	if wi.WorkloadPool != "" && !workloadPoolRe.MatchString(wi.WorkloadPool) {
+		return fmt.Errorf("workload pool %q must be PROJECT_ID.svc.id.goog format", wi.WorkloadPool)
+	}
+
+	addrs := make(map[netip.Addr]bool)
+	identities := make(map[string]bool)
+	for _, pod := range wi.Pods {
+		if !pod.Addr.IsValid() && pod.ClientIdentity == "" {
+			return fmt.Errorf("pod %q requires either address or client identity", pod.Name)
+		}
+		if pod.Addr.IsValid() {
+			if addrs[pod.Addr] {
+				return fmt.Errorf("duplicate pod address %s", pod.Addr)
+			}
+			addrs[pod.Addr] = true
+		}
+		if pod.ClientIdentity != "" {
+			if identities[pod.ClientIdentity] {
+				return fmt.Errorf("duplicate pod client identity %q", pod.ClientIdentity)
+			}
+			identities[pod.ClientIdentity] = true
+		}
+	}
+
+	for ksa, gsa := range wi.Bindings {
+		if ns, name, ok := strings.Cut(ksa, "/"); !ok || ns == "" || name == "" {
+			return fmt.Errorf("kubernetes service account %q must be NAMESPACE/NAME format", ksa)
+		}
+		if !validEmailRe.MatchString(gsa) {
+			return fmt.Errorf("google service account %q of %q is invalid", gsa, ksa)
+		}
+	}
+
+	return nil
+}
+
+// workloadPool returns the workload identity pool of the cluster.
+func (wi WorkloadIdentity) workloadPool(projectID string) string {
+	if wi.WorkloadPool != "" {
+		return wi.WorkloadPool
+	}
+
+	return projectID + ".svc.id.goog"
+}
+
+// lookup returns the pod which has the identity, or the addr if identity is empty.
+func (wi WorkloadIdentity) lookup(addr netip.Addr, identity string) (WorkloadIdentityPod, bool) {
+	for _, pod := range wi.Pods {
+		if identity != "" {
+			if pod.ClientIdentity == identity {
+				return pod, true
+			}
+			continue
+		}
+		if pod.Addr.IsValid() && pod.Addr == addr {
+			return pod, true
+		}
+	}
+
+	return WorkloadIdentityPod{}, false
+}
+
+// remoteAddrKey is the context key of the remote address of the connection.
+type remoteAddrKey struct{}
+
+// withRemoteAddr returns the copy of ctx with the remote address of c, which is used as the http.Server.ConnContext.
+func withRemoteAddr(ctx context.Context, c net.Conn) context.Context {
+	return context.WithValue(ctx, remoteAddrKey{}, c.RemoteAddr())
+}
+
+// remoteAddr returns the remote IP address of the connection of ctx.
+func remoteAddr(ctx context.Context) (netip.Addr, bool) {
+	addr, ok := ctx.Value(remoteAddrKey{}).(net.Addr)
+	if !ok {
+		return netip.Addr{}, false
+	}
+
+	addrPort, err := netip.ParseAddrPort(addr.String())
+	if err != nil {
+		return netip.Addr{}, false
+	}
+
+	return addrPort.Addr().Unmap(), true
+}
+
+// setWorkloadIdentity replaces the Workload Identity configuration with wi. The nil wi disables the Workload Identity emulation.
+func (h *InstanceHandler) setWorkloadIdentity(wi *WorkloadIdentity) {
+	h.mu.Lock()
+	h.workloadIdentity = wi
+	h.mu.Unlock()
+	h.tokenCache.flush()
+}
+
+// workloadIdentityModel returns the current Workload Identity configuration, or nil if disabled.
+func (h *InstanceHandler) workloadIdentityModel() *WorkloadIdentity {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	return h.workloadIdentity
+}
+
+// workloadIdentityServiceAccounts serves the service-accounts directory for the calling pod of r.
+//
+// The pod which Kubernetes service account is bound to the Google service account sees the Google service account,
+// and the other pods see the workload identity pool and get the federated access token of
+// principal://iam.googleapis.com/projects/PROJECT_NUMBER/locations/global/workloadIdentityPools/POOL/subject/ns/NAMESPACE/sa/NAME,
+// same as the gke-metadata-server.
+func (h *InstanceHandler) workloadIdentityServiceAccounts(w safehttp.ResponseWriter, r *safehttp.IncomingRequest, wi *WorkloadIdentity) safehttp.Result {
+	addr, _ := remoteAddr(r.Context())
+	pod, ok := wi.lookup(addr, r.Header.Get(ClientIdentityHeader))
+	if !ok {
+		err := fmt.Errorf("could not find the pod of %s", addr)
+		return w.WriteError(NewStatusError(err, safehttp.StatusForbidden))
+	}
+
+	projectID, _ := h.projectModel().projectID()
+	gsa, bound := wi.Bindings[pod.kubernetesServiceAccount()]
+	email := wi.workloadPool(projectID)
+	if bound {
+		email = gsa
+	}
+
+	path := r.URL().Path()
+	if path == "" {
+		return w.Write(safehtml.HTMLEscaped(strings.Join([]string{"default/", email + "/"}, "\n")))
+	}
+
+	sa, attr := pathpkg.Split(path)
+	if sa = strings.TrimSuffix(sa, "/"); sa != "default" && sa != email {
+		return w.WriteError(safehttp.StatusNotFound)
+	}
+
+	q, err := r.URL().Query()
+	if err != nil {
+		return w.WriteError(NewStatusError(err, safehttp.StatusBadRequest))
+	}
+
+	switch attr {
+	case "":
+		return w.Write(safehtml.HTMLEscaped(strings.Join(serviceAccountsEndpoints, "\n")))
+
+	case "aliases":
+		return h.serviceAccountsAliasesHandler(w, r, ServiceAccount{Email: email, Aliases: []string{"default"}})
+
+	case "email":
+		return w.Write(safehtml.HTMLEscaped(email))
+
+	case "scopes":
+		return h.serviceAccountsScopesHandler(w, r, ServiceAccount{Email: email})
+
+	case "identity":
+		audience := q.String("audience", "")
+		if audience == "" {
+			return w.WriteError(NewStatusError(errors.New("non-empty audience parameter required"), safehttp.StatusBadRequest))
+		}
+		if !bound {
+			err := fmt.Errorf("kubernetes service account %s is not bound to a google service account", pod.kubernetesServiceAccount())
+			return w.WriteError(NewStatusError(err, safehttp.StatusNotFound))
+		}
+
+		key := tokenCacheKey{source: "impersonate", serviceAccount: gsa, audience: audience, format: IDTokenFormatStandard}
+		tok, err := h.tokenCache.token(r.Context(), key, time.Now(), func(ctx context.Context) (*oauth2.Token, error) {
+			if h.usesLocalIAMCredentials() {
+				return h.generateIDToken(ctx, gsa, audience, nil)
+			}
+
+			ts, err := impersonate.IDTokenSource(ctx, impersonate.IDTokenConfig{
+				TargetPrincipal: gsa,
+				Audience:        audience,
+				IncludeEmail:    true,
+			})
+			if err != nil {
+				return nil, err
+			}
+
+			return ts.Token()
+		})
+		if err != nil {
+			return w.WriteError(NewStatusError(err, safehttp.StatusInternalServerError))
+		}
+
+		return w.Write(safehtml.HTMLEscaped(tok.AccessToken))
+
+	case "token":
+		var scopes []string
+		if s := q.String("scopes", ""); s != "" {
+			scopes = strings.Split(s, ",")
+		}
+
+		now := time.Now()
+		if !bound {
+			// the token of the unbound Kubernetes service account is the federated token of the workload identity pool principal,
+			// which the local STS, IAM Credentials and tokeninfo endpoints accept, even if the offline token mode is enabled
+			projectNumber, ok := h.projectModel().numericProjectID()
+			if !ok {
+				err := errors.New("federated token of the unbound kubernetes service account requires the numeric project ID")
+				return w.WriteError(NewStatusError(err, safehttp.StatusNotFound))
+			}
+			principal := federatedPrincipal{
+				pool:    "projects/" + projectNumber + "/locations/global/workloadIdentityPools/" + email,
+				subject: "ns/" + pod.namespace() + "/sa/" + pod.serviceAccount(),
+			}
+			key := tokenCacheKey{source: "federated", serviceAccount: principal.pool + "/subject/" + principal.subject, scopes: scopesKey(scopes)}
+			tok, err := h.tokenCache.token(r.Context(), key, now, func(context.Context) (*oauth2.Token, error) {
+				return h.sts.issue(principal, scopes, now)
+			})
+			if err != nil {
+				return w.WriteError(NewStatusError(err, safehttp.StatusInternalServerError))
+			}
+
+			return writeToken(w, tok, now)
+		}
+
+		if h.offlineTokens.enabled() {
+			// the token of the bound Google service account is issued by the offline token mode
+			key := tokenCacheKey{source: "offline", serviceAccount: email, scopes: scopesKey(scopes)}
+			tok, err := h.tokenCache.token(r.Context(), key, now, func(context.Context) (*oauth2.Token, error) {
+				return h.offlineTokens.issue(email, scopes, 0, now)
+			})
+			if err != nil {
+				return w.WriteError(NewStatusError(err, safehttp.StatusInternalServerError))
+			}
+
+			return writeToken(w, tok, now)
+		}
+
+		if len(scopes) == 0 {
+			scopes = []string{cloudPlatformScope}
+		}
+		key := tokenCacheKey{source: "impersonate", serviceAccount: gsa, scopes: scopesKey(scopes)}
+		tok, err := h.tokenCache.token(r.Context(), key, now, func(ctx context.Context) (*oauth2.Token, error) {
+			if h.usesLocalIAMCredentials() {
+				return h.generateAccessToken(ctx, gsa, scopes, nil)
+			}
+
+			ts, err := impersonate.CredentialsTokenSource(ctx, impersonate.CredentialsConfig{
+				TargetPrincipal: gsa,
+				Scopes:          scopes,
+			})
+			if err != nil {
+				return nil, err
+			}
+
+			return ts.Token()
+		})
+		if err != nil {
+			return w.WriteError(NewStatusError(err, safehttp.StatusInternalServerError))
+		}
+
+		return writeToken(w, tok, now)
+	}
+
+	return w.WriteError(safehttp.StatusNotFound)
+}
+
+// writeToken writes tok as the TokenResponse. The expires_in counts down to the expiry of tok from now.
+func writeToken(w safehttp.ResponseWriter, tok *oauth2.Token, now time.Time) safehttp.Result {
+	resp := TokenResponse{
+		AccessToken: tok.AccessToken,
+		ExpiresIn:   int(tok.Expiry.Sub(now).Round(time.Second).Seconds()),
+		TokenType:   tok.TokenType,
+	}
+
+	return WriteJSON(w, &resp)
+}
@@ -0,0 +1,152 @@
+// Copyright 2022 The compute-metadata-server Authors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package fakemetadata_test
+
+import (
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"testing"
+
+	json "github.com/goccy/go-json"
+
+	"github.com/zchee/compute-metadata-server/fakemetadata"
+)
+
+func TestWorkloadIdentity(t *testing.T) {
+	srv := startServer(t)
+
+	if err := srv.SetProject(fakemetadata.Project{ProjectID: "my-project", NumericProjectID: 123456789012}); err != nil {
+		t.Fatal(err)
+	}
+	wi := &fakemetadata.WorkloadIdentity{
+		Pods: []fakemetadata.WorkloadIdentityPod{
+			{Name: "pod-a", Namespace: "team-a", ServiceAccount: "app", Addr: netip.MustParseAddr("127.0.0.2")},
+			{Name: "pod-b", Namespace: "team-b", ClientIdentity: "pod-b"},
+		},
+		Bindings: map[string]string{
+			"team-a/app": "app@my-project.iam.gserviceaccount.com",
+		},
+	}
+	if err := srv.SetWorkloadIdentity(wi); err != nil {
+		t.Fatal(err)
+	}
+
+	// get sends the request from the pod of localAddr or the client identity
+	get := func(localAddr, identity, path string) response {
+		t.Helper()
+
+		client := &http.Client{
+			Transport: &http.Transport{
+				DialContext: (&net.Dialer{LocalAddr: &net.TCPAddr{IP: net.ParseIP(localAddr)}}).DialContext,
+			},
+		}
+		req, err := metadataRequest(srv, http.MethodGet, "instance/service-accounts/"+path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if identity != "" {
+			req.Header.Set(fakemetadata.ClientIdentityHeader, identity)
+		}
+		resp, err := fetch(client, req)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return resp
+	}
+
+	tests := map[string]struct {
+		localAddr string
+		identity  string
+		path      string
+		wantCode  int
+		wantBody  string
+	}{
+		"BoundEmail": {
+			localAddr: "127.0.0.2",
+			path:      "default/email",
+			wantCode:  http.StatusOK,
+			wantBody:  "app@my-project.iam.gserviceaccount.com",
+		},
+		"BoundDirectory": {
+			localAddr: "127.0.0.2",
+			path:      "",
+			wantCode:  http.StatusOK,
+			wantBody:  "default/\napp@my-project.iam.gserviceaccount.com/",
+		},
+		"UnboundEmail": {
+			localAddr: "127.0.0.1",
+			identity:  "pod-b",
+			path:      "default/email",
+			wantCode:  http.StatusOK,
+			wantBody:  "my-project.svc.id.goog",
+		},
+		"UnboundIdentity": {
+			localAddr: "127.0.0.1",
+			identity:  "pod-b",
+			path:      "default/identity?audience=https://example.com",
+			wantCode:  http.StatusNotFound,
+		},
+		"OtherServiceAccount": {
+			localAddr: "127.0.0.2",
+			path:      "other@my-project.iam.gserviceaccount.com/email",
+			wantCode:  http.StatusNotFound,
+		},
+		"UnknownPod": {
+			localAddr: "127.0.0.3",
+			path:      "default/email",
+			wantCode:  http.StatusForbidden,
+		},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			resp := get(tt.localAddr, tt.identity, tt.path)
+			if resp.status != tt.wantCode {
+				t.Fatalf("status = %d, want %d: %s", resp.status, tt.wantCode, resp.body)
+			}
+			if tt.wantBody != "" && resp.body != tt.wantBody {
+				t.Fatalf("body = %q, want %q", resp.body, tt.wantBody)
+			}
+		})
+	}
+
+	// the unbound Kubernetes service account gets the federated token of the workload identity pool principal,
+	// even if the offline token mode is enabled
+	const wantSub = "principal://iam.googleapis.com/projects/123456789012/locations/global/workloadIdentityPools/my-project.svc.id.goog/subject/ns/team-b/sa/default"
+	for _, offline := range []bool{false, true} {
+		if offline {
+			if err := srv.EnableOfflineTokens(fakemetadata.OfflineTokens{}); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		resp := get("127.0.0.1", "pod-b", "default/token?scopes=scope1")
+		if resp.status != http.StatusOK {
+			t.Fatalf("status of the unbound token (offline %t) = %d: %s", offline, resp.status, resp.body)
+		}
+		var tok fakemetadata.TokenResponse
+		if err := json.Unmarshal([]byte(resp.body), &tok); err != nil {
+			t.Fatal(err)
+		}
+		if tok.AccessToken == "" || tok.ExpiresIn <= 0 {
+			t.Fatalf("unexpected token response (offline %t): %+v", offline, tok)
+		}
+
+		infoResp, err := http.PostForm("http://"+srv.Addr()+fakemetadata.TokenInfoPath, url.Values{"access_token": {tok.AccessToken}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var info map[string]string
+		err = json.NewDecoder(infoResp.Body).Decode(&info)
+		infoResp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info["sub"] != wantSub || info["scope"] != "scope1" {
+			t.Fatalf("tokeninfo (offline %t) = %v, want sub %q", offline, info, wantSub)
+		}
+	}
+}
@@ -0,0 +1,434 @@
+// Copyright 2022 The compute-metadata-server Authors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package fakemetadata
+
+import (
+	"bytes"
+	"cmp"
+	"crypto"
+	"crypto/rsa"
+	_ "crypto/sha512" // registers crypto.SHA512 of the signature and digest methods
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"slices"
+	"strings"
+)
+
+// List of the namespaces and algorithms of the XML signature.
+const (
+	xmlNamespace     = "http://www.w3.org/XML/1998/namespace"
+	xmlDSigNamespace = "http://www.w3.org/2000/09/xmldsig#"
+
+	excC14NAlgorithm            = "http://www.w3.org/2001/10/xml-exc-c14n#"
+	envelopedSignatureAlgorithm = "http://www.w3.org/2000/09/xmldsig#enveloped-signature"
+)
+
+// signatureMethods is the map of the supported SignatureMethod algorithms to the hash of the RSA PKCS #1 v1.5 signature.
+//
+// SHA-1 is not supported, since its collisions are practical.
+var signatureMethods = map[string]crypto.Hash{
+	"http://www.w3.org/2001/04/xmldsig-more#rsa-sha256": crypto.SHA256,
+	"http://www.w3.org/2001/04/xmldsig-more#rsa-sha512": crypto.SHA512,
+}
+
+// digestMethods is the map of the supported DigestMethod algorithms to the hash.
+var digestMethods = map[string]crypto.Hash{
+	"http://www.w3.org/2001/04/xmlenc#sha256": crypto.SHA256,
+	"http://www.w3.org/2001/04/xmlenc#sha512": crypto.SHA512,
+}
+
+// xmlNode is the element of the parsed XML document.
+//
+// Unlike the xml.Unmarshal, it keeps the namespace prefixes and declarations which the canonicalization requires.
+type xmlNode struct {
+	parent   *xmlNode
+	prefix   string
+	local    string
+	ns       map[string]string // in-scope namespaces of the prefix, "" is the default namespace
+	attrs    []xml.Attr        // attributes except the namespace declarations, Name.Space is the prefix
+	children []any             // *xmlNode or xml.CharData
+}
+
+// parseXML parses b to the tree of xmlNode, and returns the root element.
+//
+// The comments are dropped, and the document type declarations and processing instructions in the root element are rejected.
+func parseXML(b []byte) (*xmlNode, error) {
+	d := xml.NewDecoder(bytes.NewReader(b))
+
+	var root, cur *xmlNode
+	for {
+		tok, err := d.RawToken()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		switch tok := tok.(type) {
+		case xml.StartElement:
+			if cur == nil && root != nil {
+				return nil, errors.New("multiple root elements")
+			}
+			n := &xmlNode{
+				parent: cur,
+				prefix: tok.Name.Space,
+				local:  tok.Name.Local,
+				ns:     map[string]string{"xml": xmlNamespace},
+			}
+			if cur == nil {
+				root = n
+			} else {
+				maps.Copy(n.ns, cur.ns)
+				cur.children = append(cur.children, n)
+			}
+			for _, attr := range tok.Attr {
+				switch {
+				case attr.Name.Space == "xmlns":
+					n.ns[attr.Name.Local] = attr.Value
+				case attr.Name.Space == "" && attr.Name.Local == "xmlns":
+					n.ns[""] = attr.Value
+				default:
+					n.attrs = append(n.attrs, attr)
+				}
+			}
+			if _, ok := n.ns[n.prefix]; !ok && n.prefix != "" {
+				return nil, fmt.Errorf("undeclared namespace prefix %q", n.prefix)
+			}
+			for _, attr := range n.attrs {
+				if _, ok := n.ns[attr.Name.Space]; !ok && attr.Name.Space != "" {
+					return nil, fmt.Errorf("undeclared namespace prefix %q", attr.Name.Space)
+				}
+			}
+			cur = n
+
+		case xml.EndElement:
+			// RawToken does not check that the start and end elements match
+			if cur == nil || tok.Name.Space != cur.prefix || tok.Name.Local != cur.local {
+				return nil, fmt.Errorf("unexpected end element %s", tok.Name.Local)
+			}
+			cur = cur.parent
+
+		case xml.CharData:
+			if cur != nil {
+				cur.children = append(cur.children, tok.Copy())
+			}
+
+		case xml.ProcInst:
+			if cur != nil {
+				return nil, errors.New("processing instructions are not supported")
+			}
+
+		case xml.Directive:
+			return nil, errors.New("document type declarations are not allowed")
+		}
+	}
+	if root == nil {
+		return nil, errors.New("no root element")
+	}
+	if cur != nil {
+		return nil, io.ErrUnexpectedEOF
+	}
+
+	return root, nil
+}
+
+// is reports whether n is the element of local in the namespace space.
+func (n *xmlNode) is(space, local string) bool {
+	return n.ns[n.prefix] == space && n.local == local
+}
+
+// elements returns the child elements of local in the namespace space.
+func (n *xmlNode) elements(space, local string) []*xmlNode {
+	var elems []*xmlNode
+	for _, c := range n.children {
+		if c, ok := c.(*xmlNode); ok && c.is(space, local) {
+			elems = append(elems, c)
+		}
+	}
+
+	return elems
+}
+
+// element returns the only child element of local in the namespace space.
+func (n *xmlNode) element(space, local string) (*xmlNode, error) {
+	elems := n.elements(space, local)
+	if len(elems) != 1 {
+		return nil, fmt.Errorf("%s must have one %s element, got %d", n.local, local, len(elems))
+	}
+
+	return elems[0], nil
+}
+
+// attr returns the value of the unqualified attribute local of n.
+func (n *xmlNode) attr(local string) string {
+	for _, attr := range n.attrs {
+		if attr.Name.Space == "" && attr.Name.Local == local {
+			return attr.Value
+		}
+	}
+
+	return ""
+}
+
+// checkUniqueIDs returns the error if n or its descendants have the duplicate ID attributes.
+func (n *xmlNode) checkUniqueIDs(ids map[string]bool) error {
+	if id := n.attr("ID"); id != "" {
+		if ids[id] {
+			return fmt.Errorf("duplicate ID %q", id)
+		}
+		ids[id] = true
+	}
+	for _, c := range n.children {
+		if c, ok := c.(*xmlNode); ok {
+			if err := c.checkUniqueIDs(ids); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// text returns the concatenated character data of n.
+func (n *xmlNode) text() string {
+	var sb strings.Builder
+	for _, c := range n.children {
+		if c, ok := c.(xml.CharData); ok {
+			sb.Write(c)
+		}
+	}
+
+	return sb.String()
+}
+
+// qname returns the qualified name of the element or attribute.
+func qname(prefix, local string) string {
+	if prefix == "" {
+		return local
+	}
+
+	return prefix + ":" + local
+}
+
+var (
+	c14nTextEscaper = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;", "\r", "&#xD;")
+	c14nAttrEscaper = strings.NewReplacer("&", "&amp;", "<", "&lt;", `"`, "&quot;", "\t", "&#x9;", "\n", "&#xA;", "\r", "&#xD;")
+)
+
+// canonicalize returns the Exclusive XML Canonicalization without comments of n, omitting the descendant element exclude.
+//
+// The prefixes of inclusive, which is the InclusiveNamespaces PrefixList, are rendered as the inclusive canonicalization,
+// and "" is the default namespace.
+//
+// See: https://www.w3.org/TR/xml-exc-c14n/
+func canonicalize(n, exclude *xmlNode, inclusive []string) []byte {
+	var buf bytes.Buffer
+	writeCanonical(&buf, n, exclude, inclusive, map[string]string{"": ""})
+
+	return buf.Bytes()
+}
+
+// writeCanonical writes the canonical form of n to buf. rendered is the namespaces which the output ancestors declare.
+func writeCanonical(buf *bytes.Buffer, n, exclude *xmlNode, inclusive []string, rendered map[string]string) {
+	// the namespaces are rendered where they are visibly utilized, unless the output ancestor renders the same one
+	utilized := []string{n.prefix}
+	for _, attr := range n.attrs {
+		if attr.Name.Space != "" {
+			utilized = append(utilized, attr.Name.Space)
+		}
+	}
+	for _, prefix := range inclusive {
+		if _, ok := n.ns[prefix]; ok {
+			utilized = append(utilized, prefix)
+		}
+	}
+	var decls []string
+	for _, prefix := range utilized {
+		if uri, ok := rendered[prefix]; prefix == "xml" || ok && uri == n.ns[prefix] || slices.Contains(decls, prefix) {
+			continue
+		}
+		decls = append(decls, prefix)
+	}
+	slices.Sort(decls)
+
+	name := qname(n.prefix, n.local)
+	buf.WriteString("<" + name)
+	if len(decls) > 0 {
+		rendered = maps.Clone(rendered)
+	}
+	for _, prefix := range decls {
+		rendered[prefix] = n.ns[prefix]
+		decl := "xmlns"
+		if prefix != "" {
+			decl += ":" + prefix
+		}
+		buf.WriteString(" " + decl + `="` + c14nAttrEscaper.Replace(n.ns[prefix]) + `"`)
+	}
+
+	// the unqualified attributes have no namespace, and sort first
+	space := func(attr xml.Attr) string {
+		if attr.Name.Space == "" {
+			return ""
+		}
+		return n.ns[attr.Name.Space]
+	}
+	attrs := slices.SortedFunc(slices.Values(n.attrs), func(a, b xml.Attr) int {
+		return cmp.Or(strings.Compare(space(a), space(b)), strings.Compare(a.Name.Local, b.Name.Local))
+	})
+	for _, attr := range attrs {
+		buf.WriteString(" " + qname(attr.Name.Space, attr.Name.Local) + `="` + c14nAttrEscaper.Replace(attr.Value) + `"`)
+	}
+	buf.WriteString(">")
+
+	for _, c := range n.children {
+		switch c := c.(type) {
+		case *xmlNode:
+			if c != exclude {
+				writeCanonical(buf, c, exclude, inclusive, rendered)
+			}
+		case xml.CharData:
+			buf.WriteString(c14nTextEscaper.Replace(string(c)))
+		}
+	}
+	buf.WriteString("</" + name + ">")
+}
+
+// inclusiveNamespaces returns the InclusiveNamespaces PrefixList of the canonicalization method or transform n.
+func inclusiveNamespaces(n *xmlNode) []string {
+	elems := n.elements(excC14NAlgorithm, "InclusiveNamespaces")
+	if len(elems) == 0 {
+		return nil
+	}
+	prefixes := strings.Fields(elems[0].attr("PrefixList"))
+	for i, prefix := range prefixes {
+		if prefix == "#default" {
+			prefixes[i] = ""
+		}
+	}
+
+	return prefixes
+}
+
+// decodeBase64Text decodes the base64 encoded character data of n, which may be wrapped.
+func decodeBase64Text(n *xmlNode) ([]byte, error) {
+	return base64.StdEncoding.DecodeString(strings.Join(strings.Fields(n.text()), ""))
+}
+
+// verifyEnvelopedSignature verifies the enveloped XML signature of n by one of the RSA keys of certs, and returns
+// the canonical form of n without the signature, which is the signed content.
+//
+// The signature must refer n by the ID attribute, which is unique in the document, and use the Exclusive XML Canonicalization.
+// The KeyInfo of the signature is ignored, so only the certs are trusted.
+func verifyEnvelopedSignature(n *xmlNode, certs []*x509.Certificate) ([]byte, error) {
+	root := n
+	for root.parent != nil {
+		root = root.parent
+	}
+	if err := root.checkUniqueIDs(make(map[string]bool)); err != nil {
+		return nil, err
+	}
+
+	sig, err := n.element(xmlDSigNamespace, "Signature")
+	if err != nil {
+		return nil, err
+	}
+	signedInfo, err := sig.element(xmlDSigNamespace, "SignedInfo")
+	if err != nil {
+		return nil, err
+	}
+
+	c14nMethod, err := signedInfo.element(xmlDSigNamespace, "CanonicalizationMethod")
+	if err != nil {
+		return nil, err
+	}
+	if alg := c14nMethod.attr("Algorithm"); alg != excC14NAlgorithm {
+		return nil, fmt.Errorf("unsupported canonicalization method %q", alg)
+	}
+	sigMethod, err := signedInfo.element(xmlDSigNamespace, "SignatureMethod")
+	if err != nil {
+		return nil, err
+	}
+	sigHash, ok := signatureMethods[sigMethod.attr("Algorithm")]
+	if !ok {
+		return nil, fmt.Errorf("unsupported signature method %q", sigMethod.attr("Algorithm"))
+	}
+
+	ref, err := signedInfo.element(xmlDSigNamespace, "Reference")
+	if err != nil {
+		return nil, err
+	}
+	if id := n.attr("ID"); id == "" || ref.attr("URI") != "#"+id {
+		return nil, fmt.Errorf("signature reference %q does not refer the signed %s", ref.attr("URI"), n.local)
+	}
+	transforms, err := ref.element(xmlDSigNamespace, "Transforms")
+	if err != nil {
+		return nil, err
+	}
+	var (
+		enveloped, excC14N bool
+		inclusive          []string
+	)
+	for _, transform := range transforms.elements(xmlDSigNamespace, "Transform") {
+		switch alg := transform.attr("Algorithm"); alg {
+		case envelopedSignatureAlgorithm:
+			enveloped = true
+		case excC14NAlgorithm:
+			excC14N = true
+			inclusive = inclusiveNamespaces(transform)
+		default:
+			return nil, fmt.Errorf("unsupported transform %q", alg)
+		}
+	}
+	if !enveloped || !excC14N {
+		return nil, errors.New("signature reference requires the enveloped signature and exclusive canonicalization transforms")
+	}
+	digestMethod, err := ref.element(xmlDSigNamespace, "DigestMethod")
+	if err != nil {
+		return nil, err
+	}
+	digestHash, ok := digestMethods[digestMethod.attr("Algorithm")]
+	if !ok {
+		return nil, fmt.Errorf("unsupported digest method %q", digestMethod.attr("Algorithm"))
+	}
+	digestValue, err := ref.element(xmlDSigNamespace, "DigestValue")
+	if err != nil {
+		return nil, err
+	}
+	wantDigest, err := decodeBase64Text(digestValue)
+	if err != nil {
+		return nil, fmt.Errorf("could not decode digest value: %w", err)
+	}
+
+	signed := canonicalize(n, sig, inclusive)
+	h := digestHash.New()
+	h.Write(signed)
+	if !bytes.Equal(h.Sum(nil), wantDigest) {
+		return nil, errors.New("digest of the signed content does not match")
+	}
+
+	sigValue, err := sig.element(xmlDSigNamespace, "SignatureValue")
+	if err != nil {
+		return nil, err
+	}
+	value, err := decodeBase64Text(sigValue)
+	if err != nil {
+		return nil, fmt.Errorf("could not decode signature value: %w", err)
+	}
+	h = sigHash.New()
+	h.Write(canonicalize(signedInfo, nil, inclusiveNamespaces(c14nMethod)))
+	sum := h.Sum(nil)
+	for _, cert := range certs {
+		if key, ok := cert.PublicKey.(*rsa.PublicKey); ok && rsa.VerifyPKCS1v15(key, sigHash, sum, value) == nil {
+			return signed, nil
+		}
+	}
+
+	return nil, errors.New("signature is not signed by the trusted certificates")
+}
@@ -0,0 +1,185 @@
+// Copyright 2022 The compute-metadata-server Authors
+// SPDX-License-Identifier: BSD-3-Clause
+
+package fakemetadata
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	_ "crypto/sha1"
+	"crypto/x509"
+	"encoding/base64"
+	"math/big"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCanonicalize(t *testing.T) {
+	tests := map[string]struct {
+		doc       string
+		path      []string // local names of the canonicalized descendant
+		inclusive []string
+		want      string
+	}{
+		// the example of https://www.w3.org/TR/xml-exc-c14n/#sec-Enveloping
+		"SpecExample": {
+			doc: `<n0:local xmlns:n0="foo:bar" xmlns:n3="ftp://example.org">
+   <n1:elem2 xmlns:n1="http://example.net" xml:lang="en">
+       <n3:stuff xmlns:n3="ftp://example.org"/>
+   </n1:elem2>
+</n0:local>`,
+			path: []string{"elem2"},
+			want: `<n1:elem2 xmlns:n1="http://example.net" xml:lang="en">
+       <n3:stuff xmlns:n3="ftp://example.org"></n3:stuff>
+   </n1:elem2>`,
+		},
+		"SpecExampleInheritedNamespaces": {
+			doc: `<n2:pdu xmlns:n1="http://example.com" xmlns:n2="http://foo.example" xml:lang="fr" xml:space="retain">
+   <n1:elem2 xmlns:n1="http://example.net" xml:lang="en">
+       <n3:stuff xmlns:n3="ftp://example.org"/>
+   </n1:elem2>
+</n2:pdu>`,
+			path: []string{"elem2"},
+			want: `<n1:elem2 xmlns:n1="http://example.net" xml:lang="en">
+       <n3:stuff xmlns:n3="ftp://example.org"></n3:stuff>
+   </n1:elem2>`,
+		},
+		"SortAndEscape": {
+			doc:  `<?xml version="1.0"?><!-- comment --><a z="1" b:y="2" a="&quot;&#9;&lt;" xmlns:b="urn:b" xmlns="urn:a"><c xmlns="">x &amp; &lt; &gt;<![CDATA[<y>]]></c><b:d/></a>`,
+			want: `<a xmlns="urn:a" xmlns:b="urn:b" a="&quot;&#x9;&lt;" z="1" b:y="2"><c xmlns="">x &amp; &lt; &gt;&lt;y&gt;</c><b:d></b:d></a>`,
+		},
+		"UnusedNamespaces": {
+			doc:  `<a xmlns:b="urn:b" xmlns:c="urn:c"><b:d><!-- comment --></b:d></a>`,
+			want: `<a><b:d xmlns:b="urn:b"></b:d></a>`,
+		},
+		"InclusiveNamespaces": {
+			doc:       `<a xmlns:b="urn:b" xmlns:c="urn:c"><b:d></b:d></a>`,
+			inclusive: []string{"c", "e"},
+			want:      `<a xmlns:c="urn:c"><b:d xmlns:b="urn:b"></b:d></a>`,
+		},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			n, err := parseXML([]byte(tt.doc))
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, local := range tt.path {
+				for _, c := range n.children {
+					if c, ok := c.(*xmlNode); ok && c.local == local {
+						n = c
+					}
+				}
+			}
+
+			if got := string(canonicalize(n, nil, tt.inclusive)); got != tt.want {
+				t.Fatalf("canonicalize() =\n%s\nwant\n%s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseXML(t *testing.T) {
+	tests := map[string]string{
+		"Empty":               ``,
+		"Unterminated":        `<a><b></b>`,
+		"MismatchedEnd":       `<a><b></a></b>`,
+		"MultipleRoots":       `<a></a><b></b>`,
+		"UndeclaredPrefix":    `<a:b></a:b>`,
+		"UndeclaredAttrNS":    `<a b:c="1"></a>`,
+		"DocumentType":        `<!DOCTYPE a [<!ENTITY e "x">]><a>&e;</a>`,
+		"ProcessingInElement": `<a><?pi x?></a>`,
+	}
+	for name, doc := range tests {
+		t.Run(name, func(t *testing.T) {
+			if n, err := parseXML([]byte(doc)); err == nil {
+				t.Fatalf("parseXML(%q) = %+v, want error", doc, n)
+			}
+		})
+	}
+}
+
+func TestVerifyEnvelopedSignature(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{SerialNumber: big.NewInt(1), NotBefore: time.Now(), NotAfter: time.Now().Add(time.Hour)}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const content = `<a ID="_1"><b>x</b></a>`
+	// sign returns content with the valid enveloped signature of the algorithms, even if they are not supported
+	sign := func(sigAlg string, sigHash crypto.Hash, digestAlg string, digestHash crypto.Hash) string {
+		h := digestHash.New()
+		h.Write([]byte(content))
+		signedInfo := `<ds:SignedInfo xmlns:ds="` + xmlDSigNamespace + `">` +
+			`<ds:CanonicalizationMethod Algorithm="` + excC14NAlgorithm + `"></ds:CanonicalizationMethod>` +
+			`<ds:SignatureMethod Algorithm="` + sigAlg + `"></ds:SignatureMethod>` +
+			`<ds:Reference URI="#_1"><ds:Transforms>` +
+			`<ds:Transform Algorithm="` + envelopedSignatureAlgorithm + `"></ds:Transform>` +
+			`<ds:Transform Algorithm="` + excC14NAlgorithm + `"></ds:Transform>` +
+			`</ds:Transforms><ds:DigestMethod Algorithm="` + digestAlg + `"></ds:DigestMethod>` +
+			`<ds:DigestValue>` + base64.StdEncoding.EncodeToString(h.Sum(nil)) + `</ds:DigestValue></ds:Reference></ds:SignedInfo>`
+		h = sigHash.New()
+		h.Write([]byte(signedInfo))
+		sig, err := rsa.SignPKCS1v15(rand.Reader, key, sigHash, h.Sum(nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// the canonical SignedInfo declares the ds namespace by itself, which the Signature declares in the document
+		return `<a ID="_1"><ds:Signature xmlns:ds="` + xmlDSigNamespace + `">` + strings.Replace(signedInfo, ` xmlns:ds="`+xmlDSigNamespace+`"`, "", 1) +
+			`<ds:SignatureValue>` + base64.StdEncoding.EncodeToString(sig) + `</ds:SignatureValue></ds:Signature><b>x</b></a>`
+	}
+
+	const (
+		rsaSHA1   = "http://www.w3.org/2000/09/xmldsig#rsa-sha1"
+		rsaSHA256 = "http://www.w3.org/2001/04/xmldsig-more#rsa-sha256"
+		rsaSHA512 = "http://www.w3.org/2001/04/xmldsig-more#rsa-sha512"
+		sha1      = "http://www.w3.org/2000/09/xmldsig#sha1"
+		sha256    = "http://www.w3.org/2001/04/xmlenc#sha256"
+	)
+	tests := map[string]struct {
+		doc     string
+		wantErr bool
+	}{
+		"SHA256": {
+			doc: sign(rsaSHA256, crypto.SHA256, sha256, crypto.SHA256),
+		},
+		"SHA512": {
+			doc: sign(rsaSHA512, crypto.SHA512, sha256, crypto.SHA256),
+		},
+		"SHA1SignatureMethod": {
+			doc:     sign(rsaSHA1, crypto.SHA1, sha256, crypto.SHA256),
+			wantErr: true,
+		},
+		"SHA1DigestMethod": {
+			doc:     sign(rsaSHA256, crypto.SHA256, sha1, crypto.SHA1),
+			wantErr: true,
+		},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			n, err := parseXML([]byte(tt.doc))
+			if err != nil {
+				t.Fatal(err)
+			}
+			signed, err := verifyEnvelopedSignature(n, []*x509.Certificate{cert})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("verifyEnvelopedSignature() error = %v, wantErr %t", err, tt.wantErr)
+			}
+			if !tt.wantErr && string(signed) != content {
+				t.Fatalf("verifyEnvelopedSignature() = %s, want %s", signed, content)
+			}
+		})
+	}
+}